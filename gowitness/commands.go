@@ -0,0 +1,550 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"globalwitness/lib"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// A command returns its error rather than exiting, so that what it deferred, like flushing the
+// batched history on closing the database, still runs
+type command struct {
+	run     func(args []string) error
+	summary string
+}
+
+// Every command takes -config and the setting flags, see config.go
+var commands = map[string]command{
+	"run":        {runDaemon, "Crawl the network and serve the API until stopped, the default"},
+	"crawl-once": {runCrawlOnce, "Connect to every known node once and print a summary"},
+	"probe":      {runProbe, "Handshake with a single node and print what it told us"},
+	"history":    {runHistory, "Print the stored history of a node"},
+	"inspect":    {runInspect, "List the messages in capture files"},
+	"migrate":    {runMigrate, "Create the tables that do not exist yet"},
+	"maintain":   {runMaintain, "Partition the node history, roll up and drop what is past its retention"},
+	"import":     {runImport, "Add the nodes of a node list"},
+	"export":     {runExport, "Write the known nodes as a node list"},
+	"replay":     {runReplay, "Feed capture files of a session through a handler"},
+	"enrich":     {runEnrich, "Enrich nodes with their netgroup, AS and location"},
+	"report":     {runReport, "Write the daily network reports as CSV"},
+	"config":     {runConfig, "Print the effective configuration"},
+}
+
+func printUsage(w io.Writer) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(w, "Usage: globalwitness [command] [-config file] [-<setting> value]... [args]")
+	fmt.Fprintln(w, "\nCommands:")
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-12s %s\n", name, commands[name].summary)
+	}
+	fmt.Fprintln(w, "\nRun a command with -h for its flags.")
+}
+
+// Parses a node address as given on the command line into a connstring
+func connStringArg(addr string, config *Config) (string, error) {
+	params, _ := lib.ChainParamsByName(config.Node.Chain)
+	defaultPort, err := strconv.ParseUint(params.DefaultPort, 10, 16)
+	if err != nil {
+		return "", err
+	}
+	connString, err := lib.ConnStringFor(addr, uint16(defaultPort))
+	if err != nil {
+		return "", fmt.Errorf("Invalid node address %s: %s", addr, err.Error())
+	}
+	return connString, nil
+}
+
+// Connects to every known node, or a random sample of them, once with sessions cut short
+func runCrawlOnce(args []string) error {
+	flags := flag.NewFlagSet("crawl-once", flag.ExitOnError)
+	session := flags.Duration("session", time.Second*30, "Maximum duration of each session")
+	limit := flags.Int("limit", 0, "Crawl a random sample of this many nodes, all of them if 0")
+	configFlags := addConfigFlags(flags)
+	_ = flags.Parse(args)
+	if *session <= 0 || *limit < 0 {
+		return errors.New("Usage: crawl-once [-session D] [-limit N]")
+	}
+
+	config := configFlags.load()
+	handlerConfig := config.handlerConfig()
+	handlerConfig.Lifetime.MaxDuration = *session
+	cd := lib.MakeCoordinator("crawl-once", config.MaxPeers, config.databaseConfig(), config.redisConfig(),
+		config.bootstrapConfig(), config.captureConfig(), config.txSampler(), lib.MempoolConfig{},
+		config.transportConfig(), handlerConfig, nil, nil)
+	cd.Connect()
+	defer cd.DbConn.Close()
+
+	if cd.DbConn.CountNodes() == 0 {
+		log.Println("No known nodes, bootstrapping from seeds.")
+		lib.Bootstrap(cd.DbConn, cd.BootstrapConfig)
+	}
+	nodes, err := cd.DbConn.GetNodes()
+	if err != nil {
+		return fmt.Errorf("Failed to read the nodes: %s", err.Error())
+	}
+	rand.Shuffle(len(nodes), func(i, j int) {
+		nodes[i], nodes[j] = nodes[j], nodes[i]
+	})
+	if *limit > 0 && *limit < len(nodes) {
+		nodes = nodes[:*limit]
+	}
+
+	log.Println("Crawling", len(nodes), "nodes with", config.MaxPeers, "sessions at a time.")
+	summary := cd.CrawlOnce(nodes)
+	log.Println("Crawled", summary.Nodes, "nodes in", summary.Duration.Round(time.Second), "-",
+		summary.Connected, "connected,", summary.Failed, "failed,", summary.Skipped, "skipped as already connected")
+	return nil
+}
+
+// Handshakes with a single node and prints the result as JSON, nothing is stored
+func runProbe(args []string) error {
+	flags := flag.NewFlagSet("probe", flag.ExitOnError)
+	configFlags := addConfigFlags(flags)
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("Usage: probe [-config file] <addr>")
+	}
+
+	config := configFlags.loadWithoutStorage()
+	connString, err := connStringArg(flags.Arg(0), config)
+	if err != nil {
+		return err
+	}
+	result, err := lib.Probe(connString, config.handlerConfig(), config.transportConfig())
+	if err != nil {
+		return fmt.Errorf("Failed to probe %s: %s", connString, err.Error())
+	}
+
+	out, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+// Prints the history of a node, oldest event first
+func runHistory(args []string) error {
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	limit := flags.Uint64("limit", 100, "Number of most recent events to print")
+	daily := flags.Bool("daily", false, "Print the daily summaries of rolled up events instead")
+	configFlags := addConfigFlags(flags)
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("Usage: history [-limit N] [-daily] <addr>")
+	}
+
+	config := configFlags.load()
+	connString, err := connStringArg(flags.Arg(0), config)
+	if err != nil {
+		return err
+	}
+	db, err := lib.ConnectPostgres(config.databaseConfig())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	node := db.GetNodeByConnString(connString)
+	if node == nil {
+		return fmt.Errorf("%s is not a known node", connString)
+	}
+	fmt.Printf("%s (id %d) %s, discovered %s, last seen %s\n", node.ConnString, node.Id, node.Version,
+		node.Discovery.Format(time.RFC3339), node.LastSeen.Format(time.RFC3339))
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if *daily {
+		days := db.GetNodeHistoryDaily(node.Id, *limit)
+		if days == nil {
+			return fmt.Errorf("Failed to read the daily history of %s", connString)
+		}
+		for i := len(days) - 1; i >= 0; i-- {
+			fmt.Fprintf(writer, "%s\t%s\t%d\t%s\t%s\n", days[i].Day.Format("2006-01-02"), days[i].EventType,
+				days[i].Events, days[i].First.Format(time.RFC3339), days[i].Last.Format(time.RFC3339))
+		}
+		_ = writer.Flush()
+		return nil
+	}
+
+	entries := db.GetNodeHistoryByNodeId(node.Id, *limit)
+	if entries == nil {
+		return fmt.Errorf("Failed to read the history of %s", connString)
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		fmt.Fprintf(writer, "%s\t%s\t%s\n", entries[i].Timestamp.Format(time.RFC3339), entries[i].EventType,
+			entries[i].Data.String)
+	}
+	_ = writer.Flush()
+	if cutoff := config.databaseConfig().History.RawSince(time.Now()); !cutoff.IsZero() {
+		fmt.Printf("Events before %s are rolled up into daily summaries, see -daily\n", cutoff.Format("2006-01-02"))
+	}
+	return nil
+}
+
+// Lists every message of the given capture files with its direction, command and size
+func runInspect(args []string) error {
+	flags := flag.NewFlagSet("inspect", flag.ExitOnError)
+	_ = flags.Parse(args)
+	if flags.NArg() == 0 {
+		return errors.New("Usage: inspect <capture file>...")
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, path := range flags.Args() {
+		// What was listed so far is printed before giving up on a broken file
+		if err := inspectCapture(writer, path); err != nil {
+			_ = writer.Flush()
+			return err
+		}
+	}
+	_ = writer.Flush()
+	return nil
+}
+
+// Lists the messages of the capture file at path
+func inspectCapture(writer io.Writer, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader, err := lib.NewCaptureReader(file)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %s", path, err.Error())
+	}
+
+	fmt.Fprintf(writer, "# %s: %s\n", path, reader.ConnString)
+	count := 0
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s after %d messages: %s", path, count, err.Error())
+		}
+		count++
+
+		// The command is the NUL padded second field of the 24 byte header
+		command, payload := "", 0
+		if len(record.Frame) >= 24 {
+			command = strings.TrimRight(string(record.Frame[4:16]), "\x00")
+			payload = len(record.Frame) - 24
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%d\n", record.Timestamp.Format(time.RFC3339Nano),
+			record.Direction, command, payload)
+	}
+	fmt.Fprintf(writer, "# %d messages\n", count)
+	return nil
+}
+
+func runMigrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	configFlags := addConfigFlags(flags)
+	_ = flags.Parse(args)
+
+	db, err := lib.ConnectPostgres(configFlags.load().databaseConfig())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := db.Migrate(); err != nil {
+		return err
+	}
+	log.Println("Database schema is up to date.")
+	return nil
+}
+
+func runMaintain(args []string) error {
+	flags := flag.NewFlagSet("maintain", flag.ExitOnError)
+	configFlags := addConfigFlags(flags)
+	_ = flags.Parse(args)
+
+	config := configFlags.load()
+	db, err := lib.ConnectPostgres(config.databaseConfig())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := db.Migrate(); err != nil {
+		return err
+	}
+	result, err := db.MaintainNodeHistory(config.databaseConfig().History, time.Now())
+	if err != nil {
+		return err
+	}
+	if result.Partitioned {
+		log.Println("Partitioned nodehistory by month.")
+	}
+	for _, name := range result.Created {
+		log.Println("Created partition", name)
+	}
+	for _, name := range result.Dropped {
+		log.Println("Dropped partition", name)
+	}
+	log.Println("Rolled up", result.RolledUp, "events past the retention.")
+	return nil
+}
+
+// Guesses the node list format from the file name, e.g. peers.dat or nodes.csv
+func nodeListFormat(path string) string {
+	switch base := filepath.Base(path); base {
+	case lib.NodeListPeers, lib.NodeListAnchors:
+		return base
+	}
+	if ext := filepath.Ext(path); ext != "" {
+		return ext[1:]
+	}
+	return lib.NodeListCSV
+}
+
+func runImport(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	format := flags.String("format", "", "csv, jsonl, peers.dat or anchors.dat. Guessed from the file name if omitted.")
+	chain := flags.String("chain", "", "Chain the node list belongs to, node.chain if omitted")
+	referrer := flags.Int64("referrer", lib.ReferrerImport, "Referrer id to record for the imported nodes")
+	configFlags := addConfigFlags(flags)
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("Usage: import [-format F] [-chain C] [-referrer N] <file>")
+	}
+
+	path := flags.Arg(0)
+	if *format == "" {
+		*format = nodeListFormat(path)
+	}
+	config := configFlags.load()
+	if *chain == "" {
+		*chain = config.Node.Chain
+	}
+	params, err := lib.ChainParamsByName(*chain)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	db, err := lib.ConnectPostgres(config.databaseConfig())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	read, added, err := lib.ImportNodes(db, file, *format, params, *referrer)
+	if err != nil {
+		return fmt.Errorf("Failed to import %s: %s", path, err.Error())
+	}
+	log.Println("Imported", added, "new nodes out of", read, "addresses in", path)
+	return nil
+}
+
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", "", "csv or jsonl. Guessed from the file name if omitted.")
+	configFlags := addConfigFlags(flags)
+	_ = flags.Parse(args)
+
+	var out io.Writer = os.Stdout
+	path := flags.Arg(0)
+	if path != "" && path != "-" {
+		file, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+		if *format == "" {
+			*format = nodeListFormat(path)
+		}
+	}
+	if *format == "" {
+		*format = lib.NodeListCSV
+	}
+
+	db, err := lib.ConnectPostgres(configFlags.load().databaseConfig())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	count, err := lib.ExportNodes(db, out, *format)
+	if err != nil {
+		return fmt.Errorf("Failed to export nodes: %s", err.Error())
+	}
+	log.Println("Exported", count, "nodes")
+	return nil
+}
+
+// Feeds the capture files of a single session, in the order given, through a BitcoinHandler
+func runReplay(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	configFlags := addConfigFlags(flags)
+	_ = flags.Parse(args)
+	args = flags.Args()
+	if len(args) == 0 {
+		return errors.New("Usage: replay [-config file] <capture file>...")
+	}
+
+	readers := make([]*lib.CaptureReader, 0, len(args))
+	for _, path := range args {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		reader, err := lib.NewCaptureReader(file)
+		if err != nil {
+			return fmt.Errorf("Failed to read %s: %s", path, err.Error())
+		}
+		if len(readers) > 0 && reader.ConnString != readers[0].ConnString {
+			return fmt.Errorf("%s is a capture of %s rather than %s", path, reader.ConnString, readers[0].ConnString)
+		}
+		readers = append(readers, reader)
+	}
+
+	config := configFlags.load()
+	cd := lib.MakeCoordinator("replay", config.MaxPeers, config.databaseConfig(), config.redisConfig(),
+		lib.BootstrapConfig{}, lib.CaptureConfig{}, config.txSampler(), lib.MempoolConfig{}, lib.TransportConfig{},
+		config.handlerConfig(), nil, nil)
+
+	// Nothing of a replay ends up in the database, what it would have recorded is printed instead
+	storage := lib.MakeMemoryStorage()
+	connString := readers[0].ConnString
+	node := storage.PutNode(lib.NodeInfo{ConnString: connString, Referrer: lib.ReferrerImport})
+
+	handler := lib.MakeBitcoinHandler(node, storage, storage, cd.HandlerConfig)
+	if err := handler.Replay(cd, lib.MultiCaptureReader(readers...)); err != nil {
+		return fmt.Errorf("Replay of %s failed: %s", connString, err.Error())
+	}
+	for _, entry := range storage.History() {
+		log.Println("Recorded", entry.EventType, "at", entry.Timestamp.Format(time.RFC3339), entry.Data.String)
+	}
+	return nil
+}
+
+// Enriches the nodes with their netgroup, AS and location, by default only those that were
+// not before
+func runEnrich(args []string) error {
+	flags := flag.NewFlagSet("enrich", flag.ExitOnError)
+	all := flags.Bool("all", false, "Enrich all nodes again rather than only new ones")
+	configFlags := addConfigFlags(flags)
+	_ = flags.Parse(args)
+
+	config := configFlags.load()
+	asnDatabase := config.asnDatabase()
+	geoDatabase := config.geoDatabase()
+
+	db, err := lib.ConnectPostgres(config.databaseConfig())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := db.Migrate(); err != nil {
+		return err
+	}
+
+	var enriched int
+	if *all {
+		enriched, err = lib.EnrichAllNodes(db, asnDatabase)
+		if err != nil {
+			return fmt.Errorf("Failed to enrich nodes: %s", err.Error())
+		}
+	} else {
+		enriched = lib.EnrichNodes(db, asnDatabase)
+	}
+	log.Println("Enriched", enriched, "nodes")
+
+	if geoDatabase == nil {
+		return nil
+	}
+	var located int
+	if *all {
+		located, err = lib.LocateAllNodes(db, geoDatabase)
+		if err != nil {
+			return fmt.Errorf("Failed to locate nodes: %s", err.Error())
+		}
+	} else {
+		located = lib.LocateNodes(db, geoDatabase)
+	}
+	log.Println("Located", located, "nodes")
+	return nil
+}
+
+// Computes the network reports of the last days and writes them as CSV
+func runReport(args []string) error {
+	flags := flag.NewFlagSet("report", flag.ExitOnError)
+	days := flags.Int("days", 30, "Number of days up to and including today to report on")
+	stored := flags.Bool("stored", false, "Write the stored reports without computing them again")
+	configFlags := addConfigFlags(flags)
+	_ = flags.Parse(args)
+	if *days <= 0 {
+		return errors.New("Usage: report [-days N] [-stored] [file]")
+	}
+
+	var out io.Writer = os.Stdout
+	if path := flags.Arg(0); path != "" && path != "-" {
+		file, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	databaseConfig := configFlags.load().databaseConfig()
+	db, err := lib.ConnectPostgres(databaseConfig)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := db.Migrate(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	since := now.Add(-time.Hour * 24 * time.Duration(*days-1)).UTC().Truncate(time.Hour * 24)
+	if !*stored {
+		// The raw events of the days before the retention are gone, their stored reports are kept
+		start := since
+		if cutoff := databaseConfig.History.RawSince(now); start.Before(cutoff) {
+			log.Println("Keeping the stored reports before", cutoff.Format("2006-01-02"),
+				"whose events were rolled up")
+			start = cutoff
+		}
+		for day := start; !day.After(now); day = day.Add(time.Hour * 24) {
+			if lib.ComputeNetworkReport(db, day) == nil {
+				return fmt.Errorf("Failed to compute the network report for %s", day.Format("2006-01-02"))
+			}
+		}
+	}
+
+	reports := db.GetNetworkReports(since)
+	if reports == nil {
+		return errors.New("Failed to read the network reports")
+	}
+	if err := lib.WriteNetworkReportCSV(out, reports); err != nil {
+		return fmt.Errorf("Failed to write the network reports: %s", err.Error())
+	}
+	return nil
+}
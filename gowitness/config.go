@@ -0,0 +1,842 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"globalwitness/lib"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Configuration is read from a YAML file, then from env vars and last from flags, each
+// overriding the one before. Every setting has a flag named after its path in the file, e.g.
+// -postgres.port, and most of them an env var.
+
+type Config struct {
+	MaxPeers   int64             `yaml:"max_peers"`
+	API        apiSection        `yaml:"api"`
+	Postgres   postgresSection   `yaml:"postgres"`
+	History    historySection    `yaml:"history"`
+	Redis      redisSection      `yaml:"redis"`
+	Node       nodeSection       `yaml:"node"`
+	Responder  responderSection  `yaml:"responder"`
+	Addr       addrSection       `yaml:"addr"`
+	Session    sessionSection    `yaml:"session"`
+	Canary     canarySection     `yaml:"canary"`
+	Seeder     seederSection     `yaml:"seeder"`
+	Bootstrap  bootstrapSection  `yaml:"bootstrap"`
+	Capture    captureSection    `yaml:"capture"`
+	TxSampling txSamplingSection `yaml:"tx_sampling"`
+	Mempool    mempoolSection    `yaml:"mempool"`
+	Transport  transportSection  `yaml:"transport"`
+	ASN        asnSection        `yaml:"asn"`
+	Geo        geoSection        `yaml:"geo"`
+}
+
+type apiSection struct {
+	Port    uint16 `yaml:"port"`
+	Binding string `yaml:"binding"`
+}
+
+type postgresSection struct {
+	Host     string `yaml:"host"`
+	Port     uint16 `yaml:"port"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	Database string `yaml:"database"`
+	SSLMode  string `yaml:"sslmode"`
+	MaxOpen  int    `yaml:"max_open"`
+	MaxIdle  int    `yaml:"max_idle"`
+}
+
+// Partitioning and retention of nodehistory, see the maintain command
+type historySection struct {
+	RetentionMonths     int           `yaml:"retention_months"`
+	PremakeMonths       int           `yaml:"premake_months"`
+	MaintenanceInterval time.Duration `yaml:"maintenance_interval"`
+}
+
+type redisSection struct {
+	URL      string `yaml:"url"`
+	Password string `yaml:"password"`
+	MaxOpen  int    `yaml:"max_open"`
+	MaxIdle  int    `yaml:"max_idle"`
+}
+
+// How we present ourselves to peers and how long sessions may take
+type nodeSection struct {
+	Chain string `yaml:"chain"`
+	// A profile, custom for the settings below or random for one of RandomIdentities per session
+	Identity         string   `yaml:"identity"`
+	RandomIdentities []string `yaml:"random_identities"`
+	// The custom identity
+	UserAgent        string        `yaml:"user_agent"`
+	ProtocolVersion  uint32        `yaml:"protocol_version"`
+	Services         []string      `yaml:"services"`
+	TrickleInterval  time.Duration `yaml:"trickle_interval"`
+	DialTimeout      time.Duration `yaml:"dial_timeout"`
+	NegotiateTimeout time.Duration `yaml:"negotiate_timeout"`
+	IdleTimeout      time.Duration `yaml:"idle_timeout"`
+	// Height we advertise: none, tip, lagged or fixed
+	TipPolicy   string `yaml:"tip_policy"`
+	TipLag      int32  `yaml:"tip_lag"`
+	FixedHeight int32  `yaml:"fixed_height"`
+}
+
+// How we answer getheaders, getdata and getaddr of peers
+type responderSection struct {
+	Enabled       bool          `yaml:"enabled"`
+	GetAddrSize   int           `yaml:"getaddr_size"`
+	GetAddrMaxAge time.Duration `yaml:"getaddr_max_age"`
+}
+
+// What we answer addr messages with: none, sample, self or canary
+type addrSection struct {
+	Policy       string        `yaml:"policy"`
+	SampleSize   int           `yaml:"sample_size"`
+	SampleMaxAge time.Duration `yaml:"sample_max_age"`
+	Self         string        `yaml:"self"`
+}
+
+// When we end sessions on our own, no limit if 0
+type sessionSection struct {
+	MaxDuration   time.Duration `yaml:"max_duration"`
+	MaxAddrCycles int           `yaml:"max_addr_cycles"`
+	Idle          time.Duration `yaml:"idle"`
+}
+
+// Canaries are disabled without a prefix
+type canarySection struct {
+	Prefix     string   `yaml:"prefix"`
+	Port       uint16   `yaml:"port"`
+	Targets    []string `yaml:"targets"`
+	PerSession int      `yaml:"per_session"`
+}
+
+// The DNS seeder is disabled without a domain
+type seederSection struct {
+	Domain  string `yaml:"domain"`
+	NS      string `yaml:"ns"`
+	Mbox    string `yaml:"mbox"`
+	Port    uint16 `yaml:"port"`
+	Binding string `yaml:"binding"`
+}
+
+type bootstrapSection struct {
+	SeedFile string        `yaml:"seed_file"`
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+// Message capture is disabled without a directory
+type captureSection struct {
+	Dir         string `yaml:"dir"`
+	MaxFileSize int64  `yaml:"max_file_size"`
+}
+
+type txSamplingSection struct {
+	Policy         string   `yaml:"policy"`
+	Percentage     float64  `yaml:"percentage"`
+	MinValue       int64    `yaml:"min_value"`
+	BytesPerSecond float64  `yaml:"bytes_per_second"`
+	ScriptClasses  []string `yaml:"script_classes"`
+}
+
+// Mempool snapshots are disabled without an interval
+type mempoolSection struct {
+	SnapshotInterval time.Duration `yaml:"snapshot_interval"`
+}
+
+type transportSection struct {
+	V2               bool          `yaml:"v2"`
+	HandshakeTimeout time.Duration `yaml:"handshake_timeout"`
+	// Inbound peers are not accepted if empty
+	Listen     string `yaml:"listen"`
+	MaxInbound int64  `yaml:"max_inbound"`
+}
+
+type asnSection struct {
+	Database string `yaml:"database"`
+	// Guessed from the file name if empty
+	Format string `yaml:"format"`
+}
+
+type geoSection struct {
+	Database string `yaml:"database"`
+}
+
+func defaultConfig() *Config {
+	handler := lib.DefaultHandlerConfig()
+	// The custom identity starts out as the honest one
+	custom, _ := lib.IdentityProfile(lib.IdentityHonest)
+	return &Config{
+		MaxPeers: 16,
+		API:      apiSection{Port: 8080, Binding: "0.0.0.0"},
+		Postgres: postgresSection{Port: 5432, SSLMode: "disable", MaxOpen: 16, MaxIdle: 8},
+		History:  historySection{PremakeMonths: 2, MaintenanceInterval: time.Hour * 24},
+		Redis:    redisSection{URL: "localhost:6379", MaxOpen: 0, MaxIdle: 8},
+		Node: nodeSection{
+			Chain:            handler.ChainParams.Name,
+			Identity:         handler.Identities[0].Profile,
+			RandomIdentities: lib.IdentityProfileNames(),
+			UserAgent:        custom.UserAgent,
+			ProtocolVersion:  custom.ProtocolVersion,
+			Services:         lib.ServiceFlagNames(custom.Services),
+			TrickleInterval:  handler.TrickleInterval,
+			DialTimeout:      handler.DialTimeout,
+			NegotiateTimeout: handler.NegotiateTimeout,
+			IdleTimeout:      handler.IdleTimeout,
+			TipPolicy:        lib.TipPolicyTip,
+			TipLag:           2,
+		},
+		Responder: responderSection{Enabled: true, GetAddrSize: 250, GetAddrMaxAge: time.Hour * 24},
+		Addr: addrSection{
+			Policy:       lib.AddrPolicySample,
+			SampleSize:   1,
+			SampleMaxAge: time.Hour * 24,
+		},
+		Session:   sessionSection{MaxDuration: handler.Lifetime.MaxDuration, Idle: time.Minute * 20},
+		Canary:    canarySection{Port: 8333, Targets: make([]string, 0), PerSession: 1},
+		Seeder:    seederSection{Port: 53, Binding: "0.0.0.0"},
+		Bootstrap: bootstrapSection{Timeout: time.Second * 10},
+		Capture:   captureSection{MaxFileSize: 67108864},
+		TxSampling: txSamplingSection{
+			Policy:         lib.TxSampleNone,
+			Percentage:     10,
+			BytesPerSecond: 20000,
+			ScriptClasses:  make([]string, 0),
+		},
+		Transport: transportSection{HandshakeTimeout: time.Second * 10, MaxInbound: 32},
+	}
+}
+
+type setting struct {
+	// Path of the setting in the file, also the name of its flag
+	name  string
+	env   string
+	usage string
+	field func(config *Config) interface{}
+}
+
+var settings = []setting{
+	{"max_peers", "MAX_PEERS", "Number of peers connected at a time", func(c *Config) interface{} { return &c.MaxPeers }},
+	{"api.port", "API_PORT", "Port of the API server", func(c *Config) interface{} { return &c.API.Port }},
+	{"api.binding", "API_BINDING", "Address the API server listens on", func(c *Config) interface{} { return &c.API.Binding }},
+	{"postgres.host", "POSTGRES_HOST", "Postgres host", func(c *Config) interface{} { return &c.Postgres.Host }},
+	{"postgres.port", "POSTGRES_PORT", "Postgres port", func(c *Config) interface{} { return &c.Postgres.Port }},
+	{"postgres.user", "POSTGRES_USER", "Postgres user", func(c *Config) interface{} { return &c.Postgres.User }},
+	{"postgres.password", "POSTGRES_PASS", "Postgres password", func(c *Config) interface{} { return &c.Postgres.Password }},
+	{"postgres.database", "POSTGRES_DB", "Postgres database", func(c *Config) interface{} { return &c.Postgres.Database }},
+	{"postgres.sslmode", "POSTGRES_SSLMODE", "libpq sslmode of the Postgres connection", func(c *Config) interface{} { return &c.Postgres.SSLMode }},
+	{"postgres.max_open", "POSTGRES_MAXOPEN", "Maximum open Postgres connections", func(c *Config) interface{} { return &c.Postgres.MaxOpen }},
+	{"postgres.max_idle", "POSTGRES_MAXIDLE", "Maximum idle Postgres connections", func(c *Config) interface{} { return &c.Postgres.MaxIdle }},
+	{"history.retention_months", "HISTORY_RETENTION_MONTHS", "Months of raw node history kept besides the current one, all if 0", func(c *Config) interface{} { return &c.History.RetentionMonths }},
+	{"history.premake_months", "HISTORY_PREMAKE_MONTHS", "Monthly node history partitions created ahead of time", func(c *Config) interface{} { return &c.History.PremakeMonths }},
+	{"history.maintenance_interval", "HISTORY_MAINTENANCE_INTERVAL", "How often the daemon maintains the partitioned node history, never if 0", func(c *Config) interface{} { return &c.History.MaintenanceInterval }},
+	{"redis.url", "REDIS_URL", "Redis host:port", func(c *Config) interface{} { return &c.Redis.URL }},
+	{"redis.password", "REDIS_PASS", "Redis password", func(c *Config) interface{} { return &c.Redis.Password }},
+	{"redis.max_open", "REDIS_MAXOPEN", "Maximum open Redis connections, 0 for no limit", func(c *Config) interface{} { return &c.Redis.MaxOpen }},
+	{"redis.max_idle", "REDIS_MAXIDLE", "Maximum idle Redis connections", func(c *Config) interface{} { return &c.Redis.MaxIdle }},
+	{"node.chain", "CHAIN", "Chain we connect to: mainnet, testnet3, regtest or simnet", func(c *Config) interface{} { return &c.Node.Chain }},
+	{"node.identity", "IDENTITY", "Identity profile we present: legacy, core, globalwitness, custom or random", func(c *Config) interface{} { return &c.Node.Identity }},
+	{"node.random_identities", "RANDOM_IDENTITIES", "Comma separated profiles drawn from per session with the random identity", func(c *Config) interface{} { return &c.Node.RandomIdentities }},
+	{"node.user_agent", "USER_AGENT", "User agent of the custom identity, e.g. /Satoshi:29.0.0/", func(c *Config) interface{} { return &c.Node.UserAgent }},
+	{"node.protocol_version", "PROTOCOL_VERSION", "Protocol version of the custom identity", func(c *Config) interface{} { return &c.Node.ProtocolVersion }},
+	{"node.services", "SERVICES", "Comma separated services of the custom identity", func(c *Config) interface{} { return &c.Node.Services }},
+	{"node.trickle_interval", "TRICKLE_INTERVAL", "Interval at which inventory is trickled to peers", func(c *Config) interface{} { return &c.Node.TrickleInterval }},
+	{"node.dial_timeout", "DIAL_TIMEOUT", "Timeout of the TCP connection to a peer", func(c *Config) interface{} { return &c.Node.DialTimeout }},
+	{"node.negotiate_timeout", "NEGOTIATE_TIMEOUT", "Timeout of the version handshake", func(c *Config) interface{} { return &c.Node.NegotiateTimeout }},
+	{"node.idle_timeout", "IDLE_TIMEOUT", "Peers silent for this long are disconnected", func(c *Config) interface{} { return &c.Node.IdleTimeout }},
+	{"node.tip_policy", "TIP_POLICY", "Height we advertise: none, tip, lagged or fixed", func(c *Config) interface{} { return &c.Node.TipPolicy }},
+	{"node.tip_lag", "TIP_LAG", "Blocks the lagged tip policy stays behind the observed tip", func(c *Config) interface{} { return &c.Node.TipLag }},
+	{"node.fixed_height", "FIXED_HEIGHT", "Height advertised with the fixed tip policy", func(c *Config) interface{} { return &c.Node.FixedHeight }},
+	{"responder.enabled", "RESPONDER", "Answer getheaders from announced headers and getdata with notfound", func(c *Config) interface{} { return &c.Responder.Enabled }},
+	{"responder.getaddr_size", "GETADDR_SIZE", "Reachable nodes sent in answer to a getaddr, 0 to ignore getaddr", func(c *Config) interface{} { return &c.Responder.GetAddrSize }},
+	{"addr.policy", "ADDR_POLICY", "What we answer addr messages with: none, sample, self or canary", func(c *Config) interface{} { return &c.Addr.Policy }},
+	{"addr.sample_size", "ADDR_SAMPLE_SIZE", "Reachable nodes per answer with the sample policy", func(c *Config) interface{} { return &c.Addr.SampleSize }},
+	{"addr.sample_max_age", "ADDR_SAMPLE_MAX_AGE", "Only nodes seen this recently are sampled", func(c *Config) interface{} { return &c.Addr.SampleMaxAge }},
+	{"addr.self", "ADDR_SELF", "ip:port we advertise with the self policy", func(c *Config) interface{} { return &c.Addr.Self }},
+	{"session.max_duration", "MAX_SESSION_DURATION", "Sessions are cut off after this long, 0 for no limit", func(c *Config) interface{} { return &c.Session.MaxDuration }},
+	{"session.max_addr_cycles", "MAX_ADDR_CYCLES", "Sessions end once the peer sent this many addr messages, 0 for no limit", func(c *Config) interface{} { return &c.Session.MaxAddrCycles }},
+	{"session.idle", "SESSION_IDLE", "Sessions end once the peer sent nothing but pings for this long, 0 for no limit", func(c *Config) interface{} { return &c.Session.Idle }},
+	{"canary.prefix", "CANARY_PREFIX", "CIDR prefix we control that canary addresses are drawn from", func(c *Config) interface{} { return &c.Canary.Prefix }},
+	{"canary.port", "CANARY_PORT", "Port of the canary addresses", func(c *Config) interface{} { return &c.Canary.Port }},
+	{"canary.targets", "CANARY_TARGETS", "Comma separated connstrings of the peers canaries are injected to, all if empty", func(c *Config) interface{} { return &c.Canary.Targets }},
+	{"canary.per_session", "CANARY_PER_SESSION", "Canaries injected to each targeted peer after the handshake", func(c *Config) interface{} { return &c.Canary.PerSession }},
+	{"responder.getaddr_max_age", "GETADDR_MAX_AGE", "Only nodes seen this recently are sent in answer to a getaddr", func(c *Config) interface{} { return &c.Responder.GetAddrMaxAge }},
+	{"seeder.domain", "SEEDER_DOMAIN", "Zone served by the DNS seeder, disabled if empty", func(c *Config) interface{} { return &c.Seeder.Domain }},
+	{"seeder.ns", "SEEDER_NS", "Hostname of the NS record pointing at the seeder", func(c *Config) interface{} { return &c.Seeder.NS }},
+	{"seeder.mbox", "SEEDER_MBOX", "SOA mailbox of the seeder, hostmaster.<domain> if empty", func(c *Config) interface{} { return &c.Seeder.Mbox }},
+	{"seeder.port", "SEEDER_PORT", "Port of the DNS seeder", func(c *Config) interface{} { return &c.Seeder.Port }},
+	{"seeder.binding", "SEEDER_BINDING", "Address the DNS seeder listens on", func(c *Config) interface{} { return &c.Seeder.Binding }},
+	{"bootstrap.seed_file", "SEED_FILE", "File of seed addresses, one per line", func(c *Config) interface{} { return &c.Bootstrap.SeedFile }},
+	{"bootstrap.timeout", "BOOTSTRAP_TIMEOUT", "Timeout of the DNS seed lookups", func(c *Config) interface{} { return &c.Bootstrap.Timeout }},
+	{"capture.dir", "CAPTURE_DIR", "Directory messages are captured to, disabled if empty", func(c *Config) interface{} { return &c.Capture.Dir }},
+	{"capture.max_file_size", "CAPTURE_MAX_FILE_SIZE", "Size at which capture files are rotated", func(c *Config) interface{} { return &c.Capture.MaxFileSize }},
+	{"tx_sampling.policy", "TX_SAMPLING", "none, all, percentage or filter", func(c *Config) interface{} { return &c.TxSampling.Policy }},
+	{"tx_sampling.percentage", "TX_SAMPLING_PERCENTAGE", "Percentage of transactions sampled", func(c *Config) interface{} { return &c.TxSampling.Percentage }},
+	{"tx_sampling.min_value", "TX_SAMPLING_MIN_VALUE", "Minimum output value of filtered transactions", func(c *Config) interface{} { return &c.TxSampling.MinValue }},
+	{"tx_sampling.bytes_per_second", "TX_SAMPLING_BYTES_PER_SECOND", "Rate limit of sampled transactions per peer", func(c *Config) interface{} { return &c.TxSampling.BytesPerSecond }},
+	{"tx_sampling.script_classes", "TX_SAMPLING_SCRIPT_CLASSES", "Comma separated script classes of filtered transactions", func(c *Config) interface{} { return &c.TxSampling.ScriptClasses }},
+	{"mempool.snapshot_interval", "MEMPOOL_SNAPSHOT_INTERVAL", "Interval of mempool snapshots, disabled if 0", func(c *Config) interface{} { return &c.Mempool.SnapshotInterval }},
+	{"transport.v2", "V2_TRANSPORT", "Try the BIP324 v2 transport with peers that support it", func(c *Config) interface{} { return &c.Transport.V2 }},
+	{"transport.handshake_timeout", "V2_HANDSHAKE_TIMEOUT", "Timeout of the v2 handshake", func(c *Config) interface{} { return &c.Transport.HandshakeTimeout }},
+	{"transport.listen", "LISTEN", "ip:port inbound peers are accepted on, none are if empty", func(c *Config) interface{} { return &c.Transport.Listen }},
+	{"transport.max_inbound", "MAX_INBOUND", "Number of inbound peers connected at a time", func(c *Config) interface{} { return &c.Transport.MaxInbound }},
+	{"asn.database", "ASN_DATABASE", "ASN database nodes are enriched from", func(c *Config) interface{} { return &c.ASN.Database }},
+	{"asn.format", "ASN_DATABASE_FORMAT", "mmdb or tsv, guessed from the file name if empty", func(c *Config) interface{} { return &c.ASN.Format }},
+	{"geo.database", "GEO_DATABASE", "GeoLite2 database nodes are located with", func(c *Config) interface{} { return &c.Geo.Database }},
+}
+
+// Parses value into the setting field points at
+func setSetting(field interface{}, value string) error {
+	var err error
+	switch field := field.(type) {
+	case *string:
+		*field = value
+	case *bool:
+		*field, err = strconv.ParseBool(value)
+	case *int:
+		*field, err = strconv.Atoi(value)
+	case *int64:
+		*field, err = strconv.ParseInt(value, 10, 64)
+	case *uint16:
+		var parsed uint64
+		parsed, err = strconv.ParseUint(value, 10, 16)
+		*field = uint16(parsed)
+	case *int32:
+		var parsed int64
+		parsed, err = strconv.ParseInt(value, 10, 32)
+		*field = int32(parsed)
+	case *uint32:
+		var parsed uint64
+		parsed, err = strconv.ParseUint(value, 10, 32)
+		*field = uint32(parsed)
+	case *float64:
+		*field, err = strconv.ParseFloat(value, 64)
+	case *time.Duration:
+		*field, err = time.ParseDuration(value)
+	case *[]string:
+		*field = make([]string, 0)
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*field = append(*field, item)
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported setting type %T", field)
+	}
+	return err
+}
+
+func formatSetting(field interface{}) string {
+	if list, ok := field.(*[]string); ok {
+		return strings.Join(*list, ",")
+	}
+	return fmt.Sprint(reflect.ValueOf(field).Elem().Interface())
+}
+
+type flagValue struct {
+	setting setting
+	value   string
+}
+
+// The flags of a FlagSet that override settings, they are applied after the file and env vars
+type configFlags struct {
+	path   *string
+	values []flagValue
+}
+
+type settingFlag struct {
+	setting setting
+	flags   *configFlags
+}
+
+func (f *settingFlag) String() string {
+	if f.setting.field == nil {
+		return ""
+	}
+	return formatSetting(f.setting.field(defaultConfig()))
+}
+
+func (f *settingFlag) Set(value string) error {
+	// Parsed once here so that the flag package reports a malformed value right away
+	if err := setSetting(f.setting.field(defaultConfig()), value); err != nil {
+		return err
+	}
+	f.flags.values = append(f.flags.values, flagValue{f.setting, value})
+	return nil
+}
+
+// Registers -config and a flag for every setting on flags
+func addConfigFlags(flags *flag.FlagSet) *configFlags {
+	cf := &configFlags{values: make([]flagValue, 0)}
+	cf.path = flags.String("config", "", "YAML configuration file, the CONFIG_FILE env var if omitted")
+	for _, s := range settings {
+		flags.Var(&settingFlag{setting: s, flags: cf}, s.name, s.usage+" ("+s.env+")")
+	}
+	return cf
+}
+
+// Reads the configuration file, env vars and flags over the defaults without validating them
+func (cf *configFlags) read() (*Config, error) {
+	config := defaultConfig()
+
+	path := *cf.path
+	if path == "" {
+		path = os.Getenv("CONFIG_FILE")
+	}
+	if path != "" {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		// Strict so that a misspelt setting is an error rather than silently ignored
+		if err := yaml.UnmarshalStrict(buf, config); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %s", path, err.Error())
+		}
+	}
+
+	for _, s := range settings {
+		// Empty env vars count as unset, as MAX_PEERS always did
+		value := os.Getenv(s.env)
+		if value == "" {
+			continue
+		}
+		if err := setSetting(s.field(config), value); err != nil {
+			return nil, fmt.Errorf("failed to parse the %s env var: %s", s.env, err.Error())
+		}
+	}
+
+	for _, v := range cf.values {
+		if err := setSetting(v.setting.field(config), v.value); err != nil {
+			return nil, fmt.Errorf("failed to parse -%s: %s", v.setting.name, err.Error())
+		}
+	}
+	return config, nil
+}
+
+// Reads and validates the configuration, exits on any problem
+func (cf *configFlags) load() *Config {
+	return cf.loadChecked(true)
+}
+
+// Like load for commands that neither touch Postgres nor Redis
+func (cf *configFlags) loadWithoutStorage() *Config {
+	return cf.loadChecked(false)
+}
+
+func (cf *configFlags) loadChecked(storage bool) *Config {
+	config, err := cf.read()
+	if err != nil {
+		log.Fatalf("Failed to read the configuration: %s\n", err.Error())
+	}
+	if err := config.validate(storage); err != nil {
+		log.Fatal(err.Error())
+	}
+	return config
+}
+
+var postgresSSLModes = []string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"}
+
+// Reports every invalid setting at once, the connection settings are only required with storage
+func (config *Config) validate(storage bool) error {
+	problems := make([]string, 0)
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+	checkFile := func(name, path string) {
+		if path == "" {
+			return
+		}
+		_, err := os.Stat(path)
+		check(err == nil, "%s %s cannot be read: %v", name, path, err)
+	}
+
+	check(config.MaxPeers > 0, "max_peers must be positive")
+	check(config.API.Port != 0, "api.port must not be 0")
+
+	if storage {
+		check(config.Postgres.Host != "", "postgres.host is required")
+		check(config.Postgres.User != "", "postgres.user is required")
+		check(config.Postgres.Database != "", "postgres.database is required")
+		check(config.Redis.URL != "", "redis.url is required")
+	}
+	check(config.Postgres.Port != 0, "postgres.port must not be 0")
+	check(contains(postgresSSLModes, config.Postgres.SSLMode), "postgres.sslmode must be one of %s",
+		strings.Join(postgresSSLModes, ", "))
+	check(config.Postgres.MaxOpen >= 0 && config.Postgres.MaxIdle >= 0,
+		"postgres.max_open and postgres.max_idle must not be negative")
+	check(config.History.RetentionMonths >= 0 && config.History.PremakeMonths >= 0 &&
+		config.History.MaintenanceInterval >= 0,
+		"history.retention_months, history.premake_months and history.maintenance_interval must not be negative")
+
+	check(config.Redis.MaxOpen >= 0 && config.Redis.MaxIdle >= 0,
+		"redis.max_open and redis.max_idle must not be negative")
+
+	_, err := lib.ChainParamsByName(config.Node.Chain)
+	check(err == nil, "node.chain: %v", err)
+	_, err = config.identities()
+	check(err == nil, "node.identity: %v", err)
+	check(config.Node.TrickleInterval > 0, "node.trickle_interval must be positive")
+	check(config.Node.DialTimeout > 0, "node.dial_timeout must be positive")
+	check(config.Node.NegotiateTimeout > 0, "node.negotiate_timeout must be positive")
+	check(config.Node.IdleTimeout > 0, "node.idle_timeout must be positive")
+	err = config.tipConfig().Validate()
+	check(err == nil, "node.tip_policy: %v", err)
+	err = config.responderConfig().Validate()
+	check(err == nil, "responder: %v", err)
+	_, err = lib.MakeAddrPolicy(config.addrPolicyConfig())
+	check(err == nil, "addr.policy: %v", err)
+	_, err = lib.MakeCanaryInjector(config.canaryConfig())
+	check(err == nil, "canary: %v", err)
+	check(config.Addr.Policy != lib.AddrPolicyCanary || config.Canary.Prefix != "",
+		"addr.policy %s needs canary.prefix", lib.AddrPolicyCanary)
+	check(config.Session.MaxDuration >= 0 && config.Session.MaxAddrCycles >= 0 && config.Session.Idle >= 0,
+		"session.max_duration, session.max_addr_cycles and session.idle must not be negative")
+
+	if config.Seeder.Domain != "" {
+		check(config.Seeder.NS != "", "seeder.ns is required when seeder.domain is set")
+		check(config.Seeder.Port != 0, "seeder.port must not be 0")
+		check(net.ParseIP(config.Seeder.Binding) != nil, "seeder.binding %s is not an IP address",
+			config.Seeder.Binding)
+	}
+
+	checkFile("bootstrap.seed_file", config.Bootstrap.SeedFile)
+	check(config.Bootstrap.Timeout > 0, "bootstrap.timeout must be positive")
+	check(config.Capture.MaxFileSize > 0, "capture.max_file_size must be positive")
+
+	_, err = lib.MakeTxSampler(config.txSamplingConfig())
+	check(err == nil, "tx_sampling: %v", err)
+	check(config.Mempool.SnapshotInterval >= 0, "mempool.snapshot_interval must not be negative")
+	check(config.Transport.HandshakeTimeout > 0, "transport.handshake_timeout must be positive")
+	if config.Transport.Listen != "" {
+		_, _, err := net.SplitHostPort(config.Transport.Listen)
+		check(err == nil, "transport.listen: %v", err)
+		check(config.Transport.MaxInbound > 0, "transport.max_inbound must be positive")
+	}
+
+	checkFile("asn.database", config.ASN.Database)
+	check(config.ASN.Format == "" || config.ASN.Format == lib.ASNFormatMMDB || config.ASN.Format == lib.ASNFormatIP2ASN,
+		"asn.format must be %s or %s", lib.ASNFormatMMDB, lib.ASNFormatIP2ASN)
+	checkFile("geo.database", config.Geo.Database)
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.New("Invalid configuration:\n  " + strings.Join(problems, "\n  "))
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// The configuration as printed by config print, with the passwords masked
+func (config *Config) redacted() *Config {
+	shown := *config
+	if shown.Postgres.Password != "" {
+		shown.Postgres.Password = "********"
+	}
+	if shown.Redis.Password != "" {
+		shown.Redis.Password = "********"
+	}
+	return &shown
+}
+
+func (config *Config) databaseConfig() lib.DatabaseConfig {
+	return lib.DatabaseConfig{
+		Address:  config.Postgres.Host,
+		Port:     config.Postgres.Port,
+		Name:     config.Postgres.Database,
+		Username: config.Postgres.User,
+		Password: config.Postgres.Password,
+		SSLMode:  config.Postgres.SSLMode,
+		MaxIdle:  config.Postgres.MaxIdle,
+		MaxOpen:  config.Postgres.MaxOpen,
+		History: lib.HistoryConfig{
+			RetentionMonths:     config.History.RetentionMonths,
+			PremakeMonths:       config.History.PremakeMonths,
+			MaintenanceInterval: config.History.MaintenanceInterval,
+		},
+	}
+}
+
+func (config *Config) redisConfig() lib.RedisConfig {
+	return lib.RedisConfig{
+		RedisUrl: config.Redis.URL,
+		Password: config.Redis.Password,
+		MaxIdle:  config.Redis.MaxIdle,
+		MaxOpen:  config.Redis.MaxOpen,
+	}
+}
+
+func (config *Config) apiConfig() lib.APIServerConfig {
+	return lib.APIServerConfig{
+		Port:        config.API.Port,
+		BindAddress: config.API.Binding,
+	}
+}
+
+// The identities sessions pick from, a single one unless node.identity is random
+func (config *Config) identities() ([]lib.Identity, error) {
+	names := []string{config.Node.Identity}
+	if config.Node.Identity == lib.IdentityRandom {
+		if len(config.Node.RandomIdentities) == 0 {
+			return nil, errors.New("node.random_identities is empty")
+		}
+		names = config.Node.RandomIdentities
+	}
+
+	identities := make([]lib.Identity, 0, len(names))
+	for _, name := range names {
+		identity, err := lib.IdentityProfile(name)
+		if name == lib.IdentityCustom {
+			identity = lib.Identity{
+				Profile:         lib.IdentityCustom,
+				UserAgent:       config.Node.UserAgent,
+				ProtocolVersion: config.Node.ProtocolVersion,
+			}
+			if identity.Services, err = lib.ParseServiceFlags(config.Node.Services); err != nil {
+				return nil, fmt.Errorf("%s: %s", name, err.Error())
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := identity.Validate(); err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err.Error())
+		}
+		identities = append(identities, identity)
+	}
+	return identities, nil
+}
+
+// Only called on validated configurations, the chain and identities are known to parse
+func (config *Config) handlerConfig() lib.HandlerConfig {
+	params, _ := lib.ChainParamsByName(config.Node.Chain)
+	identities, _ := config.identities()
+	return lib.HandlerConfig{
+		ChainParams:      params,
+		Identities:       identities,
+		TrickleInterval:  config.Node.TrickleInterval,
+		DialTimeout:      config.Node.DialTimeout,
+		NegotiateTimeout: config.Node.NegotiateTimeout,
+		IdleTimeout:      config.Node.IdleTimeout,
+		Tip:              config.tipConfig(),
+		Responder:        config.responderConfig(),
+		AddrPolicy:       config.addrPolicy(),
+		Canaries:         config.canaryInjector(),
+		Lifetime: lib.SessionLifetime{
+			MaxDuration:   config.Session.MaxDuration,
+			MaxAddrCycles: config.Session.MaxAddrCycles,
+			Idle:          config.Session.Idle,
+		},
+	}
+}
+
+func (config *Config) tipConfig() lib.TipConfig {
+	return lib.TipConfig{
+		Policy:      config.Node.TipPolicy,
+		Lag:         config.Node.TipLag,
+		FixedHeight: config.Node.FixedHeight,
+	}
+}
+
+func (config *Config) responderConfig() lib.ResponderConfig {
+	return lib.ResponderConfig{
+		Enabled:       config.Responder.Enabled,
+		GetAddrSize:   config.Responder.GetAddrSize,
+		GetAddrMaxAge: config.Responder.GetAddrMaxAge,
+	}
+}
+
+func (config *Config) addrPolicyConfig() lib.AddrPolicyConfig {
+	return lib.AddrPolicyConfig{
+		Policy:       config.Addr.Policy,
+		SampleSize:   config.Addr.SampleSize,
+		SampleMaxAge: config.Addr.SampleMaxAge,
+		Self:         config.Addr.Self,
+	}
+}
+
+func (config *Config) addrPolicy() lib.AddrPolicy {
+	policy, err := lib.MakeAddrPolicy(config.addrPolicyConfig())
+	if err != nil {
+		log.Fatalf("Invalid addr policy: %s\n", err.Error())
+	}
+	return policy
+}
+
+func (config *Config) canaryConfig() lib.CanaryConfig {
+	return lib.CanaryConfig{
+		Prefix:     config.Canary.Prefix,
+		Port:       config.Canary.Port,
+		Targets:    config.Canary.Targets,
+		PerSession: config.Canary.PerSession,
+	}
+}
+
+// Returns nil if canaries are disabled
+func (config *Config) canaryInjector() *lib.CanaryInjector {
+	injector, err := lib.MakeCanaryInjector(config.canaryConfig())
+	if err != nil {
+		log.Fatalf("Invalid canary configuration: %s\n", err.Error())
+	}
+	return injector
+}
+
+// Returns nil if the seeder is disabled
+func (config *Config) seederConfig() *lib.SeederConfig {
+	if config.Seeder.Domain == "" {
+		log.Println("seeder.domain is not set. DNS seeder is disabled.")
+		return nil
+	}
+	mailbox := config.Seeder.Mbox
+	if mailbox == "" {
+		mailbox = "hostmaster." + config.Seeder.Domain
+	}
+	params, _ := lib.ChainParamsByName(config.Node.Chain)
+	return &lib.SeederConfig{
+		ChainParams:     params,
+		Port:            config.Seeder.Port,
+		BindAddress:     config.Seeder.Binding,
+		Domain:          config.Seeder.Domain,
+		Nameserver:      config.Seeder.NS,
+		Mailbox:         mailbox,
+		TTL:             60,
+		MaxAnswers:      25,
+		MaxAge:          time.Hour * 24,
+		MinUptime:       0.5,
+		RefreshInterval: time.Minute * 5,
+	}
+}
+
+func (config *Config) bootstrapConfig() lib.BootstrapConfig {
+	if config.Bootstrap.SeedFile == "" {
+		log.Println("bootstrap.seed_file is not set. Bootstrapping from DNS and fixed seeds only.")
+	}
+	params, _ := lib.ChainParamsByName(config.Node.Chain)
+	return lib.BootstrapConfig{
+		ChainParams: params,
+		SeedFile:    config.Bootstrap.SeedFile,
+		Timeout:     config.Bootstrap.Timeout,
+	}
+}
+
+func (config *Config) captureConfig() lib.CaptureConfig {
+	if config.Capture.Dir == "" {
+		log.Println("capture.dir is not set. Message capture is disabled.")
+	}
+	return lib.CaptureConfig{
+		Directory:   config.Capture.Dir,
+		MaxFileSize: config.Capture.MaxFileSize,
+	}
+}
+
+func (config *Config) txSamplingConfig() lib.TxSamplingConfig {
+	return lib.TxSamplingConfig{
+		Policy:         config.TxSampling.Policy,
+		Percentage:     config.TxSampling.Percentage,
+		ScriptClasses:  config.TxSampling.ScriptClasses,
+		MinValue:       config.TxSampling.MinValue,
+		BytesPerSecond: config.TxSampling.BytesPerSecond,
+		// Allow a peer to catch up on ten seconds worth of transactions at once
+		Burst: config.TxSampling.BytesPerSecond * 10,
+	}
+}
+
+func (config *Config) txSampler() *lib.TxSampler {
+	sampler, err := lib.MakeTxSampler(config.txSamplingConfig())
+	if err != nil {
+		log.Fatalf("Invalid transaction sampling configuration: %s\n", err.Error())
+	}
+	return sampler
+}
+
+func (config *Config) mempoolConfig() lib.MempoolConfig {
+	interval := config.Mempool.SnapshotInterval
+	if interval == 0 {
+		log.Println("mempool.snapshot_interval is not set. Mempool snapshots are disabled.")
+		return lib.MempoolConfig{}
+	}
+	return lib.MempoolConfig{
+		Interval:      interval,
+		QuietPeriod:   time.Second * 15,
+		MaxCollection: time.Minute * 2,
+		CompareWindow: interval,
+	}
+}
+
+func (config *Config) transportConfig() lib.TransportConfig {
+	return lib.TransportConfig{
+		V2:               config.Transport.V2,
+		HandshakeTimeout: config.Transport.HandshakeTimeout,
+		Listen:           config.Transport.Listen,
+		MaxInbound:       config.Transport.MaxInbound,
+	}
+}
+
+// Returns nil if no database is configured, nodes then only get their netgroup
+func (config *Config) asnDatabase() lib.ASNDatabase {
+	if config.ASN.Database == "" {
+		log.Println("asn.database is not set. Nodes are enriched without their AS.")
+		return nil
+	}
+	database, err := lib.OpenASNDatabase(config.ASN.Database, config.ASN.Format)
+	if err != nil {
+		log.Fatalf("Failed to open the ASN database %s: %s\n", config.ASN.Database, err.Error())
+	}
+	return database
+}
+
+// Returns nil if no database is configured, nodes are not located then
+func (config *Config) geoDatabase() *lib.GeoDatabase {
+	if config.Geo.Database == "" {
+		log.Println("geo.database is not set. Nodes are not geolocated.")
+		return nil
+	}
+	database, err := lib.OpenGeoDatabase(config.Geo.Database)
+	if err != nil {
+		log.Fatalf("Failed to open the geolocation database %s: %s\n", config.Geo.Database, err.Error())
+	}
+	return database
+}
+
+// config print writes the effective configuration as YAML and reports whether it is valid
+func runConfig(args []string) error {
+	if len(args) == 0 || args[0] != "print" {
+		return errors.New("Usage: config print [-config file] [-<setting> value]...")
+	}
+	flags := flag.NewFlagSet("config print", flag.ExitOnError)
+	configFlags := addConfigFlags(flags)
+	_ = flags.Parse(args[1:])
+
+	config, err := configFlags.read()
+	if err != nil {
+		return fmt.Errorf("Failed to read the configuration: %s", err.Error())
+	}
+	out, err := yaml.Marshal(config.redacted())
+	if err != nil {
+		return err
+	}
+	_, _ = os.Stdout.Write(out)
+
+	if err := config.validate(true); err != nil {
+		return err
+	}
+	return nil
+}
@@ -15,7 +15,8 @@ require (
 	github.com/paulbellamy/ratecounter v0.2.0
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/stretchr/testify v1.2.2 // indirect
-	golang.org/x/crypto v0.0.0-20180910181607-0e37d006457b // indirect
-	golang.org/x/net v0.0.0-20181106065722-10aee1819953 // indirect
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
+	golang.org/x/net v0.0.0-20190404232315-eb5bcb51f2a3 // indirect
 	google.golang.org/appengine v1.4.0
+	gopkg.in/yaml.v2 v2.2.1
 )
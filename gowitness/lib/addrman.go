@@ -0,0 +1,228 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// Reader for the address manager files Bitcoin Core keeps in its data directory, peers.dat
+// and anchors.dat. Both are framed as the network magic, the payload and a double-SHA256
+// of everything before it.
+
+const (
+	// Highest peers.dat format we know how to read (V4_MULTIPORT)
+	addrManMaxFormat = 4
+
+	// Format from which on addresses are stored in the BIP155 encoding (V3_BIP155)
+	addrManBIP155Format = 3
+
+	// Peers.dat stores the lowest format able to read the file offset by this much
+	addrManIncompatibilityBase = 32
+
+	// Set in the stored version of a CAddress that uses the BIP155 encoding
+	addrManDiskVersionAddrV2 = 1 << 29
+
+	// Upper bound on entries so a corrupt count can not make us allocate the world
+	addrManMaxEntries = 1 << 24
+
+	bip155NetIPv4 = 1
+	bip155NetIPv6 = 2
+)
+
+// OnionCat range that pre-BIP155 files use to store Tor v2 addresses as IPv6
+var onionCatNet = &net.IPNet{IP: net.ParseIP("fd87:d87e:eb43::"), Mask: net.CIDRMask(48, 128)}
+
+type addrManReader struct {
+	r   io.Reader
+	err error
+}
+
+func (reader *addrManReader) read(data interface{}) {
+	if reader.err == nil {
+		reader.err = binary.Read(reader.r, binary.LittleEndian, data)
+	}
+}
+
+func (reader *addrManReader) readCompactSize() uint64 {
+	if reader.err != nil {
+		return 0
+	}
+	value, err := wire.ReadVarInt(reader.r, 0)
+	reader.err = err
+	return value
+}
+
+// Reads a CNetAddr. Returns nil for networks other than IPv4 and IPv6.
+func (reader *addrManReader) readNetAddr(bip155 bool) net.IP {
+	if !bip155 {
+		ip := make([]byte, 16)
+		reader.read(ip)
+		if reader.err != nil || onionCatNet.Contains(ip) {
+			return nil
+		}
+		return net.IP(ip)
+	}
+
+	var networkId uint8
+	reader.read(&networkId)
+	size := reader.readCompactSize()
+	if reader.err != nil {
+		return nil
+	}
+	if size > 512 {
+		reader.err = fmt.Errorf("address of %d bytes is too long", size)
+		return nil
+	}
+	addr := make([]byte, size)
+	reader.read(addr)
+	if reader.err != nil {
+		return nil
+	}
+
+	switch {
+	case networkId == bip155NetIPv4 && size == net.IPv4len:
+		return net.IP(addr)
+	case networkId == bip155NetIPv6 && size == net.IPv6len && !onionCatNet.Contains(addr):
+		return net.IP(addr)
+	default:
+		return nil
+	}
+}
+
+// Reads a CAddress in its on-disk serialization
+func (reader *addrManReader) readAddress(streamBIP155 bool) *wire.NetAddress {
+	var storedVersion int32
+	var timestamp uint32
+	reader.read(&storedVersion)
+	reader.read(&timestamp)
+
+	bip155 := streamBIP155 && storedVersion&addrManDiskVersionAddrV2 != 0
+	var services uint64
+	if bip155 {
+		services = reader.readCompactSize()
+	} else {
+		reader.read(&services)
+	}
+
+	ip := reader.readNetAddr(bip155)
+	port := make([]byte, 2)
+	reader.read(port)
+	if reader.err != nil || ip == nil {
+		return nil
+	}
+
+	return &wire.NetAddress{
+		Timestamp: time.Unix(int64(timestamp), 0),
+		Services:  wire.ServiceFlag(services),
+		IP:        ip,
+		Port:      binary.BigEndian.Uint16(port),
+	}
+}
+
+// Checks the network magic and trailing checksum, returning the payload in between
+func readAddrManFile(r io.Reader, network wire.BitcoinNet) ([]byte, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 4+chainhash.HashSize {
+		return nil, errors.New("file is too short")
+	}
+
+	if magic := wire.BitcoinNet(binary.LittleEndian.Uint32(data)); magic != network {
+		return nil, fmt.Errorf("file is for network %s, expected %s", magic, network)
+	}
+
+	body, checksum := data[:len(data)-chainhash.HashSize], data[len(data)-chainhash.HashSize:]
+	if !bytes.Equal(chainhash.DoubleHashB(body), checksum) {
+		return nil, errors.New("checksum mismatch")
+	}
+	return body[4:], nil
+}
+
+// Returns the IPv4 and IPv6 addresses in the new and tried tables of a Bitcoin Core peers.dat
+func ReadPeersDat(r io.Reader, network wire.BitcoinNet) ([]*wire.NetAddress, error) {
+	payload, err := readAddrManFile(r, network)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := &addrManReader{r: bytes.NewReader(payload)}
+	var format, compat uint8
+	var key [32]byte
+	var newCount, triedCount, bucketCount int32
+	reader.read(&format)
+	reader.read(&compat)
+	reader.read(&key)
+	reader.read(&newCount)
+	reader.read(&triedCount)
+	reader.read(&bucketCount)
+	if reader.err != nil {
+		return nil, reader.err
+	}
+
+	if compat < addrManIncompatibilityBase || compat-addrManIncompatibilityBase > addrManMaxFormat {
+		return nil, fmt.Errorf("unsupported peers.dat compatibility %d of format %d", compat, format)
+	}
+	if newCount < 0 || triedCount < 0 || newCount+triedCount > addrManMaxEntries {
+		return nil, fmt.Errorf("invalid entry counts %d new and %d tried", newCount, triedCount)
+	}
+
+	bip155 := format >= addrManBIP155Format
+	addrs := make([]*wire.NetAddress, 0, newCount+triedCount)
+	for i := int32(0); i < newCount+triedCount; i++ {
+		addr := reader.readAddress(bip155)
+		// Source address, last success and attempt count
+		reader.readNetAddr(bip155)
+		var lastSuccess int64
+		var attempts int32
+		reader.read(&lastSuccess)
+		reader.read(&attempts)
+		if reader.err != nil {
+			return nil, reader.err
+		}
+		if addr != nil {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	return addrs, nil
+}
+
+// Returns the IPv4 and IPv6 addresses in a Bitcoin Core anchors.dat
+func ReadAnchorsDat(r io.Reader, network wire.BitcoinNet) ([]*wire.NetAddress, error) {
+	payload, err := readAddrManFile(r, network)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := &addrManReader{r: bytes.NewReader(payload)}
+	count := reader.readCompactSize()
+	if reader.err != nil {
+		return nil, reader.err
+	}
+	if count > addrManMaxEntries {
+		return nil, fmt.Errorf("invalid entry count %d", count)
+	}
+
+	addrs := make([]*wire.NetAddress, 0, count)
+	for i := uint64(0); i < count; i++ {
+		addr := reader.readAddress(true)
+		if reader.err != nil {
+			return nil, reader.err
+		}
+		if addr != nil {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	return addrs, nil
+}
@@ -0,0 +1,210 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"net"
+	"strings"
+	"testing"
+)
+
+// A peers.dat of the given format and compatibility without any entries
+func peersDat(network wire.BitcoinNet, format, compat uint8) []byte {
+	var file bytes.Buffer
+	_ = binary.Write(&file, binary.LittleEndian, uint32(network))
+	file.Write([]byte{format, compat})
+	file.Write(make([]byte, 32))
+	_ = binary.Write(&file, binary.LittleEndian, [3]int32{0, 0, 1024})
+	return append(file.Bytes(), chainhash.DoubleHashB(file.Bytes())...)
+}
+
+func TestReadPeersDatCompatibility(t *testing.T) {
+	// A format 5 file that format 5 readers and later ones can read
+	_, err := ReadPeersDat(bytes.NewReader(peersDat(wire.MainNet, 5, addrManIncompatibilityBase+5)), wire.MainNet)
+	if err == nil || !strings.Contains(err.Error(), "compatibility 37") {
+		t.Fatalf("read a file we are incompatible with: %v", err)
+	}
+
+	// A format 5 file that format 4 readers can still read
+	addrs, err := ReadPeersDat(bytes.NewReader(peersDat(wire.MainNet, 5, addrManIncompatibilityBase+4)), wire.MainNet)
+	if err != nil || len(addrs) != 0 {
+		t.Fatalf("rejected a compatible file: %v", err)
+	}
+}
+
+// Writes the files the way Bitcoin Core serializes them
+type addrManWriter struct {
+	bytes.Buffer
+	bip155 bool
+}
+
+// Core's disk version, the client version with ADDRV2_FORMAT set in files that use BIP155
+func (writer *addrManWriter) diskVersion() int32 {
+	if writer.bip155 {
+		return 210000 | addrManDiskVersionAddrV2
+	}
+	return 200100
+}
+
+func (writer *addrManWriter) write(data interface{}) {
+	_ = binary.Write(writer, binary.LittleEndian, data)
+}
+
+// A CNetAddr, BIP155 network id and address or the legacy 16 bytes
+func (writer *addrManWriter) netAddr(networkId uint8, addr []byte) {
+	if writer.bip155 {
+		writer.WriteByte(networkId)
+		_ = wire.WriteVarInt(writer, 0, uint64(len(addr)))
+		writer.Write(addr)
+		return
+	}
+	writer.Write(net.IP(addr).To16())
+}
+
+// A CAddress with its disk version
+func (writer *addrManWriter) address(timestamp uint32, services uint64, networkId uint8, addr []byte, port uint16) {
+	writer.write(writer.diskVersion())
+	writer.write(timestamp)
+	if writer.bip155 {
+		_ = wire.WriteVarInt(writer, 0, services)
+	} else {
+		writer.write(services)
+	}
+	writer.netAddr(networkId, addr)
+	_ = binary.Write(writer, binary.BigEndian, port)
+}
+
+// Frames the payload with the network magic and checksum
+func (writer *addrManWriter) file(network wire.BitcoinNet) []byte {
+	file := make([]byte, 4, 4+writer.Len()+chainhash.HashSize)
+	binary.LittleEndian.PutUint32(file, uint32(network))
+	file = append(file, writer.Bytes()...)
+	return append(file, chainhash.DoubleHashB(file)...)
+}
+
+const (
+	bip155NetTorV3 = 4
+	bip155NetI2P   = 5
+	bip155NetCJDNS = 6
+)
+
+type addrManEntry struct {
+	timestamp uint32
+	services  uint64
+	networkId uint8
+	addr      []byte
+	port      uint16
+}
+
+// A peers.dat with new and tried entries, each from source 198.51.100.1, followed by the bucket
+// tables of Core and, with BIP155, the asmap checksum
+func writePeersDat(network wire.BitcoinNet, bip155 bool, newEntries, triedEntries []addrManEntry) []byte {
+	writer := &addrManWriter{bip155: bip155}
+	format, compat := uint8(1), uint8(addrManIncompatibilityBase)
+	if bip155 {
+		format, compat = addrManBIP155Format, addrManIncompatibilityBase+addrManBIP155Format
+	}
+	writer.Write([]byte{format, compat})
+	writer.Write(bytes.Repeat([]byte{0x11}, 32))
+	writer.write([3]int32{int32(len(newEntries)), int32(len(triedEntries)), 1024 ^ (1 << 30)})
+	for i, entry := range append(append([]addrManEntry{}, newEntries...), triedEntries...) {
+		writer.address(entry.timestamp, entry.services, entry.networkId, entry.addr, entry.port)
+		writer.netAddr(bip155NetIPv4, net.ParseIP("198.51.100.1").To4())
+		if i < len(newEntries) {
+			writer.write(int64(0))
+		} else {
+			writer.write(int64(entry.timestamp))
+		}
+		writer.write(int32(i))
+	}
+	for bucket := 0; bucket < 1024; bucket++ {
+		if bucket < len(newEntries) {
+			writer.write([2]int32{1, int32(bucket)})
+		} else {
+			writer.write(int32(0))
+		}
+	}
+	if bip155 {
+		writer.Write(make([]byte, 32))
+	}
+	return writer.file(network)
+}
+
+func checkAddrManAddresses(t *testing.T, addrs []*wire.NetAddress, expected []addrManEntry) {
+	t.Helper()
+	if len(addrs) != len(expected) {
+		t.Fatalf("read %d addresses instead of %d: %+v", len(addrs), len(expected), addrs)
+	}
+	for i, entry := range expected {
+		addr := addrs[i]
+		if !addr.IP.Equal(net.IP(entry.addr)) || addr.Port != entry.port ||
+			addr.Services != wire.ServiceFlag(entry.services) || addr.Timestamp.Unix() != int64(entry.timestamp) {
+			t.Fatalf("read %+v instead of %+v", addr, entry)
+		}
+	}
+}
+
+var (
+	addrManIPv4 = addrManEntry{1610000000, uint64(wire.SFNodeNetwork | wire.SFNodeWitness | SFNodeNetworkLimited),
+		bip155NetIPv4, net.ParseIP("203.0.113.5").To4(), 8333}
+	addrManIPv6 = addrManEntry{1609459200, uint64(wire.SFNodeNetwork), bip155NetIPv6,
+		net.ParseIP("2001:db8::7"), 8333}
+	addrManTried = addrManEntry{1610000100, uint64(wire.SFNodeNetwork | wire.SFNodeBloom | wire.SFNodeWitness),
+		bip155NetIPv4, net.ParseIP("192.0.2.44").To4(), 8334}
+	addrManTorV3 = addrManEntry{1610000200, uint64(wire.SFNodeNetwork | wire.SFNodeWitness), bip155NetTorV3,
+		bytes.Repeat([]byte{0xab}, 32), 8333}
+	addrManI2P = addrManEntry{1610000300, uint64(wire.SFNodeWitness), bip155NetI2P,
+		bytes.Repeat([]byte{0xcd}, 32), 0}
+	addrManCJDNS = addrManEntry{1610000400, uint64(wire.SFNodeNetwork), bip155NetCJDNS,
+		net.ParseIP("fc00::1"), 8333}
+	// Tor v2 as files before BIP155 store it
+	addrManOnionCat = addrManEntry{1600000000, uint64(wire.SFNodeNetwork), bip155NetIPv6,
+		net.ParseIP("fd87:d87e:eb43:ab:cdef:1234:5678:9abc"), 8333}
+)
+
+func TestReadPeersDat(t *testing.T) {
+	file := writePeersDat(wire.MainNet, true,
+		[]addrManEntry{addrManIPv4, addrManTorV3, addrManIPv6, addrManI2P, addrManCJDNS},
+		[]addrManEntry{addrManTried})
+	addrs, err := ReadPeersDat(bytes.NewReader(file), wire.MainNet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only IPv4 and IPv6, the fc00::/8 of CJDNS is its own network rather than IPv6
+	checkAddrManAddresses(t, addrs, []addrManEntry{addrManIPv4, addrManIPv6, addrManTried})
+
+	if _, err := ReadPeersDat(bytes.NewReader(file), wire.TestNet3); err == nil {
+		t.Fatal("read a mainnet peers.dat for testnet")
+	}
+	file[len(file)/2] ^= 1
+	if _, err := ReadPeersDat(bytes.NewReader(file), wire.MainNet); err == nil {
+		t.Fatal("read a corrupt peers.dat")
+	}
+}
+
+// Files written before BIP155 store every address as 16 bytes, IPv4 ones mapped into IPv6
+func TestReadPeersDatBeforeBIP155(t *testing.T) {
+	file := writePeersDat(wire.TestNet3, false, []addrManEntry{addrManIPv4, addrManOnionCat},
+		[]addrManEntry{addrManIPv6})
+	addrs, err := ReadPeersDat(bytes.NewReader(file), wire.TestNet3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAddrManAddresses(t, addrs, []addrManEntry{addrManIPv4, addrManIPv6})
+}
+
+func TestReadAnchorsDat(t *testing.T) {
+	writer := &addrManWriter{bip155: true}
+	anchors := []addrManEntry{addrManTried, addrManTorV3, addrManIPv6}
+	_ = wire.WriteVarInt(writer, 0, uint64(len(anchors)))
+	for _, entry := range anchors {
+		writer.address(entry.timestamp, entry.services, entry.networkId, entry.addr, entry.port)
+	}
+	addrs, err := ReadAnchorsDat(bytes.NewReader(writer.file(wire.MainNet)), wire.MainNet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAddrManAddresses(t, addrs, []addrManEntry{addrManTried, addrManIPv6})
+}
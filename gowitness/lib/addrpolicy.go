@@ -0,0 +1,185 @@
+package lib
+
+import (
+	"fmt"
+	"github.com/btcsuite/btcd/wire"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// What we tell a peer in answer to its addr messages. Core does not answer them at all, so
+// anything we send is seen by the peer and possibly relayed on to others.
+
+const (
+	// Nothing, like Core
+	AddrPolicyNone = "none"
+	// A random sample of the reachable nodes we know of
+	AddrPolicySample = "sample"
+	// Our own address, like a node advertising itself
+	AddrPolicySelf = "self"
+	// A fresh canary per answer, see CanaryInjector
+	AddrPolicyCanary = "canary"
+
+	// Services of the addresses we make up. Core only keeps addresses of full nodes it could
+	// sync from, whatever identity we present ourselves.
+	advertisedServices = wire.SFNodeNetwork | wire.SFNodeWitness
+
+	// Samples are drawn from this many reachable nodes, read again from the database at this
+	// interval rather than for every answer
+	reachablePoolSize        = wire.MaxAddrPerMsg
+	reachablePoolRefreshRate = time.Minute * 10
+)
+
+type AddrPolicyConfig struct {
+	// One of the AddrPolicy* policies, AddrPolicyNone if empty
+	Policy string
+	// Nodes per answer with the sample policy, only nodes seen within SampleMaxAge
+	SampleSize   int
+	SampleMaxAge time.Duration
+	// ip:port we advertise with the self policy
+	Self string
+}
+
+// Chooses the addresses sent to the peer of handler in answer to an addr message of it
+type AddrPolicy interface {
+	Addresses(handler *BitcoinHandler) []*wire.NetAddress
+}
+
+type noAddrPolicy struct{}
+
+func (noAddrPolicy) Addresses(handler *BitcoinHandler) []*wire.NetAddress {
+	return nil
+}
+
+// A random pool of the reachable nodes seen within maxAge, shared by all sessions. The first
+// sample reads it, later ones refresh it in the background once it is older than
+// reachablePoolRefreshRate.
+type reachablePool struct {
+	maxAge     time.Duration
+	mtx        sync.Mutex
+	nodes      []NodeInfo
+	refreshed  time.Time
+	refreshing bool
+}
+
+func makeReachablePool(maxAge time.Duration) *reachablePool {
+	return &reachablePool{maxAge: maxAge}
+}
+
+func (pool *reachablePool) refresh(db HandlerStorage) {
+	nodes := db.GetReachableNodes(time.Now().Add(-pool.maxAge), reachablePoolSize)
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+	pool.refreshing = false
+	pool.refreshed = time.Now()
+	if nodes != nil {
+		pool.nodes = nodes
+	}
+}
+
+// Up to size random nodes of the pool other than the one with connstring exclude
+func (pool *reachablePool) sample(db HandlerStorage, size int, exclude string) []NodeInfo {
+	pool.mtx.Lock()
+	if pool.refreshed.IsZero() {
+		pool.mtx.Unlock()
+		pool.refresh(db)
+		pool.mtx.Lock()
+	} else if !pool.refreshing && time.Since(pool.refreshed) > reachablePoolRefreshRate {
+		pool.refreshing = true
+		go pool.refresh(db)
+	}
+	nodes := pool.nodes
+	pool.mtx.Unlock()
+
+	sample := make([]NodeInfo, 0, size)
+	for _, i := range rand.Perm(len(nodes)) {
+		if len(sample) == size {
+			break
+		}
+		if nodes[i].ConnString != exclude {
+			sample = append(sample, nodes[i])
+		}
+	}
+	return sample
+}
+
+type sampleAddrPolicy struct {
+	size int
+	pool *reachablePool
+}
+
+func makeSampleAddrPolicy(size int, maxAge time.Duration) sampleAddrPolicy {
+	return sampleAddrPolicy{size: size, pool: makeReachablePool(maxAge)}
+}
+
+func (policy sampleAddrPolicy) Addresses(handler *BitcoinHandler) []*wire.NetAddress {
+	nodes := policy.pool.sample(handler.db, policy.size, handler.nodeInfo.ConnString)
+	addresses := make([]*wire.NetAddress, 0, len(nodes))
+	for _, node := range nodes {
+		if address := nodeNetAddress(&node); address != nil {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+// Advertises fixed addresses as freshly seen, as full nodes
+type fixedAddrPolicy struct {
+	addresses []wire.NetAddress
+}
+
+func (policy fixedAddrPolicy) Addresses(handler *BitcoinHandler) []*wire.NetAddress {
+	addresses := make([]*wire.NetAddress, 0, len(policy.addresses))
+	now := time.Now()
+	for _, address := range policy.addresses {
+		address := address
+		address.Timestamp = now
+		address.Services = advertisedServices
+		addresses = append(addresses, &address)
+	}
+	return addresses
+}
+
+func parseAdvertisedAddress(hostport string) (wire.NetAddress, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return wire.NetAddress{}, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return wire.NetAddress{}, fmt.Errorf("%s is not an IP address", host)
+	}
+	iport, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || iport == 0 {
+		return wire.NetAddress{}, fmt.Errorf("invalid port in %s", hostport)
+	}
+	return wire.NetAddress{IP: ip, Port: uint16(iport)}, nil
+}
+
+func MakeAddrPolicy(config AddrPolicyConfig) (AddrPolicy, error) {
+	switch config.Policy {
+	case "", AddrPolicyNone:
+		return noAddrPolicy{}, nil
+	case AddrPolicySample:
+		if config.SampleSize <= 0 || config.SampleSize > wire.MaxAddrPerMsg {
+			return nil, fmt.Errorf("the sample size must be between 1 and %d", wire.MaxAddrPerMsg)
+		}
+		if config.SampleMaxAge <= 0 {
+			return nil, fmt.Errorf("the %s addr policy needs a positive maximum age", AddrPolicySample)
+		}
+		return makeSampleAddrPolicy(config.SampleSize, config.SampleMaxAge), nil
+	case AddrPolicySelf:
+		address, err := parseAdvertisedAddress(config.Self)
+		if err != nil {
+			return nil, fmt.Errorf("the %s addr policy needs our address: %v", AddrPolicySelf, err)
+		}
+		return fixedAddrPolicy{addresses: []wire.NetAddress{address}}, nil
+	case AddrPolicyCanary:
+		return canaryAddrPolicy{}, nil
+	default:
+		return nil, fmt.Errorf("unknown addr policy %s", config.Policy)
+	}
+}
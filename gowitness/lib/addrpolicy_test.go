@@ -0,0 +1,54 @@
+package lib
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Counts the reads of the reachable nodes
+type countingStorage struct {
+	*MemoryStorage
+	reads int32
+}
+
+func (storage *countingStorage) GetReachableNodes(since time.Time, limit int) []NodeInfo {
+	atomic.AddInt32(&storage.reads, 1)
+	return storage.MemoryStorage.GetReachableNodes(since, limit)
+}
+
+func TestReachablePoolIsCached(t *testing.T) {
+	storage := &countingStorage{MemoryStorage: MakeMemoryStorage()}
+	now := time.Now()
+	for i := 1; i <= 5; i++ {
+		storage.PutNode(NodeInfo{ConnString: fmt.Sprintf("[10.0.1.%d]:8333", i), Version: "/Satoshi:0.21.0/",
+			LastSeen: now})
+	}
+	pool := makeReachablePool(time.Hour)
+
+	for i := 0; i < 10; i++ {
+		sample := pool.sample(storage, 3, "[10.0.1.1]:8333")
+		if len(sample) != 3 {
+			t.Fatalf("sampled %d nodes", len(sample))
+		}
+		for _, node := range sample {
+			if node.ConnString == "[10.0.1.1]:8333" {
+				t.Fatal("sampled the excluded node")
+			}
+		}
+	}
+	if reads := atomic.LoadInt32(&storage.reads); reads != 1 {
+		t.Fatalf("read the reachable nodes %d times", reads)
+	}
+
+	pool.mtx.Lock()
+	pool.refreshed = now.Add(-reachablePoolRefreshRate - time.Second)
+	pool.mtx.Unlock()
+	if sample := pool.sample(storage, 10, ""); len(sample) != 5 {
+		t.Fatalf("sampled %d of 5 nodes while refreshing", len(sample))
+	}
+	eventually(t, "the pool is refreshed", func() bool {
+		return atomic.LoadInt32(&storage.reads) == 2
+	})
+}
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type APIServerConfig struct {
@@ -30,6 +32,30 @@ func RunAPIServer(coordinator *Coordinator, config APIServerConfig) {
 		_, _ = w.Write(serialized)
 	})
 
+	http.HandleFunc("/globalwitness/tip", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if coordinator == nil {
+			w.WriteHeader(500)
+			_, _ = w.Write([]byte("{\"result\":\"error\",\"error\":\"coordinator is nil\"}"))
+			return
+		}
+		serialized, _ := json.Marshal(coordinator.TipTracker.Snapshot())
+		w.WriteHeader(200)
+		_, _ = w.Write(serialized)
+	})
+
+	http.HandleFunc("/globalwitness/headers", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if coordinator == nil {
+			w.WriteHeader(500)
+			_, _ = w.Write([]byte("{\"result\":\"error\",\"error\":\"coordinator is nil\"}"))
+			return
+		}
+		serialized, _ := json.Marshal(coordinator.HeaderChain.Snapshot())
+		w.WriteHeader(200)
+		_, _ = w.Write(serialized)
+	})
+
 	http.HandleFunc("/globalwitness/flush", func (w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		if coordinator == nil {
@@ -74,6 +100,219 @@ func RunAPIServer(coordinator *Coordinator, config APIServerConfig) {
 		_, _ = w.Write(serialized)
 	})
 
+	http.HandleFunc("/globalwitness/feefilters", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if coordinator == nil || coordinator.Storage() == nil {
+			w.WriteHeader(500)
+			_, _ = w.Write([]byte("{\"result\":\"error\",\"error\":\"coordinator is nil\"}"))
+			return
+		}
+
+		window := time.Hour * 24
+		if param := r.URL.Query().Get("window"); param != "" {
+			parsed, err := time.ParseDuration(param)
+			if err != nil || parsed <= 0 {
+				w.WriteHeader(400)
+				_, _ = w.Write([]byte("{\"result\":\"error\",\"error\":\"invalid window\"}"))
+				return
+			}
+			window = parsed
+		}
+
+		distribution := GetFeeFilterDistribution(coordinator.Storage(), window)
+		if distribution == nil {
+			w.WriteHeader(500)
+			_, _ = w.Write([]byte("{\"result\":\"error\",\"error\":\"failed to query feefilters\"}"))
+			return
+		}
+		serialized, _ := json.Marshal(distribution)
+		w.WriteHeader(200)
+		_, _ = w.Write(serialized)
+	})
+
+	http.HandleFunc("/globalwitness/traffic", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if coordinator == nil {
+			w.WriteHeader(500)
+			_, _ = w.Write([]byte("{\"result\":\"error\",\"error\":\"coordinator is nil\"}"))
+			return
+		}
+
+		// Without a peer parameter the counters of all connected peers are returned
+		var serialized []byte
+		if peer := r.URL.Query().Get("peer"); peer != "" {
+			traffic, ok := coordinator.PeerTraffic(peer)
+			if !ok {
+				w.WriteHeader(404)
+				_, _ = w.Write([]byte("{\"result\":\"error\",\"error\":\"peer is not connected\"}"))
+				return
+			}
+			serialized, _ = json.Marshal(traffic)
+		} else {
+			serialized, _ = json.Marshal(coordinator.Traffic())
+		}
+		w.WriteHeader(200)
+		_, _ = w.Write(serialized)
+	})
+
+	http.HandleFunc("/globalwitness/spies", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if coordinator == nil || coordinator.Storage() == nil {
+			w.WriteHeader(500)
+			_, _ = w.Write([]byte("{\"result\":\"error\",\"error\":\"coordinator is nil\"}"))
+			return
+		}
+
+		window := time.Hour * 24 * 7
+		if param := r.URL.Query().Get("window"); param != "" {
+			parsed, err := time.ParseDuration(param)
+			if err != nil || parsed <= 0 {
+				w.WriteHeader(400)
+				_, _ = w.Write([]byte("{\"result\":\"error\",\"error\":\"invalid window\"}"))
+				return
+			}
+			window = parsed
+		}
+		limit := uint64(50)
+		if param := r.URL.Query().Get("limit"); param != "" {
+			parsed, err := strconv.ParseUint(param, 10, 64)
+			if err != nil || parsed == 0 {
+				w.WriteHeader(400)
+				_, _ = w.Write([]byte("{\"result\":\"error\",\"error\":\"invalid limit\"}"))
+				return
+			}
+			limit = parsed
+		}
+
+		suspects := coordinator.Storage().GetTopSpySuspects(time.Now().Add(-window), limit)
+		if suspects == nil {
+			w.WriteHeader(500)
+			_, _ = w.Write([]byte("{\"result\":\"error\",\"error\":\"failed to query spy scores\"}"))
+			return
+		}
+		serialized, _ := json.Marshal(suspects)
+		w.WriteHeader(200)
+		_, _ = w.Write(serialized)
+	})
+
+	http.HandleFunc("/globalwitness/networks/asns", func (w http.ResponseWriter, r *http.Request) {
+		serveNetworkAggregate(coordinator, w, r, func(since time.Time, limit uint64) interface{} {
+			if counts := coordinator.Storage().GetNodesPerASN(since, limit); counts != nil {
+				return counts
+			}
+			return nil
+		})
+	})
+
+	http.HandleFunc("/globalwitness/networks/useragents", func (w http.ResponseWriter, r *http.Request) {
+		serveNetworkAggregate(coordinator, w, r, func(since time.Time, limit uint64) interface{} {
+			if counts := coordinator.Storage().GetUserAgentsPerASN(since, limit); counts != nil {
+				return counts
+			}
+			return nil
+		})
+	})
+
+	http.HandleFunc("/globalwitness/networks/netgroups", func (w http.ResponseWriter, r *http.Request) {
+		serveNetworkAggregate(coordinator, w, r, func(since time.Time, limit uint64) interface{} {
+			if counts := coordinator.Storage().GetNewNodesPerNetgroup(since, limit); counts != nil {
+				return counts
+			}
+			return nil
+		})
+	})
+
+	http.HandleFunc("/globalwitness/geo/countries", func (w http.ResponseWriter, r *http.Request) {
+		serveWindowAggregate(coordinator, w, r, func(since time.Time) interface{} {
+			if counts := coordinator.Storage().GetNodesPerCountry(since); counts != nil {
+				return counts
+			}
+			return nil
+		})
+	})
+
+	http.HandleFunc("/globalwitness/geo/nodes.geojson", func (w http.ResponseWriter, r *http.Request) {
+		serveWindowAggregate(coordinator, w, r, func(since time.Time) interface{} {
+			if nodes := coordinator.Storage().GetReachableNodeLocations(since); nodes != nil {
+				return NodesAsGeoJSON(nodes)
+			}
+			return nil
+		})
+	})
+
+	http.HandleFunc("/globalwitness/reports/network", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if coordinator == nil || coordinator.Storage() == nil {
+			w.WriteHeader(500)
+			_, _ = w.Write([]byte("{\"result\":\"error\",\"error\":\"coordinator is nil\"}"))
+			return
+		}
+
+		days := uint64(30)
+		if param := r.URL.Query().Get("days"); param != "" {
+			parsed, err := strconv.ParseUint(param, 10, 16)
+			if err != nil || parsed == 0 {
+				w.WriteHeader(400)
+				_, _ = w.Write([]byte("{\"result\":\"error\",\"error\":\"invalid days\"}"))
+				return
+			}
+			days = parsed
+		}
+
+		reports := coordinator.Storage().GetNetworkReports(time.Now().Add(-time.Hour * 24 * time.Duration(days)))
+		if reports == nil {
+			w.WriteHeader(500)
+			_, _ = w.Write([]byte("{\"result\":\"error\",\"error\":\"failed to query network reports\"}"))
+			return
+		}
+		serialized, _ := json.Marshal(reports)
+		w.WriteHeader(200)
+		_, _ = w.Write(serialized)
+	})
+
+	http.HandleFunc("/globalwitness/useragents/adoption", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if coordinator == nil || coordinator.Storage() == nil {
+			w.WriteHeader(500)
+			_, _ = w.Write([]byte("{\"result\":\"error\",\"error\":\"coordinator is nil\"}"))
+			return
+		}
+
+		days := uint64(90)
+		if param := r.URL.Query().Get("days"); param != "" {
+			parsed, err := strconv.ParseUint(param, 10, 16)
+			if err != nil || parsed == 0 {
+				w.WriteHeader(400)
+				_, _ = w.Write([]byte("{\"result\":\"error\",\"error\":\"invalid days\"}"))
+				return
+			}
+			days = parsed
+		}
+		// Versions are broken down once a single implementation is asked for, or on request
+		implementation := r.URL.Query().Get("implementation")
+		byVersion := implementation != "" || r.URL.Query().Get("versions") == "true"
+
+		since := time.Now().Add(-time.Hour * 24 * time.Duration(days))
+		adoption := coordinator.Storage().GetUserAgentAdoption(since, byVersion, implementation)
+		if adoption == nil {
+			w.WriteHeader(500)
+			_, _ = w.Write([]byte("{\"result\":\"error\",\"error\":\"failed to query user agents\"}"))
+			return
+		}
+		serialized, _ := json.Marshal(adoption)
+		w.WriteHeader(200)
+		_, _ = w.Write(serialized)
+	})
+
+	http.HandleFunc("/globalwitness/canaries", func (w http.ResponseWriter, r *http.Request) {
+		serveNetworkAggregate(coordinator, w, r, func(since time.Time, limit uint64) interface{} {
+			if rows := coordinator.Storage().GetCanarySightings(since); rows != nil {
+				return MakeCanaryReport(rows)
+			}
+			return nil
+		})
+	})
+
 	binding := fmt.Sprintf("[%s]:%d", config.BindAddress, config.Port)
 
 	log.Println("Binding APIServer to", binding)
@@ -81,3 +320,61 @@ func RunAPIServer(coordinator *Coordinator, config APIServerConfig) {
 		log.Fatalf("Failed to bind API Server to %s: %s\n", binding, err.Error())
 	}
 }
+
+// Serves an aggregate over the nodes of the window given in the query, which defaults to a week
+func serveNetworkAggregate(coordinator *Coordinator, w http.ResponseWriter, r *http.Request,
+	query func(since time.Time, limit uint64) interface{}) {
+
+	w.Header().Set("Content-Type", "application/json")
+	if coordinator == nil || coordinator.Storage() == nil {
+		w.WriteHeader(500)
+		_, _ = w.Write([]byte("{\"result\":\"error\",\"error\":\"coordinator is nil\"}"))
+		return
+	}
+
+	window := time.Hour * 24 * 7
+	if param := r.URL.Query().Get("window"); param != "" {
+		parsed, err := time.ParseDuration(param)
+		if err != nil || parsed <= 0 {
+			w.WriteHeader(400)
+			_, _ = w.Write([]byte("{\"result\":\"error\",\"error\":\"invalid window\"}"))
+			return
+		}
+		window = parsed
+	}
+	limit := uint64(100)
+	if param := r.URL.Query().Get("limit"); param != "" {
+		parsed, err := strconv.ParseUint(param, 10, 64)
+		if err != nil || parsed == 0 {
+			w.WriteHeader(400)
+			_, _ = w.Write([]byte("{\"result\":\"error\",\"error\":\"invalid limit\"}"))
+			return
+		}
+		limit = parsed
+	}
+
+	result := query(time.Now().Add(-window), limit)
+	if result == nil {
+		w.WriteHeader(500)
+		_, _ = w.Write([]byte("{\"result\":\"error\",\"error\":\"failed to query nodes\"}"))
+		return
+	}
+	serialized, _ := json.Marshal(result)
+	w.WriteHeader(200)
+	_, _ = w.Write(serialized)
+}
+
+// Serves an aggregate that is always complete, like serveNetworkAggregate but rejecting a limit
+func serveWindowAggregate(coordinator *Coordinator, w http.ResponseWriter, r *http.Request,
+	query func(since time.Time) interface{}) {
+
+	if r.URL.Query().Get("limit") != "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(400)
+		_, _ = w.Write([]byte("{\"result\":\"error\",\"error\":\"limit is not supported\"}"))
+		return
+	}
+	serveNetworkAggregate(coordinator, w, r, func(since time.Time, limit uint64) interface{} {
+		return query(since)
+	})
+}
@@ -0,0 +1,26 @@
+package lib
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWindowAggregateRejectsLimit(t *testing.T) {
+	queried := false
+	query := func(since time.Time) interface{} {
+		queried = true
+		return nil
+	}
+
+	recorder := httptest.NewRecorder()
+	serveWindowAggregate(nil, recorder, httptest.NewRequest("GET", "/globalwitness/geo/countries?limit=5", nil), query)
+	if recorder.Code != 400 || queried {
+		t.Fatalf("answered a limit with %d", recorder.Code)
+	}
+	recorder = httptest.NewRecorder()
+	serveWindowAggregate(nil, recorder, httptest.NewRequest("GET", "/globalwitness/geo/countries", nil), query)
+	if recorder.Code != 500 {
+		t.Fatalf("answered without a coordinator with %d", recorder.Code)
+	}
+}
@@ -0,0 +1,260 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/gocraft/dbr"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Enrichment of nodes with their netgroup and the autonomous system announcing their address,
+// looked up in a local MaxMind ASN database or an ip2asn TSV file
+
+const (
+	ASNFormatMMDB   = "mmdb"
+	ASNFormatIP2ASN = "tsv"
+
+	// Nodes enriched per batch of the background enrichment
+	enrichmentBatchSize = 1000
+)
+
+type ASNInfo struct {
+	Number       uint32
+	Organization string
+}
+
+type ASNDatabase interface {
+	// Returns nil if the address is not announced by any AS in the database
+	Lookup(ip net.IP) *ASNInfo
+}
+
+// Opens the ASN database at path, format is guessed from the extension if empty
+func OpenASNDatabase(path string, format string) (ASNDatabase, error) {
+	if format == "" {
+		format = ASNFormatIP2ASN
+		if filepath.Ext(path) == ".mmdb" {
+			format = ASNFormatMMDB
+		}
+	}
+
+	switch format {
+	case ASNFormatMMDB:
+		reader, err := OpenMMDB(path)
+		if err != nil {
+			return nil, err
+		}
+		return &mmdbASNDatabase{reader: reader}, nil
+	case ASNFormatIP2ASN:
+		return openIP2ASN(path)
+	default:
+		return nil, fmt.Errorf("unknown ASN database format %s", format)
+	}
+}
+
+type mmdbASNDatabase struct {
+	reader *MMDBReader
+}
+
+func (database *mmdbASNDatabase) Lookup(ip net.IP) *ASNInfo {
+	record, err := database.reader.Lookup(ip)
+	if err != nil || record == nil {
+		return nil
+	}
+	number, ok := mmdbUint(mmdbField(record, "autonomous_system_number"))
+	if !ok {
+		return nil
+	}
+	organization, _ := mmdbField(record, "autonomous_system_organization").(string)
+	return &ASNInfo{Number: uint32(number), Organization: organization}
+}
+
+type ip2asnRange struct {
+	start, end net.IP
+	info       *ASNInfo
+}
+
+// The ranges of an ip2asn file sorted by their start, addresses are all 16 bytes long
+type ip2asnDatabase struct {
+	ranges []ip2asnRange
+}
+
+// Reads a TSV with the columns range_start, range_end, AS_number, country_code and
+// AS_description as published by iptoasn.com
+func openIP2ASN(path string) (*ip2asnDatabase, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	database := &ip2asnDatabase{ranges: make([]ip2asnRange, 0)}
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 5 {
+			continue
+		}
+		start, end := net.ParseIP(fields[0]), net.ParseIP(fields[1])
+		number, err := strconv.ParseUint(fields[2], 10, 32)
+		if start == nil || end == nil || err != nil {
+			return nil, fmt.Errorf("invalid ip2asn range on line %d of %s", line, path)
+		}
+		// Unrouted ranges are listed as AS 0
+		if number == 0 {
+			continue
+		}
+		database.ranges = append(database.ranges, ip2asnRange{
+			start: start.To16(),
+			end:   end.To16(),
+			info:  &ASNInfo{Number: uint32(number), Organization: fields[4]},
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(database.ranges, func(i, j int) bool {
+		return bytes.Compare(database.ranges[i].start, database.ranges[j].start) < 0
+	})
+	return database, nil
+}
+
+func (database *ip2asnDatabase) Lookup(ip net.IP) *ASNInfo {
+	address := ip.To16()
+	if address == nil {
+		return nil
+	}
+	// The last range starting at or before the address
+	i := sort.Search(len(database.ranges), func(i int) bool {
+		return bytes.Compare(database.ranges[i].start, address) > 0
+	}) - 1
+	if i < 0 || bytes.Compare(address, database.ranges[i].end) > 0 {
+		return nil
+	}
+	return database.ranges[i].info
+}
+
+// Netgroup returns the /16 of an IPv4 or the /32 of an IPv6 address in CIDR notation, the
+// granularity at which Core spreads its outbound connections
+func Netgroup(ip net.IP) string {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return (&net.IPNet{IP: ipv4.Mask(net.CIDRMask(16, 32)), Mask: net.CIDRMask(16, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(32, 128)), Mask: net.CIDRMask(32, 128)}).String()
+}
+
+// table nodenetworks, the netgroup is null if the connstring is not an IP address
+type NodeNetworkEntry struct {
+	NodeId       int64          `db:"nodeid"`
+	Netgroup     dbr.NullString `db:"netgroup"`
+	ASN          dbr.NullInt64  `db:"asn"`
+	Organization dbr.NullString `db:"organization"`
+	Updated      time.Time      `db:"updated"`
+}
+
+// Describes the network of node, asn may be nil if there is no database
+func enrichNode(node *NodeInfo, asn ASNDatabase) *NodeNetworkEntry {
+	host, _, err := net.SplitHostPort(node.ConnString)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+
+	entry := &NodeNetworkEntry{NodeId: node.Id, Netgroup: dbr.NewNullString(Netgroup(ip)), Updated: time.Now()}
+	if asn != nil {
+		if info := asn.Lookup(ip); info != nil {
+			entry.ASN = dbr.NewNullInt64(int64(info.Number))
+			entry.Organization = dbr.NewNullString(info.Organization)
+		}
+	}
+	return entry
+}
+
+// Enriches the nodes that have not been so far, returns how many were
+func EnrichNodes(db *PostgresStorage, asn ASNDatabase) int {
+	enriched := 0
+	for {
+		nodes := db.GetUnenrichedNodes(enrichmentBatchSize)
+		if len(nodes) == 0 {
+			return enriched
+		}
+
+		batch := 0
+		for i := range nodes {
+			entry := enrichNode(&nodes[i], asn)
+			if entry == nil {
+				// Still recorded, without a netgroup, so it is not retried forever
+				entry = &NodeNetworkEntry{NodeId: nodes[i].Id, Updated: time.Now()}
+			}
+			if db.SetNodeNetwork(entry) {
+				batch++
+			}
+		}
+		enriched += batch
+		if batch == 0 {
+			log.Println("Failed to store the network of any of", len(nodes), "nodes, stopping the enrichment.")
+			return enriched
+		}
+	}
+}
+
+// Enriches every node again, e.g. after the ASN database was updated
+func EnrichAllNodes(db *PostgresStorage, asn ASNDatabase) (int, error) {
+	nodes, err := db.GetNodes()
+	if err != nil {
+		return 0, err
+	}
+	enriched := 0
+	for i := range nodes {
+		if entry := enrichNode(&nodes[i], asn); entry != nil && db.SetNodeNetwork(entry) {
+			enriched++
+		}
+	}
+	return enriched, nil
+}
+
+// Enriches and locates newly added nodes every interval until the coordinator stops
+func (cd *Coordinator) runEnrichment(interval time.Duration) {
+	for cd.Status() != Stopped {
+		if enriched := EnrichNodes(cd.DbConn, cd.ASNDatabase); enriched > 0 {
+			log.Println("Enriched", enriched, "nodes with their network.")
+		}
+		cd.updateLocations()
+		time.Sleep(interval)
+	}
+}
+
+// Nodes seen in a window per AS
+type ASNNodeCount struct {
+	ASN          dbr.NullInt64  `db:"asn"`
+	Organization dbr.NullString `db:"organization"`
+	Nodes        int64          `db:"nodes"`
+}
+
+// Nodes seen in a window per AS and user agent
+type ASNUserAgentCount struct {
+	ASN          dbr.NullInt64  `db:"asn"`
+	Organization dbr.NullString `db:"organization"`
+	Version      string         `db:"version"`
+	Nodes        int64          `db:"nodes"`
+}
+
+// Nodes discovered per netgroup and day
+type NetgroupDiscoveryCount struct {
+	Netgroup string    `db:"netgroup"`
+	Day      time.Time `db:"day"`
+	Nodes    int64     `db:"nodes"`
+}
@@ -0,0 +1,174 @@
+package lib
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A string field of the MaxMind DB data section
+func mmdbString(value string) []byte {
+	if len(value) < 29 {
+		return append([]byte{mmdbTypeString<<5 | byte(len(value))}, value...)
+	}
+	return append([]byte{mmdbTypeString<<5 | 29, byte(len(value) - 29)}, value...)
+}
+
+func TestMMDBDecoder(t *testing.T) {
+	long := strings.Repeat("x", 40)
+	buf := []byte{mmdbTypeMap<<5 | 6}
+	buf = append(buf, mmdbString("n")...)
+	buf = append(buf, mmdbTypeUint32<<5|2, 0x34, 0x17)
+	buf = append(buf, mmdbString("l")...)
+	buf = append(buf, mmdbString(long)...)
+	buf = append(buf, mmdbString("b")...)
+	buf = append(buf, 1, mmdbTypeBool-7)
+	buf = append(buf, mmdbString("a")...)
+	buf = append(buf, 2, mmdbTypeArray-7, 1, mmdbTypeUint64-7, 1, 4, mmdbTypeInt32-7, 0xff, 0xff, 0xff, 0xfe)
+	buf = append(buf, mmdbString("d")...)
+	buf = append(buf, mmdbTypeDouble<<5|8, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0)
+	buf = append(buf, mmdbString("p")...)
+	pointer := len(buf)
+	buf = append(buf, mmdbTypePointer<<5, 0)
+	end := len(buf)
+	buf[pointer+1] = byte(len(buf))
+	buf = append(buf, mmdbString("Cloudflare")...)
+
+	decoded, next, err := (&mmdbDecoder{buf: buf}).decode(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != uint(end) {
+		t.Fatalf("the map ends at %d instead of %d", next, end)
+	}
+	if number, ok := mmdbUint(mmdbField(decoded, "n")); !ok || number != 13335 {
+		t.Fatalf("decoded the uint32 as %v", mmdbField(decoded, "n"))
+	}
+	if mmdbField(decoded, "l") != long || mmdbField(decoded, "b") != true || mmdbField(decoded, "d") != 1.5 {
+		t.Fatalf("decoded %+v", decoded)
+	}
+	array, ok := mmdbField(decoded, "a").([]interface{})
+	if !ok || len(array) != 2 || array[0] != uint64(1) || array[1] != int64(-2) {
+		t.Fatalf("decoded the array as %v", mmdbField(decoded, "a"))
+	}
+	if mmdbField(decoded, "p") != "Cloudflare" {
+		t.Fatalf("followed the pointer to %v", mmdbField(decoded, "p"))
+	}
+
+	if _, _, err := (&mmdbDecoder{buf: buf[:pointer]}).decode(0); err == nil {
+		t.Fatal("decoded a truncated map")
+	}
+}
+
+// Writes an IPv4 database with 24 bit records that has a record for 10.0.0.0/8 only
+func writeTestMMDB(t *testing.T) string {
+	t.Helper()
+	const nodeCount = 8
+	var file []byte
+	for i := uint(0); i < nodeCount; i++ {
+		matching, other := i+1, uint(nodeCount)
+		if i == nodeCount-1 {
+			matching = nodeCount + mmdbDataSeparatorSize
+		}
+		records := [2]uint{matching, other}
+		if (10>>(7-i))&1 == 1 {
+			records = [2]uint{other, matching}
+		}
+		for _, record := range records {
+			file = append(file, byte(record>>16), byte(record>>8), byte(record))
+		}
+	}
+	file = append(file, make([]byte, mmdbDataSeparatorSize)...)
+
+	file = append(file, mmdbTypeMap<<5|2)
+	file = append(file, mmdbString("autonomous_system_number")...)
+	file = append(file, mmdbTypeUint32<<5|2, 0xfb, 0xf4)
+	file = append(file, mmdbString("autonomous_system_organization")...)
+	file = append(file, mmdbString("Example")...)
+
+	file = append(file, mmdbMetadataMarker...)
+	file = append(file, mmdbTypeMap<<5|4)
+	file = append(file, mmdbString("node_count")...)
+	file = append(file, mmdbTypeUint32<<5|1, nodeCount)
+	file = append(file, mmdbString("record_size")...)
+	file = append(file, mmdbTypeUint16<<5|1, 24)
+	file = append(file, mmdbString("ip_version")...)
+	file = append(file, mmdbTypeUint16<<5|1, 4)
+	file = append(file, mmdbString("database_type")...)
+	file = append(file, mmdbString("GeoLite2-ASN")...)
+
+	path := filepath.Join(t.TempDir(), "asn.mmdb")
+	if err := ioutil.WriteFile(path, file, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMMDBLookup(t *testing.T) {
+	path := writeTestMMDB(t)
+	reader, err := OpenMMDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reader.DatabaseType() != "GeoLite2-ASN" {
+		t.Fatalf("database type %s", reader.DatabaseType())
+	}
+
+	database, err := OpenASNDatabase(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info := database.Lookup(net.ParseIP("10.1.2.3")); info == nil || info.Number != 64500 ||
+		info.Organization != "Example" {
+		t.Fatalf("looked up %+v", info)
+	}
+	for _, ip := range []string{"11.0.0.1", "2001:db8::1"} {
+		if info := database.Lookup(net.ParseIP(ip)); info != nil {
+			t.Fatalf("looked up %+v for %s", info, ip)
+		}
+	}
+}
+
+func TestIP2ASN(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ip2asn-combined.tsv")
+	ranges := "2001:db8::\t2001:db8::ffff\t64501\tDE\tEXAMPLE-V6\n" +
+		"10.0.0.0\t10.255.255.255\t64500\tUS\tEXAMPLE\n" +
+		"11.0.0.0\t11.0.0.255\t0\tNone\tNot routed\n" +
+		"short line\n" +
+		"1.0.0.0\t1.0.0.255\t13335\tUS\tCLOUDFLARENET\n"
+	if err := ioutil.WriteFile(path, []byte(ranges), 0644); err != nil {
+		t.Fatal(err)
+	}
+	database, err := OpenASNDatabase(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]uint32{"10.0.0.0": 64500, "10.255.255.255": 64500, "1.0.0.7": 13335,
+		"2001:db8::1": 64501, "11.0.0.1": 0, "9.255.255.255": 0, "2001:db8::1:0": 0}
+	for ip, number := range expected {
+		info := database.Lookup(net.ParseIP(ip))
+		if (info == nil && number != 0) || (info != nil && info.Number != number) {
+			t.Fatalf("looked up %+v for %s", info, ip)
+		}
+	}
+
+	if err := ioutil.WriteFile(path, []byte("10.0.0.0\tnot an ip\t64500\tUS\tEXAMPLE\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenASNDatabase(path, ASNFormatIP2ASN); err == nil {
+		t.Fatal("read an invalid range")
+	}
+}
+
+func TestEnrichNode(t *testing.T) {
+	entry := enrichNode(&NodeInfo{Id: 1, ConnString: "[10.1.2.3]:8333"}, nil)
+	if entry == nil || entry.Netgroup.String != "10.1.0.0/16" || entry.ASN.Valid {
+		t.Fatalf("enriched %+v", entry)
+	}
+	if entry := enrichNode(&NodeInfo{Id: 2, ConnString: "expyuzz4wqqyqhjn.onion:8333"}, nil); entry != nil {
+		t.Fatalf("enriched an onion with %+v", entry)
+	}
+}
@@ -1,7 +1,11 @@
 package lib
 
 import (
+	"github.com/gocraft/dbr"
+	"github.com/gomodule/redigo/redis"
+	"net"
 	"sync"
+	"time"
 )
 
 type RunnableHandler interface {
@@ -10,3 +14,29 @@ type RunnableHandler interface {
 	Status() bool
 	Stop() error
 }
+
+// Everything a BitcoinHandler reads and records during a session. PostgresStorage is the one
+// used when crawling, tests and replays substitute their own.
+type HandlerStorage interface {
+	GetNodeByConnString(connString string) *NodeInfo
+	AddNode(addr *net.IP, port uint16, referrerId int64) (*NodeInfo, bool)
+	UpdateAllNode(node *NodeInfo) bool
+	AddNodeHistory(node *NodeInfo, eventType string, timestamp time.Time, data dbr.NullString) *NodeHistoryEntry
+	AddSessionUserAgent(entry *SessionUserAgentEntry) *SessionUserAgentEntry
+	GetReachableNodes(since time.Time, limit int) []NodeInfo
+	AddTransaction(entry *TransactionEntry) bool
+	GetRawTransactions(txids []string) map[string][]byte
+	AddMempoolSnapshot(entry *MempoolSnapshotEntry) *MempoolSnapshotEntry
+	CountNodesByVersionInNetgroup(version string, netgroup string, exclude int64, since time.Time) int64
+	AddSpyScore(entry *SpyScoreEntry) *SpyScoreEntry
+	AddCanary(entry *CanaryEntry) *CanaryEntry
+	GetCanary(connString string) *CanaryEntry
+	AddCanarySighting(entry *CanarySightingEntry) *CanarySightingEntry
+}
+
+// Marks the peers a crawler is connected to so that no other connects to them as well,
+// RedisStorage when crawling
+type ActiveTags interface {
+	SetActiveTag(inConn redis.Conn, resource string, expirySeconds int) bool
+	RemoveActiveTag(inConn redis.Conn, resource string) error
+}
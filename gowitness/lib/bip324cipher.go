@@ -0,0 +1,123 @@
+package lib
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// The forward-secure ciphers of BIP324. Both rekey after every rekeyInterval messages, so
+// compromising the current key does not reveal earlier traffic.
+
+const (
+	rekeyInterval = 224
+
+	chachaKeySize   = chacha20.KeySize
+	poly1305TagSize = 16
+)
+
+var errPacketAuthentication = errors.New("v2 packet failed authentication")
+
+// The nonce used for the rekeyCounter'th key, the first four bytes are free for the caller
+func rekeyNonce(prefix uint32, rekeyCounter uint64) [chacha20.NonceSize]byte {
+	var nonce [chacha20.NonceSize]byte
+	binary.LittleEndian.PutUint32(nonce[0:4], prefix)
+	binary.LittleEndian.PutUint64(nonce[4:12], rekeyCounter)
+	return nonce
+}
+
+// Returns the ChaCha20 keystream starting at block counter under key and nonce
+func chacha20Stream(key []byte, nonce [chacha20.NonceSize]byte, counter uint32) *chacha20.Cipher {
+	stream, err := chacha20.NewUnauthenticatedCipher(key, nonce[:])
+	if err != nil {
+		// Only the sizes of key and nonce are checked and ours are fixed
+		panic(err)
+	}
+	stream.SetCounter(counter)
+	return stream
+}
+
+// FSChaCha20 encrypts the 3 byte packet lengths. The keystream runs on across packets, after
+// rekeyInterval of them the next 32 bytes of it become the new key.
+type fsChaCha20 struct {
+	stream       *chacha20.Cipher
+	chunks       uint32
+	rekeyCounter uint64
+}
+
+func newFSChaCha20(key []byte) *fsChaCha20 {
+	return &fsChaCha20{stream: chacha20Stream(key, rekeyNonce(0, 0), 0)}
+}
+
+func (cipher *fsChaCha20) crypt(chunk []byte) []byte {
+	out := make([]byte, len(chunk))
+	cipher.stream.XORKeyStream(out, chunk)
+
+	cipher.chunks++
+	if cipher.chunks == rekeyInterval {
+		key := make([]byte, chachaKeySize)
+		cipher.stream.XORKeyStream(key, key)
+		cipher.chunks = 0
+		cipher.rekeyCounter++
+		cipher.stream = chacha20Stream(key, rekeyNonce(0, cipher.rekeyCounter), 0)
+	}
+	return out
+}
+
+// FSChaCha20Poly1305 is the RFC 8439 AEAD with the packet counter as nonce and a new key after
+// every rekeyInterval packets
+type fsChaCha20Poly1305 struct {
+	key          []byte
+	aead         cipher.AEAD
+	packets      uint32
+	rekeyCounter uint64
+}
+
+func newFSChaCha20Poly1305(key []byte) *fsChaCha20Poly1305 {
+	aead := &fsChaCha20Poly1305{}
+	aead.setKey(append([]byte(nil), key...))
+	return aead
+}
+
+func (aead *fsChaCha20Poly1305) setKey(key []byte) {
+	sealer, err := chacha20poly1305.New(key)
+	if err != nil {
+		panic(err)
+	}
+	aead.key, aead.aead = key, sealer
+}
+
+func (aead *fsChaCha20Poly1305) nonce() []byte {
+	nonce := rekeyNonce(aead.packets, aead.rekeyCounter)
+	return nonce[:]
+}
+
+func (aead *fsChaCha20Poly1305) next() {
+	aead.packets++
+	if aead.packets == rekeyInterval {
+		// The new key is what encrypting 32 zero bytes under a nonce that is never used for
+		// packets yields, so the keystream after the Poly1305 key block
+		key := make([]byte, chachaKeySize)
+		chacha20Stream(aead.key, rekeyNonce(0xffffffff, aead.rekeyCounter), 1).XORKeyStream(key, key)
+		aead.setKey(key)
+		aead.packets = 0
+		aead.rekeyCounter++
+	}
+}
+
+func (aead *fsChaCha20Poly1305) encrypt(aad, plaintext []byte) []byte {
+	ciphertext := aead.aead.Seal(nil, aead.nonce(), plaintext, aad)
+	aead.next()
+	return ciphertext
+}
+
+func (aead *fsChaCha20Poly1305) decrypt(aad, ciphertext []byte) ([]byte, error) {
+	plaintext, err := aead.aead.Open(nil, aead.nonce(), ciphertext, aad)
+	if err != nil {
+		return nil, errPacketAuthentication
+	}
+	aead.next()
+	return plaintext, nil
+}
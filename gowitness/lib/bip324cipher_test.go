@@ -0,0 +1,104 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"golang.org/x/crypto/chacha20poly1305"
+	"testing"
+)
+
+// RFC 8439 2.3.2, the block with counter 1
+func TestChaCha20Stream(t *testing.T) {
+	key := make([]byte, chachaKeySize)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	nonce := [12]byte{0, 0, 0, 0x09, 0, 0, 0, 0x4a}
+	block := make([]byte, 64)
+	chacha20Stream(key, nonce, 1).XORKeyStream(block, block)
+
+	expected := "10f1e7e4d13b5915500fdd1fa32071c4c7d1f4c733c068030422aa9ac3d46c4e" +
+		"d2826446079faa0914c2d705d98b02a2b5129cd1de164eb9cbd083e8a2503c4e"
+	if hex.EncodeToString(block) != expected {
+		t.Fatalf("block %x", block)
+	}
+}
+
+// Checks the length ciphertexts across rekeys against the keystream of each key in one piece:
+// rekeyInterval lengths, then the next key
+func TestFSChaCha20Rekey(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, chachaKeySize)
+	cipher := newFSChaCha20(key)
+
+	for rekeyCounter := uint64(0); rekeyCounter < 3; rekeyCounter++ {
+		keystream := make([]byte, rekeyInterval*v2LengthSize+chachaKeySize)
+		chacha20Stream(key, rekeyNonce(0, rekeyCounter), 0).XORKeyStream(keystream, keystream)
+		for chunk := 0; chunk < rekeyInterval; chunk++ {
+			expected := keystream[chunk*v2LengthSize : (chunk+1)*v2LengthSize]
+			if out := cipher.crypt(make([]byte, v2LengthSize)); !bytes.Equal(out, expected) {
+				t.Fatalf("length %d after %d rekeys: %x, expected %x", chunk, rekeyCounter, out, expected)
+			}
+		}
+		key = keystream[rekeyInterval*v2LengthSize:]
+	}
+}
+
+// RFC 8439 2.8.2, its nonce is the packet counter 7 and the rekey counter 0x4746454443424140
+func TestFSChaCha20Poly1305Vector(t *testing.T) {
+	key, _ := hex.DecodeString("808182838485868788898a8b8c8d8e8f909192939495969798999a9b9c9d9e9f")
+	aad, _ := hex.DecodeString("50515253c0c1c2c3c4c5c6c7")
+	plaintext := []byte("Ladies and Gentlemen of the class of '99: If I could offer you only one tip for the future, sunscreen would be it.")
+	expected := "d31a8d34648e60db7b86afbc53ef7ec2a4aded51296e08fea9e2b5a736ee62d6" +
+		"3dbea45e8ca9671282fafb69da92728b1a71de0a9e060b2905d6a5b67ecd3b36" +
+		"92ddbd7f2d778b8c9803aee328091b58fab324e4fad675945585808b4831d7bc" +
+		"3ff4def08e4b7a9de576d26586cec64b6116" +
+		"1ae10b594f09e26a7e902ecbd0600691"
+
+	aead := newFSChaCha20Poly1305(key)
+	aead.packets, aead.rekeyCounter = 7, 0x4746454443424140
+	if ciphertext := aead.encrypt(aad, plaintext); hex.EncodeToString(ciphertext) != expected {
+		t.Fatalf("ciphertext %x", ciphertext)
+	}
+
+	aead = newFSChaCha20Poly1305(key)
+	aead.packets, aead.rekeyCounter = 7, 0x4746454443424140
+	ciphertext, _ := hex.DecodeString(expected)
+	decrypted, err := aead.decrypt(aad, ciphertext)
+	if err != nil || !bytes.Equal(decrypted, plaintext) {
+		t.Fatalf("decrypted %q: %v", decrypted, err)
+	}
+}
+
+// Checks packets across rekeys against the RFC 8439 AEAD, rekeying as BIP324 specifies: the new
+// key is the encryption of 32 zero bytes under the nonce 0xffffffff || rekey counter
+func TestFSChaCha20Poly1305Rekey(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, chachaKeySize)
+	aead := newFSChaCha20Poly1305(key)
+	aad := []byte("aad")
+
+	for rekeyCounter := uint64(0); rekeyCounter < 3; rekeyCounter++ {
+		reference, _ := chacha20poly1305.New(key)
+		for packet := uint32(0); packet < rekeyInterval; packet++ {
+			plaintext := make([]byte, 8)
+			binary.LittleEndian.PutUint32(plaintext, packet)
+			nonce := rekeyNonce(packet, rekeyCounter)
+			expected := reference.Seal(nil, nonce[:], plaintext, aad)
+			if ciphertext := aead.encrypt(aad, plaintext); !bytes.Equal(ciphertext, expected) {
+				t.Fatalf("packet %d after %d rekeys: ciphertext %x, expected %x", packet, rekeyCounter,
+					ciphertext, expected)
+			}
+		}
+		nonce := rekeyNonce(0xffffffff, rekeyCounter)
+		key = reference.Seal(nil, nonce[:], make([]byte, chachaKeySize), nil)[:chachaKeySize]
+	}
+}
+
+func TestFSChaCha20Poly1305Tampering(t *testing.T) {
+	key := make([]byte, chachaKeySize)
+	ciphertext := newFSChaCha20Poly1305(key).encrypt(nil, []byte("version"))
+	ciphertext[0] ^= 1
+	if _, err := newFSChaCha20Poly1305(key).decrypt(nil, ciphertext); err != errPacketAuthentication {
+		t.Fatalf("tampered packet decrypted: %v", err)
+	}
+}
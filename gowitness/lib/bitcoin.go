@@ -1,29 +1,74 @@
 package lib
 
 import (
+	"bytes"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/peer"
 	"github.com/btcsuite/btcd/wire"
 	"github.com/gocraft/dbr"
+	"io"
 	"log"
 	"net"
-	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
 // Ping/Pong Nonce and inv trickle handled by the `PeerBase.
 type BitcoinHandler struct {
+	// Unix nanoseconds of the last message other than a ping or pong, first for atomic alignment
+	lastActivity       int64
 	nodeInfo           *NodeInfo
-	db                 *PostgresStorage
-	rs                 *RedisStorage
+	db                 HandlerStorage
+	rs                 ActiveTags
 	peerCfg            *WitnessConfig
+	config             HandlerConfig
+	identity           Identity
 	requestBlockInv    bool
 	peerInstance       *Witness
 	started            time.Time
 	lastActivityReport *time.Time
+	txSampler          *TxSampler
+	txRequests         *txRequests
+	mempoolCollection  mempoolCollection
+	transport          string
+	traffic            *TrafficStats
+	// Commands of the unknown messages stored so far, only the first of each is
+	unknownCommands    map[string]struct{}
+	spyObservations    spyObservations
+	gossip             *GossipTracker
+	tip                *TipTracker
+	headers            *HeaderChain
+	// An announcement that did not connect while we wait for the headers in between
+	unconnectedHeaders []*wire.BlockHeader
+	answeredGetAddr    bool
+	addrCycles         int32
+	ending             sync.Once
+	endReason          string
+	// Set for peers that connected to us, see RunInbound
+	inbound            bool
+	// Set while replaying a capture, see now
+	replayClock        *replayClock
+}
+
+// Names the begin and end events of a session, which are prefixed for inbound sessions
+func (handler *BitcoinHandler) sessionEvent(event string) string {
+	if handler.inbound {
+		return "inbound_" + event
+	}
+	return event
+}
+
+// The time events are recorded with, when the message being handled was captured during a replay
+func (handler *BitcoinHandler) now() time.Time {
+	if handler.replayClock != nil {
+		return handler.replayClock.now()
+	}
+	return time.Now()
 }
 
 // table nodehistory
@@ -46,21 +91,27 @@ type NodeInfo struct {
 	Data                    dbr.NullString      `db:"data"`
 }
 
+// Serialized into the data column of the nodes table, describes what the node
+// told us about itself during the last successful handshake
+type NodeMetadata struct {
+	Services                uint64
+	ProtocolVersion         int32
+	StartingHeight          int32
+}
+
 func (handler *BitcoinHandler) testNewAdvertisement(addr wire.NetAddress) {
 	if addr.Port == 0 {
 		addr.Port = 8333
 	}
 
 	connstring := fmt.Sprintf("[%s]:%d", addr.IP.String(), addr.Port)
+	agent := ParseUserAgent(handler.identity.UserAgent)
 	testCfg := peer.Config{
-		UserAgentName:    "Satoshi",
-		UserAgentVersion: "0.17.99",
-		ChainParams:      &chaincfg.MainNetParams,
-		Services:         wire.SFNodeXthin | wire.SFNodeWitness | wire.SFNodeGetUTXO |
-			wire.SFNodeCF | wire.SFNodeBloom | wire.SFNodeBit5 |
-			wire.SFNode2X | wire.SFNodeNetwork,
-		// Trickle slowly on purpose as to not contaminate the data
-		TrickleInterval:  time.Minute * 2,
+		UserAgentName:    agent.Implementation,
+		UserAgentVersion: agent.Version,
+		ChainParams:      handler.config.ChainParams,
+		Services:         handler.identity.Services,
+		TrickleInterval:  handler.config.TrickleInterval,
 	}
 	testCfg.Listeners.OnVersion = func(newPeer *peer.Peer, msg *wire.MsgVersion) *wire.MsgReject {
 		defer newPeer.Disconnect()
@@ -86,7 +137,7 @@ func (handler *BitcoinHandler) testNewAdvertisement(addr wire.NetAddress) {
 	}
 
 	// Establish the connection to the peer address and mark it connected.
-	conn, err := net.DialTimeout("tcp", handler.nodeInfo.ConnString, time.Duration(5) * time.Second)
+	conn, err := handler.config.dial(handler.nodeInfo.ConnString)
 	newPeer.AssociateConnection(conn)
 	newPeer.WaitForDisconnect()
 }
@@ -94,11 +145,19 @@ func (handler *BitcoinHandler) testNewAdvertisement(addr wire.NetAddress) {
 
 // OnAddr is invoked when a peer receives an addr bitcoin message.
 func (handler *BitcoinHandler) onAddrHandler(p *Witness, msg *wire.MsgAddr) {
+	handler.spyObservations.onAddresses(len(msg.AddrList))
+	now := handler.now()
 	for _, addr := range msg.AddrList {
 		if addr.Port == 0 {
 			addr.Port = 8333
 		}
+		// Canaries are neither gossip nor nodes we could connect to
+		if handler.config.Canaries.isCanary(addr.IP) {
+			handler.config.Canaries.observe(handler, addr, now)
+			continue
+		}
 		connstring := fmt.Sprintf("[%s]:%d", addr.IP.String(), addr.Port)
+		handler.gossip.add(handler.nodeInfo.Id, connstring)
 		instance := handler.db.GetNodeByConnString(connstring)
 
 		// Check if we already have this node
@@ -116,43 +175,19 @@ func (handler *BitcoinHandler) onAddrHandler(p *Witness, msg *wire.MsgAddr) {
 		log.Println("Added new unconfirmed node:", recommendedNode.ConnString)
 	}
 
-	// Just tell the peer about a few nodes -- hacky for now since it isnt the focus
-	randomNode := handler.db.GetRandomNode()
-	if randomNode == nil {
-		return
-	}
-	ip, port, err := net.SplitHostPort(randomNode.ConnString)
-	if err != nil {
-		log.Println("An error occurred while splitting host-port for sending to peer:", err.Error())
-		return
+	sent := make(chan struct{}, 1)
+	var addresses []*wire.NetAddress
+	if handler.config.AddrPolicy != nil {
+		addresses = handler.config.AddrPolicy.Addresses(handler)
 	}
-	iport, err := strconv.ParseUint(port, 10, 16)
-	if err != nil {
-		log.Println("An error occurred while splitting parsing the port from split host port for sending to peer:", err.Error())
-		return
-	}
-	myaddr := wire.NewMsgAddr()
-	_ = myaddr.AddAddresses(&wire.NetAddress {
-		IP: net.ParseIP(ip),
-		Port: uint16(iport),
-		Services: wire.SFNodeNetwork,
-		Timestamp: time.Now(),
-	})
-	_ = myaddr.AddAddress(p.NA())
-
-	// TODO Have a better mechanism than disconnect after 1hr w/o configuration
-	var doneChan chan struct{}
-	if time.Now().Sub(handler.started) > time.Hour {
-		doneChan = make(chan struct{})
-	}
-	p.QueueMessage(myaddr, doneChan)
-	if doneChan != nil {
-		go func(doneChan chan struct{}) {
-			_ = <-doneChan
-			log.Println("Disconnecting from peer", handler.nodeInfo.ConnString, "after a cycle of addr exchange")
-			p.Disconnect()
-		}(doneChan)
+	if len(addresses) > 0 {
+		reply := wire.NewMsgAddr()
+		_ = reply.AddAddresses(addresses...)
+		p.QueueMessage(reply, sent)
+	} else {
+		sent <- struct{}{}
 	}
+	handler.onAddrCycle(p, sent)
 }
 
 func (handler *BitcoinHandler) onInvHandler(p *Witness, msg *wire.MsgInv) {
@@ -160,18 +195,22 @@ func (handler *BitcoinHandler) onInvHandler(p *Witness, msg *wire.MsgInv) {
 	if invSize == 0 {
 		return
 	}
+	txReq := wire.NewMsgGetData()
 	for _, inv := range msg.InvList {
 		switch t := inv.Type; t {
 		case wire.InvTypeTx:
 			//log.Println("->Tx", inv.Hash.String())
+			// Answers to our mempool request are not sampled, they would all be requested at once
+			if !handler.mempoolCollection.add(&inv.Hash) {
+				handler.spyObservations.onTxAnnounced()
+				handler.sampleTransaction(p, inv, txReq)
+			}
 		case wire.InvTypeBlock:
 			log.Println("->Block", inv.Hash.String(), "from", handler.nodeInfo.ConnString)
-			gh := wire.NewMsgGetHeaders()
-			err := gh.AddBlockLocatorHash(&inv.Hash)
+			// The headers from our tip up to the block, or the block alone until we have a tip
+			err := p.PushGetHeadersMsg(handler.headers.Locator(), &inv.Hash)
 			if err != nil {
 				log.Println("Error creating getheaders message:", err.Error())
-			} else {
-				p.QueueMessage(gh, nil)
 			}
 			if handler.requestBlockInv {
 				req := wire.NewMsgGetData()
@@ -192,10 +231,133 @@ func (handler *BitcoinHandler) onInvHandler(p *Witness, msg *wire.MsgInv) {
 			log.Println("->FilteredWitnessBlock", inv.Hash.String())
 		case wire.InvTypeWitnessTx:
 			log.Println("->WitnessTx", inv.Hash.String())
+			handler.spyObservations.onTxAnnounced()
+			handler.sampleTransaction(p, inv, txReq)
+		case InvTypeWTx:
+			if !handler.mempoolCollection.add(&inv.Hash) {
+				handler.spyObservations.onTxAnnounced()
+				handler.sampleTransaction(p, inv, txReq)
+			}
 		default:
 			log.Println("->Unknown inventory type", inv.Type, "hash", inv.Hash)
 		}
 	}
+	if len(txReq.InvList) > 0 {
+		p.QueueMessage(txReq, nil)
+	}
+}
+
+// Adds an announced transaction to req if the sampling policy and the bandwidth left to the
+// peer allow for it. Transactions announced by wtxid are claimed by their wtxid, so a segwit
+// transaction may be fetched once from a wtxid relaying peer and once from another one.
+func (handler *BitcoinHandler) sampleTransaction(p *Witness, inv *wire.InvVect, req *wire.MsgGetData) {
+	hash := &inv.Hash
+	requests := handler.txRequests
+	if requests == nil {
+		return
+	}
+	now := time.Now()
+	requests.expire(handler.txSampler, now)
+	if len(requests.pending) >= txSampleMaxPending {
+		return
+	}
+	if !requests.bucket.TryTake(txSampleSizeEstimate) {
+		return
+	}
+	if !handler.txSampler.claim(hash, now) {
+		requests.bucket.Take(-txSampleSizeEstimate)
+		return
+	}
+
+	// Ask for the witness serialization so that sizes and fee rates are accurate, BIP339 has
+	// wtxids requested as they were announced
+	invType := inv.Type
+	if invType != InvTypeWTx && p.IsWitnessEnabled() {
+		invType = wire.InvTypeWitnessTx
+	}
+	if err := req.AddInvVect(wire.NewInvVect(invType, hash)); err != nil {
+		requests.bucket.Take(-txSampleSizeEstimate)
+		handler.txSampler.release(hash, now)
+		return
+	}
+	requests.pending[*hash] = now
+}
+
+func (handler *BitcoinHandler) onNotFoundHandler(p *Witness, msg *wire.MsgNotFound) {
+	requests := handler.txRequests
+	if requests == nil {
+		return
+	}
+	for _, inv := range msg.InvList {
+		requested, ok := requests.pending[inv.Hash]
+		if !ok {
+			continue
+		}
+		delete(requests.pending, inv.Hash)
+		requests.bucket.Take(-txSampleSizeEstimate)
+		handler.txSampler.release(&inv.Hash, requested)
+	}
+}
+
+// Stores a transaction we requested along with when and by whom it was first announced to us
+func (handler *BitcoinHandler) onTxHandler(p *Witness, msg *wire.MsgTx) {
+	requests := handler.txRequests
+	if requests == nil {
+		return
+	}
+	// Requests made by wtxid are pending under the wtxid
+	txid, wtxid := msg.TxHash(), msg.WitnessHash()
+	announced, ok := requests.pending[txid]
+	if !ok {
+		announced, ok = requests.pending[wtxid]
+	}
+	if !ok {
+		return
+	}
+	delete(requests.pending, txid)
+	delete(requests.pending, wtxid)
+	handler.txSampler.fetched(&txid)
+	handler.txSampler.fetched(&wtxid)
+
+	size := msg.SerializeSize()
+	requests.bucket.Take(float64(size - txSampleSizeEstimate))
+	if !handler.txSampler.keep(msg) {
+		return
+	}
+
+	var raw bytes.Buffer
+	if err := msg.Serialize(&raw); err != nil {
+		log.Println("Failed to serialize transaction", txid.String(), ":", err.Error())
+		return
+	}
+	entry := TransactionEntry{
+		TxId:      txid.String(),
+		WTxId:     wtxid.String(),
+		NodeId:    handler.nodeInfo.Id,
+		FirstSeen: announced,
+		Size:      size,
+		VSize:     transactionVSize(msg),
+		Raw:       raw.Bytes(),
+	}
+
+	// The fee is only known if we happen to have stored every transaction it spends from
+	parentIds := make([]string, 0, len(msg.TxIn))
+	for _, in := range msg.TxIn {
+		parentIds = append(parentIds, in.PreviousOutPoint.Hash.String())
+	}
+	parents := make(map[chainhash.Hash]*wire.MsgTx)
+	for _, parentRaw := range handler.db.GetRawTransactions(parentIds) {
+		parent := wire.NewMsgTx(wire.TxVersion)
+		if err := parent.Deserialize(bytes.NewReader(parentRaw)); err == nil {
+			parents[parent.TxHash()] = parent
+		}
+	}
+	if fee, ok := transactionFee(msg, parents); ok {
+		entry.Fee = dbr.NewNullInt64(fee)
+		entry.FeeRate = dbr.NewNullFloat64(float64(fee) / float64(entry.VSize))
+	}
+
+	handler.db.AddTransaction(&entry)
 }
 
 type ConnectionFailureMetadata struct {
@@ -204,16 +366,50 @@ type ConnectionFailureMetadata struct {
 
 type SessionBeginMetadata struct {
 	CurrentPeerVersion string
+	// TransportV1 or TransportV2, whichever this session runs on
+	Transport          string
+	// What we presented ourselves as
+	Identity           Identity
 }
 
-func (handler *BitcoinHandler) Run(cd *Coordinator) error {
-	handler.started = time.Now()
+// Recorded for every feefilter, MinFee is in satoshis per 1000 virtual bytes
+type FeeFilterMetadata struct {
+	MinFee int64
+}
+
+// Recorded for every sendcmpct, Announce tells whether the peer picked us as one of its
+// high-bandwidth compact block relays
+type CompactRelayMetadata struct {
+	Announce bool
+	Version  uint64
+}
+
+// Recorded for the first message of every command we do not understand in a session, Sample
+// holds the start of the payload in hex
+type UnknownMessageMetadata struct {
+	Command string
+	Length  int
+	Sample  string
+}
+
+// Wires the listeners of the peer config up to the handler
+func (handler *BitcoinHandler) setListeners(cd *Coordinator) {
+	handler.gossip = cd.GossipTracker
+	handler.tip = cd.TipTracker
+	handler.headers = cd.HeaderChain
+	if cd.TxSampler.Enabled() {
+		handler.txSampler = cd.TxSampler
+		handler.txRequests = newTxRequests(cd.TxSampler.config)
+	}
 
 	handler.peerCfg.Listeners.OnAddr = func(p *Witness, msg *wire.MsgAddr) {
 		handler.onAddrHandler(p, msg)
 	}
 	handler.peerCfg.Listeners.OnTx = func(p *Witness, msg *wire.MsgTx) {
-		log.Println("MsgTx:", *msg)
+		handler.onTxHandler(p, msg)
+	}
+	handler.peerCfg.Listeners.OnNotFound = func(p *Witness, msg *wire.MsgNotFound) {
+		handler.onNotFoundHandler(p, msg)
 	}
 	handler.peerCfg.Listeners.OnInv = func(p *Witness, msg *wire.MsgInv) {
 		handler.onInvHandler(p, msg)
@@ -221,33 +417,110 @@ func (handler *BitcoinHandler) Run(cd *Coordinator) error {
 	handler.peerCfg.Listeners.OnBlock = func(p *Witness, msg *wire.MsgBlock, buf []byte) {
 		log.Println("MsgBlock: size:", len(buf), "hash:", msg.BlockHash().String(), "timestamp:", msg.Header.Timestamp.String())
 	}
+	handler.peerCfg.Listeners.OnCmpctBlock = func(p *Witness, msg *MsgCmpctBlock) {
+		handler.onAnnouncedHeaders(p, []*wire.BlockHeader{&msg.Header})
+		log.Println("->CmpctBlock", msg.BlockHash().String(), "from", handler.nodeInfo.ConnString,
+			"with", len(msg.ShortIds), "short ids and", len(msg.PrefilledTx), "prefilled transactions")
+	}
+	handler.peerCfg.Listeners.OnSendCmpct = func(p *Witness, msg *MsgSendCmpct) {
+		event := CompactRelayMetadata{Announce: msg.Announce, Version: msg.Version}
+		serialized, _ := json.Marshal(&event)
+		_ = handler.db.AddNodeHistory(handler.nodeInfo,
+			"compact_relay",
+			handler.now(),
+			dbr.NewNullString(serialized),
+		)
+	}
+	handler.peerCfg.Listeners.OnUnknown = func(p *Witness, msg *MsgUnknown) {
+		if _, ok := handler.unknownCommands[msg.Command()]; ok {
+			return
+		}
+		handler.unknownCommands[msg.Command()] = struct{}{}
+		log.Println("Unknown message", msg.Command(), "of", len(msg.Payload), "bytes from", handler.nodeInfo.ConnString)
+
+		sample := msg.Payload
+		if len(sample) > unknownMessageSampleSize {
+			sample = sample[:unknownMessageSampleSize]
+		}
+		event := UnknownMessageMetadata{
+			Command: msg.Command(),
+			Length:  len(msg.Payload),
+			Sample:  hex.EncodeToString(sample),
+		}
+		serialized, _ := json.Marshal(&event)
+		_ = handler.db.AddNodeHistory(handler.nodeInfo,
+			"unknown_message",
+			handler.now(),
+			dbr.NewNullString(serialized),
+		)
+	}
+	handler.peerCfg.Listeners.OnFeeFilter = func(p *Witness, msg *wire.MsgFeeFilter) {
+		event := FeeFilterMetadata{MinFee: msg.MinFee}
+		serialized, _ := json.Marshal(&event)
+		_ = handler.db.AddNodeHistory(handler.nodeInfo,
+			"feefilter",
+			handler.now(),
+			dbr.NewNullString(serialized),
+		)
+	}
 	handler.peerCfg.Listeners.OnHeaders = func(p *Witness, msg *wire.MsgHeaders) {
 		for i, header := range msg.Headers {
 			log.Printf("Header %d: %s [version=%d, prev=%s, merkleroot=%s, time=%s, difficulty=%d, nonce=%d]\n", i,
 				header.BlockHash().String(), header.Version, header.PrevBlock.String(), header.MerkleRoot.String(), header.Timestamp.String(), header.Bits, header.Nonce)
 		}
+		handler.onHeadersHandler(p, msg)
+	}
+	handler.peerCfg.Listeners.OnGetHeaders = func(p *Witness, msg *wire.MsgGetHeaders) {
+		handler.onGetHeadersHandler(p, msg)
+	}
+	handler.peerCfg.Listeners.OnGetData = func(p *Witness, msg *wire.MsgGetData) {
+		handler.onGetDataHandler(p, msg)
 	}
 	handler.peerCfg.Listeners.OnVersion = func(p *Witness, msg *wire.MsgVersion) *wire.MsgReject {
 		handler.nodeInfo.Version = msg.UserAgent
-		handler.nodeInfo.LastSeen = time.Now()
+		handler.nodeInfo.LastSeen = handler.now()
+		handler.tip.observe(msg.LastBlock, handler.nodeInfo.LastSeen)
+
+		metadata := NodeMetadata{
+			Services:        uint64(msg.Services),
+			ProtocolVersion: msg.ProtocolVersion,
+			StartingHeight:  msg.LastBlock,
+		}
+		serializedMetadata, _ := json.Marshal(&metadata)
+		handler.nodeInfo.Data = dbr.NewNullString(serializedMetadata)
 
 		// Insert connection event to history
-		event := SessionBeginMetadata{CurrentPeerVersion:handler.nodeInfo.Version}
+		event := SessionBeginMetadata{CurrentPeerVersion:handler.nodeInfo.Version, Transport:handler.transport,
+			Identity:handler.identity}
 		serialized, _ := json.Marshal(&event)
-		_ = cd.DbConn.AddNodeHistory(handler.nodeInfo,
-			"session_begin",
+		_ = handler.db.AddNodeHistory(handler.nodeInfo,
+			handler.sessionEvent("session_begin"),
 			handler.nodeInfo.LastSeen,
 			dbr.NewNullString(serialized),
 		)
+		if !handler.inbound {
+			handler.db.AddSessionUserAgent(makeSessionUserAgentEntry(handler.nodeInfo.Id, handler.nodeInfo.LastSeen, msg.UserAgent))
+		}
 		return nil
 	}
 	handler.peerCfg.Listeners.OnVerAck = func(p *Witness, msg *wire.MsgVerAck) {
 		//log.Println("Handshake completed with", handler.nodeInfo.ConnString, "(VerAck)")
-		if !handler.db.UpdateAllNode(handler.nodeInfo) {
+		if !handler.inbound && !handler.db.UpdateAllNode(handler.nodeInfo) {
 			log.Println("Failed to update node session time for", handler.nodeInfo.ConnString)
 		}
 
+		handler.spyObservations.onVerAck()
 		handler.peerInstance.QueueMessage(wire.NewMsgSendHeaders(), nil)
+		if canaries := handler.config.Canaries; canaries.Enabled() {
+			_, _ = p.PushAddrMsg(canaries.inject(handler, canaries.config.PerSession))
+		}
+		if cd.MempoolTracker.Enabled() {
+			go handler.runMempoolSnapshots(p, cd.MempoolTracker)
+		}
+	}
+	handler.peerCfg.Listeners.OnGetAddr = func(p *Witness, msg *wire.MsgGetAddr) {
+		handler.spyObservations.onGetAddr()
+		handler.onGetAddrHandler(p, msg)
 	}
 	handler.peerCfg.Listeners.OnReject = func(p *Witness, msg *wire.MsgReject) {
 		log.Println("MsgReject:", *msg)
@@ -259,6 +532,8 @@ func (handler *BitcoinHandler) Run(cd *Coordinator) error {
 		if err != nil {
 			return
 		}
+		handler.traffic.AddReceived(msg.Command(), bytesRead)
+		handler.onActivity(msg.Command())
 
 		if handler.lastActivityReport == nil || time.Now().Sub(*handler.lastActivityReport) > time.Minute {
 			_ = handler.rs.SetActiveTag(nil, handler.nodeInfo.ConnString, 120)
@@ -266,14 +541,26 @@ func (handler *BitcoinHandler) Run(cd *Coordinator) error {
 			handler.lastActivityReport = &now
 		}
 	}
+	handler.peerCfg.Listeners.OnWrite = func(p *Witness, bytesWritten int, msg wire.Message, err error) {
+		if err != nil {
+			return
+		}
+		handler.traffic.AddSent(msg.Command(), bytesWritten)
+	}
+}
+
+func (handler *BitcoinHandler) Run(cd *Coordinator) error {
+	handler.started = time.Now()
+	handler.spyObservations.started = handler.started
+	handler.setListeners(cd)
 
 	onConnFail := func(coord *Coordinator, eventType string, err error) {
 		coord.FailCounter.Incr(1)
-		_ = coord.RedisConn.RemoveActiveTag(nil, handler.nodeInfo.ConnString)
+		_ = handler.rs.RemoveActiveTag(nil, handler.nodeInfo.ConnString)
 
 		msg := ConnectionFailureMetadata{Output:err.Error()}
 		serialized, _ := json.Marshal(&msg)
-		_ = cd.DbConn.AddNodeHistory(handler.nodeInfo,
+		_ = handler.db.AddNodeHistory(handler.nodeInfo,
 			eventType,
 			time.Now(),
 			dbr.NewNullString(serialized),
@@ -283,11 +570,13 @@ func (handler *BitcoinHandler) Run(cd *Coordinator) error {
 	cd.AttemptCounter.Incr(1)
 
 	// Establish the connection to the peer address and mark it connected.
-	conn, err := net.DialTimeout("tcp", handler.nodeInfo.ConnString, time.Duration(5) * time.Second)
+	conn, transport, err := dialPeer(handler.nodeInfo.ConnString, handler.config,
+		cd.TransportConfig.V2 && handler.mayAcceptV2(), cd.TransportConfig.HandshakeTimeout)
 	if err != nil {
 		onConnFail(cd, "connect_error", err)
 		return err
 	}
+	handler.transport = transport
 
 	p, err := NewOutboundPeer(handler.peerCfg, handler.nodeInfo.ConnString)
 	if err != nil {
@@ -296,15 +585,9 @@ func (handler *BitcoinHandler) Run(cd *Coordinator) error {
 	}
 
 	cd.SuccessCounter.Incr(1)
-
-	handler.peerInstance = p
-	p.AssociateConnection(conn)
-
 	// Incrementing PeerCount only after knowing this is a conforming peer
 	atomic.AddInt64(&cd.PeerCount, 1)
-
-	p.WaitForDisconnect()
-
+	handler.runSession(cd, p, conn)
 	cd.VoluntaryDisconnectCounter.Incr(1)
 
 	// Decrementing PeerCount after disconnecting from the peer for any reason
@@ -313,6 +596,133 @@ func (handler *BitcoinHandler) Run(cd *Coordinator) error {
 	return nil
 }
 
+// Handles a peer that connected to us on conn like Run handles the ones we connect to. Inbound
+// sessions use the v1 transport and do not count towards MaxPeers. A peer connecting to us says
+// nothing about whether it is reachable, so its sessions are recorded as inbound_session_begin
+// and inbound_session_end and the node keeps what our own connections found out about it.
+func (handler *BitcoinHandler) RunInbound(cd *Coordinator, conn net.Conn) {
+	handler.started = time.Now()
+	handler.spyObservations.started = handler.started
+	handler.inbound = true
+	handler.setListeners(cd)
+	handler.transport = TransportV1
+	handler.runSession(cd, NewInboundPeer(handler.peerCfg), conn)
+}
+
+// Runs the session of p on conn until it ends and records how it went
+func (handler *BitcoinHandler) runSession(cd *Coordinator, p *Witness, conn net.Conn) {
+	if cd.CaptureConfig.Directory != "" {
+		capture, err := NewCaptureWriter(cd.CaptureConfig, handler.nodeInfo.ConnString)
+		if err != nil {
+			log.Println("Failed to start capture for", handler.nodeInfo.ConnString, ":", err.Error())
+		} else {
+			p.cfg.Capture = capture
+			defer capture.Close()
+		}
+	}
+
+	handler.peerInstance = p
+	cd.registerHandler(handler)
+	defer cd.unregisterHandler(handler)
+	p.AssociateConnection(conn)
+	done := make(chan struct{})
+	go handler.enforceLifetime(p, done)
+
+	p.WaitForDisconnect()
+	close(done)
+
+	ended := time.Now()
+	// Taking the once makes sure a reason being recorded right now is complete
+	handler.ending.Do(func() {})
+	event := SessionEndMetadata{
+		Duration:      ended.Sub(handler.started).Seconds(),
+		BytesSent:     p.BytesSent(),
+		BytesReceived: p.BytesReceived(),
+		Traffic:       handler.traffic.Snapshot(),
+		Reason:        handler.endReason,
+	}
+	serialized, _ := json.Marshal(&event)
+	_ = handler.db.AddNodeHistory(handler.nodeInfo,
+		handler.sessionEvent("session_end"),
+		ended,
+		dbr.NewNullString(serialized),
+	)
+	handler.storeSpyScore(ended)
+}
+
+// Whether a v2 handshake is worth a try, which is the case unless the last handshake showed
+// the peer lacks the service bit
+func (handler *BitcoinHandler) mayAcceptV2() bool {
+	if !handler.nodeInfo.Data.Valid {
+		return true
+	}
+	var metadata NodeMetadata
+	if err := json.Unmarshal([]byte(handler.nodeInfo.Data.String), &metadata); err != nil {
+		return true
+	}
+	return wire.ServiceFlag(metadata.Services)&SFNodeP2PV2 == SFNodeP2PV2
+}
+
+// Runs the handler against a capture instead of a live connection. The frames we received are
+// fed back through the same listeners, whatever the handler sends in response is discarded.
+// Events are stamped with the time their message was captured. Replays record into the storage
+// of the handler, which should not be the one of the crawler, and leave the tip and gossip the
+// coordinator collects across sessions alone.
+func (handler *BitcoinHandler) Replay(cd *Coordinator, capture CaptureSource) error {
+	clock := &replayClock{}
+	handler.replayClock = clock
+	handler.setListeners(cd)
+	handler.gossip = nil
+	handler.tip = nil
+	// Every frame is read and handled before the next one, so the clock moves along with them
+	onRead := handler.peerCfg.Listeners.OnRead
+	handler.peerCfg.Listeners.OnRead = func(p *Witness, bytesRead int, msg wire.Message, err error) {
+		clock.advance()
+		onRead(p, bytesRead, msg, err)
+	}
+
+	p, err := NewOutboundPeer(handler.peerCfg, handler.nodeInfo.ConnString)
+	if err != nil {
+		return err
+	}
+
+	frames, remote := io.Pipe()
+	handler.peerInstance = p
+	p.AssociateConnection(&replayConn{frames: frames})
+
+	replayed := 0
+	var replayErr error
+	for {
+		record, err := capture.Next()
+		if err != nil {
+			if err != io.EOF {
+				replayErr = err
+			}
+			break
+		}
+		if record.Direction != CaptureReceived {
+			continue
+		}
+		if replayed == 0 {
+			handler.started = record.Timestamp
+			handler.spyObservations.started = record.Timestamp
+		}
+		clock.push(record.Timestamp)
+		if _, err := remote.Write(record.Frame); err != nil {
+			replayErr = err
+			break
+		}
+		replayed++
+	}
+
+	// The peer reads the next frame only once it handled the one before, so it sees EOF, and
+	// disconnects, after it handled the last
+	_ = remote.Close()
+	p.WaitForDisconnect()
+	log.Println("Replayed", replayed, "messages from", handler.nodeInfo.ConnString)
+	return replayErr
+}
+
 func (handler *BitcoinHandler) Status() bool {
 	return false
 }
@@ -321,26 +731,130 @@ func (handler *BitcoinHandler) Stop() error {
 	return nil
 }
 
-func MakeBitcoinHandler(node *NodeInfo, db *PostgresStorage, rs *RedisStorage) *BitcoinHandler {
+// Names of the service bits in configuration, in bit order
+var serviceFlagNames = []struct {
+	name string
+	flag wire.ServiceFlag
+}{
+	{"network", wire.SFNodeNetwork},
+	{"getutxo", wire.SFNodeGetUTXO},
+	{"bloom", wire.SFNodeBloom},
+	{"witness", wire.SFNodeWitness},
+	{"xthin", wire.SFNodeXthin},
+	{"bit5", wire.SFNodeBit5},
+	{"cf", wire.SFNodeCF},
+	{"2x", wire.SFNode2X},
+	{"network_limited", SFNodeNetworkLimited},
+	{"p2p_v2", SFNodeP2PV2},
+}
+
+// Parses service names such as network or witness into the bitmask we advertise
+func ParseServiceFlags(names []string) (wire.ServiceFlag, error) {
+	var services wire.ServiceFlag
+	for _, name := range names {
+		known := false
+		for _, service := range serviceFlagNames {
+			if service.name == name {
+				services |= service.flag
+				known = true
+			}
+		}
+		if !known {
+			return 0, fmt.Errorf("unknown service %s", name)
+		}
+	}
+	return services, nil
+}
+
+// The names of the known bits set in services
+func ServiceFlagNames(services wire.ServiceFlag) []string {
+	names := make([]string, 0)
+	for _, service := range serviceFlagNames {
+		if services&service.flag == service.flag {
+			names = append(names, service.name)
+		}
+	}
+	return names
+}
+
+// Identities we present to peers and the timeouts of a session
+type HandlerConfig struct {
+	ChainParams *chaincfg.Params
+	// Each session picks one at random, so a single one is used throughout
+	Identities       []Identity
+	TrickleInterval  time.Duration
+	DialTimeout      time.Duration
+	NegotiateTimeout time.Duration
+	IdleTimeout      time.Duration
+	// When we end sessions on our own
+	Lifetime SessionLifetime
+	// What we answer addr messages with, nothing if nil
+	AddrPolicy AddrPolicy
+	// Injects canaries and recognizes them when they come back, nil without canaries
+	Canaries *CanaryInjector
+	// The height we advertise, see TipTracker
+	Tip TipConfig
+	// Set by the coordinator from its TipTracker, we advertise height 0 without it
+	NewestBlock HashFunc
+	// How we answer requests of peers
+	Responder ResponderConfig
+	// Opens the connections to peers, net.DialTimeout if nil. Tests connect handlers to testpeer with it
+	Dial func(network, address string, timeout time.Duration) (net.Conn, error)
+}
+
+func (config HandlerConfig) dial(connString string) (net.Conn, error) {
+	if config.Dial == nil {
+		return net.DialTimeout("tcp", connString, config.DialTimeout)
+	}
+	return config.Dial("tcp", connString, config.DialTimeout)
+}
+
+// The identity and timeouts used before they were configurable
+func DefaultHandlerConfig() HandlerConfig {
+	legacy, _ := IdentityProfile(IdentityLegacy)
+	return HandlerConfig{
+		ChainParams: &chaincfg.MainNetParams,
+		Identities:  []Identity{legacy},
+		// Trickle slowly on purpose as to not contaminate the data
+		TrickleInterval:  time.Minute * 2,
+		DialTimeout:      time.Second * 5,
+		NegotiateTimeout: time.Second * 30,
+		IdleTimeout:      time.Minute * 5,
+		Lifetime:         SessionLifetime{MaxDuration: time.Hour},
+	}
+}
+
+// A fresh WitnessConfig for a session presenting identity, without listeners
+func (config HandlerConfig) witnessConfig(identity Identity) *WitnessConfig {
+	return &WitnessConfig{
+		NewestBlock:               config.NewestBlock,
+		UserAgent:                 identity.UserAgent,
+		ProtocolVersion:           identity.ProtocolVersion,
+		ChainParams:               config.ChainParams,
+		Services:                  identity.Services,
+		EagerBlockPropagation:     false,
+		PropagateBlocks:           false,
+		TrickleInterval:           config.TrickleInterval,
+		NegotiateTimeout:          config.NegotiateTimeout,
+		IdleTimeout:               config.IdleTimeout,
+		CompactBlockAnnouncements: true,
+		WtxidRelay:                true,
+	}
+}
+
+func MakeBitcoinHandler(node *NodeInfo, db HandlerStorage, rs ActiveTags, config HandlerConfig) *BitcoinHandler {
+	identity := pickIdentity(config.Identities)
 	return &BitcoinHandler{
 		peerInstance:       nil,
 		nodeInfo:           node,
 		db:                 db,
 		rs:                 rs,
+		config:             config,
+		identity:           identity,
 		lastActivityReport: nil,
 		requestBlockInv:    false,
-		peerCfg:            &WitnessConfig{
-			UserAgentName:           "Satoshi",
-
-			UserAgentVersion:        "0.17.99",
-			ChainParams:             &chaincfg.MainNetParams,
-			Services:                wire.SFNodeXthin | wire.SFNodeWitness | wire.SFNodeGetUTXO |
-				                                        wire.SFNodeCF | wire.SFNodeBloom |
-				                                        wire.SFNodeBit5 | wire.SFNode2X |
-				                                        wire.SFNodeNetwork,
-			EagerBlockPropagation:   false,
-			PropagateBlocks:         false,
-			TrickleInterval:         time.Minute * 2,
-		},
+		traffic:            MakeTrafficStats(),
+		unknownCommands:    make(map[string]struct{}),
+		peerCfg:            config.witnessConfig(identity),
 	}
 }
@@ -0,0 +1,175 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Referrer ids recorded for nodes that were not recommended to us by another node, inbound ones
+// connected to us
+const (
+	ReferrerDNSSeed   int64 = -1
+	ReferrerFixedSeed int64 = -2
+	ReferrerSeedFile  int64 = -3
+	ReferrerImport    int64 = -4
+	ReferrerInbound   int64 = -5
+)
+
+type BootstrapConfig struct {
+	ChainParams *chaincfg.Params
+	// Looks up the addresses of a DNS seed, net.DefaultResolver.LookupHost if nil. Tests point
+	// the bootstrap phase at a local resolver with it
+	Resolve func(ctx context.Context, host string) ([]string, error)
+	// Optional file with one address per line, either host:port or a bare IP for the default port
+	SeedFile string
+	// Time allowed for each DNS seed lookup
+	Timeout time.Duration
+}
+
+type seedSource struct {
+	name     string
+	referrer int64
+	lines    []string
+}
+
+// Looks up the parameters of a chain by the name btcd gives it, e.g. mainnet or testnet3
+func ChainParamsByName(name string) (*chaincfg.Params, error) {
+	for _, params := range []*chaincfg.Params{&chaincfg.MainNetParams, &chaincfg.TestNet3Params,
+		&chaincfg.RegressionNetParams, &chaincfg.SimNetParams} {
+		if params.Name == name {
+			return params, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown chain %s", name)
+}
+
+// Parses a seed line into an IP and port, falling back to defaultPort if the line has none
+func parseSeedAddress(line string, defaultPort uint16) (net.IP, uint16, error) {
+	if ip := net.ParseIP(strings.Trim(line, "[]")); ip != nil {
+		return ip, defaultPort, nil
+	}
+
+	host, portStr, err := net.SplitHostPort(line)
+	if err != nil {
+		return nil, 0, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, 0, fmt.Errorf("%s is not an IP address", host)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ip, uint16(port), nil
+}
+
+func readSeedFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+func addSeedNodes(db HandlerStorage, ips []net.IP, port uint16, referrer int64) int {
+	added := 0
+	for _, ip := range ips {
+		if _, discovered := db.AddNode(&ip, port, referrer); discovered {
+			added++
+		}
+	}
+	return added
+}
+
+// Populates the nodes table from the DNS seeds of the chain, the bundled fixed seeds and the
+// configured seed file. Returns the number of nodes that were not known before.
+func Bootstrap(db HandlerStorage, config BootstrapConfig) int {
+	params := config.ChainParams
+	if params == nil {
+		params = &chaincfg.MainNetParams
+	}
+	resolve := config.Resolve
+	if resolve == nil {
+		resolve = net.DefaultResolver.LookupHost
+	}
+	defaultPort, err := strconv.ParseUint(params.DefaultPort, 10, 16)
+	if err != nil {
+		log.Println("Failed to parse the default port of", params.Name, "while bootstrapping:", err.Error())
+		return 0
+	}
+
+	added := 0
+	for _, seed := range params.DNSSeeds {
+		host := seed.Host
+		if seed.HasFiltering {
+			host = fmt.Sprintf("x%x.%s", uint64(wire.SFNodeNetwork|wire.SFNodeWitness), seed.Host)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), config.Timeout)
+		addrs, err := resolve(ctx, host)
+		cancel()
+		if err != nil {
+			log.Println("DNS seed lookup failed for", host, ":", err.Error())
+			continue
+		}
+
+		ips := make([]net.IP, 0, len(addrs))
+		for _, addr := range addrs {
+			if ip := net.ParseIP(addr); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+		count := addSeedNodes(db, ips, uint16(defaultPort), ReferrerDNSSeed)
+		log.Println("Added", count, "new nodes out of", len(ips), "from DNS seed", host)
+		added += count
+	}
+
+	sources := []seedSource{
+		{"fixed seeds", ReferrerFixedSeed, fixedSeeds[params.Net]},
+	}
+	if config.SeedFile != "" {
+		lines, err := readSeedFile(config.SeedFile)
+		if err != nil {
+			log.Println("Failed to read seed file", config.SeedFile, ":", err.Error())
+		} else {
+			sources = append(sources, seedSource{config.SeedFile, ReferrerSeedFile, lines})
+		}
+	}
+
+	for _, source := range sources {
+		count := 0
+		for _, line := range source.lines {
+			ip, port, err := parseSeedAddress(line, uint16(defaultPort))
+			if err != nil {
+				log.Println("Skipping invalid seed", line, "from", source.name, ":", err.Error())
+				continue
+			}
+			count += addSeedNodes(db, []net.IP{ip}, port, source.referrer)
+		}
+		log.Println("Added", count, "new nodes out of", len(source.lines), "from", source.name)
+		added += count
+	}
+
+	return added
+}
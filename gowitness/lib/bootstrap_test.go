@@ -0,0 +1,81 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"github.com/btcsuite/btcd/chaincfg"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestFixedSeedsParse(t *testing.T) {
+	for network, seeds := range fixedSeeds {
+		for _, seed := range seeds {
+			if _, _, err := parseSeedAddress(seed, 8333); err != nil {
+				t.Fatalf("fixed seed %s of %s: %v", seed, network, err)
+			}
+		}
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+	params := chaincfg.MainNetParams
+	params.DNSSeeds = []chaincfg.DNSSeed{
+		{Host: "seed.example", HasFiltering: true},
+		{Host: "plain.example", HasFiltering: false},
+		{Host: "down.example", HasFiltering: false},
+	}
+	answers := map[string][]string{
+		"x9.seed.example": {"192.0.2.1", "2001:db8::1"},
+		"plain.example":   {"192.0.2.2", "not an address"},
+	}
+	resolved := make([]string, 0)
+	seedFile := filepath.Join(t.TempDir(), "seeds.txt")
+	seeds := "# seeds\n192.0.2.3\n[2001:db8::3]:8334\n192.0.2.2:8333\nnot a seed\n"
+	if err := ioutil.WriteFile(seedFile, []byte(seeds), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	storage := MakeMemoryStorage()
+	added := Bootstrap(storage, BootstrapConfig{
+		ChainParams: &params,
+		Resolve: func(ctx context.Context, host string) ([]string, error) {
+			resolved = append(resolved, host)
+			if addrs, ok := answers[host]; ok {
+				return addrs, nil
+			}
+			return nil, errors.New("no such host")
+		},
+		SeedFile: seedFile,
+	})
+
+	if len(resolved) != 3 || resolved[0] != "x9.seed.example" || resolved[1] != "plain.example" {
+		t.Fatalf("resolved %v", resolved)
+	}
+	// The seed file repeats one of the DNS answers
+	if expected := 3 + len(fixedSeeds[params.Net]) + 2; added != expected {
+		t.Fatalf("added %d nodes instead of %d", added, expected)
+	}
+	referrers := map[string]int64{
+		"[192.0.2.1]:8333":    ReferrerDNSSeed,
+		"[2001:db8::1]:8333":  ReferrerDNSSeed,
+		"[192.0.2.2]:8333":    ReferrerDNSSeed,
+		"[192.0.2.3]:8333":    ReferrerSeedFile,
+		"[2001:db8::3]:8334":  ReferrerSeedFile,
+		"[2.39.173.126]:8333": ReferrerFixedSeed,
+	}
+	for connString, referrer := range referrers {
+		node := storage.GetNodeByConnString(connString)
+		if node == nil || node.Referrer != referrer {
+			t.Fatalf("stored %+v for %s", node, connString)
+		}
+	}
+
+	if added := Bootstrap(storage, BootstrapConfig{ChainParams: &params, Resolve: func(ctx context.Context,
+		host string) ([]string, error) {
+		return answers[host], nil
+	}}); added != 0 {
+		t.Fatalf("added %d known nodes again", added)
+	}
+}
@@ -0,0 +1,249 @@
+package lib
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/gocraft/dbr"
+	"log"
+	"net"
+	"sort"
+	"time"
+)
+
+// Canaries are addresses out of a prefix we control that nobody but us ever advertised. Each is
+// advertised to a single peer, so whoever sends it back to us learned it, directly or through
+// others, from that peer. This is the ground truth on how addr gossip spreads.
+
+const (
+	// Attempts at drawing an address nobody knows before giving up
+	canaryDrawAttempts = 8
+)
+
+type CanaryConfig struct {
+	// CIDR prefix canaries are drawn from, canaries are disabled without one
+	Prefix string
+	Port   uint16
+	// Connstrings of the peers canaries are injected to, every peer if empty
+	Targets []string
+	// Canaries injected right after the handshake
+	PerSession int
+}
+
+// Draws canaries for the peers we inject them to and recognizes them when they come back
+type CanaryInjector struct {
+	config  CanaryConfig
+	network *net.IPNet
+	targets map[string]struct{}
+}
+
+// Returns nil if canaries are disabled
+func MakeCanaryInjector(config CanaryConfig) (*CanaryInjector, error) {
+	if config.Prefix == "" {
+		return nil, nil
+	}
+	_, network, err := net.ParseCIDR(config.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := network.Mask.Size()
+	if bits-ones < 8 {
+		return nil, fmt.Errorf("prefix %s leaves less than 8 bits to draw canaries from", config.Prefix)
+	}
+	if config.Port == 0 {
+		return nil, errors.New("the canary port must not be 0")
+	}
+	if config.PerSession < 0 || config.PerSession > wire.MaxAddrPerMsg {
+		return nil, fmt.Errorf("canaries per session must be between 0 and %d", wire.MaxAddrPerMsg)
+	}
+	targets := make(map[string]struct{})
+	for _, target := range config.Targets {
+		targets[target] = struct{}{}
+	}
+	return &CanaryInjector{config: config, network: network, targets: targets}, nil
+}
+
+func (injector *CanaryInjector) Enabled() bool {
+	return injector != nil
+}
+
+func (injector *CanaryInjector) isCanary(ip net.IP) bool {
+	return injector != nil && injector.network.Contains(ip)
+}
+
+func (injector *CanaryInjector) isTarget(connString string) bool {
+	if len(injector.targets) == 0 {
+		return true
+	}
+	_, ok := injector.targets[connString]
+	return ok
+}
+
+// A random address of the prefix, the host bits drawn uniformly
+func (injector *CanaryInjector) draw() (net.IP, error) {
+	ip := make(net.IP, len(injector.network.IP))
+	if _, err := rand.Read(ip); err != nil {
+		return nil, err
+	}
+	for i := range ip {
+		ip[i] = injector.network.IP[i] | (ip[i] &^ injector.network.Mask[i])
+	}
+	return ip, nil
+}
+
+// Draws count canaries nobody knows of, records them as injected to the peer of handler and
+// returns them to be sent. Returns nothing for peers that are not targeted.
+func (injector *CanaryInjector) inject(handler *BitcoinHandler, count int) []*wire.NetAddress {
+	if injector == nil || count == 0 || !injector.isTarget(handler.nodeInfo.ConnString) {
+		return nil
+	}
+	now := handler.now()
+	addresses := make([]*wire.NetAddress, 0, count)
+	for attempt := 0; len(addresses) < count && attempt < count*canaryDrawAttempts; attempt++ {
+		ip, err := injector.draw()
+		if err != nil {
+			log.Println("Failed to draw a canary:", err.Error())
+			break
+		}
+		entry := &CanaryEntry{
+			ConnString: fmt.Sprintf("[%s]:%d", ip.String(), injector.config.Port),
+			NodeId:     handler.nodeInfo.Id,
+			Injected:   now,
+		}
+		if handler.db.AddCanary(entry) == nil {
+			continue
+		}
+		addresses = append(addresses, &wire.NetAddress{
+			Timestamp: now,
+			Services:  advertisedServices,
+			IP:        ip,
+			Port:      injector.config.Port,
+		})
+	}
+	if len(addresses) > 0 {
+		log.Println("Injecting", len(addresses), "canaries to", handler.nodeInfo.ConnString)
+	}
+	return addresses
+}
+
+// Records that the peer of handler advertised the canary address
+func (injector *CanaryInjector) observe(handler *BitcoinHandler, address *wire.NetAddress, seen time.Time) {
+	connString := fmt.Sprintf("[%s]:%d", address.IP.String(), address.Port)
+	canary := handler.db.GetCanary(connString)
+	if canary == nil {
+		// Out of our prefix, but not one we injected
+		return
+	}
+	log.Println("Canary", connString, "injected to node", canary.NodeId, "came back from",
+		handler.nodeInfo.ConnString, "after", seen.Sub(canary.Injected))
+	_ = handler.db.AddCanarySighting(&CanarySightingEntry{
+		CanaryId:   canary.Id,
+		NodeId:     handler.nodeInfo.Id,
+		Timestamp:  seen,
+		Advertised: address.Timestamp,
+	})
+}
+
+// Answers addr messages with a fresh canary
+type canaryAddrPolicy struct{}
+
+func (canaryAddrPolicy) Addresses(handler *BitcoinHandler) []*wire.NetAddress {
+	return handler.config.Canaries.inject(handler, 1)
+}
+
+// table canaries
+type CanaryEntry struct {
+	Id         int64     `db:"id"`
+	ConnString string    `db:"connstring"`
+	NodeId     int64     `db:"nodeid"`
+	Injected   time.Time `db:"injected"`
+}
+
+// table canarysightings
+type CanarySightingEntry struct {
+	Id         int64     `db:"id"`
+	CanaryId   int64     `db:"canaryid"`
+	NodeId     int64     `db:"nodeid"`
+	Timestamp  time.Time `db:"timestamp"`
+	Advertised time.Time `db:"advertised"`
+}
+
+// table canaries joined with the nodes it was injected to and came back from, Reporter is empty
+// for canaries that did not come back
+type CanarySightingRow struct {
+	Canary     string         `db:"canary"`
+	Target     string         `db:"target"`
+	Injected   time.Time      `db:"injected"`
+	Reporter   dbr.NullString `db:"reporter"`
+	Seen       dbr.NullTime   `db:"seen"`
+	Advertised dbr.NullTime   `db:"advertised"`
+}
+
+type CanaryHop struct {
+	Reporter string
+	Seen     time.Time
+	// Seconds from the injection to the sighting
+	Latency float64
+	// The timestamp the reporter gave the address
+	Advertised time.Time
+}
+
+// Where a canary went after we injected it, sightings in the order they occurred
+type CanaryPropagation struct {
+	Canary    string
+	Target    string
+	Injected  time.Time
+	Sightings []CanaryHop
+}
+
+type CanaryReport struct {
+	Injected int
+	Returned int
+	// Seconds until the first sighting of the canaries that came back
+	MedianFirstLatency float64
+	Canaries           []CanaryPropagation
+}
+
+// Groups rows ordered by injection and sighting time into the propagation of each canary
+func MakeCanaryReport(rows []CanarySightingRow) CanaryReport {
+	report := CanaryReport{Canaries: make([]CanaryPropagation, 0)}
+	index := make(map[string]int)
+	for _, row := range rows {
+		i, ok := index[row.Canary]
+		if !ok {
+			i = len(report.Canaries)
+			index[row.Canary] = i
+			report.Canaries = append(report.Canaries, CanaryPropagation{
+				Canary:    row.Canary,
+				Target:    row.Target,
+				Injected:  row.Injected,
+				Sightings: make([]CanaryHop, 0),
+			})
+		}
+		if !row.Reporter.Valid {
+			continue
+		}
+		report.Canaries[i].Sightings = append(report.Canaries[i].Sightings, CanaryHop{
+			Reporter:   row.Reporter.String,
+			Seen:       row.Seen.Time,
+			Latency:    row.Seen.Time.Sub(row.Injected).Seconds(),
+			Advertised: row.Advertised.Time,
+		})
+	}
+
+	latencies := make([]float64, 0)
+	for _, canary := range report.Canaries {
+		if len(canary.Sightings) == 0 {
+			continue
+		}
+		latencies = append(latencies, canary.Sightings[0].Latency)
+	}
+	report.Injected = len(report.Canaries)
+	report.Returned = len(latencies)
+	if len(latencies) > 0 {
+		sort.Float64s(latencies)
+		report.MedianFirstLatency = latencies[len(latencies)/2]
+	}
+	return report
+}
@@ -0,0 +1,307 @@
+package lib
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Capture files start with captureMagic followed by the length prefixed connstring of the peer,
+// then hold one record per message:
+//
+//	int64  unix timestamp in nanoseconds
+//	uint8  direction, see CaptureDirection
+//	uint32 frame length
+//	[]byte frame exactly as it went over the wire, header included
+//
+// All integers are little endian.
+
+const (
+	captureMagic = "GWCAP001"
+
+	// Frames can not legitimately exceed the header plus the max payload
+	captureMaxFrameSize = 24 + 32*1024*1024
+
+	captureFileExtension = ".gwcap"
+)
+
+type CaptureDirection uint8
+
+const (
+	CaptureReceived CaptureDirection = 0
+	CaptureSent     CaptureDirection = 1
+)
+
+func (direction CaptureDirection) String() string {
+	if direction == CaptureSent {
+		return "sent"
+	}
+	return "received"
+}
+
+type CaptureConfig struct {
+	// Captures are disabled if empty
+	Directory string
+	// A new file is started once the current one grows past this many bytes
+	MaxFileSize int64
+}
+
+type CaptureRecord struct {
+	Timestamp time.Time
+	Direction CaptureDirection
+	Frame     []byte
+}
+
+// CaptureWriter appends the messages exchanged with a single peer to rotating files
+type CaptureWriter struct {
+	mtx        sync.Mutex
+	config     CaptureConfig
+	connString string
+	prefix     string
+	sequence   int
+	file       *os.File
+	writer     *bufio.Writer
+	written    int64
+}
+
+func NewCaptureWriter(config CaptureConfig, connString string) (*CaptureWriter, error) {
+	if err := os.MkdirAll(config.Directory, 0755); err != nil {
+		return nil, err
+	}
+
+	// Connstrings look like [1.2.3.4]:8333 which is awkward in file names
+	sanitized := strings.NewReplacer("[", "", "]", "", ":", "_").Replace(connString)
+	return &CaptureWriter{
+		config:     config,
+		connString: connString,
+		prefix:     fmt.Sprintf("%s-%d", sanitized, time.Now().Unix()),
+	}, nil
+}
+
+func (w *CaptureWriter) rotate() error {
+	if err := w.closeFile(); err != nil {
+		return err
+	}
+
+	path := filepath.Join(w.config.Directory, fmt.Sprintf("%s-%04d%s", w.prefix, w.sequence, captureFileExtension))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	w.sequence++
+	w.file = file
+	w.writer = bufio.NewWriter(file)
+	w.written = 0
+
+	header := make([]byte, 0, len(captureMagic)+2+len(w.connString))
+	header = append(header, captureMagic...)
+	header = append(header, byte(len(w.connString)), byte(len(w.connString)>>8))
+	header = append(header, w.connString...)
+	n, err := w.writer.Write(header)
+	w.written += int64(n)
+	return err
+}
+
+// Appends a single frame to the capture, starting a new file first if needed
+//
+// This function is safe for concurrent access.
+func (w *CaptureWriter) WriteRecord(direction CaptureDirection, frame []byte) error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if w.file == nil || (w.config.MaxFileSize > 0 && w.written >= w.config.MaxFileSize) {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+
+	record := make([]byte, 13, 13+len(frame))
+	binary.LittleEndian.PutUint64(record[0:8], uint64(time.Now().UnixNano()))
+	record[8] = byte(direction)
+	binary.LittleEndian.PutUint32(record[9:13], uint32(len(frame)))
+	record = append(record, frame...)
+
+	n, err := w.writer.Write(record)
+	w.written += int64(n)
+	return err
+}
+
+func (w *CaptureWriter) closeFile() error {
+	if w.file == nil {
+		return nil
+	}
+	flushErr := w.writer.Flush()
+	closeErr := w.file.Close()
+	w.file = nil
+	w.writer = nil
+	if flushErr != nil {
+		return flushErr
+	}
+	return closeErr
+}
+
+func (w *CaptureWriter) Close() error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return w.closeFile()
+}
+
+// CaptureReader reads back the records of a single capture file
+type CaptureReader struct {
+	r          *bufio.Reader
+	ConnString string
+}
+
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	reader := bufio.NewReader(r)
+	header := make([]byte, len(captureMagic)+2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if string(header[:len(captureMagic)]) != captureMagic {
+		return nil, errors.New("not a capture file")
+	}
+
+	connString := make([]byte, binary.LittleEndian.Uint16(header[len(captureMagic):]))
+	if _, err := io.ReadFull(reader, connString); err != nil {
+		return nil, err
+	}
+	return &CaptureReader{r: reader, ConnString: string(connString)}, nil
+}
+
+// Returns the next record in the file or io.EOF once there are none left
+func (reader *CaptureReader) Next() (*CaptureRecord, error) {
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(reader.r, header); err != nil {
+		return nil, err
+	}
+
+	size := binary.LittleEndian.Uint32(header[9:13])
+	if size > captureMaxFrameSize {
+		return nil, fmt.Errorf("frame of %d bytes exceeds the maximum", size)
+	}
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(reader.r, frame); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	return &CaptureRecord{
+		Timestamp: time.Unix(0, int64(binary.LittleEndian.Uint64(header[0:8]))),
+		Direction: CaptureDirection(header[8]),
+		Frame:     frame,
+	}, nil
+}
+
+// CaptureSource yields capture records in order until it returns io.EOF
+type CaptureSource interface {
+	Next() (*CaptureRecord, error)
+}
+
+type multiCaptureReader struct {
+	readers []*CaptureReader
+}
+
+func (multi *multiCaptureReader) Next() (*CaptureRecord, error) {
+	for len(multi.readers) > 0 {
+		record, err := multi.readers[0].Next()
+		if err != io.EOF {
+			return record, err
+		}
+		multi.readers = multi.readers[1:]
+	}
+	return nil, io.EOF
+}
+
+// Reads the files a session was rotated into back to back
+func MultiCaptureReader(readers ...*CaptureReader) CaptureSource {
+	return &multiCaptureReader{readers: readers}
+}
+
+// The capture time of the frame being handled during a replay. Frames are pushed as they are
+// written to the peer and the peer advances the clock as it reads them.
+type replayClock struct {
+	mtx     sync.Mutex
+	pending []time.Time
+	current time.Time
+}
+
+func (clock *replayClock) push(timestamp time.Time) {
+	clock.mtx.Lock()
+	defer clock.mtx.Unlock()
+	clock.pending = append(clock.pending, timestamp)
+}
+
+func (clock *replayClock) advance() {
+	clock.mtx.Lock()
+	defer clock.mtx.Unlock()
+	if len(clock.pending) > 0 {
+		clock.current = clock.pending[0]
+		clock.pending = clock.pending[1:]
+	}
+}
+
+func (clock *replayClock) now() time.Time {
+	clock.mtx.Lock()
+	defer clock.mtx.Unlock()
+	return clock.current
+}
+
+// The connection a replayed peer reads the captured frames from. What the peer writes is
+// discarded, so its writes never fail and cut the replay short, and it reads EOF only once it
+// has handled every frame written to frames.
+type replayConn struct {
+	frames *io.PipeReader
+}
+
+func (conn *replayConn) Read(b []byte) (int, error) {
+	return conn.frames.Read(b)
+}
+
+func (conn *replayConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (conn *replayConn) Close() error {
+	return conn.frames.CloseWithError(io.ErrClosedPipe)
+}
+
+func (conn *replayConn) LocalAddr() net.Addr {
+	return replayAddr{}
+}
+
+func (conn *replayConn) RemoteAddr() net.Addr {
+	return replayAddr{}
+}
+
+func (conn *replayConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (conn *replayConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (conn *replayConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+type replayAddr struct{}
+
+func (replayAddr) Network() string {
+	return "replay"
+}
+
+func (replayAddr) String() string {
+	return "replay"
+}
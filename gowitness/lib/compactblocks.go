@@ -0,0 +1,310 @@
+package lib
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"io"
+)
+
+// Compact block relay as specified in BIP152
+
+const (
+	CmdSendCmpct   = "sendcmpct"
+	CmdCmpctBlock  = "cmpctblock"
+	CmdGetBlockTxn = "getblocktxn"
+	CmdBlockTxn    = "blocktxn"
+
+	// CompactBlocksVersion is the protocol version from which on peers understand BIP152
+	CompactBlocksVersion uint32 = 70014
+
+	// Version 1 uses txids and the legacy serialization, version 2 wtxids and the witness one
+	CompactBlocksLegacy  uint64 = 1
+	CompactBlocksWitness uint64 = 2
+
+	// Size of a short transaction id in bytes
+	shortIdSize = 6
+
+	// Block indexes are 16 bits wide in Bitcoin Core
+	maxCompactBlockIndex = 0xffff
+)
+
+// MsgSendCmpct announces that compact blocks of Version are understood. With Announce set the
+// sender asks to receive new blocks as cmpctblock right away, i.e. it picked the receiver as one
+// of its high-bandwidth relays.
+type MsgSendCmpct struct {
+	Announce bool
+	Version  uint64
+}
+
+func NewMsgSendCmpct(announce bool, version uint64) *MsgSendCmpct {
+	return &MsgSendCmpct{Announce: announce, Version: version}
+}
+
+func (msg *MsgSendCmpct) BtcDecode(r io.Reader, pver uint32, enc wire.MessageEncoding) error {
+	var announce uint8
+	if err := binary.Read(r, binary.LittleEndian, &announce); err != nil {
+		return err
+	}
+	msg.Announce = announce != 0
+	return binary.Read(r, binary.LittleEndian, &msg.Version)
+}
+
+func (msg *MsgSendCmpct) BtcEncode(w io.Writer, pver uint32, enc wire.MessageEncoding) error {
+	var announce uint8
+	if msg.Announce {
+		announce = 1
+	}
+	if err := binary.Write(w, binary.LittleEndian, announce); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.LittleEndian, msg.Version)
+}
+
+func (msg *MsgSendCmpct) Command() string {
+	return CmdSendCmpct
+}
+
+func (msg *MsgSendCmpct) MaxPayloadLength(pver uint32) uint32 {
+	return 9
+}
+
+// PrefilledTx is a transaction sent along with a compact block, Index is its absolute position
+// in the block
+type PrefilledTx struct {
+	Index uint32
+	Tx    *wire.MsgTx
+}
+
+// MsgCmpctBlock announces a block as its header and the short ids of its transactions
+type MsgCmpctBlock struct {
+	Header      wire.BlockHeader
+	Nonce       uint64
+	ShortIds    []uint64
+	PrefilledTx []PrefilledTx
+}
+
+func (msg *MsgCmpctBlock) BtcDecode(r io.Reader, pver uint32, enc wire.MessageEncoding) error {
+	if err := msg.Header.Deserialize(r); err != nil {
+		return err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &msg.Nonce); err != nil {
+		return err
+	}
+
+	count, err := wire.ReadVarInt(r, pver)
+	if err != nil {
+		return err
+	}
+	if count > uint64(wire.MaxBlockPayload/shortIdSize) {
+		return fmt.Errorf("too many short ids in cmpctblock: %d", count)
+	}
+	msg.ShortIds = make([]uint64, count)
+	buf := make([]byte, 8)
+	for i := range msg.ShortIds {
+		if _, err := io.ReadFull(r, buf[:shortIdSize]); err != nil {
+			return err
+		}
+		msg.ShortIds[i] = binary.LittleEndian.Uint64(buf)
+	}
+
+	count, err = wire.ReadVarInt(r, pver)
+	if err != nil {
+		return err
+	}
+	if count > maxCompactBlockIndex+1 {
+		return fmt.Errorf("too many prefilled transactions in cmpctblock: %d", count)
+	}
+	msg.PrefilledTx = make([]PrefilledTx, count)
+	indexes, err := readDifferentialIndexes(r, pver, len(msg.PrefilledTx), func(i int, index uint32) error {
+		tx := &wire.MsgTx{}
+		if err := tx.BtcDecode(r, pver, enc); err != nil {
+			return err
+		}
+		msg.PrefilledTx[i] = PrefilledTx{Index: index, Tx: tx}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if uint64(indexes) > uint64(len(msg.ShortIds))+uint64(len(msg.PrefilledTx)) {
+		return fmt.Errorf("prefilled transaction index %d is out of range", indexes-1)
+	}
+	return nil
+}
+
+func (msg *MsgCmpctBlock) BtcEncode(w io.Writer, pver uint32, enc wire.MessageEncoding) error {
+	if err := msg.Header.Serialize(w); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, msg.Nonce); err != nil {
+		return err
+	}
+
+	if err := wire.WriteVarInt(w, pver, uint64(len(msg.ShortIds))); err != nil {
+		return err
+	}
+	buf := make([]byte, 8)
+	for _, shortId := range msg.ShortIds {
+		binary.LittleEndian.PutUint64(buf, shortId)
+		if _, err := w.Write(buf[:shortIdSize]); err != nil {
+			return err
+		}
+	}
+
+	if err := wire.WriteVarInt(w, pver, uint64(len(msg.PrefilledTx))); err != nil {
+		return err
+	}
+	var next uint32
+	for _, prefilled := range msg.PrefilledTx {
+		if prefilled.Index < next {
+			return fmt.Errorf("prefilled transaction indexes are not ascending")
+		}
+		if err := wire.WriteVarInt(w, pver, uint64(prefilled.Index-next)); err != nil {
+			return err
+		}
+		if err := prefilled.Tx.BtcEncode(w, pver, enc); err != nil {
+			return err
+		}
+		next = prefilled.Index + 1
+	}
+	return nil
+}
+
+func (msg *MsgCmpctBlock) Command() string {
+	return CmdCmpctBlock
+}
+
+func (msg *MsgCmpctBlock) MaxPayloadLength(pver uint32) uint32 {
+	return wire.MaxBlockPayload
+}
+
+func (msg *MsgCmpctBlock) BlockHash() chainhash.Hash {
+	return msg.Header.BlockHash()
+}
+
+// MsgGetBlockTxn asks for the transactions at Indexes of a block announced with cmpctblock
+type MsgGetBlockTxn struct {
+	BlockHash chainhash.Hash
+	Indexes   []uint32
+}
+
+func (msg *MsgGetBlockTxn) BtcDecode(r io.Reader, pver uint32, enc wire.MessageEncoding) error {
+	if _, err := io.ReadFull(r, msg.BlockHash[:]); err != nil {
+		return err
+	}
+	count, err := wire.ReadVarInt(r, pver)
+	if err != nil {
+		return err
+	}
+	if count > maxCompactBlockIndex+1 {
+		return fmt.Errorf("too many indexes in getblocktxn: %d", count)
+	}
+	msg.Indexes = make([]uint32, count)
+	_, err = readDifferentialIndexes(r, pver, len(msg.Indexes), func(i int, index uint32) error {
+		msg.Indexes[i] = index
+		return nil
+	})
+	return err
+}
+
+func (msg *MsgGetBlockTxn) BtcEncode(w io.Writer, pver uint32, enc wire.MessageEncoding) error {
+	if _, err := w.Write(msg.BlockHash[:]); err != nil {
+		return err
+	}
+	if err := wire.WriteVarInt(w, pver, uint64(len(msg.Indexes))); err != nil {
+		return err
+	}
+	var next uint32
+	for _, index := range msg.Indexes {
+		if index < next {
+			return fmt.Errorf("getblocktxn indexes are not ascending")
+		}
+		if err := wire.WriteVarInt(w, pver, uint64(index-next)); err != nil {
+			return err
+		}
+		next = index + 1
+	}
+	return nil
+}
+
+func (msg *MsgGetBlockTxn) Command() string {
+	return CmdGetBlockTxn
+}
+
+func (msg *MsgGetBlockTxn) MaxPayloadLength(pver uint32) uint32 {
+	return wire.MaxBlockPayload
+}
+
+// MsgBlockTxn answers a getblocktxn with the requested transactions in order
+type MsgBlockTxn struct {
+	BlockHash    chainhash.Hash
+	Transactions []*wire.MsgTx
+}
+
+func (msg *MsgBlockTxn) BtcDecode(r io.Reader, pver uint32, enc wire.MessageEncoding) error {
+	if _, err := io.ReadFull(r, msg.BlockHash[:]); err != nil {
+		return err
+	}
+	count, err := wire.ReadVarInt(r, pver)
+	if err != nil {
+		return err
+	}
+	if count > maxCompactBlockIndex+1 {
+		return fmt.Errorf("too many transactions in blocktxn: %d", count)
+	}
+	msg.Transactions = make([]*wire.MsgTx, count)
+	for i := range msg.Transactions {
+		tx := &wire.MsgTx{}
+		if err := tx.BtcDecode(r, pver, enc); err != nil {
+			return err
+		}
+		msg.Transactions[i] = tx
+	}
+	return nil
+}
+
+func (msg *MsgBlockTxn) BtcEncode(w io.Writer, pver uint32, enc wire.MessageEncoding) error {
+	if _, err := w.Write(msg.BlockHash[:]); err != nil {
+		return err
+	}
+	if err := wire.WriteVarInt(w, pver, uint64(len(msg.Transactions))); err != nil {
+		return err
+	}
+	for _, tx := range msg.Transactions {
+		if err := tx.BtcEncode(w, pver, enc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (msg *MsgBlockTxn) Command() string {
+	return CmdBlockTxn
+}
+
+func (msg *MsgBlockTxn) MaxPayloadLength(pver uint32) uint32 {
+	return wire.MaxBlockPayload
+}
+
+// Reads count differentially encoded indexes, calling read with the absolute value of each.
+// Returns one past the last index.
+func readDifferentialIndexes(r io.Reader, pver uint32, count int, read func(int, uint32) error) (uint32, error) {
+	var next uint64
+	for i := 0; i < count; i++ {
+		offset, err := wire.ReadVarInt(r, pver)
+		if err != nil {
+			return 0, err
+		}
+		index := next + offset
+		if offset > maxCompactBlockIndex || index > maxCompactBlockIndex {
+			return 0, fmt.Errorf("compact block index %d is out of range", index)
+		}
+		if err := read(i, uint32(index)); err != nil {
+			return 0, err
+		}
+		next = index + 1
+	}
+	return uint32(next), nil
+}
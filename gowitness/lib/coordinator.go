@@ -1,9 +1,9 @@
 package lib
 
 import (
-	"fmt"
 	"github.com/paulbellamy/ratecounter"
 	"log"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -21,8 +21,12 @@ type DatabaseConfig struct {
 	Username      string
 	Password      string
 	Name          string
+	// One of the libpq sslmodes, disable if empty
+	SSLMode       string
 	MaxOpen       int
 	MaxIdle       int
+	// Partitioning and retention of nodehistory
+	History       HistoryConfig
 }
 
 type RedisConfig struct {
@@ -37,6 +41,8 @@ type Coordinator struct {
 	Peers             			 []NodeInfo
 	MaxPeers 	      			 int64
 	PeerCount         		 	 int64
+	// Sessions of peers that connected to us, they do not count towards MaxPeers
+	inboundCount                 int64
 	ExecutionStatus   			 uint32
 	DbConn            		     *PostgresStorage
 	RedisConn         			 *RedisStorage
@@ -46,25 +52,64 @@ type Coordinator struct {
 	VoluntaryDisconnectCounter   *ratecounter.RateCounter
 	AttemptCounter               *ratecounter.RateCounter
 	SkippedDueToInNetworkCounter *ratecounter.RateCounter
+	TxSampler                    *TxSampler
+	MempoolTracker               *MempoolTracker
+	// Looked up when enriching nodes with their network, nil if there is no database
+	ASNDatabase                  ASNDatabase
+	// Nodes are only located if there is one
+	GeoDatabase                  *GeoDatabase
+	GossipTracker                *GossipTracker
+	// Heights peers report, the source of the height we advertise
+	TipTracker                   *TipTracker
+	// Headers announced by peers, served to those asking for them
+	HeaderChain                  *HeaderChain
+	// Handlers of the connected peers, keyed by connstring
+	handlers                     sync.Map
+	// Guards DbConn for the goroutines started before Connect
+	storageMtx                   sync.RWMutex
 	DatabaseConfig
 	RedisConfig
+	BootstrapConfig
+	CaptureConfig
+	TransportConfig
+	HandlerConfig
 }
 
 func (cd *Coordinator) initDatabase() *PostgresStorage {
-	db := MakePostgresStorage(fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
-		cd.DatabaseConfig.Address, 5432, cd.DatabaseConfig.Username, cd.DatabaseConfig.Password, cd.DatabaseConfig.Name))
-
-	err := db.Connect(cd.DatabaseConfig.MaxOpen, cd.DatabaseConfig.MaxIdle)
+	db, err := ConnectPostgres(cd.DatabaseConfig)
 	if err != nil {
-		log.Fatalf(err.Error())
+		log.Fatal(err.Error())
 	}
+	return db
+}
 
-	err = db.Ping()
-	if err != nil {
-		log.Fatalf(err.Error())
+// Establishes the storage connections without starting to crawl
+func (cd *Coordinator) Connect() {
+	// Connect to Postgres
+	db := cd.initDatabase()
+	log.Println("Database connection established.")
+	if err := db.Migrate(); err != nil {
+		log.Fatal(err.Error())
+	}
+	if loaded := cd.TipTracker.Load(db); loaded > 0 {
+		log.Println("Observed tip at height", cd.TipTracker.Observed(), "from", loaded, "recently seen nodes.")
 	}
+	cd.storageMtx.Lock()
+	cd.DbConn = db
+	cd.storageMtx.Unlock()
 
-	return db
+	// Connect to Redis
+	cd.RedisConn = MakeRedisStorage(cd.RedisConfig.RedisUrl, cd.RedisConfig.Password)
+	cd.RedisConn.Connect(cd.RedisConfig.MaxOpen, cd.RedisConfig.MaxIdle)
+	log.Println("Redis connection established.")
+}
+
+// The Postgres storage, nil until Connect established it. Goroutines that may run before Connect,
+// like the API server and the DNS seeder, go through this instead of reading DbConn.
+func (cd *Coordinator) Storage() *PostgresStorage {
+	cd.storageMtx.RLock()
+	defer cd.storageMtx.RUnlock()
+	return cd.DbConn
 }
 
 // Returns true if and only if a change in ExecutionStatus occurred
@@ -74,19 +119,24 @@ func (cd *Coordinator) Run() bool {
 	}
 
 	log.Println("Coordinator started.")
+	cd.Connect()
 
-	// Connect to Postgres
-	cd.DbConn = cd.initDatabase()
-	log.Println("Database connection established.")
-
-	// Connect to Redis
-	cd.RedisConn = MakeRedisStorage(cd.RedisConfig.RedisUrl, cd.RedisConfig.Password)
-	cd.RedisConn.Connect(cd.RedisConfig.MaxOpen, cd.RedisConfig.MaxIdle)
-	log.Println("Redis connection established.")
+	// A fresh deployment has nothing to sample from, so seed the nodes table first
+	if cd.DbConn.CountNodes() == 0 {
+		log.Println("No known nodes, bootstrapping from seeds.")
+		added := Bootstrap(cd.DbConn, cd.BootstrapConfig)
+		log.Println("Bootstrap added", added, "nodes.")
+	}
 
 	nextNodes := cd.DbConn.GetRandomNodes(0.1)
 
 	cd.ExecutionStatus = Running
+	if err := cd.listenInbound(); err != nil {
+		log.Fatal(err.Error())
+	}
+	go cd.runEnrichment(time.Minute)
+	go cd.runNetworkReports()
+	go cd.runHistoryMaintenance()
 
 	for atomic.LoadUint32(&cd.ExecutionStatus) == Running {
 		currentPeerCount := atomic.LoadInt64(&cd.PeerCount)
@@ -99,7 +149,18 @@ func (cd *Coordinator) Run() bool {
 			nextNodes = cd.DbConn.GetRandomNodes(0.1)
 		}
 
+		// The sample comes up empty when the table is small, so fall back to all of the
+		// nodes there, or to the seeds again if there are none at all
+		if len(nextNodes) == 0 {
+			if cd.DbConn.CountNodes() == 0 {
+				Bootstrap(cd.DbConn, cd.BootstrapConfig)
+			} else {
+				nextNodes = cd.DbConn.GetRandomNodes(100)
+			}
+		}
+
 		if len(nextNodes) == 0 {
+			time.Sleep(time.Second * 15)
 			continue
 		}
 
@@ -110,12 +171,60 @@ func (cd *Coordinator) Run() bool {
 			continue
 		}
 
-		handler := MakeBitcoinHandler(randomNode, cd.DbConn, cd.RedisConn)
+		handler := MakeBitcoinHandler(randomNode, cd.DbConn, cd.RedisConn, cd.HandlerConfig)
 		go handler.Run(cd)
 	}
 	return true
 }
 
+// Outcome of a single pass over the known nodes
+type CrawlSummary struct {
+	Nodes     int
+	Skipped   int
+	Connected int
+	Failed    int
+	Duration  time.Duration
+}
+
+// Connects to every node in nodes once, at most MaxPeers at a time, and returns when all
+// sessions ended. Sessions are bounded by the Lifetime of the handler config.
+func (cd *Coordinator) CrawlOnce(nodes []NodeInfo) CrawlSummary {
+	started := time.Now()
+	summary := CrawlSummary{Nodes: len(nodes)}
+	var mtx sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, cd.MaxPeers)
+
+	for i := range nodes {
+		if cd.RedisConn.CheckActiveTag(nil, nodes[i].ConnString) {
+			cd.SkippedDueToInNetworkCounter.Incr(1)
+			summary.Skipped++
+			continue
+		}
+
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(node *NodeInfo) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			err := MakeBitcoinHandler(node, cd.DbConn, cd.RedisConn, cd.HandlerConfig).Run(cd)
+			mtx.Lock()
+			if err != nil {
+				summary.Failed++
+			} else {
+				summary.Connected++
+			}
+			mtx.Unlock()
+		}(&nodes[i])
+	}
+	wg.Wait()
+
+	summary.Duration = time.Since(started)
+	return summary
+}
+
 func (cd *Coordinator) Status() uint32 {
 	return atomic.LoadUint32(&cd.ExecutionStatus)
 }
@@ -179,7 +288,16 @@ func (cd *Coordinator) Stop() bool {
 	return true
 }
 
-func MakeCoordinator(name string, maxPeers int64, database DatabaseConfig, redisConfig RedisConfig) *Coordinator {
+func MakeCoordinator(name string, maxPeers int64, database DatabaseConfig, redisConfig RedisConfig,
+	bootstrapConfig BootstrapConfig, captureConfig CaptureConfig, txSampler *TxSampler, mempoolConfig MempoolConfig,
+	transportConfig TransportConfig, handlerConfig HandlerConfig, asnDatabase ASNDatabase,
+	geoDatabase *GeoDatabase) *Coordinator {
+	tipTracker := MakeTipTracker(handlerConfig.Tip)
+	handlerConfig.NewestBlock = tipTracker.NewestBlock
+	if handlerConfig.Responder.GetAddrSize > 0 {
+		getAddr := makeSampleAddrPolicy(handlerConfig.Responder.GetAddrSize, handlerConfig.Responder.GetAddrMaxAge)
+		handlerConfig.Responder.getAddr = &getAddr
+	}
 	return &Coordinator{
 		ExecutionStatus: Stopped,
 		CoordinatorName: name,
@@ -187,6 +305,10 @@ func MakeCoordinator(name string, maxPeers int64, database DatabaseConfig, redis
 		Peers: make([]NodeInfo, 0),
 		DatabaseConfig: database,
 		RedisConfig: redisConfig,
+		BootstrapConfig: bootstrapConfig,
+		CaptureConfig: captureConfig,
+		TransportConfig: transportConfig,
+		HandlerConfig: handlerConfig,
 		PeerCount: 0,
 		DbConn: nil,
 		RedisConn: nil,
@@ -195,6 +317,13 @@ func MakeCoordinator(name string, maxPeers int64, database DatabaseConfig, redis
 		SuccessCounter: ratecounter.NewRateCounter(time.Minute),
 		VoluntaryDisconnectCounter: ratecounter.NewRateCounter(time.Minute),
 		SkippedDueToInNetworkCounter: ratecounter.NewRateCounter(time.Minute),
+		TxSampler: txSampler,
+		MempoolTracker: MakeMempoolTracker(mempoolConfig),
+		ASNDatabase: asnDatabase,
+		GeoDatabase: geoDatabase,
+		GossipTracker: MakeGossipTracker(),
+		TipTracker: tipTracker,
+		HeaderChain: MakeHeaderChain(handlerConfig.ChainParams),
 		Guard: nil,
 	}
 }
\ No newline at end of file
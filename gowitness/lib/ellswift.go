@@ -0,0 +1,240 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"errors"
+	"github.com/btcsuite/btcd/btcec"
+	"io"
+	"math/big"
+)
+
+// ElligatorSwift encoding of secp256k1 public keys and the x-only ECDH built on it, as used by
+// the BIP324 handshake. Speed does not matter here since it runs once per connection, so the
+// field arithmetic is plain math/big.
+
+const ellSwiftSize = 64
+
+var (
+	fieldP     = btcec.S256().P
+	fieldSeven = big.NewInt(7)
+	// A square root of -3, which one does not matter for the encoding
+	fieldMinus3Sqrt, _ = fieldSqrt(new(big.Int).Sub(fieldP, big.NewInt(3)))
+	fieldSqrtExponent  = new(big.Int).Rsh(new(big.Int).Add(fieldP, big.NewInt(1)), 2)
+	fieldHalf          = new(big.Int).ModInverse(big.NewInt(2), fieldP)
+)
+
+func fieldMod(a *big.Int) *big.Int {
+	return a.Mod(a, fieldP)
+}
+
+func fieldAdd(a, b *big.Int) *big.Int {
+	return fieldMod(new(big.Int).Add(a, b))
+}
+
+func fieldSub(a, b *big.Int) *big.Int {
+	return fieldMod(new(big.Int).Sub(a, b))
+}
+
+func fieldMul(a, b *big.Int) *big.Int {
+	return fieldMod(new(big.Int).Mul(a, b))
+}
+
+func fieldNeg(a *big.Int) *big.Int {
+	return fieldMod(new(big.Int).Neg(a))
+}
+
+// Division by zero yields zero, callers rule it out beforehand
+func fieldDiv(a, b *big.Int) *big.Int {
+	inverse := new(big.Int).ModInverse(b, fieldP)
+	if inverse == nil {
+		return new(big.Int)
+	}
+	return fieldMul(a, inverse)
+}
+
+// Returns a square root of a if there is one, p is 3 mod 4 so it is a^((p+1)/4)
+func fieldSqrt(a *big.Int) (*big.Int, bool) {
+	root := new(big.Int).Exp(a, fieldSqrtExponent, fieldP)
+	if fieldMul(root, root).Cmp(fieldMod(new(big.Int).Set(a))) != 0 {
+		return nil, false
+	}
+	return root, true
+}
+
+// x^3 + 7
+func curveRhs(x *big.Int) *big.Int {
+	return fieldAdd(fieldMul(fieldMul(x, x), x), fieldSeven)
+}
+
+func isValidX(x *big.Int) bool {
+	_, ok := fieldSqrt(curveRhs(x))
+	return ok
+}
+
+// Decodes the field elements (u, t) into the x coordinate of a point on the curve
+func xSwiftEC(u, t *big.Int) *big.Int {
+	u, t = new(big.Int).Set(u), new(big.Int).Set(t)
+	if u.Sign() == 0 {
+		u.SetInt64(1)
+	}
+	if t.Sign() == 0 {
+		t.SetInt64(1)
+	}
+	u3Plus7 := curveRhs(u)
+	if fieldAdd(u3Plus7, fieldMul(t, t)).Sign() == 0 {
+		t = fieldAdd(t, t)
+	}
+
+	x := fieldDiv(fieldSub(u3Plus7, fieldMul(t, t)), fieldAdd(t, t))
+	y := fieldDiv(fieldAdd(x, t), fieldMul(fieldMinus3Sqrt, u))
+	candidates := []*big.Int{
+		fieldAdd(u, fieldMul(big.NewInt(4), fieldMul(y, y))),
+		fieldMul(fieldSub(fieldNeg(fieldDiv(x, y)), u), fieldHalf),
+		fieldMul(fieldSub(fieldDiv(x, y), u), fieldHalf),
+	}
+	for _, candidate := range candidates {
+		if isValidX(candidate) {
+			return candidate
+		}
+	}
+	// One of the candidates is always on the curve
+	panic("xSwiftEC found no point on the curve")
+}
+
+// Finds t such that xSwiftEC(u, t) = x, c selects which of up to eight solutions to return.
+// Returns nil if there is none for this c.
+func xSwiftECInv(x, u *big.Int, c int) *big.Int {
+	var s, v *big.Int
+	if c&2 == 0 {
+		if isValidX(fieldSub(fieldNeg(x), u)) {
+			return nil
+		}
+		v = x
+		denominator := fieldAdd(fieldAdd(fieldMul(u, u), fieldMul(u, v)), fieldMul(v, v))
+		if denominator.Sign() == 0 {
+			return nil
+		}
+		s = fieldNeg(fieldDiv(curveRhs(u), denominator))
+	} else {
+		s = fieldSub(x, u)
+		if s.Sign() == 0 {
+			return nil
+		}
+		inner := fieldAdd(fieldMul(big.NewInt(4), curveRhs(u)), fieldMul(fieldMul(big.NewInt(3), s), fieldMul(u, u)))
+		r, ok := fieldSqrt(fieldNeg(fieldMul(s, inner)))
+		if !ok {
+			return nil
+		}
+		// With r = 0 the odd case would duplicate the even one
+		if c&1 != 0 && r.Sign() == 0 {
+			return nil
+		}
+		v = fieldMul(fieldAdd(fieldNeg(u), fieldDiv(r, s)), fieldHalf)
+	}
+
+	w, ok := fieldSqrt(s)
+	if !ok {
+		return nil
+	}
+	oneMinus := fieldMul(fieldSub(big.NewInt(1), fieldMinus3Sqrt), fieldHalf)
+	onePlus := fieldMul(fieldAdd(big.NewInt(1), fieldMinus3Sqrt), fieldHalf)
+	switch c & 5 {
+	case 0:
+		return fieldNeg(fieldMul(w, fieldAdd(fieldMul(u, oneMinus), v)))
+	case 1:
+		return fieldMul(w, fieldAdd(fieldMul(u, onePlus), v))
+	case 4:
+		return fieldMul(w, fieldAdd(fieldMul(u, oneMinus), v))
+	default:
+		return fieldNeg(fieldMul(w, fieldAdd(fieldMul(u, onePlus), v)))
+	}
+}
+
+func fieldBytes(a *big.Int) []byte {
+	buf := make([]byte, 32)
+	b := a.Bytes()
+	copy(buf[32-len(b):], b)
+	return buf
+}
+
+// Encodes the x coordinate x into 64 bytes that are indistinguishable from random
+func ellSwiftEncode(x *big.Int, random io.Reader) ([]byte, error) {
+	buf := make([]byte, 33)
+	for {
+		if _, err := io.ReadFull(random, buf); err != nil {
+			return nil, err
+		}
+		u := fieldMod(new(big.Int).SetBytes(buf[:32]))
+		if u.Sign() == 0 {
+			continue
+		}
+		t := xSwiftECInv(x, u, int(buf[32]&7))
+		// Guards against the cases above that do not decode back to x
+		if t == nil || xSwiftEC(u, t).Cmp(x) != 0 {
+			continue
+		}
+		return append(fieldBytes(u), fieldBytes(t)...), nil
+	}
+}
+
+func ellSwiftDecode(encoded []byte) *big.Int {
+	u := fieldMod(new(big.Int).SetBytes(encoded[:32]))
+	t := fieldMod(new(big.Int).SetBytes(encoded[32:64]))
+	return xSwiftEC(u, t)
+}
+
+// An ephemeral key for a single handshake
+type ellSwiftKey struct {
+	private []byte
+	encoded []byte
+}
+
+func newEllSwiftKey(random io.Reader) (*ellSwiftKey, error) {
+	curve := btcec.S256()
+	private := make([]byte, 32)
+	for {
+		if _, err := io.ReadFull(random, private); err != nil {
+			return nil, err
+		}
+		scalar := new(big.Int).SetBytes(private)
+		if scalar.Sign() != 0 && scalar.Cmp(curve.N) < 0 {
+			break
+		}
+	}
+
+	x, _ := curve.ScalarBaseMult(private)
+	encoded, err := ellSwiftEncode(x, random)
+	if err != nil {
+		return nil, err
+	}
+	return &ellSwiftKey{private: private, encoded: encoded}, nil
+}
+
+func taggedHash(tag string, data ...[]byte) []byte {
+	tagHash := sha256.Sum256([]byte(tag))
+	hash := sha256.New()
+	hash.Write(tagHash[:])
+	hash.Write(tagHash[:])
+	for _, d := range data {
+		hash.Write(d)
+	}
+	return hash.Sum(nil)
+}
+
+// Computes the BIP324 shared secret between our key and the encoding the other side sent
+func (key *ellSwiftKey) sharedSecret(theirs []byte, initiator bool) ([]byte, error) {
+	if len(theirs) != ellSwiftSize {
+		return nil, errors.New("invalid ElligatorSwift encoding length")
+	}
+
+	// Either of the two points with this x works, the result only depends on x
+	x := ellSwiftDecode(theirs)
+	y, _ := fieldSqrt(curveRhs(x))
+	sharedX, _ := btcec.S256().ScalarMult(x, y, key.private)
+
+	initiatorEncoded, responderEncoded := key.encoded, theirs
+	if !initiator {
+		initiatorEncoded, responderEncoded = theirs, key.encoded
+	}
+	return taggedHash("bip324_ellswift_xonly_ecdh", initiatorEncoded, responderEncoded, fieldBytes(sharedX)), nil
+}
@@ -0,0 +1,90 @@
+package lib
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Percentiles reported for the fee floors of the network
+var feeFilterPercentiles = []int{10, 25, 50, 75, 90}
+
+type FeeFilterBucket struct {
+	MinFee int64
+	Nodes  int
+}
+
+type FeeFilterSummary struct {
+	Nodes  int
+	Median int64
+}
+
+// Distribution of the latest feefilter of each node, fees are in satoshis per 1000 virtual bytes
+type FeeFilterDistribution struct {
+	Since       time.Time
+	Nodes       int
+	Percentiles map[string]int64
+	// One bucket per distinct value, nodes round their feefilter so there are few of them
+	Histogram []FeeFilterBucket
+	// Keyed by the first component of the user agent, see UserAgent.Base
+	Implementations map[string]FeeFilterSummary
+}
+
+// Value at the given percentile of sorted values by the nearest-rank method
+func percentile(sorted []int64, p int) int64 {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// Summarizes the feefilters nodes sent us within the window
+func GetFeeFilterDistribution(db *PostgresStorage, window time.Duration) *FeeFilterDistribution {
+	since := time.Now().Add(-window)
+	filters := db.GetLatestFeeFilters(since)
+	if filters == nil {
+		return nil
+	}
+
+	distribution := FeeFilterDistribution{
+		Since:           since,
+		Nodes:           len(filters),
+		Percentiles:     make(map[string]int64),
+		Histogram:       make([]FeeFilterBucket, 0),
+		Implementations: make(map[string]FeeFilterSummary),
+	}
+
+	fees := make([]int64, 0, len(filters))
+	byImplementation := make(map[string][]int64)
+	for _, filter := range filters {
+		fees = append(fees, filter.MinFee)
+		implementation := ParseUserAgent(filter.Version).Base()
+		byImplementation[implementation] = append(byImplementation[implementation], filter.MinFee)
+	}
+	if len(fees) == 0 {
+		return &distribution
+	}
+
+	sort.Slice(fees, func(i, j int) bool { return fees[i] < fees[j] })
+	for _, p := range feeFilterPercentiles {
+		distribution.Percentiles[fmt.Sprintf("p%d", p)] = percentile(fees, p)
+	}
+	for _, fee := range fees {
+		last := len(distribution.Histogram) - 1
+		if last >= 0 && distribution.Histogram[last].MinFee == fee {
+			distribution.Histogram[last].Nodes++
+		} else {
+			distribution.Histogram = append(distribution.Histogram, FeeFilterBucket{MinFee: fee, Nodes: 1})
+		}
+	}
+	for implementation, implementationFees := range byImplementation {
+		sort.Slice(implementationFees, func(i, j int) bool { return implementationFees[i] < implementationFees[j] })
+		distribution.Implementations[implementation] = FeeFilterSummary{
+			Nodes:  len(implementationFees),
+			Median: percentile(implementationFees, 50),
+		}
+	}
+
+	return &distribution
+}
@@ -0,0 +1,665 @@
+package lib
+
+import "github.com/btcsuite/btcd/wire"
+
+// fixedSeeds bootstrap a fresh deployment when the DNS seeds of its chain are unreachable, the
+// way the fixed seeds compiled into Bitcoin Core do. They are the IPv4 and IPv6 nodes of
+// contrib/seeds/nodes_main.txt of Bitcoin Core v0.21.0, its onion nodes left out as we do not
+// connect to Tor. The testnet seeds of that release are all onions, so testnet3 has none.
+var fixedSeeds = map[wire.BitcoinNet][]string{
+	wire.MainNet: {
+		"2.39.173.126:8333",
+		"3.14.168.201:48333",
+		"4.36.112.44:8333",
+		"5.8.18.31:8333",
+		"5.14.200.167:8333",
+		"5.56.20.2:8333",
+		"5.102.146.99:8333",
+		"5.103.137.146:9333",
+		"5.128.87.126:8333",
+		"5.133.65.82:8333",
+		"5.187.55.242:8333",
+		"5.188.62.24:8333",
+		"5.188.62.33:8333",
+		"5.199.133.193:8333",
+		"8.38.89.152:8333",
+		"13.231.20.249:8333",
+		"18.27.79.17:8333",
+		"20.184.15.116:8433",
+		"23.28.205.97:8333",
+		"23.106.252.230:8333",
+		"23.175.0.202:8333",
+		"23.175.0.212:8333",
+		"23.241.250.252:8333",
+		"23.245.24.154:8333",
+		"24.86.184.66:8333",
+		"24.116.246.9:8333",
+		"24.141.34.166:8333",
+		"24.155.196.246:8333",
+		"24.157.130.222:8333",
+		"24.188.176.255:8333",
+		"24.237.70.53:8333",
+		"27.124.4.67:8333",
+		"31.17.70.80:8333",
+		"31.21.8.32:8333",
+		"31.45.118.10:8333",
+		"31.132.17.56:8333",
+		"31.134.121.223:8333",
+		"32.214.183.114:8333",
+		"35.137.236.32:8333",
+		"35.185.145.105:8333",
+		"35.209.51.212:8333",
+		"35.245.175.76:8333",
+		"37.116.95.41:8333",
+		"37.143.9.107:8333",
+		"37.143.116.43:8333",
+		"37.191.244.149:8333",
+		"37.211.78.253:8333",
+		"37.221.209.222:24333",
+		"37.228.92.110:8333",
+		"43.225.62.107:8333",
+		"43.225.157.152:8333",
+		"45.36.184.6:8333",
+		"45.48.168.16:8333",
+		"45.85.85.8:8333",
+		"45.85.85.9:8333",
+		"45.129.180.214:8333",
+		"45.149.78.128:8333",
+		"45.151.125.218:8333",
+		"45.154.255.46:8333",
+		"45.155.157.239:8333",
+		"46.28.132.34:8333",
+		"46.28.204.21:8333",
+		"46.32.50.98:8333",
+		"46.59.13.35:8333",
+		"46.128.40.173:8333",
+		"46.128.140.193:8333",
+		"46.146.248.89:8333",
+		"46.166.162.45:20001",
+		"46.188.15.6:8333",
+		"46.229.165.142:8333",
+		"46.229.238.187:8333",
+		"46.249.83.82:8333",
+		"46.254.217.169:8333",
+		"47.74.191.34:8333",
+		"47.115.53.163:8333",
+		"47.187.26.135:8333",
+		"47.222.103.234:8333",
+		"47.253.5.99:8333",
+		"49.232.82.76:8333",
+		"49.247.215.43:8333",
+		"50.2.13.166:8333",
+		"50.34.39.72:8333",
+		"50.45.232.189:8333",
+		"50.68.104.92:8333",
+		"51.68.36.57:8333",
+		"51.154.60.34:8333",
+		"52.169.238.66:8333",
+		"54.197.30.223:8333",
+		"54.227.66.57:8333",
+		"58.158.0.86:8333",
+		"58.171.135.242:8333",
+		"58.229.208.158:8333",
+		"60.244.109.19:8333",
+		"62.38.75.208:8333",
+		"62.74.143.11:8333",
+		"62.80.227.49:8333",
+		"62.152.58.16:9421",
+		"62.210.167.199:8333",
+		"62.234.188.160:8333",
+		"62.251.54.163:8333",
+		"63.227.116.162:8333",
+		"65.19.155.82:8333",
+		"65.95.49.102:8333",
+		"66.18.172.21:8333",
+		"66.240.237.155:8333",
+		"67.210.228.203:8333",
+		"69.30.215.42:8333",
+		"69.59.18.206:8333",
+		"69.64.33.71:8333",
+		"69.119.193.9:8333",
+		"69.209.23.72:8333",
+		"70.123.125.237:8333",
+		"70.185.56.136:8333",
+		"71.38.90.235:8333",
+		"72.12.73.70:8333",
+		"72.53.134.182:8333",
+		"72.225.7.80:8333",
+		"72.234.182.39:8333",
+		"72.250.184.57:8333",
+		"73.83.103.79:8333",
+		"74.118.137.119:8333",
+		"74.133.100.74:8333",
+		"74.215.219.214:8333",
+		"74.220.255.190:8333",
+		"75.158.39.231:8333",
+		"77.53.53.196:8333",
+		"77.70.16.245:8333",
+		"77.105.87.97:8333",
+		"77.120.113.69:8433",
+		"77.120.122.22:8433",
+		"77.166.83.167:8333",
+		"77.247.178.130:8333",
+		"78.27.139.13:8333",
+		"78.63.28.146:8333",
+		"78.83.103.4:8333",
+		"78.141.123.99:8333",
+		"79.77.33.131:8333",
+		"79.77.133.30:8333",
+		"79.101.1.25:8333",
+		"79.117.192.229:8333",
+		"79.133.228.55:8333",
+		"79.146.21.163:8333",
+		"80.89.203.172:8001",
+		"80.93.213.246:8333",
+		"80.192.98.110:8334",
+		"80.229.28.60:8333",
+		"80.232.247.210:8333",
+		"80.242.39.76:8333",
+		"80.253.94.252:8333",
+		"81.0.198.25:8333",
+		"81.7.13.84:8333",
+		"81.117.225.245:8333",
+		"81.135.137.225:8333",
+		"81.171.22.143:8333",
+		"81.191.233.134:8333",
+		"81.232.78.75:8333",
+		"81.242.91.23:8333",
+		"82.29.58.109:8333",
+		"82.136.99.22:8333",
+		"82.149.97.25:17567",
+		"82.165.19.48:8333",
+		"82.194.153.233:8333",
+		"82.197.215.125:8333",
+		"82.199.102.10:8333",
+		"82.200.205.30:8333",
+		"82.202.68.231:8333",
+		"82.221.128.31:8333",
+		"82.228.6.131:8333",
+		"83.85.139.94:8333",
+		"83.99.245.20:8333",
+		"83.137.41.10:8333",
+		"83.174.209.87:8333",
+		"83.217.8.31:44420",
+		"84.38.3.249:8333",
+		"84.38.185.122:8333",
+		"84.92.92.247:8333",
+		"84.192.16.234:8333",
+		"84.194.158.124:8333",
+		"84.212.145.24:8333",
+		"84.212.244.95:8333",
+		"84.216.51.36:8333",
+		"84.255.249.163:8333",
+		"85.25.255.147:8333",
+		"85.70.156.209:8333",
+		"85.145.142.46:8333",
+		"85.170.233.95:8333",
+		"85.184.138.108:8333",
+		"85.190.0.5:8333",
+		"85.191.200.51:8333",
+		"85.192.191.6:18500",
+		"85.194.238.131:8333",
+		"85.195.54.110:8333",
+		"85.214.161.252:8333",
+		"85.214.185.51:8333",
+		"85.241.106.203:8333",
+		"85.246.168.252:8333",
+		"86.56.238.247:8333",
+		"87.61.90.230:8333",
+		"87.79.68.86:8333",
+		"87.79.94.221:8333",
+		"87.120.8.5:20008",
+		"87.246.46.132:8333",
+		"87.247.111.222:8333",
+		"88.84.222.252:8333",
+		"88.86.243.241:8333",
+		"88.87.93.52:1691",
+		"88.119.197.200:8333",
+		"88.129.253.94:8333",
+		"88.147.244.250:8333",
+		"88.208.3.195:8333",
+		"88.212.44.33:8333",
+		"88.214.57.95:8333",
+		"89.106.199.38:8333",
+		"89.108.126.228:8333",
+		"89.115.120.43:8333",
+		"89.133.68.65:8333",
+		"89.190.19.162:8333",
+		"89.248.172.10:8333",
+		"90.146.153.21:8333",
+		"90.182.165.18:8333",
+		"91.106.188.229:8333",
+		"91.193.237.116:8333",
+		"91.204.99.178:8333",
+		"91.204.149.5:8333",
+		"91.214.70.63:8333",
+		"91.228.152.236:8333",
+		"92.12.154.115:8333",
+		"92.249.143.44:8333",
+		"93.12.66.98:8333",
+		"93.46.54.4:8333",
+		"93.115.20.130:8333",
+		"93.123.180.164:8333",
+		"93.189.145.169:8333",
+		"93.241.228.102:8333",
+		"94.19.7.55:8333",
+		"94.19.128.204:8333",
+		"94.52.112.227:8333",
+		"94.154.96.130:8333",
+		"94.156.174.201:8333",
+		"94.158.246.183:8333",
+		"94.177.171.73:8333",
+		"94.199.178.233:8100",
+		"94.237.125.30:8333",
+		"94.247.134.77:8333",
+		"95.48.228.45:8333",
+		"95.69.249.63:8333",
+		"95.82.146.70:8333",
+		"95.83.73.31:8333",
+		"95.84.164.43:8333",
+		"95.87.226.56:8333",
+		"95.110.234.93:8333",
+		"95.163.71.126:8333",
+		"95.164.65.194:8333",
+		"95.174.66.211:8333",
+		"95.211.174.137:8333",
+		"95.216.11.156:8433",
+		"96.47.114.108:8333",
+		"97.84.232.105:8333",
+		"97.99.205.241:8333",
+		"98.25.193.114:8333",
+		"99.115.25.13:8333",
+		"101.32.19.184:8333",
+		"101.100.174.240:8333",
+		"102.132.245.16:8333",
+		"103.14.244.190:8333",
+		"103.76.48.5:8333",
+		"103.84.84.250:8335",
+		"103.99.168.150:8333",
+		"103.109.101.216:8333",
+		"103.122.247.102:8333",
+		"103.129.13.45:8333",
+		"103.198.192.14:20008",
+		"103.224.119.99:8333",
+		"103.231.191.7:8333",
+		"103.235.230.196:8333",
+		"104.171.242.155:8333",
+		"104.238.220.199:8333",
+		"106.163.158.127:8333",
+		"107.150.41.179:8333",
+		"107.159.93.103:8333",
+		"108.183.77.12:8333",
+		"109.9.175.65:8333",
+		"109.99.63.159:8333",
+		"109.110.81.90:8333",
+		"109.123.213.130:8333",
+		"109.134.232.81:8333",
+		"109.169.20.168:8333",
+		"109.199.241.148:8333",
+		"109.229.210.6:8333",
+		"109.236.105.40:8333",
+		"109.248.206.13:8333",
+		"111.42.74.65:8333",
+		"111.90.140.179:8333",
+		"112.215.205.236:8333",
+		"113.52.135.125:8333",
+		"114.23.246.137:8333",
+		"115.47.141.250:8885",
+		"115.70.110.4:8333",
+		"116.34.189.55:8333",
+		"118.103.126.140:28333",
+		"118.189.187.219:8333",
+		"119.3.208.236:8333",
+		"119.8.47.225:8333",
+		"119.17.151.61:8333",
+		"120.25.24.30:8333",
+		"120.241.34.10:8333",
+		"121.98.205.100:8333",
+		"122.112.148.153:8339",
+		"122.116.42.140:8333",
+		"124.217.235.180:8333",
+		"125.236.215.133:8333",
+		"129.13.189.212:8333",
+		"130.185.77.105:8333",
+		"131.188.40.191:8333",
+		"131.193.220.15:8333",
+		"135.23.124.239:8333",
+		"136.33.185.32:8333",
+		"136.56.170.96:8333",
+		"137.226.34.46:8333",
+		"138.229.26.42:8333",
+		"139.9.249.234:8333",
+		"141.101.8.36:8333",
+		"143.176.224.104:8333",
+		"144.2.69.224:8333",
+		"144.34.161.65:18333",
+		"144.91.116.44:8333",
+		"144.137.29.181:8333",
+		"148.66.50.50:8335",
+		"148.72.150.231:8333",
+		"148.170.212.44:8333",
+		"149.167.99.190:8333",
+		"154.92.16.191:8333",
+		"154.221.27.21:8333",
+		"156.19.19.90:8333",
+		"156.241.5.190:8333",
+		"157.13.61.76:8333",
+		"157.13.61.80:8333",
+		"157.230.166.98:14391",
+		"158.75.203.2:8333",
+		"158.181.125.150:8333",
+		"158.181.226.33:8333",
+		"159.100.242.254:8333",
+		"159.100.248.234:8333",
+		"159.138.87.18:8333",
+		"160.16.0.30:8333",
+		"162.0.227.54:8333",
+		"162.0.227.56:8333",
+		"162.62.18.226:8333",
+		"162.209.1.233:8333",
+		"162.243.175.86:8333",
+		"162.244.80.208:8333",
+		"162.250.188.87:8333",
+		"162.250.189.53:8333",
+		"163.158.202.112:8333",
+		"163.158.243.230:8333",
+		"165.73.62.31:8333",
+		"166.62.82.103:32771",
+		"166.70.94.106:8333",
+		"167.86.90.239:8333",
+		"169.44.34.203:8333",
+		"172.93.101.73:8333",
+		"172.105.7.47:8333",
+		"173.23.103.30:8000",
+		"173.53.79.6:8333",
+		"173.70.12.86:8333",
+		"173.89.28.137:8333",
+		"173.176.184.54:8333",
+		"173.208.128.10:8333",
+		"173.254.204.69:8333",
+		"173.255.204.124:8333",
+		"174.94.155.224:8333",
+		"174.114.102.41:8333",
+		"174.114.124.12:8333",
+		"176.10.227.59:8333",
+		"176.31.224.214:8333",
+		"176.74.136.237:8333",
+		"176.99.2.207:8333",
+		"176.106.191.2:8333",
+		"176.160.228.9:8333",
+		"176.191.182.3:8333",
+		"176.212.185.153:8333",
+		"176.241.137.183:8333",
+		"177.38.215.73:8333",
+		"178.16.222.146:8333",
+		"178.132.2.246:8333",
+		"178.143.191.171:8333",
+		"178.148.172.209:8333",
+		"178.148.226.180:8333",
+		"178.150.96.46:8333",
+		"178.182.227.50:8333",
+		"178.236.137.63:8333",
+		"178.255.42.126:8333",
+		"180.150.52.37:8333",
+		"181.39.32.99:8333",
+		"181.48.77.26:8333",
+		"181.52.223.52:8333",
+		"181.238.51.152:8333",
+		"183.88.223.208:8333",
+		"183.110.220.210:30301",
+		"184.95.58.166:8336",
+		"184.164.147.82:41333",
+		"184.171.208.109:8333",
+		"185.25.48.39:8333",
+		"185.25.48.184:8333",
+		"185.64.116.15:8333",
+		"185.80.219.132:8333",
+		"185.85.3.140:8333",
+		"185.95.219.53:8333",
+		"185.108.244.41:8333",
+		"185.134.233.121:8333",
+		"185.145.128.21:8333",
+		"185.148.3.227:8333",
+		"185.153.196.240:8333",
+		"185.158.114.184:8333",
+		"185.165.168.196:8333",
+		"185.181.230.74:8333",
+		"185.185.26.141:8111",
+		"185.186.208.162:8333",
+		"185.189.132.178:57780",
+		"185.211.59.50:8333",
+		"185.233.148.146:8333",
+		"185.238.129.113:8333",
+		"185.249.199.106:8333",
+		"185.251.161.54:8333",
+		"187.189.153.136:8333",
+		"188.37.24.190:8333",
+		"188.42.40.234:18333",
+		"188.61.46.36:8333",
+		"188.68.45.143:8333",
+		"188.127.229.105:8333",
+		"188.134.6.84:8333",
+		"188.134.8.36:8333",
+		"188.214.129.65:20012",
+		"188.230.168.114:8333",
+		"189.34.14.93:8333",
+		"189.207.46.32:8333",
+		"190.211.204.68:8333",
+		"191.209.21.188:8333",
+		"192.3.11.20:8333",
+		"192.3.185.210:8333",
+		"192.65.170.15:8333",
+		"192.65.170.50:8333",
+		"192.146.137.18:8333",
+		"192.157.202.178:8333",
+		"192.227.80.83:8333",
+		"193.10.203.23:8334",
+		"193.25.6.206:8333",
+		"193.42.110.30:8333",
+		"193.58.196.212:8333",
+		"193.106.28.8:8333",
+		"193.189.190.123:8333",
+		"193.194.163.35:8333",
+		"193.194.163.53:8333",
+		"194.14.246.205:8333",
+		"194.36.91.253:8333",
+		"194.126.113.135:8333",
+		"194.135.135.69:8333",
+		"195.56.63.4:8333",
+		"195.56.63.5:8333",
+		"195.67.139.54:8333",
+		"195.135.194.8:8333",
+		"195.202.169.149:8333",
+		"195.206.105.42:8333",
+		"195.209.249.164:8333",
+		"198.1.231.6:8333",
+		"198.200.43.215:8333",
+		"199.182.184.204:8333",
+		"199.247.7.208:8333",
+		"199.247.249.188:8333",
+		"200.7.252.118:8333",
+		"200.20.186.254:8333",
+		"200.83.166.136:8333",
+		"202.55.87.45:8333",
+		"202.79.167.65:8333",
+		"202.108.211.135:8333",
+		"202.169.102.73:8333",
+		"203.130.48.117:8885",
+		"203.132.95.10:8333",
+		"203.151.166.123:8333",
+		"204.93.113.108:8333",
+		"204.111.241.195:8333",
+		"206.124.149.66:8333",
+		"207.115.102.98:8333",
+		"207.229.46.150:8333",
+		"208.76.252.198:8333",
+		"208.100.13.56:8333",
+		"208.100.178.175:8333",
+		"208.110.99.105:8333",
+		"209.6.210.179:8333",
+		"209.133.220.74:8333",
+		"209.141.57.57:8333",
+		"211.27.147.67:8333",
+		"212.34.225.118:8333",
+		"212.89.173.216:8333",
+		"212.99.226.36:9020",
+		"212.237.96.98:8333",
+		"213.89.131.53:8333",
+		"216.38.129.164:8333",
+		"216.134.165.55:8333",
+		"216.146.251.8:8333",
+		"216.189.190.95:8333",
+		"216.226.128.189:8333",
+		"216.236.164.82:8333",
+		"217.19.216.210:8333",
+		"217.26.32.10:8333",
+		"217.64.47.138:8333",
+		"217.64.133.220:8333",
+		"217.92.55.246:8333",
+		"218.31.113.245:8333",
+		"218.255.242.114:8333",
+		"220.133.39.61:8333",
+		"223.16.30.175:8333",
+		"[2001:19f0:6001:306f:ec4:7aff:fe8f:66ec]:8333",
+		"[2001:1bc0:cc::a001]:8333",
+		"[2001:1c02:2f18:d00:b62e:99ff:fe49:d492]:8333",
+		"[2001:4100:0:64::93]:8333",
+		"[2001:4100:0:64:dcaf:afff:fe00:6707]:8333",
+		"[2001:470:a:c13::2]:8333",
+		"[2001:4801:7819:74:b745:b9d5:ff10:a61a]:8333",
+		"[2001:4ba0:fffa:5d::93]:8333",
+		"[2001:610:1908:ff01:f816:3eff:fe33:2e32]:8333",
+		"[2001:638:a000:4140::ffff:191]:8333",
+		"[2001:648:2800:131:4b1f:f6fc:20f7:f99f]:8333",
+		"[2001:678:7dc:8::2]:8333",
+		"[2001:678:cc8::1:10:88]:20008",
+		"[2001:67c:1220:80c::93e5:dd2]:8333",
+		"[2001:67c:1220:80c:e5dc:ad0c:9289:c28f]:8333",
+		"[2001:67c:16dc:1201:5054:ff:fe17:4dac]:8333",
+		"[2001:67c:2354:2::22]:8333",
+		"[2001:67c:26b4:12:7ae3:b5ff:fe04:6f9c]:8333",
+		"[2001:67c:2f0::20:fa]:8333",
+		"[2001:718:801:311:5054:ff:fe19:c483]:8333",
+		"[2001:8d8:87c:7c00::99:3c1]:8333",
+		"[2001:8f1:1404:3700:8e49:715a:2e09:b634]:9444",
+		"[2001:b07:5d29:99a5:194b:3874:d65e:a90d]:8333",
+		"[2001:ba8:1f1:f0fe::2]:8333",
+		"[2001:bc8:1200:0:dac4:97ff:fe2a:3554]:20008",
+		"[2001:da8:100d:22:10fa:d85f:10f2:21fd]:8333",
+		"[2001:da8:8001:7a39:f035:7d:b99f:eb79]:8333",
+		"[2001:e42:103:100::30]:8333",
+		"[2400:2412:103:c900:825:8f20:eaff:65c2]:8333",
+		"[2400:4052:e20:4f00:69fe:bb33:7b1c:a1ca]:8333",
+		"[2401:1800:7800:105:be76:4eff:fe1c:b35]:8333",
+		"[2401:3900:2:1::2]:8333",
+		"[2401:b140::44:150]:8333",
+		"[2401:d002:4402:0:8f28:591a:6ea0:c683]:8333",
+		"[2403:6200:8821:3d68:195b:87e9:6819:d5c8]:8333",
+		"[2405:6580:2140:3a00:c28c:983:364b:5d70]:8333",
+		"[2405:9800:b911:a18a:58eb:cd3c:9d82:ea4a]:8333",
+		"[2405:aa00:2::40]:8333",
+		"[2409:10:ca20:1df0:224:e8ff:fe1f:60d9]:8333",
+		"[2409:8a1e:a9af:3660:1c5a:5b6b:8a2d:9848]:8333",
+		"[2409:8a1e:a9af:3660:404:39ba:88f2:e8df]:8333",
+		"[240b:10:9141:400:49b4:3a2e:1e5:84c]:8333",
+		"[240d:1a:759:6000:a7b1:451a:8874:e1ac]:8333",
+		"[240d:1a:759:6000:ddab:3141:4da0:8878]:8333",
+		"[2600:8805:2400:14e:12dd:b1ff:fef2:3013]:8333",
+		"[2601:602:8d80:b63:dc3e:24ff:fe92:5eb]:8333",
+		"[2602:ffb6:4:2798:f816:3eff:fe2f:5441]:8333",
+		"[2602:ffb6:4:739e:f816:3eff:fe00:c2b3]:8333",
+		"[2602:ffb8::208:72:57:200]:8333",
+		"[2604:1380:4111:9300::1]:8333",
+		"[2604:4300:a:2e:21b:21ff:fe11:392]:8333",
+		"[2604:4500::2e06]:8112",
+		"[2604:5500:706a:4000:fc79:b9bb:1d7:c325]:8333",
+		"[2604:5500:c134:4000::3fc]:32797",
+		"[2604:6800:5e11:162:5c8f:d2ff:fe26:146f]:8333",
+		"[2605:4d00::50]:8333",
+		"[2605:6400:20:13bf:df1d:181c:83bb:22e8]:8333",
+		"[2605:ae00:203::203]:8333",
+		"[2605:c000:2a0a:1::102]:8333",
+		"[2607:f2c0:f00e:300::54]:8333",
+		"[2607:f2f8:ad40:bc1::1]:8333",
+		"[2607:f470:8:1048:ae1f:6bff:fe70:7240]:8333",
+		"[2607:ff28:800f:97:225:90ff:fe75:1110]:8333",
+		"[2620:11c:5001:1118:d267:e5ff:fee9:e673]:8333",
+		"[2620:6e:a000:2001::6]:8333",
+		"[2804:14d:4c93:9809:9769:da80:1832:3480]:8333",
+		"[2a00:1328:e101:c00::163]:8333",
+		"[2a00:1398:4:2a03:215:5dff:fed6:1033]:8333",
+		"[2a00:13a0:3015:1:85:14:79:26]:8333",
+		"[2a00:1630:14::101]:8333",
+		"[2a00:1768:2001:27::ef6a]:8333",
+		"[2a00:1828:a004:2::666]:8333",
+		"[2a00:1838:36:17::38cb]:8333",
+		"[2a00:1838:36:7d::d3c6]:8333",
+		"[2a00:1c10:2:709:58f7:e0ff:fe24:a0ba]:22220",
+		"[2a00:1c10:2:709::217]:22220",
+		"[2a00:1f40:5001:100::31]:8333",
+		"[2a00:6020:1395:1400:baf7:2d43:60b3:198b]:8333",
+		"[2a00:7c80:0:10b::3faf]:8333",
+		"[2a00:8a60:e012:a00::21]:8333",
+		"[2a00:ab00:603:84::3]:8333",
+		"[2a00:bbe0:cc:0:62a4:4cff:fe23:7510]:8333",
+		"[2a00:ca8:a1f:3025:f949:e442:c940:13e8]:8333",
+		"[2a00:d2a0:a:3d00:1cdf:38bb:a7d6:c251]:8333",
+		"[2a00:d880:11::20e]:8333",
+		"[2a00:ec0:7207:9100:5f8f:25dd:2574:3982]:8333",
+		"[2a00:f820:433::36]:8333",
+		"[2a01:138:a017:b018::42]:8333",
+		"[2a01:430:17:1::ffff:1153]:8333",
+		"[2a01:490:16:301::2]:8333",
+		"[2a01:4b00:807c:1b00:cda1:c6a:2bad:2418]:8333",
+		"[2a01:4b00:80e7:5405::1]:8333",
+		"[2a01:4f8:192:4212::2]:8433",
+		"[2a01:7a0:2:137c::3]:8333",
+		"[2a01:7a7:2:1467:ec4:7aff:fee2:5690]:8333",
+		"[2a01:7c8:d002:10f:5054:ff:fe5c:dac7]:8333",
+		"[2a01:7c8:d002:318:5054:ff:febe:cbb1]:8333",
+		"[2a01:8740:1:ffc5::8c6a]:8333",
+		"[2a01:cb00:f98:ca00:5054:ff:fed4:763d]:8333",
+		"[2a01:cb14:cf6:bc00:21e5:f12e:32c8:145]:8333",
+		"[2a01:d0:0:1c::245]:8333",
+		"[2a01:d0:bef2::12]:8333",
+		"[2a01:e35:2e40:6830:211:32ff:fea6:de3d]:8333",
+		"[2a02:1205:c6aa:60c0:70d8:aaee:a82d:993c]:8333",
+		"[2a02:169:502::614]:8333",
+		"[2a02:180:1:1::5b8f:538c]:8333",
+		"[2a02:348:62:5ef7::1]:8333",
+		"[2a02:390:9000:0:218:7dff:fe10:be33]:8333",
+		"[2a02:7aa0:1619::adc:8de0]:8333",
+		"[2a02:7b40:b0df:8925::1]:8333",
+		"[2a02:7b40:b905:37db::1]:8333",
+		"[2a02:810d:8cbf:f3a8:96c6:91ff:fe17:ae1d]:8333",
+		"[2a02:8389:1c0:9680:201:2eff:fe82:b3cc]:8333",
+		"[2a02:a454:a516:1:517:928:7e0d:957c]:8333",
+		"[2a02:af8:fab0:804:151:236:34:161]:8333",
+		"[2a02:af8:fab0:808:85:234:145:132]:8333",
+		"[2a02:e00:fff0:1e2::a]:8333",
+		"[2a03:2260:3006:d:d307:5d1d:32ca:1fe8]:8333",
+		"[2a03:6000:870:0:46:23:87:218]:8333",
+		"[2a03:9da0:f6:1::2]:8333",
+		"[2a03:c980:db:47::]:8333",
+		"[2a03:e2c0:1ce::2]:8333",
+		"[2a04:3544:1000:1510:706c:abff:fe6c:501c]:8333",
+		"[2a04:52c0:101:383::2a87]:8333",
+		"[2a04:52c0:101:3fb::4c27]:8333",
+		"[2a04:ee41:83:50df:d908:f71d:2a86:b337]:8333",
+		"[2a05:6d40:b94e:d100:225:90ff:fe0d:cfc2]:8333",
+		"[2a05:e5c0:0:100:250:56ff:feb9:d6cb]:8333",
+		"[2a05:fc87:1:6::2]:8333",
+		"[2a05:fc87:4::8]:8333",
+		"[2a07:5741:0:115d::1]:8333",
+		"[2a07:a880:4601:1062:b4b4:bd2a:39d4:7acf]:51401",
+		"[2a07:abc4::1:946]:8333",
+		"[2a07:b400:1:34c::2:1002]:8333",
+		"[2a0a:8c41::b4]:8333",
+		"[2a0a:c801:1:7::183]:8333",
+		"[2a0b:ae40:3:4a0a::15]:8333",
+		"[2a0f:df00:0:254::46]:8333",
+		"[2c0f:f598:5:1:1001::1]:8333",
+		"[2c0f:fce8:0:400:b7c::1]:8333",
+	},
+	wire.TestNet3: {},
+}
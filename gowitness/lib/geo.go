@@ -0,0 +1,242 @@
+package lib
+
+import (
+	"github.com/gocraft/dbr"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Geolocation of nodes from a local GeoLite2-City or GeoLite2-Country database. The file is
+// reloaded when it changes on disk, after which all nodes are located again.
+
+type GeoLocation struct {
+	Country   string
+	City      string
+	Latitude  *float64
+	Longitude *float64
+}
+
+type GeoDatabase struct {
+	mtx      sync.RWMutex
+	path     string
+	reader   *MMDBReader
+	modified time.Time
+}
+
+func OpenGeoDatabase(path string) (*GeoDatabase, error) {
+	database := &GeoDatabase{path: path}
+	if _, err := database.Refresh(); err != nil {
+		return nil, err
+	}
+	return database, nil
+}
+
+// Reloads the file if it changed since it was last read, returns whether it did
+func (database *GeoDatabase) Refresh() (bool, error) {
+	info, err := os.Stat(database.path)
+	if err != nil {
+		return false, err
+	}
+
+	database.mtx.RLock()
+	unchanged := database.reader != nil && info.ModTime().Equal(database.modified)
+	database.mtx.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	reader, err := OpenMMDB(database.path)
+	if err != nil {
+		return false, err
+	}
+	database.mtx.Lock()
+	database.reader = reader
+	database.modified = info.ModTime()
+	database.mtx.Unlock()
+	return true, nil
+}
+
+// Returns nil if the database has no location for ip
+func (database *GeoDatabase) Lookup(ip net.IP) *GeoLocation {
+	database.mtx.RLock()
+	reader := database.reader
+	database.mtx.RUnlock()
+
+	record, err := reader.Lookup(ip)
+	if err != nil || record == nil {
+		return nil
+	}
+	location := &GeoLocation{}
+	location.Country, _ = mmdbField(record, "country", "iso_code").(string)
+	location.City, _ = mmdbField(record, "city", "names", "en").(string)
+	if latitude, ok := mmdbField(record, "location", "latitude").(float64); ok {
+		location.Latitude = &latitude
+	}
+	if longitude, ok := mmdbField(record, "location", "longitude").(float64); ok {
+		location.Longitude = &longitude
+	}
+	if location.Country == "" && location.Latitude == nil {
+		return nil
+	}
+	return location
+}
+
+// table nodelocations
+type NodeLocationEntry struct {
+	NodeId    int64           `db:"nodeid"`
+	Country   dbr.NullString  `db:"country"`
+	City      dbr.NullString  `db:"city"`
+	Latitude  dbr.NullFloat64 `db:"latitude"`
+	Longitude dbr.NullFloat64 `db:"longitude"`
+	Updated   time.Time       `db:"updated"`
+}
+
+// Nodes without a location still get a row so that they are not looked up over and over
+func locateNode(node *NodeInfo, geo *GeoDatabase) *NodeLocationEntry {
+	entry := &NodeLocationEntry{NodeId: node.Id, Updated: time.Now()}
+	host, _, err := net.SplitHostPort(node.ConnString)
+	if err != nil {
+		return entry
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return entry
+	}
+
+	if location := geo.Lookup(ip); location != nil {
+		if location.Country != "" {
+			entry.Country = dbr.NewNullString(location.Country)
+		}
+		if location.City != "" {
+			entry.City = dbr.NewNullString(location.City)
+		}
+		if location.Latitude != nil && location.Longitude != nil {
+			entry.Latitude = dbr.NewNullFloat64(*location.Latitude)
+			entry.Longitude = dbr.NewNullFloat64(*location.Longitude)
+		}
+	}
+	return entry
+}
+
+// Locates the nodes that have not been so far, returns how many were
+func LocateNodes(db *PostgresStorage, geo *GeoDatabase) int {
+	located := 0
+	for {
+		nodes := db.GetUnlocatedNodes(enrichmentBatchSize)
+		if len(nodes) == 0 {
+			return located
+		}
+
+		batch := 0
+		for i := range nodes {
+			if db.SetNodeLocation(locateNode(&nodes[i], geo)) {
+				batch++
+			}
+		}
+		located += batch
+		if batch == 0 {
+			log.Println("Failed to store the location of any of", len(nodes), "nodes, stopping the geolocation.")
+			return located
+		}
+	}
+}
+
+// Locates every node again, e.g. after the database file changed
+func LocateAllNodes(db *PostgresStorage, geo *GeoDatabase) (int, error) {
+	nodes, err := db.GetNodes()
+	if err != nil {
+		return 0, err
+	}
+	located := 0
+	for i := range nodes {
+		if db.SetNodeLocation(locateNode(&nodes[i], geo)) {
+			located++
+		}
+	}
+	return located, nil
+}
+
+// Locates new nodes, or all of them if the database file changed since the last call
+func (cd *Coordinator) updateLocations() {
+	if cd.GeoDatabase == nil {
+		return
+	}
+
+	reloaded, err := cd.GeoDatabase.Refresh()
+	if err != nil {
+		log.Println("Failed to reload the geolocation database:", err.Error())
+	}
+	if reloaded {
+		located, err := LocateAllNodes(cd.DbConn, cd.GeoDatabase)
+		if err != nil {
+			log.Println("Failed to locate nodes after reloading the geolocation database:", err.Error())
+		}
+		log.Println("Geolocation database changed, located", located, "nodes again.")
+		return
+	}
+	if located := LocateNodes(cd.DbConn, cd.GeoDatabase); located > 0 {
+		log.Println("Located", located, "nodes.")
+	}
+}
+
+// Reachable nodes seen in a window per country, the country is null for unknown locations
+type CountryNodeCount struct {
+	Country dbr.NullString `db:"country"`
+	Nodes   int64          `db:"nodes"`
+}
+
+// A reachable node with its location
+type NodeLocation struct {
+	ConnString string          `db:"connstring"`
+	Version    string          `db:"version"`
+	LastSeen   time.Time       `db:"lastseen"`
+	Country    dbr.NullString  `db:"country"`
+	City       dbr.NullString  `db:"city"`
+	Latitude   dbr.NullFloat64 `db:"latitude"`
+	Longitude  dbr.NullFloat64 `db:"longitude"`
+}
+
+type GeoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []GeoJSONFeature `json:"features"`
+}
+
+type GeoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   GeoJSONPoint           `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type GeoJSONPoint struct {
+	Type string `json:"type"`
+	// Longitude first as GeoJSON requires
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+// Builds a GeoJSON point for every node that has coordinates
+func NodesAsGeoJSON(nodes []NodeLocation) *GeoJSONFeatureCollection {
+	collection := &GeoJSONFeatureCollection{Type: "FeatureCollection", Features: make([]GeoJSONFeature, 0, len(nodes))}
+	for _, node := range nodes {
+		if !node.Latitude.Valid || !node.Longitude.Valid {
+			continue
+		}
+		collection.Features = append(collection.Features, GeoJSONFeature{
+			Type: "Feature",
+			Geometry: GeoJSONPoint{
+				Type:        "Point",
+				Coordinates: [2]float64{node.Longitude.Float64, node.Latitude.Float64},
+			},
+			Properties: map[string]interface{}{
+				"connstring": node.ConnString,
+				"useragent":  node.Version,
+				"lastseen":   node.LastSeen,
+				"country":    node.Country.String,
+				"city":       node.City.String,
+			},
+		})
+	}
+	return collection
+}
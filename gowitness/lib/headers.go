@@ -0,0 +1,259 @@
+package lib
+
+import (
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"math/big"
+	"sync"
+)
+
+// The headers peers announce to us, kept in memory so that we can answer getheaders like a
+// pruned node would. We do not sync from genesis: the chain starts at the first block announced
+// after startup and only its most recent headers are kept.
+
+const (
+	// About two weeks of blocks, enough for any peer that is not far behind
+	maxHeaderChainLength = 2016
+	// Headers of competing branches kept until one of them outgrows the chain
+	maxSideHeaders = 64
+	// Core announces at most this many headers at once, longer messages answer a getheaders
+	maxHeadersAnnouncement = 8
+	// Locator entries stepping back one block at a time before the step doubles
+	locatorDenseEntries = 10
+)
+
+type HeaderChain struct {
+	mtx      sync.RWMutex
+	powLimit *big.Int
+	// The best branch, oldest first
+	headers []wire.BlockHeader
+	// Positions of headers counted since the first one we accepted, base of them were trimmed
+	positions map[chainhash.Hash]int
+	base      int
+	side      map[chainhash.Hash]wire.BlockHeader
+}
+
+func MakeHeaderChain(params *chaincfg.Params) *HeaderChain {
+	return &HeaderChain{
+		powLimit:  params.PowLimit,
+		headers:   make([]wire.BlockHeader, 0, maxHeaderChainLength),
+		positions: make(map[chainhash.Hash]int),
+		side:      make(map[chainhash.Hash]wire.BlockHeader),
+	}
+}
+
+// The proof of work of a header has to match the target it claims and the target has to be
+// one the chain allows for. Nothing else is validated, we do not know the heights.
+func (chain *HeaderChain) validWork(header *wire.BlockHeader, hash *chainhash.Hash) bool {
+	target := blockchain.CompactToBig(header.Bits)
+	if target.Sign() <= 0 || target.Cmp(chain.powLimit) > 0 {
+		return false
+	}
+	return blockchain.HashToBig(hash).Cmp(target) <= 0
+}
+
+// Adds a header to the chain. Headers of a competing branch are kept aside and replace the tip
+// once their branch is longer. Returns false if the header did not connect, the chain is left as
+// it is then: we most likely missed blocks and the caller asks for them, see Restart.
+func (chain *HeaderChain) Add(header *wire.BlockHeader) bool {
+	if chain == nil {
+		return false
+	}
+	hash := header.BlockHash()
+	chain.mtx.Lock()
+	defer chain.mtx.Unlock()
+
+	if _, ok := chain.positions[hash]; ok {
+		return true
+	}
+	if _, ok := chain.side[hash]; ok {
+		return true
+	}
+	if !chain.validWork(header, &hash) {
+		return false
+	}
+
+	tip := len(chain.headers) - 1
+	if position, ok := chain.positions[header.PrevBlock]; ok {
+		if position-chain.base == tip {
+			chain.append(header, hash)
+		} else {
+			chain.addSide(header, hash)
+		}
+		return true
+	}
+
+	if _, ok := chain.side[header.PrevBlock]; ok {
+		chain.addSide(header, hash)
+		chain.reorganize(header, hash)
+		return true
+	}
+
+	if tip < 0 {
+		chain.append(header, hash)
+		return true
+	}
+	return false
+}
+
+// Starts the chain over with headers, for when even the headers since our tip do not connect
+// to it. Only done if the first of them is newer than our tip and took at least as much work,
+// otherwise a low-work chain fed to us first would keep the real one out. Headers that do not
+// follow on from the first are dropped. Returns false if the chain was kept.
+func (chain *HeaderChain) Restart(headers []*wire.BlockHeader) bool {
+	if chain == nil || len(headers) == 0 {
+		return false
+	}
+	first := headers[0]
+	hash := first.BlockHash()
+	chain.mtx.Lock()
+	defer chain.mtx.Unlock()
+
+	if _, ok := chain.positions[hash]; ok || !chain.validWork(first, &hash) {
+		return false
+	}
+	if tip := len(chain.headers) - 1; tip >= 0 && (!first.Timestamp.After(chain.headers[tip].Timestamp) ||
+		blockchain.CompactToBig(first.Bits).Cmp(blockchain.CompactToBig(chain.headers[tip].Bits)) > 0) {
+		return false
+	}
+
+	chain.reset()
+	chain.append(first, hash)
+	for _, header := range headers[1:] {
+		hash := header.BlockHash()
+		if header.PrevBlock != chain.headers[len(chain.headers)-1].BlockHash() || !chain.validWork(header, &hash) {
+			break
+		}
+		chain.append(header, hash)
+	}
+	return true
+}
+
+func (chain *HeaderChain) append(header *wire.BlockHeader, hash chainhash.Hash) {
+	chain.positions[hash] = chain.base + len(chain.headers)
+	chain.headers = append(chain.headers, *header)
+	if len(chain.headers) > maxHeaderChainLength {
+		delete(chain.positions, chain.headers[0].BlockHash())
+		chain.headers = chain.headers[1:]
+		chain.base++
+	}
+}
+
+func (chain *HeaderChain) addSide(header *wire.BlockHeader, hash chainhash.Hash) {
+	if len(chain.side) >= maxSideHeaders {
+		chain.side = make(map[chainhash.Hash]wire.BlockHeader)
+	}
+	chain.side[hash] = *header
+}
+
+// Switches to the branch ending in hash if it forks off the chain and is longer than it
+func (chain *HeaderChain) reorganize(header *wire.BlockHeader, hash chainhash.Hash) {
+	branch := []wire.BlockHeader{*header}
+	prev := header.PrevBlock
+	for {
+		sideHeader, ok := chain.side[prev]
+		if !ok {
+			break
+		}
+		branch = append(branch, sideHeader)
+		prev = sideHeader.PrevBlock
+	}
+	fork, ok := chain.positions[prev]
+	if !ok || fork-chain.base+len(branch) <= len(chain.headers)-1 {
+		return
+	}
+
+	for _, stale := range chain.headers[fork-chain.base+1:] {
+		delete(chain.positions, stale.BlockHash())
+	}
+	chain.headers = chain.headers[:fork-chain.base+1]
+	for i := len(branch) - 1; i >= 0; i-- {
+		branchHash := branch[i].BlockHash()
+		delete(chain.side, branchHash)
+		chain.append(&branch[i], branchHash)
+	}
+}
+
+func (chain *HeaderChain) reset() {
+	chain.base += len(chain.headers)
+	chain.headers = chain.headers[:0]
+	chain.positions = make(map[chainhash.Hash]int)
+	chain.side = make(map[chainhash.Hash]wire.BlockHeader)
+}
+
+// A locator of our best branch, empty before the first header was accepted
+func (chain *HeaderChain) Locator() blockchain.BlockLocator {
+	locator := make(blockchain.BlockLocator, 0)
+	if chain == nil {
+		return locator
+	}
+	chain.mtx.RLock()
+	defer chain.mtx.RUnlock()
+
+	step := 1
+	for i := len(chain.headers) - 1; i >= 0; i -= step {
+		hash := chain.headers[i].BlockHash()
+		locator = append(locator, &hash)
+		if len(locator) >= locatorDenseEntries {
+			step *= 2
+		}
+	}
+	return locator
+}
+
+// The headers following the first locator hash we know of, up to and including hashStop, as
+// answered to a getheaders. An empty locator asks for the header of hashStop alone. Like a node
+// that pruned them, we answer nothing to a locator of blocks we do not have.
+func (chain *HeaderChain) HeadersAfter(locator []*chainhash.Hash, hashStop *chainhash.Hash) []*wire.BlockHeader {
+	headers := make([]*wire.BlockHeader, 0)
+	if chain == nil {
+		return headers
+	}
+	chain.mtx.RLock()
+	defer chain.mtx.RUnlock()
+
+	if len(locator) == 0 {
+		if position, ok := chain.positions[*hashStop]; ok {
+			header := chain.headers[position-chain.base]
+			headers = append(headers, &header)
+		}
+		return headers
+	}
+
+	start := -1
+	for _, hash := range locator {
+		if position, ok := chain.positions[*hash]; ok {
+			start = position - chain.base + 1
+			break
+		}
+	}
+	if start < 0 {
+		return headers
+	}
+	for i := start; i < len(chain.headers) && len(headers) < wire.MaxBlockHeadersPerMsg; i++ {
+		header := chain.headers[i]
+		headers = append(headers, &header)
+		if header.BlockHash() == *hashStop {
+			break
+		}
+	}
+	return headers
+}
+
+type HeaderChainSnapshot struct {
+	Length int
+	Tip    string
+	Side   int
+}
+
+func (chain *HeaderChain) Snapshot() HeaderChainSnapshot {
+	chain.mtx.RLock()
+	defer chain.mtx.RUnlock()
+	snapshot := HeaderChainSnapshot{Length: len(chain.headers), Side: len(chain.side)}
+	if len(chain.headers) > 0 {
+		snapshot.Tip = chain.headers[len(chain.headers)-1].BlockHash().String()
+	}
+	return snapshot
+}
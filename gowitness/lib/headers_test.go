@@ -0,0 +1,133 @@
+package lib
+
+import (
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"testing"
+	"time"
+)
+
+// Mines count regtest headers on top of prev, tag tells apart branches forking off the same block
+func mineHeaders(t *testing.T, prev chainhash.Hash, start time.Time, count int, tag uint32) []*wire.BlockHeader {
+	t.Helper()
+	params := &chaincfg.RegressionNetParams
+	target := blockchain.CompactToBig(params.PowLimitBits)
+	headers := make([]*wire.BlockHeader, 0, count)
+	for i := 0; i < count; i++ {
+		header := &wire.BlockHeader{
+			Version:    0x20000000,
+			PrevBlock:  prev,
+			MerkleRoot: chainhash.Hash{byte(tag), byte(tag >> 8)},
+			Timestamp:  start.Add(time.Duration(i+1) * 10 * time.Minute),
+			Bits:       params.PowLimitBits,
+		}
+		for {
+			hash := header.BlockHash()
+			if blockchain.HashToBig(&hash).Cmp(target) <= 0 {
+				break
+			}
+			header.Nonce++
+		}
+		headers = append(headers, header)
+		prev = header.BlockHash()
+	}
+	return headers
+}
+
+func addHeaders(chain *HeaderChain, headers []*wire.BlockHeader) bool {
+	connected := true
+	for _, header := range headers {
+		connected = chain.Add(header) && connected
+	}
+	return connected
+}
+
+func tipHash(chain *HeaderChain) string {
+	return chain.Snapshot().Tip
+}
+
+func TestHeaderChainConnects(t *testing.T) {
+	chain := MakeHeaderChain(&chaincfg.RegressionNetParams)
+	start := time.Unix(1600000000, 0)
+	headers := mineHeaders(t, chainhash.Hash{1}, start, 20, 0)
+	if !addHeaders(chain, headers) {
+		t.Fatal("a connected chain did not connect")
+	}
+	if snapshot := chain.Snapshot(); snapshot.Length != 20 || snapshot.Tip != headers[19].BlockHash().String() {
+		t.Fatalf("unexpected chain %+v", snapshot)
+	}
+
+	locator := chain.Locator()
+	if len(locator) == 0 || *locator[0] != headers[19].BlockHash() {
+		t.Fatal("locator does not start at the tip")
+	}
+	stop := headers[15].BlockHash()
+	after := chain.HeadersAfter([]*chainhash.Hash{locator[6]}, &stop)
+	if len(after) != 2 || after[0].BlockHash() != headers[14].BlockHash() || after[1].BlockHash() != stop {
+		t.Fatalf("HeadersAfter returned %d headers", len(after))
+	}
+	unknown := chainhash.Hash{2}
+	if after := chain.HeadersAfter([]*chainhash.Hash{&unknown}, &stop); len(after) != 0 {
+		t.Fatal("answered a locator of unknown blocks")
+	}
+}
+
+// A gap keeps the chain, the missing headers fill it in afterwards
+func TestHeaderChainGap(t *testing.T) {
+	chain := MakeHeaderChain(&chaincfg.RegressionNetParams)
+	headers := mineHeaders(t, chainhash.Hash{1}, time.Unix(1600000000, 0), 30, 0)
+	addHeaders(chain, headers[:20])
+
+	if chain.Add(headers[25]) {
+		t.Fatal("a header past a gap connected")
+	}
+	if tipHash(chain) != headers[19].BlockHash().String() || chain.Snapshot().Length != 20 {
+		t.Fatal("a header past a gap changed the chain")
+	}
+	if !addHeaders(chain, headers[20:]) {
+		t.Fatal("the headers in between did not connect")
+	}
+	if tipHash(chain) != headers[29].BlockHash().String() || chain.Snapshot().Length != 30 {
+		t.Fatalf("unexpected chain %+v", chain.Snapshot())
+	}
+}
+
+func TestHeaderChainRestart(t *testing.T) {
+	chain := MakeHeaderChain(&chaincfg.RegressionNetParams)
+	start := time.Unix(1600000000, 0)
+	ours := mineHeaders(t, chainhash.Hash{1}, start, 10, 0)
+	addHeaders(chain, ours)
+
+	older := mineHeaders(t, chainhash.Hash{2}, start.Add(-time.Hour), 3, 1)
+	if chain.Restart(older) {
+		t.Fatal("restarted with headers older than our tip")
+	}
+	newer := mineHeaders(t, chainhash.Hash{3}, start.Add(24*time.Hour), 3, 2)
+	if !chain.Restart(newer) {
+		t.Fatal("did not restart with newer headers")
+	}
+	if snapshot := chain.Snapshot(); snapshot.Length != 3 || snapshot.Tip != newer[2].BlockHash().String() {
+		t.Fatalf("unexpected chain %+v", snapshot)
+	}
+}
+
+func TestHeaderChainReorganizes(t *testing.T) {
+	chain := MakeHeaderChain(&chaincfg.RegressionNetParams)
+	start := time.Unix(1600000000, 0)
+	trunk := mineHeaders(t, chainhash.Hash{1}, start, 10, 0)
+	addHeaders(chain, trunk)
+
+	branch := mineHeaders(t, trunk[6].BlockHash(), trunk[6].Timestamp, 4, 1)
+	if !addHeaders(chain, branch[:3]) {
+		t.Fatal("a competing branch did not connect")
+	}
+	if tipHash(chain) != trunk[9].BlockHash().String() {
+		t.Fatal("reorganized to a branch that is not longer")
+	}
+	chain.Add(branch[3])
+	if snapshot := chain.Snapshot(); snapshot.Tip != branch[3].BlockHash().String() || snapshot.Length != 11 {
+		t.Fatalf("did not reorganize to the longer branch: %+v", snapshot)
+	}
+}
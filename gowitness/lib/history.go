@@ -0,0 +1,556 @@
+package lib
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/gocraft/dbr"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Nodehistory grows at the rate of our connection attempts. Maintenance turns it into a table
+// partitioned by month (PostgreSQL 12 or later), keeps partitions for the coming months ready and
+// drops the ones past the retention once their events were rolled up into nodehistorydaily.
+// Readers of raw events look back no further than the retention, or add the daily summaries.
+//
+// The table as it was before partitioning becomes the partition from its oldest event up to the
+// month after the conversion. Rows outside of all monthly partitions land in the default
+// partition and are moved out of it when their partition is created.
+
+const (
+	historyTable            = "nodehistory"
+	historyDefaultPartition = "nodehistory_default"
+
+	// Events are inserted in batches of up to historyBatchSize, at most historyBatchDelay after
+	// they were recorded
+	historyBatchSize  = 500
+	historyBatchDelay = time.Second
+	// Events kept while the database is unreachable
+	historyMaxQueued = 100 * historyBatchSize
+)
+
+var (
+	historyMonthPartition  = regexp.MustCompile(`^nodehistory_y(\d{4})m(\d{2})$`)
+	historyBeforePartition = regexp.MustCompile(`^nodehistory_before_y(\d{4})m(\d{2})$`)
+)
+
+type HistoryConfig struct {
+	// Months of raw events kept besides the current one, all of them if 0
+	RetentionMonths int
+	// Monthly partitions created ahead of time
+	PremakeMonths int
+	// How often the daemon runs maintenance, never if 0
+	MaintenanceInterval time.Duration
+}
+
+// Raw events before the returned time may have been rolled up by now, it is zero if they are
+// kept forever
+func (config HistoryConfig) RawSince(now time.Time) time.Time {
+	if config.RetentionMonths <= 0 {
+		return time.Time{}
+	}
+	return monthStart(now).AddDate(0, -config.RetentionMonths, 0)
+}
+
+// What a maintenance run did
+type HistoryMaintenance struct {
+	Partitioned bool
+	Created     []string
+	Dropped     []string
+	// Raw events rolled up into daily summaries and deleted
+	RolledUp int64
+}
+
+// table nodehistorydaily
+type NodeHistoryDailyEntry struct {
+	Day       time.Time `db:"day"`
+	NodeId    int64     `db:"nodeid"`
+	EventType string    `db:"eventtype"`
+	Events    int64     `db:"events"`
+	First     time.Time `db:"first"`
+	Last      time.Time `db:"last"`
+}
+
+// Events waiting to be inserted into nodehistory. Those of the last historyBatchDelay, at most
+// historyBatchSize of them, are lost if the process dies, and so are the ones that do not fit
+// into historyMaxQueued while the database is unreachable.
+type historyBatch struct {
+	mtx     sync.Mutex
+	entries []*NodeHistoryEntry
+	timer   *time.Timer
+	// Set while the batch waits to retry events, it is not flushed early then
+	retrying bool
+}
+
+// Adds entry to the batch, flush is run once it is full or historyBatchDelay after the first of
+// its events was added
+func (batch *historyBatch) add(entry *NodeHistoryEntry, flush func()) {
+	batch.mtx.Lock()
+	defer batch.mtx.Unlock()
+	batch.entries = append(batch.entries, entry)
+	batch.trim()
+	if len(batch.entries) >= historyBatchSize && !batch.retrying {
+		go flush()
+	} else if batch.timer == nil {
+		batch.timer = time.AfterFunc(historyBatchDelay, flush)
+	}
+}
+
+// Puts entries that failed to be inserted back in front of the batch, flush is run with them
+// historyBatchDelay later at the earliest
+func (batch *historyBatch) retry(entries []*NodeHistoryEntry, flush func()) {
+	batch.mtx.Lock()
+	defer batch.mtx.Unlock()
+	batch.entries = append(append(make([]*NodeHistoryEntry, 0, len(entries)+len(batch.entries)), entries...),
+		batch.entries...)
+	batch.trim()
+	batch.retrying = true
+	if batch.timer == nil {
+		batch.timer = time.AfterFunc(historyBatchDelay, flush)
+	}
+}
+
+func (batch *historyBatch) trim() {
+	if dropped := len(batch.entries) - historyMaxQueued; dropped > 0 {
+		log.Println("Dropping the", dropped, "oldest history events, too many are waiting to be inserted.")
+		batch.entries = batch.entries[dropped:]
+	}
+}
+
+// Empties the batch and returns what was in it
+func (batch *historyBatch) take() []*NodeHistoryEntry {
+	batch.mtx.Lock()
+	defer batch.mtx.Unlock()
+	entries := batch.entries
+	batch.entries = nil
+	batch.retrying = false
+	if batch.timer != nil {
+		batch.timer.Stop()
+		batch.timer = nil
+	}
+	return entries
+}
+
+// Inserts entries with one statement. If that fails while the database is reachable, they are
+// inserted one by one so that a bad event costs only itself. If it is not, all of them are
+// returned to be tried again.
+func insertHistoryBatch(entries []*NodeHistoryEntry, insert func([]*NodeHistoryEntry) error,
+	ping func() error) []*NodeHistoryEntry {
+
+	err := insert(entries)
+	if err == nil {
+		return nil
+	}
+	log.Println("Error while inserting", len(entries), "history events:", err.Error())
+	if err := ping(); err != nil {
+		return entries
+	}
+	for _, entry := range entries {
+		if err := insert([]*NodeHistoryEntry{entry}); err != nil {
+			log.Println("Dropping the", entry.EventType, "event of node", entry.NodeId, "at", entry.Timestamp,
+				":", err.Error())
+		}
+	}
+	return nil
+}
+
+// Queues entry to be inserted with the other events of the next historyBatchDelay
+func (storage *PostgresStorage) queueNodeHistory(entry *NodeHistoryEntry) {
+	storage.historyBatch.add(entry, storage.FlushNodeHistory)
+}
+
+// Inserts the queued events right away
+func (storage *PostgresStorage) FlushNodeHistory() {
+	entries := storage.historyBatch.take()
+	if len(entries) == 0 {
+		return
+	}
+	if err := storage.checkConnected(); err != nil {
+		log.Println("Dropping", len(entries), "history events:", err.Error())
+		return
+	}
+
+	retry := insertHistoryBatch(entries, storage.insertNodeHistory, storage.db.Ping)
+	if len(retry) > 0 {
+		storage.historyBatch.retry(retry, storage.FlushNodeHistory)
+	}
+}
+
+func (storage *PostgresStorage) insertNodeHistory(entries []*NodeHistoryEntry) error {
+	sess := storage.db.NewSession(nil)
+	insert := sess.InsertInto(historyTable).Columns("nodeid", "eventtype", "timestamp", "data")
+	for _, entry := range entries {
+		insert.Record(entry)
+	}
+	_, err := insert.Exec()
+	return err
+}
+
+// Caps since at the retention of raw events
+func (storage *PostgresStorage) rawHistorySince(since time.Time) time.Time {
+	if cutoff := storage.history.RawSince(time.Now()); since.Before(cutoff) {
+		return cutoff
+	}
+	return since
+}
+
+type historyPartition struct {
+	name string
+	// Events before this are in the partition
+	end time.Time
+}
+
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+func monthPartitionName(month time.Time) string {
+	return fmt.Sprintf("nodehistory_y%04dm%02d", month.Year(), int(month.Month()))
+}
+
+func beforePartitionName(month time.Time) string {
+	return fmt.Sprintf("nodehistory_before_y%04dm%02d", month.Year(), int(month.Month()))
+}
+
+func timestampLiteral(t time.Time) string {
+	return "'" + t.UTC().Format("2006-01-02 15:04:05") + "+00'"
+}
+
+func parsePartitionMonth(match []string) time.Time {
+	year, _ := strconv.Atoi(match[1])
+	month, _ := strconv.Atoi(match[2])
+	return time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+}
+
+func (storage *PostgresStorage) isHistoryPartitioned() (bool, error) {
+	var kind string
+	err := storage.db.QueryRow(`SELECT c.relkind FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relname = $1 AND n.nspname = current_schema()`, historyTable).Scan(&kind)
+	if err != nil {
+		return false, fmt.Errorf("failed to look up %s: %s", historyTable, err.Error())
+	}
+	return kind == "p", nil
+}
+
+// The start of the partition the plain nodehistory table becomes: the month of its oldest event,
+// or the month before next if it has none that are older
+func legacyHistoryStart(oldest dbr.NullTime, next time.Time) time.Time {
+	start := next.AddDate(0, -1, 0)
+	if oldest.Valid && oldest.Time.Before(start) {
+		start = monthStart(oldest.Time)
+	}
+	return start
+}
+
+// Turns the plain nodehistory table into a partitioned one with the old table as the partition
+// from its oldest event up to next. Everything that scans the old table happens before it is
+// locked: a validated constraint proves its bounds and the indexes of the partitioned table are
+// built concurrently, so attaching it checks and builds nothing.
+func (storage *PostgresStorage) partitionHistory(next time.Time) error {
+	legacy := beforePartitionName(next)
+	var oldest dbr.NullTime
+	if err := storage.db.QueryRow(`SELECT MIN(timestamp) FROM nodehistory`).Scan(&oldest); err != nil {
+		return fmt.Errorf("failed to find the oldest event of %s: %s", historyTable, err.Error())
+	}
+	start := legacyHistoryStart(oldest, next)
+
+	bound := legacy + "_bound"
+	prepare := []string{
+		`ALTER TABLE nodehistory DROP CONSTRAINT IF EXISTS ` + bound,
+		`ALTER TABLE nodehistory ADD CONSTRAINT ` + bound + ` CHECK (timestamp IS NOT NULL AND timestamp >= ` +
+			timestampLiteral(start) + ` AND timestamp < ` + timestampLiteral(next) + `) NOT VALID`,
+		`ALTER TABLE nodehistory VALIDATE CONSTRAINT ` + bound,
+		`CREATE UNIQUE INDEX CONCURRENTLY IF NOT EXISTS ` + legacy + `_id_timestamp_idx ON nodehistory (id, timestamp)`,
+		`CREATE INDEX CONCURRENTLY IF NOT EXISTS ` + legacy + `_nodeid_timestamp_idx ON nodehistory (nodeid, timestamp)`,
+		`CREATE INDEX CONCURRENTLY IF NOT EXISTS ` + legacy + `_eventtype_timestamp_idx ON nodehistory (eventtype, timestamp)`,
+	}
+	for _, statement := range prepare {
+		if _, err := storage.db.Exec(statement); err != nil {
+			return fmt.Errorf("failed to prepare %s for partitioning, events without a timestamp have to be "+
+				"deleted first: %s", historyTable, err.Error())
+		}
+	}
+
+	tx, err := storage.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var sequence dbr.NullString
+	if err := tx.QueryRow(`SELECT pg_get_serial_sequence($1, 'id')`, historyTable).Scan(&sequence); err != nil {
+		return err
+	}
+	statements := []string{
+		`LOCK TABLE nodehistory IN ACCESS EXCLUSIVE MODE`,
+		// Proven by the constraint rather than checked row by row
+		`ALTER TABLE nodehistory ALTER COLUMN timestamp SET NOT NULL`,
+		`ALTER TABLE nodehistory RENAME TO ` + legacy,
+		`ALTER TABLE ` + legacy + ` ADD CONSTRAINT ` + legacy + `_id_timestamp_key UNIQUE USING INDEX ` +
+			legacy + `_id_timestamp_idx`,
+		`CREATE TABLE nodehistory (LIKE ` + legacy + ` INCLUDING DEFAULTS) PARTITION BY RANGE (timestamp)`,
+		`ALTER TABLE nodehistory ADD PRIMARY KEY (id, timestamp)`,
+		`CREATE INDEX nodehistory_nodeid_timestamp_idx ON nodehistory (nodeid, timestamp)`,
+		`CREATE INDEX nodehistory_eventtype_timestamp_idx ON nodehistory (eventtype, timestamp)`,
+	}
+	// The ids keep coming from the sequence of the old table, which must not go when it is dropped
+	if sequence.Valid {
+		statements = append(statements, `ALTER SEQUENCE `+sequence.String+` OWNED BY nodehistory.id`)
+	}
+	statements = append(statements,
+		`ALTER TABLE nodehistory ATTACH PARTITION `+legacy+` FOR VALUES FROM (`+timestampLiteral(start)+
+			`) TO (`+timestampLiteral(next)+`)`,
+		`ALTER TABLE `+legacy+` DROP CONSTRAINT `+bound,
+		`CREATE TABLE `+historyDefaultPartition+` PARTITION OF nodehistory DEFAULT`,
+	)
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return fmt.Errorf("failed to partition %s: %s", historyTable, err.Error())
+		}
+	}
+	return tx.Commit()
+}
+
+// Tells where a partition ends by its name, false for the default partition and other tables
+func parseHistoryPartition(name string) (historyPartition, bool) {
+	if match := historyMonthPartition.FindStringSubmatch(name); match != nil {
+		return historyPartition{name, parsePartitionMonth(match).AddDate(0, 1, 0)}, true
+	}
+	if match := historyBeforePartition.FindStringSubmatch(name); match != nil {
+		return historyPartition{name, parsePartitionMonth(match)}, true
+	}
+	return historyPartition{}, false
+}
+
+// The months to create partitions for: the ones after the last partition, which starts with
+// the current month if there are none, up to premake months ahead of current
+func historyMonthsToCreate(partitions []historyPartition, current time.Time, premake int) []time.Time {
+	next := current
+	if len(partitions) > 0 {
+		next = partitions[len(partitions)-1].end
+	}
+	months := make([]time.Time, 0)
+	for month := next; !month.After(current.AddDate(0, premake, 0)); month = month.AddDate(0, 1, 0) {
+		months = append(months, month)
+	}
+	return months
+}
+
+// The partitions, oldest first, that end no later than cutoff
+func expiredHistoryPartitions(partitions []historyPartition, cutoff time.Time) []historyPartition {
+	expired := make([]historyPartition, 0)
+	for _, partition := range partitions {
+		if partition.end.After(cutoff) {
+			break
+		}
+		expired = append(expired, partition)
+	}
+	return expired
+}
+
+// The partitions other than the default one, the oldest first
+func (storage *PostgresStorage) historyPartitions() ([]historyPartition, error) {
+	rows, err := storage.db.Query(`SELECT c.relname FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		WHERE i.inhparent = $1::regclass`, historyTable)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	partitions := make([]historyPartition, 0)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		if partition, ok := parseHistoryPartition(name); ok {
+			partitions = append(partitions, partition)
+		}
+	}
+	sort.Slice(partitions, func(i, j int) bool {
+		return partitions[i].end.Before(partitions[j].end)
+	})
+	return partitions, rows.Err()
+}
+
+// Creates the partition of month, moving the events of that month out of the default partition
+func (storage *PostgresStorage) createHistoryPartition(month time.Time) error {
+	name := monthPartitionName(month)
+	from, to := timestampLiteral(month), timestampLiteral(month.AddDate(0, 1, 0))
+	tx, err := storage.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		`CREATE TABLE ` + name + ` (LIKE nodehistory INCLUDING DEFAULTS)`,
+		`WITH moved AS (DELETE FROM ` + historyDefaultPartition + ` WHERE timestamp >= ` + from +
+			` AND timestamp < ` + to + ` RETURNING *) INSERT INTO ` + name + ` SELECT * FROM moved`,
+		`ALTER TABLE nodehistory ATTACH PARTITION ` + name + ` FOR VALUES FROM (` + from + `) TO (` + to + `)`,
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return fmt.Errorf("failed to create partition %s: %s", name, err.Error())
+		}
+	}
+	return tx.Commit()
+}
+
+// Adds the events of source matching where to the daily summaries in tx, returns their number
+func rollUpHistory(tx *sql.Tx, source string, where string) (int64, error) {
+	var events int64
+	err := tx.QueryRow(`WITH daily AS (
+			SELECT (timestamp AT TIME ZONE 'UTC')::date AS day, nodeid, eventtype,
+				COUNT(*) AS events, MIN(timestamp) AS first, MAX(timestamp) AS last
+			FROM ` + source + ` WHERE ` + where + `
+			GROUP BY 1, 2, 3
+		), merged AS (
+			INSERT INTO nodehistorydaily (day, nodeid, eventtype, events, first, last)
+			SELECT * FROM daily
+			ON CONFLICT (day, nodeid, eventtype) DO UPDATE SET
+				events = nodehistorydaily.events + EXCLUDED.events,
+				first = LEAST(nodehistorydaily.first, EXCLUDED.first),
+				last = GREATEST(nodehistorydaily.last, EXCLUDED.last)
+		)
+		SELECT COALESCE(SUM(events), 0) FROM daily`).Scan(&events)
+	return events, err
+}
+
+// Rolls up the events of the partition and drops it, both or neither
+func (storage *PostgresStorage) dropHistoryPartition(name string) (int64, error) {
+	tx, err := storage.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	events, err := rollUpHistory(tx, name, "TRUE")
+	if err != nil {
+		return 0, fmt.Errorf("failed to roll up partition %s: %s", name, err.Error())
+	}
+	if _, err := tx.Exec(`DROP TABLE ` + name); err != nil {
+		return 0, fmt.Errorf("failed to drop partition %s: %s", name, err.Error())
+	}
+	return events, tx.Commit()
+}
+
+func (storage *PostgresStorage) expireDefaultHistory(cutoff time.Time) (int64, error) {
+	tx, err := storage.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	expired := "timestamp < " + timestampLiteral(cutoff)
+	events, err := rollUpHistory(tx, historyDefaultPartition, expired)
+	if err != nil {
+		return 0, fmt.Errorf("failed to roll up %s: %s", historyDefaultPartition, err.Error())
+	}
+	if _, err := tx.Exec(`DELETE FROM ` + historyDefaultPartition + ` WHERE ` + expired); err != nil {
+		return 0, fmt.Errorf("failed to expire %s: %s", historyDefaultPartition, err.Error())
+	}
+	return events, tx.Commit()
+}
+
+// Partitions nodehistory if it is not yet, creates the partitions up to PremakeMonths ahead of
+// now and rolls up and drops the ones that ended RetentionMonths before the current month
+func (storage *PostgresStorage) MaintainNodeHistory(config HistoryConfig, now time.Time) (*HistoryMaintenance, error) {
+	connectionErr := storage.checkConnected()
+	if connectionErr != nil {
+		return nil, connectionErr
+	}
+	result := &HistoryMaintenance{Created: make([]string, 0), Dropped: make([]string, 0)}
+	current := monthStart(now)
+
+	partitioned, err := storage.isHistoryPartitioned()
+	if err != nil {
+		return nil, err
+	}
+	if !partitioned {
+		log.Println("Partitioning", historyTable, "by month, this locks it until done.")
+		if err := storage.partitionHistory(current.AddDate(0, 1, 0)); err != nil {
+			return nil, err
+		}
+		result.Partitioned = true
+	}
+
+	partitions, err := storage.historyPartitions()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the partitions of %s: %s", historyTable, err.Error())
+	}
+	// Months missed since the last partition are created as well, their events are in the
+	// default partition until then
+	for _, month := range historyMonthsToCreate(partitions, current, config.PremakeMonths) {
+		if err := storage.createHistoryPartition(month); err != nil {
+			return result, err
+		}
+		result.Created = append(result.Created, monthPartitionName(month))
+	}
+
+	if config.RetentionMonths <= 0 {
+		return result, nil
+	}
+	cutoff := current.AddDate(0, -config.RetentionMonths, 0)
+	for _, partition := range expiredHistoryPartitions(partitions, cutoff) {
+		events, err := storage.dropHistoryPartition(partition.name)
+		if err != nil {
+			return result, err
+		}
+		result.Dropped = append(result.Dropped, partition.name)
+		result.RolledUp += events
+	}
+	events, err := storage.expireDefaultHistory(cutoff)
+	result.RolledUp += events
+	return result, err
+}
+
+func (storage *PostgresStorage) GetNodeHistoryDaily(nodeId int64, limit uint64) []NodeHistoryDailyEntry {
+	session := storage.db.NewSession(nil)
+	entries := make([]NodeHistoryDailyEntry, 0)
+
+	_, err := session.Select("*").
+		From("nodehistorydaily").
+		Where("nodeid = ?", nodeId).
+		OrderDesc("day").
+		Limit(limit).
+		Load(&entries)
+	if err != nil {
+		log.Println("Error while executing the query in GetNodeHistoryDaily(...):", err.Error())
+		return nil
+	}
+	return entries
+}
+
+func (cd *Coordinator) runHistoryMaintenance() {
+	interval := cd.DatabaseConfig.History.MaintenanceInterval
+	if interval <= 0 {
+		return
+	}
+	// Partitioning locks the table for a while, it is left to the maintain command
+	partitioned, err := cd.DbConn.isHistoryPartitioned()
+	if err != nil || !partitioned {
+		log.Println(historyTable, "is not partitioned, run the maintain command to have its history maintained.")
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for cd.Status() != Stopped {
+		result, err := cd.DbConn.MaintainNodeHistory(cd.DatabaseConfig.History, time.Now())
+		if err != nil {
+			log.Println("Maintenance of the node history failed:", err.Error())
+		} else if len(result.Created) > 0 || len(result.Dropped) > 0 {
+			log.Println("Maintained the node history: created", result.Created, "dropped", result.Dropped,
+				"and rolled up", result.RolledUp, "events")
+		}
+		<-ticker.C
+	}
+}
@@ -0,0 +1,175 @@
+package lib
+
+import (
+	"errors"
+	"github.com/gocraft/dbr"
+	"testing"
+	"time"
+)
+
+func TestHistoryRawSince(t *testing.T) {
+	now := time.Date(2021, time.March, 17, 12, 0, 0, 0, time.UTC)
+	if since := (HistoryConfig{}).RawSince(now); !since.IsZero() {
+		t.Fatalf("raw events kept forever are cut off at %s", since)
+	}
+	expected := time.Date(2020, time.December, 1, 0, 0, 0, 0, time.UTC)
+	if since := (HistoryConfig{RetentionMonths: 3}).RawSince(now); !since.Equal(expected) {
+		t.Fatalf("raw events are cut off at %s", since)
+	}
+}
+
+func utcMonth(year int, month time.Month) time.Time {
+	return time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+}
+
+func TestHistoryPartitionNames(t *testing.T) {
+	partitions := map[string]time.Time{
+		monthPartitionName(utcMonth(2021, time.February)):  utcMonth(2021, time.March),
+		monthPartitionName(utcMonth(2020, time.December)):  utcMonth(2021, time.January),
+		beforePartitionName(utcMonth(2020, time.November)): utcMonth(2020, time.November),
+	}
+	for name, end := range partitions {
+		partition, ok := parseHistoryPartition(name)
+		if !ok || partition.name != name || !partition.end.Equal(end) {
+			t.Fatalf("parsed %s as %+v", name, partition)
+		}
+	}
+	if name := monthPartitionName(utcMonth(2021, time.February)); name != "nodehistory_y2021m02" {
+		t.Fatalf("named the partition %s", name)
+	}
+	for _, name := range []string{historyDefaultPartition, "nodehistory_y2021m2", "nodehistorydaily"} {
+		if partition, ok := parseHistoryPartition(name); ok {
+			t.Fatalf("parsed %s as %+v", name, partition)
+		}
+	}
+}
+
+func TestLegacyHistoryStart(t *testing.T) {
+	next := utcMonth(2021, time.April)
+	oldest := dbr.NewNullTime(time.Date(2019, time.July, 17, 8, 0, 0, 0, time.UTC))
+	if start := legacyHistoryStart(oldest, next); !start.Equal(utcMonth(2019, time.July)) {
+		t.Fatalf("the legacy partition starts at %s", start)
+	}
+	for _, oldest := range []dbr.NullTime{{}, dbr.NewNullTime(utcMonth(2021, time.March).Add(time.Hour))} {
+		if start := legacyHistoryStart(oldest, next); !start.Equal(utcMonth(2021, time.March)) {
+			t.Fatalf("the legacy partition of %+v starts at %s", oldest, start)
+		}
+	}
+}
+
+func TestHistoryPartitionRanges(t *testing.T) {
+	current := utcMonth(2021, time.March)
+	months := historyMonthsToCreate(nil, current, 2)
+	if len(months) != 3 || !months[0].Equal(current) || !months[2].Equal(utcMonth(2021, time.May)) {
+		t.Fatalf("created %v", months)
+	}
+
+	// Maintenance last ran in December, the partitions up to January exist
+	partitions := []historyPartition{
+		{beforePartitionName(utcMonth(2020, time.November)), utcMonth(2020, time.November)},
+		{monthPartitionName(utcMonth(2020, time.November)), utcMonth(2020, time.December)},
+		{monthPartitionName(utcMonth(2020, time.December)), utcMonth(2021, time.January)},
+		{monthPartitionName(utcMonth(2021, time.January)), utcMonth(2021, time.February)},
+	}
+	months = historyMonthsToCreate(partitions, current, 1)
+	if len(months) != 3 || !months[0].Equal(utcMonth(2021, time.February)) || !months[2].Equal(utcMonth(2021, time.April)) {
+		t.Fatalf("created %v", months)
+	}
+	if months := historyMonthsToCreate(partitions, utcMonth(2020, time.December), 0); len(months) != 0 {
+		t.Fatalf("created %v although the partitions are ahead", months)
+	}
+
+	expired := expiredHistoryPartitions(partitions, (HistoryConfig{RetentionMonths: 3}).RawSince(current))
+	if len(expired) != 2 || expired[1].name != "nodehistory_y2020m11" {
+		t.Fatalf("expired %+v", expired)
+	}
+}
+
+// Collects the batches flush was run with
+type historyFlushes struct {
+	batch   *historyBatch
+	flushed chan []*NodeHistoryEntry
+}
+
+func (flushes *historyFlushes) flush() {
+	if entries := flushes.batch.take(); len(entries) > 0 {
+		flushes.flushed <- entries
+	}
+}
+
+func (flushes *historyFlushes) next(t *testing.T, within time.Duration) []*NodeHistoryEntry {
+	t.Helper()
+	select {
+	case entries := <-flushes.flushed:
+		return entries
+	case <-time.After(within):
+		t.Fatal("the batch was not flushed")
+		return nil
+	}
+}
+
+func TestHistoryBatchFlushes(t *testing.T) {
+	flushes := &historyFlushes{batch: &historyBatch{}, flushed: make(chan []*NodeHistoryEntry, 4)}
+
+	for i := 0; i < historyBatchSize; i++ {
+		flushes.batch.add(&NodeHistoryEntry{NodeId: int64(i)}, flushes.flush)
+	}
+	if entries := flushes.next(t, historyBatchDelay/2); len(entries) != historyBatchSize {
+		t.Fatalf("flushed %d events of a full batch", len(entries))
+	}
+
+	started := time.Now()
+	flushes.batch.add(&NodeHistoryEntry{NodeId: 1}, flushes.flush)
+	flushes.batch.add(&NodeHistoryEntry{NodeId: 2}, flushes.flush)
+	entries := flushes.next(t, 2*historyBatchDelay)
+	if len(entries) != 2 || time.Since(started) < historyBatchDelay {
+		t.Fatalf("flushed %d events after %s", len(entries), time.Since(started))
+	}
+
+	// Events that failed are retried after the delay, even with a full batch, and stay first
+	retried := make([]*NodeHistoryEntry, historyBatchSize)
+	for i := range retried {
+		retried[i] = &NodeHistoryEntry{NodeId: int64(i)}
+	}
+	started = time.Now()
+	flushes.batch.retry(retried, flushes.flush)
+	flushes.batch.add(&NodeHistoryEntry{NodeId: -1}, flushes.flush)
+	entries = flushes.next(t, 2*historyBatchDelay)
+	if len(entries) != historyBatchSize+1 || entries[0] != retried[0] || entries[historyBatchSize].NodeId != -1 ||
+		time.Since(started) < historyBatchDelay {
+		t.Fatalf("flushed %d events after %s", len(entries), time.Since(started))
+	}
+}
+
+func TestInsertHistoryBatch(t *testing.T) {
+	entries := []*NodeHistoryEntry{{EventType: "session_begin"}, {EventType: "bad"}, {EventType: "session_end"}}
+	inserted := make([]string, 0)
+	insert := func(batch []*NodeHistoryEntry) error {
+		for _, entry := range batch {
+			if entry.EventType == "bad" {
+				return errors.New("invalid event")
+			}
+		}
+		for _, entry := range batch {
+			inserted = append(inserted, entry.EventType)
+		}
+		return nil
+	}
+	reachable := func() error { return nil }
+	unreachable := func() error { return errors.New("connection refused") }
+
+	if retry := insertHistoryBatch(entries[:1], insert, unreachable); retry != nil || len(inserted) != 1 {
+		t.Fatalf("inserted %v, retrying %d", inserted, len(retry))
+	}
+
+	inserted = inserted[:0]
+	if retry := insertHistoryBatch(entries, insert, reachable); retry != nil ||
+		len(inserted) != 2 || inserted[0] != "session_begin" || inserted[1] != "session_end" {
+		t.Fatalf("inserted %v, retrying %d", inserted, len(retry))
+	}
+
+	inserted = inserted[:0]
+	if retry := insertHistoryBatch(entries, insert, unreachable); len(retry) != len(entries) || len(inserted) != 0 {
+		t.Fatalf("inserted %v, retrying %d", inserted, len(retry))
+	}
+}
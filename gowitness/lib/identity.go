@@ -0,0 +1,111 @@
+package lib
+
+import (
+	"fmt"
+	"github.com/btcsuite/btcd/wire"
+	"math/rand"
+	"strings"
+)
+
+// Identities we present to peers in our version message. Handlers pick one of the identities
+// of their config per session and record it with the session_begin event, so that experiments
+// on how peers treat each identity can be reproduced.
+
+const (
+	// What globalwitness always advertised, btcwire prefix and all
+	IdentityLegacy = "legacy"
+	// A recent Bitcoin Core release with its default services
+	IdentityCore = "core"
+	// Who we are, without claiming any service we do not provide
+	IdentityHonest = "globalwitness"
+	// Configured setting by setting rather than from a profile
+	IdentityCustom = "custom"
+	// Not a profile, a session draws from a list of them instead
+	IdentityRandom = "random"
+
+	// SFNodeNetworkLimited is the BIP159 bit of pruned nodes serving the last 288 blocks
+	SFNodeNetworkLimited wire.ServiceFlag = 1 << 10
+)
+
+type Identity struct {
+	Profile string
+	// Advertised as is, e.g. /Satoshi:29.0.0/
+	UserAgent       string
+	ProtocolVersion uint32
+	Services        wire.ServiceFlag
+}
+
+var identityProfiles = []Identity{
+	{
+		Profile:         IdentityLegacy,
+		UserAgent:       "/btcwire:0.5.0/Satoshi:0.17.99/",
+		ProtocolVersion: MaxProtocolVersion,
+		Services: wire.SFNodeXthin | wire.SFNodeWitness | wire.SFNodeGetUTXO |
+			wire.SFNodeCF | wire.SFNodeBloom |
+			wire.SFNodeBit5 | wire.SFNode2X |
+			wire.SFNodeNetwork,
+	},
+	{
+		Profile:         IdentityCore,
+		UserAgent:       "/Satoshi:29.0.0/",
+		ProtocolVersion: 70016,
+		Services:        wire.SFNodeNetwork | wire.SFNodeWitness | SFNodeNetworkLimited | SFNodeP2PV2,
+	},
+	{
+		Profile:         IdentityHonest,
+		UserAgent:       "/globalwitness:0.1.0/",
+		ProtocolVersion: MaxProtocolVersion,
+		Services:        0,
+	},
+}
+
+// Returns the built-in profile called name
+func IdentityProfile(name string) (Identity, error) {
+	for _, identity := range identityProfiles {
+		if identity.Profile == name {
+			return identity, nil
+		}
+	}
+	return Identity{}, fmt.Errorf("unknown identity profile %s", name)
+}
+
+func IdentityProfileNames() []string {
+	names := make([]string, 0, len(identityProfiles))
+	for _, identity := range identityProfiles {
+		names = append(names, identity.Profile)
+	}
+	return names
+}
+
+// Checks that the identity can go into a version message and be parsed by peers
+func (identity Identity) Validate() error {
+	if len(identity.UserAgent) > wire.MaxUserAgentLen {
+		return fmt.Errorf("user agent is longer than %d bytes", wire.MaxUserAgentLen)
+	}
+	if !strings.HasPrefix(identity.UserAgent, "/") || !strings.HasSuffix(identity.UserAgent, "/") {
+		return fmt.Errorf("user agent %s does not start and end with a slash", identity.UserAgent)
+	}
+	for _, component := range ParseUserAgent(identity.UserAgent).Components {
+		if component.Name == "" {
+			return fmt.Errorf("user agent %s has a component without a name", identity.UserAgent)
+		}
+	}
+	if identity.ProtocolVersion < wire.MultipleAddressVersion || identity.ProtocolVersion > MaxProtocolVersion {
+		return fmt.Errorf("protocol version %d is not between %d and %d", identity.ProtocolVersion,
+			wire.MultipleAddressVersion, MaxProtocolVersion)
+	}
+	return nil
+}
+
+// The identity of a session, drawn at random if there are several
+func pickIdentity(identities []Identity) Identity {
+	switch len(identities) {
+	case 0:
+		identity, _ := IdentityProfile(IdentityLegacy)
+		return identity
+	case 1:
+		return identities[0]
+	default:
+		return identities[rand.Intn(len(identities))]
+	}
+}
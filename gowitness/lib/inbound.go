@@ -0,0 +1,86 @@
+package lib
+
+import (
+	"github.com/btcsuite/btcd/chaincfg"
+	"log"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Peers connecting to us. Crawlers and spy nodes find us through the addresses we advertise, so
+// their sessions are recorded and scored like the ones we open ourselves.
+
+// Opens the listener of TransportConfig.Listen and accepts peers on it until the coordinator
+// stops, nothing happens if no address is configured
+func (cd *Coordinator) listenInbound() error {
+	if cd.TransportConfig.Listen == "" {
+		return nil
+	}
+	listener, err := net.Listen("tcp", cd.TransportConfig.Listen)
+	if err != nil {
+		return err
+	}
+	log.Println("Accepting inbound peers on", listener.Addr().String())
+
+	go func() {
+		for cd.Status() != Stopped {
+			time.Sleep(time.Second)
+		}
+		_ = listener.Close()
+	}()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if cd.Status() == Stopped {
+					return
+				}
+				log.Println("Failed to accept an inbound peer:", err.Error())
+				time.Sleep(time.Second)
+				continue
+			}
+			go cd.acceptInbound(conn)
+		}
+	}()
+	return nil
+}
+
+// Runs the session of a peer that connected to us, unless there are MaxInbound already
+func (cd *Coordinator) acceptInbound(conn net.Conn) {
+	defer atomic.AddInt64(&cd.inboundCount, -1)
+	if atomic.AddInt64(&cd.inboundCount, 1) > cd.TransportConfig.MaxInbound {
+		_ = conn.Close()
+		return
+	}
+
+	node := inboundNode(cd.DbConn, conn.RemoteAddr(), cd.HandlerConfig.ChainParams)
+	if node == nil {
+		_ = conn.Close()
+		return
+	}
+	MakeBitcoinHandler(node, cd.DbConn, cd.RedisConn, cd.HandlerConfig).RunInbound(cd, conn)
+}
+
+// The node a peer connecting from addr is recorded as: its address at the default port, where
+// a node accepting connections of its own would be found
+func inboundNode(db HandlerStorage, addr net.Addr, params *chaincfg.Params) *NodeInfo {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	port, err := strconv.ParseUint(params.DefaultPort, 10, 16)
+	if err != nil {
+		return nil
+	}
+	ip := tcpAddr.IP
+	if ipv4 := ip.To4(); ipv4 != nil {
+		ip = ipv4
+	}
+	node, added := db.AddNode(&ip, uint16(port), ReferrerInbound)
+	if node == nil || added {
+		return node
+	}
+	return db.GetNodeByConnString(node.ConnString)
+}
@@ -0,0 +1,85 @@
+package lib
+
+import (
+	"github.com/btcsuite/btcd/wire"
+	"sync/atomic"
+	"time"
+)
+
+// When we end a session on our own. Without a limit a session lasts until the peer disconnects
+// or the witness gives up on it, see WitnessConfig.IdleTimeout.
+
+const (
+	SessionEndMaxDuration = "max_duration"
+	SessionEndAddrCycles  = "addr_cycles"
+	SessionEndIdle        = "idle"
+)
+
+type SessionLifetime struct {
+	// Sessions are cut off after this long, no limit if 0
+	MaxDuration time.Duration
+	// Sessions end once the peer sent this many addr messages, no limit if 0
+	MaxAddrCycles int
+	// Sessions end once the peer sent nothing but pings and pongs for this long, no limit if 0.
+	// Pings keep the witness from timing out on a peer that has nothing to tell us.
+	Idle time.Duration
+}
+
+// Disconnects with reason recorded in the session_end event, only the first reason sticks
+func (handler *BitcoinHandler) endSession(p *Witness, reason string) {
+	handler.ending.Do(func() {
+		handler.endReason = reason
+		p.Disconnect()
+	})
+}
+
+func (handler *BitcoinHandler) onActivity(command string) {
+	if command == wire.CmdPing || command == wire.CmdPong {
+		return
+	}
+	atomic.StoreInt64(&handler.lastActivity, time.Now().UnixNano())
+}
+
+// Counts an addr message towards MaxAddrCycles. The last cycle ends once our answer, signalled
+// on sent, went out.
+func (handler *BitcoinHandler) onAddrCycle(p *Witness, sent <-chan struct{}) {
+	limit := handler.config.Lifetime.MaxAddrCycles
+	if limit > 0 && int(atomic.AddInt32(&handler.addrCycles, 1)) == limit {
+		go func() {
+			<-sent
+			handler.endSession(p, SessionEndAddrCycles)
+		}()
+	}
+}
+
+// Enforces the lifetime of the session with p until done is closed
+func (handler *BitcoinHandler) enforceLifetime(p *Witness, done <-chan struct{}) {
+	lifetime := handler.config.Lifetime
+	if lifetime.MaxDuration > 0 {
+		timeout := time.AfterFunc(lifetime.MaxDuration, func() {
+			handler.endSession(p, SessionEndMaxDuration)
+		})
+		defer timeout.Stop()
+	}
+	if lifetime.Idle <= 0 {
+		<-done
+		return
+	}
+
+	atomic.StoreInt64(&handler.lastActivity, time.Now().UnixNano())
+	timer := time.NewTimer(lifetime.Idle)
+	defer timer.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-timer.C:
+			silent := time.Since(time.Unix(0, atomic.LoadInt64(&handler.lastActivity)))
+			if silent >= lifetime.Idle {
+				handler.endSession(p, SessionEndIdle)
+				return
+			}
+			timer.Reset(lifetime.Idle - silent)
+		}
+	}
+}
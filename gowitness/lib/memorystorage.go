@@ -0,0 +1,291 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gocraft/dbr"
+	"github.com/gomodule/redigo/redis"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Keeps what a handler records in memory instead of Postgres and Redis, for tests and replays
+// that must not touch the production data
+type MemoryStorage struct {
+	mtx          sync.Mutex
+	nextId       int64
+	nodes        map[string]*NodeInfo
+	history      []NodeHistoryEntry
+	userAgents   []SessionUserAgentEntry
+	transactions map[string]TransactionEntry
+	snapshots    []MempoolSnapshotEntry
+	spyScores    []SpyScoreEntry
+	canaries     map[string]*CanaryEntry
+	sightings    []CanarySightingEntry
+	activeTags   map[string]time.Time
+}
+
+func MakeMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		nodes:        make(map[string]*NodeInfo),
+		transactions: make(map[string]TransactionEntry),
+		canaries:     make(map[string]*CanaryEntry),
+		activeTags:   make(map[string]time.Time),
+	}
+}
+
+func (storage *MemoryStorage) id() int64 {
+	storage.nextId++
+	return storage.nextId
+}
+
+// Stores node as is, with a new id unless it has one
+func (storage *MemoryStorage) PutNode(node NodeInfo) *NodeInfo {
+	storage.mtx.Lock()
+	defer storage.mtx.Unlock()
+	if node.Id <= 0 {
+		node.Id = storage.id()
+	}
+	storage.nodes[node.ConnString] = &node
+	copied := node
+	return &copied
+}
+
+func (storage *MemoryStorage) GetNodeByConnString(connString string) *NodeInfo {
+	storage.mtx.Lock()
+	defer storage.mtx.Unlock()
+	node, ok := storage.nodes[connString]
+	if !ok {
+		return nil
+	}
+	copied := *node
+	return &copied
+}
+
+func (storage *MemoryStorage) AddNode(addr *net.IP, port uint16, referrerId int64) (*NodeInfo, bool) {
+	storage.mtx.Lock()
+	defer storage.mtx.Unlock()
+	now := time.Now()
+	node := NodeInfo{
+		Id:         -1,
+		Referrer:   referrerId,
+		ConnString: fmt.Sprintf("[%s]:%d", addr.String(), port),
+		Discovery:  now,
+		LastSeen:   now,
+	}
+	if _, ok := storage.nodes[node.ConnString]; ok {
+		return &node, false
+	}
+	node.Id = storage.id()
+	stored := node
+	storage.nodes[node.ConnString] = &stored
+	return &node, true
+}
+
+func (storage *MemoryStorage) UpdateAllNode(node *NodeInfo) bool {
+	storage.mtx.Lock()
+	defer storage.mtx.Unlock()
+	for connString, stored := range storage.nodes {
+		if stored.Id == node.Id {
+			delete(storage.nodes, connString)
+			updated := *node
+			storage.nodes[node.ConnString] = &updated
+			return true
+		}
+	}
+	return true
+}
+
+func (storage *MemoryStorage) AddNodeHistory(node *NodeInfo, eventType string, timestamp time.Time,
+	data dbr.NullString) *NodeHistoryEntry {
+	storage.mtx.Lock()
+	defer storage.mtx.Unlock()
+	entry := NodeHistoryEntry{
+		Id:        storage.id(),
+		NodeId:    node.Id,
+		EventType: eventType,
+		Timestamp: timestamp,
+		Data:      data,
+	}
+	storage.history = append(storage.history, entry)
+	return &entry
+}
+
+// The history recorded so far in the order it was added
+func (storage *MemoryStorage) History() []NodeHistoryEntry {
+	storage.mtx.Lock()
+	defer storage.mtx.Unlock()
+	return append([]NodeHistoryEntry(nil), storage.history...)
+}
+
+func (storage *MemoryStorage) AddSessionUserAgent(entry *SessionUserAgentEntry) *SessionUserAgentEntry {
+	storage.mtx.Lock()
+	defer storage.mtx.Unlock()
+	entry.Id = storage.id()
+	storage.userAgents = append(storage.userAgents, *entry)
+	return entry
+}
+
+func (storage *MemoryStorage) GetReachableNodes(since time.Time, limit int) []NodeInfo {
+	storage.mtx.Lock()
+	defer storage.mtx.Unlock()
+	entries := make([]NodeInfo, 0)
+	for _, node := range storage.nodes {
+		if node.LastSeen.After(since) && node.Version != "" {
+			entries = append(entries, *node)
+		}
+	}
+	rand.Shuffle(len(entries), func(i, j int) {
+		entries[i], entries[j] = entries[j], entries[i]
+	})
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries
+}
+
+func (storage *MemoryStorage) GetSeedCandidates(maxAge time.Duration) []SeedCandidate {
+	storage.mtx.Lock()
+	defer storage.mtx.Unlock()
+	since := time.Now().Add(-maxAge)
+	candidates := make(map[int64]*SeedCandidate)
+	for _, node := range storage.nodes {
+		if !node.LastSeen.After(since) {
+			continue
+		}
+		var metadata NodeMetadata
+		_ = json.Unmarshal([]byte(node.Data.String), &metadata)
+		candidates[node.Id] = &SeedCandidate{ConnString: node.ConnString, Services: metadata.Services}
+	}
+	for _, entry := range storage.history {
+		candidate, ok := candidates[entry.NodeId]
+		if !ok || !entry.Timestamp.After(since) {
+			continue
+		}
+		switch entry.EventType {
+		case "session_begin":
+			candidate.Successes++
+			fallthrough
+		case "connect_error", "protocol_error":
+			candidate.Attempts++
+		}
+	}
+
+	entries := make([]SeedCandidate, 0, len(candidates))
+	for _, candidate := range candidates {
+		if candidate.Attempts > 0 {
+			entries = append(entries, *candidate)
+		}
+	}
+	return entries
+}
+
+func (storage *MemoryStorage) AddTransaction(entry *TransactionEntry) bool {
+	storage.mtx.Lock()
+	defer storage.mtx.Unlock()
+	if _, ok := storage.transactions[entry.TxId]; ok {
+		return false
+	}
+	storage.transactions[entry.TxId] = *entry
+	return true
+}
+
+func (storage *MemoryStorage) GetRawTransactions(txids []string) map[string][]byte {
+	storage.mtx.Lock()
+	defer storage.mtx.Unlock()
+	raw := make(map[string][]byte)
+	for _, txid := range txids {
+		if entry, ok := storage.transactions[txid]; ok {
+			raw[txid] = entry.Raw
+		}
+	}
+	return raw
+}
+
+func (storage *MemoryStorage) AddMempoolSnapshot(entry *MempoolSnapshotEntry) *MempoolSnapshotEntry {
+	storage.mtx.Lock()
+	defer storage.mtx.Unlock()
+	entry.Id = storage.id()
+	storage.snapshots = append(storage.snapshots, *entry)
+	return entry
+}
+
+// The netgroup of every node counts, not only of those that were enriched
+func (storage *MemoryStorage) CountNodesByVersionInNetgroup(version string, netgroup string, exclude int64,
+	since time.Time) int64 {
+	storage.mtx.Lock()
+	defer storage.mtx.Unlock()
+	var count int64
+	for _, node := range storage.nodes {
+		if node.Id != exclude && node.Version == version && node.LastSeen.After(since) &&
+			connStringNetgroup(node.ConnString) == netgroup {
+			count++
+		}
+	}
+	return count
+}
+
+func (storage *MemoryStorage) AddSpyScore(entry *SpyScoreEntry) *SpyScoreEntry {
+	storage.mtx.Lock()
+	defer storage.mtx.Unlock()
+	entry.Id = storage.id()
+	storage.spyScores = append(storage.spyScores, *entry)
+	return entry
+}
+
+// The spy scores recorded so far in the order they were added
+func (storage *MemoryStorage) SpyScores() []SpyScoreEntry {
+	storage.mtx.Lock()
+	defer storage.mtx.Unlock()
+	return append([]SpyScoreEntry(nil), storage.spyScores...)
+}
+
+func (storage *MemoryStorage) AddCanary(entry *CanaryEntry) *CanaryEntry {
+	storage.mtx.Lock()
+	defer storage.mtx.Unlock()
+	if _, ok := storage.nodes[entry.ConnString]; ok {
+		return nil
+	}
+	if _, ok := storage.canaries[entry.ConnString]; ok {
+		return nil
+	}
+	entry.Id = storage.id()
+	stored := *entry
+	storage.canaries[entry.ConnString] = &stored
+	return entry
+}
+
+func (storage *MemoryStorage) GetCanary(connString string) *CanaryEntry {
+	storage.mtx.Lock()
+	defer storage.mtx.Unlock()
+	entry, ok := storage.canaries[connString]
+	if !ok {
+		return nil
+	}
+	copied := *entry
+	return &copied
+}
+
+func (storage *MemoryStorage) AddCanarySighting(entry *CanarySightingEntry) *CanarySightingEntry {
+	storage.mtx.Lock()
+	defer storage.mtx.Unlock()
+	entry.Id = storage.id()
+	storage.sightings = append(storage.sightings, *entry)
+	return entry
+}
+
+func (storage *MemoryStorage) SetActiveTag(inConn redis.Conn, resource string, expirySeconds int) bool {
+	storage.mtx.Lock()
+	defer storage.mtx.Unlock()
+	storage.activeTags[resource] = time.Now().Add(time.Duration(expirySeconds) * time.Second)
+	return true
+}
+
+func (storage *MemoryStorage) RemoveActiveTag(inConn redis.Conn, resource string) error {
+	storage.mtx.Lock()
+	defer storage.mtx.Unlock()
+	delete(storage.activeTags, resource)
+	return nil
+}
@@ -0,0 +1,221 @@
+package lib
+
+import (
+	"encoding/json"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/gocraft/dbr"
+	"log"
+	"sync"
+	"time"
+)
+
+// Upper bound on the txids listed per difference in the stored data, the counts are exact
+const mempoolMaxListedDifferences = 1000
+
+type MempoolConfig struct {
+	// Time between mempool requests to a peer, snapshots are disabled if zero
+	Interval time.Duration
+	// A snapshot is complete once the peer sent no transaction inv for this long
+	QuietPeriod time.Duration
+	// A snapshot is cut off after this long even if invs keep coming
+	MaxCollection time.Duration
+	// Snapshots of other peers taken at most this far apart are compared against each other
+	CompareWindow time.Duration
+}
+
+// table mempoolsnapshots
+type MempoolSnapshotEntry struct {
+	Id        int64          `db:"id"`
+	NodeId    int64          `db:"nodeid"`
+	Timestamp time.Time      `db:"timestamp"`
+	Size      int64          `db:"size"`
+	Compared  int64          `db:"compared"`
+	Missing   int64          `db:"missing"`
+	Extra     int64          `db:"extra"`
+	Data      dbr.NullString `db:"data"`
+}
+
+// Serialized into the data column of the mempoolsnapshots table
+type MempoolDivergence struct {
+	// Transactions most of the compared peers had but this one did not
+	Missing []string
+	// Transactions none of the compared peers had
+	Extra []string
+	// Set if either list was cut short at mempoolMaxListedDifferences
+	Truncated bool
+}
+
+type mempoolSnapshot struct {
+	nodeId int64
+	taken  time.Time
+	// Peers that negotiated BIP339 list wtxids, which can only be compared among each other
+	wtxid bool
+	txids map[chainhash.Hash]struct{}
+}
+
+// Collects the invs a single peer sends in response to our mempool message
+type mempoolCollection struct {
+	mtx      sync.Mutex
+	snapshot *mempoolSnapshot
+	lastInv  time.Time
+}
+
+// Adds hash to the snapshot in progress, returns false if there is none
+func (collection *mempoolCollection) add(hash *chainhash.Hash) bool {
+	collection.mtx.Lock()
+	defer collection.mtx.Unlock()
+	if collection.snapshot == nil {
+		return false
+	}
+	collection.snapshot.txids[*hash] = struct{}{}
+	collection.lastInv = time.Now()
+	return true
+}
+
+func (collection *mempoolCollection) start(nodeId int64, wtxid bool) {
+	collection.mtx.Lock()
+	defer collection.mtx.Unlock()
+	now := time.Now()
+	collection.snapshot = &mempoolSnapshot{
+		nodeId: nodeId,
+		taken:  now,
+		wtxid:  wtxid,
+		txids:  make(map[chainhash.Hash]struct{}),
+	}
+	collection.lastInv = now
+}
+
+// Ends the collection and returns the snapshot once the peer went quiet or ran out of time
+func (collection *mempoolCollection) finish(config MempoolConfig) *mempoolSnapshot {
+	collection.mtx.Lock()
+	defer collection.mtx.Unlock()
+	if collection.snapshot == nil {
+		return nil
+	}
+	if time.Since(collection.lastInv) < config.QuietPeriod &&
+		time.Since(collection.snapshot.taken) < config.MaxCollection {
+		return nil
+	}
+	snapshot := collection.snapshot
+	collection.snapshot = nil
+	return snapshot
+}
+
+// MempoolTracker keeps the latest snapshot of every peer to diff new snapshots against
+type MempoolTracker struct {
+	mtx       sync.Mutex
+	config    MempoolConfig
+	snapshots map[int64]*mempoolSnapshot
+}
+
+func MakeMempoolTracker(config MempoolConfig) *MempoolTracker {
+	return &MempoolTracker{
+		config:    config,
+		snapshots: make(map[int64]*mempoolSnapshot),
+	}
+}
+
+func (tracker *MempoolTracker) Enabled() bool {
+	return tracker != nil && tracker.config.Interval > 0
+}
+
+// Compares snapshot against the snapshots other peers gave us around the same time, stores the
+// result and keeps snapshot around for the comparisons that follow
+func (tracker *MempoolTracker) Submit(db HandlerStorage, snapshot *mempoolSnapshot) *MempoolSnapshotEntry {
+	tracker.mtx.Lock()
+	references := make([]*mempoolSnapshot, 0)
+	for nodeId, other := range tracker.snapshots {
+		if time.Since(other.taken) > tracker.config.CompareWindow*2 {
+			delete(tracker.snapshots, nodeId)
+			continue
+		}
+		age := snapshot.taken.Sub(other.taken)
+		if nodeId != snapshot.nodeId && other.wtxid == snapshot.wtxid &&
+			age <= tracker.config.CompareWindow && age >= -tracker.config.CompareWindow {
+			references = append(references, other)
+		}
+	}
+	tracker.snapshots[snapshot.nodeId] = snapshot
+
+	// Snapshots are only replaced, never modified, so they can be read outside of the lock
+	tracker.mtx.Unlock()
+
+	counts := make(map[chainhash.Hash]int)
+	for _, reference := range references {
+		for txid := range reference.txids {
+			counts[txid]++
+		}
+	}
+
+	divergence := MempoolDivergence{Missing: make([]string, 0), Extra: make([]string, 0)}
+	var missing, extra int64
+	for txid, count := range counts {
+		if _, ok := snapshot.txids[txid]; !ok && count*2 > len(references) {
+			missing++
+			if len(divergence.Missing) < mempoolMaxListedDifferences {
+				divergence.Missing = append(divergence.Missing, txid.String())
+			} else {
+				divergence.Truncated = true
+			}
+		}
+	}
+	if len(references) > 0 {
+		for txid := range snapshot.txids {
+			if _, ok := counts[txid]; !ok {
+				extra++
+				if len(divergence.Extra) < mempoolMaxListedDifferences {
+					divergence.Extra = append(divergence.Extra, txid.String())
+				} else {
+					divergence.Truncated = true
+				}
+			}
+		}
+	}
+
+	serialized, _ := json.Marshal(&divergence)
+	return db.AddMempoolSnapshot(&MempoolSnapshotEntry{
+		NodeId:    snapshot.nodeId,
+		Timestamp: snapshot.taken,
+		Size:      int64(len(snapshot.txids)),
+		Compared:  int64(len(references)),
+		Missing:   missing,
+		Extra:     extra,
+		Data:      dbr.NewNullString(serialized),
+	})
+}
+
+// Periodically asks a peer that serves bloom filters for its mempool until it disconnects
+func (handler *BitcoinHandler) runMempoolSnapshots(p *Witness, tracker *MempoolTracker) {
+	if p.Services()&wire.SFNodeBloom != wire.SFNodeBloom {
+		return
+	}
+
+	ticker := time.NewTicker(tracker.config.Interval)
+	defer ticker.Stop()
+	for {
+		handler.mempoolCollection.start(handler.nodeInfo.Id, p.WtxidRelay())
+		p.QueueMessage(wire.NewMsgMemPool(), nil)
+
+		var snapshot *mempoolSnapshot
+		for snapshot == nil {
+			select {
+			case <-time.After(time.Second):
+				snapshot = handler.mempoolCollection.finish(tracker.config)
+			case <-p.quit:
+				return
+			}
+		}
+		entry := tracker.Submit(handler.db, snapshot)
+		if entry != nil {
+			log.Println("Mempool snapshot of", handler.nodeInfo.ConnString, "has", entry.Size,
+				"transactions,", entry.Missing, "missing and", entry.Extra, "extra compared to", entry.Compared, "peers")
+		}
+
+		select {
+		case <-ticker.C:
+		case <-p.quit:
+			return
+		}
+	}
+}
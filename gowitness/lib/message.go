@@ -0,0 +1,112 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"io"
+	"io/ioutil"
+	"strings"
+	"unicode/utf8"
+)
+
+// Constructors for the messages wire does not know about, keyed by their command
+var extensionMessages = map[string]func() wire.Message{
+	CmdSendCmpct:   func() wire.Message { return &MsgSendCmpct{} },
+	CmdCmpctBlock:  func() wire.Message { return &MsgCmpctBlock{} },
+	CmdGetBlockTxn: func() wire.Message { return &MsgGetBlockTxn{} },
+	CmdBlockTxn:    func() wire.Message { return &MsgBlockTxn{} },
+	CmdWTxIdRelay:  func() wire.Message { return &MsgWTxIdRelay{} },
+	CmdSendAddrV2:  func() wire.Message { return &MsgSendAddrV2{} },
+}
+
+// Commands wire decodes itself
+var wireCommands = map[string]struct{}{
+	wire.CmdVersion: {}, wire.CmdVerAck: {}, wire.CmdGetAddr: {}, wire.CmdAddr: {},
+	wire.CmdGetBlocks: {}, wire.CmdBlock: {}, wire.CmdInv: {}, wire.CmdGetData: {},
+	wire.CmdNotFound: {}, wire.CmdTx: {}, wire.CmdPing: {}, wire.CmdPong: {},
+	wire.CmdGetHeaders: {}, wire.CmdHeaders: {}, wire.CmdAlert: {}, wire.CmdMemPool: {},
+	wire.CmdFilterAdd: {}, wire.CmdFilterClear: {}, wire.CmdFilterLoad: {}, wire.CmdMerkleBlock: {},
+	wire.CmdReject: {}, wire.CmdSendHeaders: {}, wire.CmdFeeFilter: {}, wire.CmdGetCFilters: {},
+	wire.CmdGetCFHeaders: {}, wire.CmdGetCFCheckpt: {}, wire.CmdCFilter: {}, wire.CmdCFHeaders: {},
+	wire.CmdCFCheckpt: {},
+}
+
+// Bytes at the start of an unknown message's payload that are kept for inspection
+const unknownMessageSampleSize = 256
+
+// MsgUnknown carries a message with a command neither wire nor we know, undecoded
+type MsgUnknown struct {
+	command string
+	Payload []byte
+}
+
+func (msg *MsgUnknown) BtcDecode(r io.Reader, pver uint32, enc wire.MessageEncoding) error {
+	payload, err := ioutil.ReadAll(r)
+	msg.Payload = payload
+	return err
+}
+
+func (msg *MsgUnknown) BtcEncode(w io.Writer, pver uint32, enc wire.MessageEncoding) error {
+	_, err := w.Write(msg.Payload)
+	return err
+}
+
+func (msg *MsgUnknown) Command() string {
+	return msg.command
+}
+
+func (msg *MsgUnknown) MaxPayloadLength(pver uint32) uint32 {
+	return wire.MaxMessagePayload
+}
+
+// Reads a message like wire.ReadMessageWithEncodingN, but also decodes the commands in
+// extensionMessages and returns any other command wire does not know as MsgUnknown instead
+// of failing. Everything else is handed to wire unchanged.
+func readMessageN(r io.Reader, pver uint32, btcnet wire.BitcoinNet,
+	enc wire.MessageEncoding) (int, wire.Message, []byte, error) {
+
+	header := make([]byte, wire.MessageHeaderSize)
+	n, err := io.ReadFull(r, header)
+	if err != nil {
+		return n, nil, nil, err
+	}
+
+	// Oversized and foreign frames are left for wire to reject without reading the payload
+	length := binary.LittleEndian.Uint32(header[16:20])
+	magic := wire.BitcoinNet(binary.LittleEndian.Uint32(header[0:4]))
+	command := strings.TrimRight(string(header[4:16]), "\x00")
+	newMessage, extension := extensionMessages[command]
+	if !extension {
+		newMessage = func() wire.Message { return &MsgUnknown{command: command} }
+	}
+	_, known := wireCommands[command]
+	if length > wire.MaxMessagePayload || magic != btcnet || known || !utf8.ValidString(command) {
+		return wire.ReadMessageWithEncodingN(io.MultiReader(bytes.NewReader(header), r), pver, btcnet, enc)
+	}
+
+	msg := newMessage()
+	if maxLength := msg.MaxPayloadLength(pver); length > maxLength {
+		_, _ = io.CopyN(ioutil.Discard, r, int64(length))
+		return n, nil, nil, &wire.MessageError{Func: "readMessageN", Description: fmt.Sprintf(
+			"payload of %d bytes exceeds the maximum of %d for %s", length, maxLength, command)}
+	}
+
+	payload := make([]byte, length)
+	read, err := io.ReadFull(r, payload)
+	n += read
+	if err != nil {
+		return n, nil, nil, err
+	}
+
+	if !bytes.Equal(chainhash.DoubleHashB(payload)[0:4], header[20:24]) {
+		return n, nil, nil, &wire.MessageError{Func: "readMessageN",
+			Description: fmt.Sprintf("payload checksum of %s failed", command)}
+	}
+	if err := msg.BtcDecode(bytes.NewBuffer(payload), pver, enc); err != nil {
+		return n, nil, nil, err
+	}
+	return n, msg, payload, nil
+}
@@ -0,0 +1,315 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net"
+)
+
+// A reader for MaxMind DB files such as GeoLite2-ASN or GeoLite2-Country. The whole file is
+// loaded into memory, records are decoded into maps, slices and plain values.
+
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+const (
+	mmdbTypeExtended = 0
+	mmdbTypePointer  = 1
+	mmdbTypeString   = 2
+	mmdbTypeDouble   = 3
+	mmdbTypeBytes    = 4
+	mmdbTypeUint16   = 5
+	mmdbTypeUint32   = 6
+	mmdbTypeMap      = 7
+	mmdbTypeInt32    = 8
+	mmdbTypeUint64   = 9
+	mmdbTypeUint128  = 10
+	mmdbTypeArray    = 11
+	mmdbTypeBool     = 14
+	mmdbTypeFloat    = 15
+
+	// Separates the search tree from the data section
+	mmdbDataSeparatorSize = 16
+)
+
+type MMDBReader struct {
+	buf          []byte
+	nodeCount    uint
+	recordSize   uint
+	ipVersion    uint
+	databaseType string
+	// Start of the data section in buf
+	dataStart uint
+	// Node at which IPv4 lookups start in an IPv6 tree
+	ipv4Start uint
+}
+
+func OpenMMDB(path string) (*MMDBReader, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	markerAt := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if markerAt < 0 {
+		return nil, fmt.Errorf("%s is not a MaxMind DB file", path)
+	}
+	metadataStart := uint(markerAt + len(mmdbMetadataMarker))
+	decoded, _, err := (&mmdbDecoder{buf: buf, base: metadataStart}).decode(metadataStart)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode the metadata of %s: %s", path, err.Error())
+	}
+	metadata, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("the metadata of %s is not a map", path)
+	}
+
+	reader := &MMDBReader{buf: buf}
+	reader.nodeCount, _ = mmdbUint(metadata["node_count"])
+	reader.recordSize, _ = mmdbUint(metadata["record_size"])
+	reader.ipVersion, _ = mmdbUint(metadata["ip_version"])
+	reader.databaseType, _ = metadata["database_type"].(string)
+	if reader.recordSize != 24 && reader.recordSize != 28 && reader.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d in %s", reader.recordSize, path)
+	}
+
+	treeSize := reader.nodeCount * reader.recordSize / 4
+	reader.dataStart = treeSize + mmdbDataSeparatorSize
+	if reader.dataStart > uint(markerAt) {
+		return nil, fmt.Errorf("the search tree of %s exceeds the file", path)
+	}
+
+	if reader.ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < reader.nodeCount; i++ {
+			node, _ = reader.readNode(node, 0)
+		}
+		reader.ipv4Start = node
+	}
+	return reader, nil
+}
+
+// DatabaseType names the kind of records in the file, e.g. GeoLite2-ASN
+func (reader *MMDBReader) DatabaseType() string {
+	return reader.databaseType
+}
+
+func (reader *MMDBReader) readNode(node uint, bit uint) (uint, error) {
+	offset := node * reader.recordSize / 4
+	if offset+reader.recordSize/4 > uint(len(reader.buf)) {
+		return 0, errors.New("search tree node out of range")
+	}
+	b := reader.buf[offset:]
+	switch reader.recordSize {
+	case 24:
+		if bit == 0 {
+			return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]), nil
+		}
+		return uint(b[3])<<16 | uint(b[4])<<8 | uint(b[5]), nil
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]), nil
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6]), nil
+	default:
+		if bit == 0 {
+			return uint(binary.BigEndian.Uint32(b[0:4])), nil
+		}
+		return uint(binary.BigEndian.Uint32(b[4:8])), nil
+	}
+}
+
+// Returns the record for ip, or nil if the database has none
+func (reader *MMDBReader) Lookup(ip net.IP) (interface{}, error) {
+	address := ip.To4()
+	node := uint(0)
+	if address != nil {
+		node = reader.ipv4Start
+	} else {
+		if reader.ipVersion != 6 {
+			return nil, nil
+		}
+		address = ip.To16()
+	}
+	if address == nil {
+		return nil, fmt.Errorf("invalid IP address %v", ip)
+	}
+
+	for i := uint(0); i < uint(len(address))*8 && node < reader.nodeCount; i++ {
+		bit := uint(address[i/8]>>(7-i%8)) & 1
+		next, err := reader.readNode(node, bit)
+		if err != nil {
+			return nil, err
+		}
+		node = next
+	}
+	if node == reader.nodeCount {
+		return nil, nil
+	}
+	if node < reader.nodeCount {
+		return nil, errors.New("search tree ended before the address did")
+	}
+
+	offset := reader.dataStart + node - reader.nodeCount - mmdbDataSeparatorSize
+	record, _, err := (&mmdbDecoder{buf: reader.buf, base: reader.dataStart}).decode(offset)
+	return record, err
+}
+
+// Decodes the data section format, pointers are relative to base
+type mmdbDecoder struct {
+	buf  []byte
+	base uint
+}
+
+func (decoder *mmdbDecoder) bytes(offset, size uint) ([]byte, error) {
+	if offset+size > uint(len(decoder.buf)) || offset+size < offset {
+		return nil, errors.New("MaxMind DB field exceeds the file")
+	}
+	return decoder.buf[offset : offset+size], nil
+}
+
+func (decoder *mmdbDecoder) uint(offset, size uint) (uint64, error) {
+	b, err := decoder.bytes(offset, size)
+	if err != nil {
+		return 0, err
+	}
+	var value uint64
+	for _, c := range b {
+		value = value<<8 | uint64(c)
+	}
+	return value, nil
+}
+
+// Decodes the field at offset, returning it and the offset following it
+func (decoder *mmdbDecoder) decode(offset uint) (interface{}, uint, error) {
+	control, err := decoder.bytes(offset, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset++
+	fieldType := uint(control[0] >> 5)
+
+	if fieldType == mmdbTypePointer {
+		sizeBits := uint(control[0]>>3) & 3
+		pointer, err := decoder.uint(offset, sizeBits+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		switch sizeBits {
+		case 0:
+			pointer |= uint64(control[0]&7) << 8
+		case 1:
+			pointer = (pointer | uint64(control[0]&7)<<16) + 2048
+		case 2:
+			pointer = (pointer | uint64(control[0]&7)<<24) + 526336
+		}
+		value, _, err := decoder.decode(decoder.base + uint(pointer))
+		return value, offset + sizeBits + 1, err
+	}
+
+	if fieldType == mmdbTypeExtended {
+		extended, err := decoder.bytes(offset, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		fieldType = 7 + uint(extended[0])
+		offset++
+	}
+
+	size := uint(control[0] & 0x1f)
+	if size >= 29 {
+		extra := size - 28
+		value, err := decoder.uint(offset, extra)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += extra
+		switch extra {
+		case 1:
+			size = 29 + uint(value)
+		case 2:
+			size = 285 + uint(value)
+		default:
+			size = 65821 + uint(value)
+		}
+	}
+
+	switch fieldType {
+	case mmdbTypeString:
+		b, err := decoder.bytes(offset, size)
+		return string(b), offset + size, err
+	case mmdbTypeBytes:
+		b, err := decoder.bytes(offset, size)
+		return append([]byte{}, b...), offset + size, err
+	case mmdbTypeDouble:
+		value, err := decoder.uint(offset, 8)
+		return math.Float64frombits(value), offset + 8, err
+	case mmdbTypeFloat:
+		value, err := decoder.uint(offset, 4)
+		return float64(math.Float32frombits(uint32(value))), offset + 4, err
+	case mmdbTypeUint16, mmdbTypeUint32, mmdbTypeUint64:
+		value, err := decoder.uint(offset, size)
+		return value, offset + size, err
+	case mmdbTypeInt32:
+		value, err := decoder.uint(offset, size)
+		return int64(int32(uint32(value))), offset + size, err
+	case mmdbTypeUint128:
+		b, err := decoder.bytes(offset, size)
+		return new(big.Int).SetBytes(b), offset + size, err
+	case mmdbTypeBool:
+		return size != 0, offset, nil
+	case mmdbTypeMap:
+		record := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := decoder.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, errors.New("MaxMind DB map key is not a string")
+			}
+			value, next, err := decoder.decode(next)
+			if err != nil {
+				return nil, 0, err
+			}
+			record[name] = value
+			offset = next
+		}
+		return record, offset, nil
+	case mmdbTypeArray:
+		values := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			value, next, err := decoder.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			values = append(values, value)
+			offset = next
+		}
+		return values, offset, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported MaxMind DB field type %d", fieldType)
+	}
+}
+
+func mmdbUint(value interface{}) (uint, bool) {
+	number, ok := value.(uint64)
+	return uint(number), ok
+}
+
+// Follows path through nested maps of a record, e.g. "country", "iso_code"
+func mmdbField(record interface{}, path ...string) interface{} {
+	for _, key := range path {
+		fields, ok := record.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		record = fields[key]
+	}
+	return record
+}
@@ -0,0 +1,179 @@
+package lib
+
+import (
+	"encoding/csv"
+	"github.com/gocraft/dbr"
+	"io"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Daily reports on the size of the network. Reachable nodes are those we completed a handshake
+// with on a day, churn compares them to the day before. The unreachable population is estimated
+// by capture-recapture over addr gossip: the peers are split in two by the parity of their id,
+// each half is one capture occasion, and the addresses we failed to connect to on that day are
+// the population being estimated.
+
+const (
+	gossipSampleEven uint8 = 1
+	gossipSampleOdd  uint8 = 2
+
+	gossipFlushInterval = time.Minute * 5
+	reportInterval      = time.Hour
+)
+
+// table networkreports
+type NetworkReportEntry struct {
+	Day         time.Time       `db:"day"`
+	Reachable   int64           `db:"reachable"`
+	Joined      int64           `db:"joined"`
+	Departed    int64           `db:"departed"`
+	Known       int64           `db:"known"`
+	GossipEven  int64           `db:"gossipeven"`
+	GossipOdd   int64           `db:"gossipodd"`
+	GossipBoth  int64           `db:"gossipboth"`
+	Unreachable dbr.NullFloat64 `db:"unreachable"`
+	Updated     time.Time       `db:"updated"`
+}
+
+// GossipTracker collects which half of the peers announced each address, per day, until the
+// sightings are flushed to the database
+type GossipTracker struct {
+	mtx       sync.Mutex
+	sightings map[time.Time]map[string]uint8
+}
+
+func MakeGossipTracker() *GossipTracker {
+	return &GossipTracker{sightings: make(map[time.Time]map[string]uint8)}
+}
+
+func reportDay(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Hour * 24)
+}
+
+// Records that the peer with id nodeId announced connString
+func (tracker *GossipTracker) add(nodeId int64, connString string) {
+	if tracker == nil {
+		return
+	}
+	sample := gossipSampleEven
+	if nodeId%2 != 0 {
+		sample = gossipSampleOdd
+	}
+
+	day := reportDay(time.Now())
+	tracker.mtx.Lock()
+	defer tracker.mtx.Unlock()
+	addresses, ok := tracker.sightings[day]
+	if !ok {
+		addresses = make(map[string]uint8)
+		tracker.sightings[day] = addresses
+	}
+	addresses[connString] |= sample
+}
+
+// Writes the collected sightings to the database, they are kept for the next flush on failure
+func (tracker *GossipTracker) Flush(db *PostgresStorage) {
+	tracker.mtx.Lock()
+	sightings := tracker.sightings
+	tracker.sightings = make(map[time.Time]map[string]uint8)
+	tracker.mtx.Unlock()
+
+	for day, addresses := range sightings {
+		if db.AddGossipSightings(day, addresses) {
+			continue
+		}
+		tracker.mtx.Lock()
+		pending, ok := tracker.sightings[day]
+		if !ok {
+			pending = make(map[string]uint8)
+			tracker.sightings[day] = pending
+		}
+		for connString, samples := range addresses {
+			pending[connString] |= samples
+		}
+		tracker.mtx.Unlock()
+	}
+}
+
+// Chapman's bias corrected Lincoln-Petersen estimate of a population from two captures of
+// first and second individuals with both of them caught twice
+func chapmanEstimate(first, second, both int64) float64 {
+	return float64((first+1)*(second+1))/float64(both+1) - 1
+}
+
+// Computes the report for the day containing t and stores it
+func ComputeNetworkReport(db *PostgresStorage, t time.Time) *NetworkReportEntry {
+	day := reportDay(t)
+	entry := db.GetNetworkCounts(day)
+	if entry == nil {
+		return nil
+	}
+	if entry.GossipEven > 0 && entry.GossipOdd > 0 {
+		entry.Unreachable = dbr.NewNullFloat64(chapmanEstimate(entry.GossipEven, entry.GossipOdd, entry.GossipBoth))
+	}
+	entry.Updated = time.Now()
+	if !db.SetNetworkReport(entry) {
+		return nil
+	}
+	return entry
+}
+
+// Flushes gossip sightings and keeps the reports of today and yesterday up to date until the
+// coordinator stops
+func (cd *Coordinator) runNetworkReports() {
+	flush := time.NewTicker(gossipFlushInterval)
+	defer flush.Stop()
+	report := time.NewTicker(reportInterval)
+	defer report.Stop()
+
+	for cd.Status() != Stopped {
+		select {
+		case <-flush.C:
+			cd.GossipTracker.Flush(cd.DbConn)
+		case <-report.C:
+			cd.GossipTracker.Flush(cd.DbConn)
+			now := time.Now()
+			ComputeNetworkReport(cd.DbConn, now.Add(-time.Hour*24))
+			if entry := ComputeNetworkReport(cd.DbConn, now); entry != nil {
+				log.Println("Network report for", entry.Day.Format("2006-01-02"), "has", entry.Reachable,
+					"reachable nodes,", entry.Joined, "joined and", entry.Departed, "departed")
+			}
+		}
+	}
+}
+
+var networkReportHeader = []string{"day", "reachable", "joined", "departed", "known",
+	"gossip_even", "gossip_odd", "gossip_both", "unreachable_estimate"}
+
+// Writes reports as CSV, the estimate column is empty where there was too little gossip
+func WriteNetworkReportCSV(w io.Writer, entries []NetworkReportEntry) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(networkReportHeader); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		unreachable := ""
+		if entry.Unreachable.Valid {
+			unreachable = strconv.FormatFloat(entry.Unreachable.Float64, 'f', 0, 64)
+		}
+		record := []string{
+			entry.Day.Format("2006-01-02"),
+			strconv.FormatInt(entry.Reachable, 10),
+			strconv.FormatInt(entry.Joined, 10),
+			strconv.FormatInt(entry.Departed, 10),
+			strconv.FormatInt(entry.Known, 10),
+			strconv.FormatInt(entry.GossipEven, 10),
+			strconv.FormatInt(entry.GossipOdd, 10),
+			strconv.FormatInt(entry.GossipBoth, 10),
+			unreachable,
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
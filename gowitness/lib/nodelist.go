@@ -0,0 +1,161 @@
+package lib
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Formats understood by ImportNodes and ExportNodes
+const (
+	NodeListCSV     = "csv"
+	NodeListJSONL   = "jsonl"
+	NodeListPeers   = "peers.dat"
+	NodeListAnchors = "anchors.dat"
+)
+
+var nodeListCSVHeader = []string{"id", "connstring", "referrer", "version", "discovery", "lastseen", "data"}
+
+// Writes every row of the nodes table to w, returns the number of nodes written
+func ExportNodes(db *PostgresStorage, w io.Writer, format string) (int, error) {
+	nodes, err := db.GetNodes()
+	if err != nil {
+		return 0, err
+	}
+
+	switch format {
+	case NodeListCSV:
+		writer := csv.NewWriter(w)
+		if err := writer.Write(nodeListCSVHeader); err != nil {
+			return 0, err
+		}
+		for i, node := range nodes {
+			err := writer.Write([]string{
+				strconv.FormatInt(node.Id, 10),
+				node.ConnString,
+				strconv.FormatInt(node.Referrer, 10),
+				node.Version,
+				node.Discovery.Format(time.RFC3339),
+				node.LastSeen.Format(time.RFC3339),
+				node.Data.String,
+			})
+			if err != nil {
+				return i, err
+			}
+		}
+		writer.Flush()
+		return len(nodes), writer.Error()
+
+	case NodeListJSONL:
+		encoder := json.NewEncoder(w)
+		for i := range nodes {
+			if err := encoder.Encode(&nodes[i]); err != nil {
+				return i, err
+			}
+		}
+		return len(nodes), nil
+
+	default:
+		return 0, fmt.Errorf("unsupported export format %s", format)
+	}
+}
+
+// Reads the addresses out of a node list in the given format. Only the address is taken from
+// CSV and JSONL exports since the remaining columns describe the observations of the exporter.
+func ReadNodeList(r io.Reader, format string, params *chaincfg.Params) ([]*wire.NetAddress, error) {
+	defaultPort, err := strconv.ParseUint(params.DefaultPort, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	connstrings := make([]string, 0)
+	switch format {
+	case NodeListPeers:
+		return ReadPeersDat(r, params.Net)
+
+	case NodeListAnchors:
+		return ReadAnchorsDat(r, params.Net)
+
+	case NodeListCSV:
+		reader := csv.NewReader(r)
+		header, err := reader.Read()
+		if err != nil {
+			return nil, err
+		}
+		column := -1
+		for i, name := range header {
+			if name == "connstring" {
+				column = i
+			}
+		}
+		if column < 0 {
+			return nil, fmt.Errorf("CSV header has no connstring column")
+		}
+		for {
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			connstrings = append(connstrings, record[column])
+		}
+
+	case NodeListJSONL:
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+			node := NodeInfo{}
+			if err := json.Unmarshal(scanner.Bytes(), &node); err != nil {
+				return nil, err
+			}
+			connstrings = append(connstrings, node.ConnString)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported import format %s", format)
+	}
+
+	addrs := make([]*wire.NetAddress, 0, len(connstrings))
+	for _, connstring := range connstrings {
+		ip, port, err := parseSeedAddress(connstring, uint16(defaultPort))
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %s: %s", connstring, err.Error())
+		}
+		addrs = append(addrs, wire.NewNetAddressIPPort(ip, port, 0))
+	}
+	return addrs, nil
+}
+
+// Adds the nodes in a node list with the given referrer. Returns the number of addresses read
+// and how many of them were new to us.
+func ImportNodes(db *PostgresStorage, r io.Reader, format string, params *chaincfg.Params,
+	referrer int64) (int, int, error) {
+
+	addrs, err := ReadNodeList(r, format, params)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	added := 0
+	for _, addr := range addrs {
+		ip := net.IP(addr.IP)
+		if _, discovered := db.AddNode(&ip, addr.Port, referrer); discovered {
+			added++
+		}
+	}
+	return len(addrs), added, nil
+}
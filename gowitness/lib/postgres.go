@@ -13,6 +13,8 @@ import (
 type PostgresStorage struct {
 	connString   string
 	db           *dbr.Connection
+	history      HistoryConfig
+	historyBatch historyBatch
 }
 
 func (storage *PostgresStorage) Connect(maxOpen, maxIdle int) error {
@@ -42,6 +44,7 @@ func (storage *PostgresStorage) Close() error {
 	if connectionErr != nil {
 		return connectionErr
 	}
+	storage.FlushNodeHistory()
 
 	err := storage.db.Close()
 	if err == nil {
@@ -57,6 +60,32 @@ func (storage *PostgresStorage) checkConnected() error {
 	return nil
 }
 
+// Connects to the database described by config and makes sure it is reachable
+func ConnectPostgres(config DatabaseConfig) (*PostgresStorage, error) {
+	sslMode := config.SSLMode
+	if sslMode == "" {
+		sslMode = "disable"
+	}
+	port := config.Port
+	if port == 0 {
+		port = 5432
+	}
+	db := MakePostgresStorage(fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+		config.Address, port, config.Username, config.Password, config.Name, sslMode))
+
+	db.history = config.History
+	err := db.Connect(config.MaxOpen, config.MaxIdle)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Ping()
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
 func MakePostgresStorage(connString string) *PostgresStorage {
 	// Unnecessary abstraction but to be fixed later
 	return &PostgresStorage{
@@ -122,6 +151,7 @@ func (storage *PostgresStorage) AddNode(addr *net.IP, port uint16, referrerId in
 }
 
 
+// Queues the event for the next batch insert, the id of the returned entry stays -1
 func (storage *PostgresStorage) AddNodeHistory(node *NodeInfo, eventType string,
 	timestamp time.Time, data dbr.NullString) *NodeHistoryEntry {
 
@@ -132,26 +162,8 @@ func (storage *PostgresStorage) AddNodeHistory(node *NodeInfo, eventType string,
 		Timestamp: timestamp,
 		NodeId: node.Id,
 	}
-
-	sess := storage.db.NewSession(nil)
-	tx, err := sess.Begin()
-	if err != nil {
-		log.Printf("Error while getting session in AddNodeHistory(...): %s\n", err.Error())
-		return nil
-	}
-	defer tx.RollbackUnlessCommitted()
-
-	err = tx.InsertInto("nodehistory").Columns("nodeid", "eventtype", "timestamp", "data").Record(&entry).Returning("id").Load(&entry.Id)
-	if err != nil {
-		log.Println("Error while executing the query in AddNodeHistory(...):", err.Error())
-		return nil
-	}
-
-	err = tx.Commit()
-	if err != nil {
-		log.Println("Error while executing committing the query in AddNodeHistory(...):", err.Error())
-		return nil
-	}
+	queued := entry
+	storage.queueNodeHistory(&queued)
 	return &entry
 }
 
@@ -182,6 +194,7 @@ func (storage *PostgresStorage) UpdateAllNode(node *NodeInfo) bool {
 				Set("discovery", node.Discovery).
 				Set("lastseen", node.LastSeen).
 				Set("version", node.Version).
+				Set("data", node.Data).
 				Where("id = ?", node.Id).Exec()
 	if err != nil {
 		log.Println("Error while executing committing the query in UpdateAllNode(...):", err.Error())
@@ -203,6 +216,17 @@ func (storage *PostgresStorage) GetRandomNodes(percentage float32) []NodeInfo {
 	return entries
 }
 
+func (storage *PostgresStorage) CountNodes() int64 {
+	session := storage.db.NewSession(nil)
+	var count int64
+	err := session.Select("COUNT(*)").From("nodes").LoadOne(&count)
+	if err != nil {
+		log.Println("Error while executing the query in CountNodes():", err.Error())
+		return -1
+	}
+	return count
+}
+
 func (storage *PostgresStorage) GetRandomNode() *NodeInfo {
 	session := storage.db.NewSession(nil)
 	node := NodeInfo{}
@@ -215,13 +239,28 @@ func (storage *PostgresStorage) GetRandomNode() *NodeInfo {
 	return &node
 }
 
+// Returns up to limit random nodes that completed a handshake with us since
+func (storage *PostgresStorage) GetReachableNodes(since time.Time, limit int) []NodeInfo {
+	session := storage.db.NewSession(nil)
+	entries := make([]NodeInfo, 0)
+
+	_, err := session.SelectBySql(`SELECT * FROM nodes
+		WHERE lastseen > ? AND version <> ''
+		ORDER BY random() LIMIT ?`, since, limit).Load(&entries)
+	if err != nil {
+		log.Println("Error while executing the query in GetReachableNodes(...):", err.Error())
+		return nil
+	}
+	return entries
+}
+
 func (storage *PostgresStorage) GetNodes() ([]NodeInfo, error) {
 	connectionErr := storage.checkConnected()
 	if connectionErr != nil {
 		return nil, connectionErr
 	}
 
-	rows, err := storage.db.Query("SELECT id, connstring, referrer, discovery, lastseen, version FROM nodes")
+	rows, err := storage.db.Query("SELECT id, connstring, referrer, discovery, lastseen, version, data FROM nodes")
 	if err != nil {
 		return nil, err
 	}
@@ -229,7 +268,7 @@ func (storage *PostgresStorage) GetNodes() ([]NodeInfo, error) {
 	nodes := make([]NodeInfo, 0)
 	for rows.Next() {
 		node := NodeInfo{}
-		err = rows.Scan(&node.Id, &node.ConnString, &node.Referrer, &node.Discovery, &node.LastSeen, &node.Version)
+		err = rows.Scan(&node.Id, &node.ConnString, &node.Referrer, &node.Discovery, &node.LastSeen, &node.Version, &node.Data)
 		if err == nil {
 			nodes = append(nodes, node)
 		}
@@ -237,4 +276,581 @@ func (storage *PostgresStorage) GetNodes() ([]NodeInfo, error) {
 
 	_ = rows.Close()
 	return nodes, rows.Err()
-}
\ No newline at end of file
+}
+// table nodes joined with an aggregate over nodehistory
+type SeedCandidate struct {
+	ConnString              string              `db:"connstring"`
+	Services                uint64              `db:"services"`
+	Attempts                int64               `db:"attempts"`
+	Successes               int64               `db:"successes"`
+}
+
+// Returns the nodes that completed a handshake with us within the last maxAge together with
+// how many of our connection attempts towards them over the same window succeeded. Every attempt
+// ends in exactly one of session_begin, connect_error and protocol_error, so only those count.
+// The window ends at the retention of raw events.
+func (storage *PostgresStorage) GetSeedCandidates(maxAge time.Duration) []SeedCandidate {
+	session := storage.db.NewSession(nil)
+	entries := make([]SeedCandidate, 0)
+
+	since := storage.rawHistorySince(time.Now().Add(-maxAge))
+	_, err := session.SelectBySql(`SELECT n.connstring,
+			COALESCE((n.data::jsonb->>'Services')::bigint, 0) AS services,
+			COUNT(h.id) AS attempts,
+			COUNT(h.id) FILTER (WHERE h.eventtype = 'session_begin') AS successes
+		FROM nodes n
+		JOIN nodehistory h ON h.nodeid = n.id AND h.timestamp > ?
+			AND h.eventtype IN ('session_begin', 'connect_error', 'protocol_error')
+		WHERE n.lastseen > ?
+		GROUP BY n.id`, since, since).Load(&entries)
+	if err != nil {
+		log.Println("Error while executing the query in GetSeedCandidates(...):", err.Error())
+		return nil
+	}
+
+	return entries
+}
+
+// table transactions
+type TransactionEntry struct {
+	TxId                    string              `db:"txid"`
+	WTxId                   string              `db:"wtxid"`
+	NodeId                  int64               `db:"nodeid"`
+	FirstSeen               time.Time           `db:"firstseen"`
+	Size                    int                 `db:"size"`
+	VSize                   int                 `db:"vsize"`
+	Fee                     dbr.NullInt64       `db:"fee"`
+	FeeRate                 dbr.NullFloat64     `db:"feerate"`
+	Raw                     []byte              `db:"raw"`
+}
+
+// Stores a fetched transaction, returns false if it failed or the transaction was already known
+func (storage *PostgresStorage) AddTransaction(entry *TransactionEntry) bool {
+	session := storage.db.NewSession(nil)
+	_, err := session.InsertInto("transactions").
+		Columns("txid", "wtxid", "nodeid", "firstseen", "size", "vsize", "fee", "feerate", "raw").
+		Record(entry).
+		Exec()
+	if err != nil {
+		if strings.Index(err.Error(), "pq: duplicate key") != 0 {
+			log.Println("Error while executing the query in AddTransaction(...):", err.Error())
+		}
+		return false
+	}
+	return true
+}
+
+// Returns the raw serialization of the stored transactions among txids, keyed by txid
+func (storage *PostgresStorage) GetRawTransactions(txids []string) map[string][]byte {
+	if len(txids) == 0 {
+		return map[string][]byte{}
+	}
+
+	session := storage.db.NewSession(nil)
+	entries := make([]TransactionEntry, 0)
+
+	_, err := session.Select("txid", "raw").
+		From("transactions").
+		Where("txid IN ?", txids).
+		Load(&entries)
+	if err != nil {
+		log.Println("Error while executing the query in GetRawTransactions(...):", err.Error())
+		return nil
+	}
+
+	raw := make(map[string][]byte, len(entries))
+	for _, entry := range entries {
+		raw[entry.TxId] = entry.Raw
+	}
+	return raw
+}
+
+func (storage *PostgresStorage) AddMempoolSnapshot(entry *MempoolSnapshotEntry) *MempoolSnapshotEntry {
+	session := storage.db.NewSession(nil)
+	err := session.InsertInto("mempoolsnapshots").
+		Columns("nodeid", "timestamp", "size", "compared", "missing", "extra", "data").
+		Record(entry).
+		Returning("id").
+		Load(&entry.Id)
+	if err != nil {
+		log.Println("Error while executing the query in AddMempoolSnapshot(...):", err.Error())
+		return nil
+	}
+	return entry
+}
+
+// The latest feefilter of a node joined with its user agent
+type NodeFeeFilter struct {
+	NodeId                  int64               `db:"nodeid"`
+	Version                 string              `db:"version"`
+	MinFee                  int64               `db:"minfee"`
+}
+
+// Returns the last feefilter every node sent us since the given time, or since the retention of
+// raw events if that is later
+func (storage *PostgresStorage) GetLatestFeeFilters(since time.Time) []NodeFeeFilter {
+	session := storage.db.NewSession(nil)
+	entries := make([]NodeFeeFilter, 0)
+	since = storage.rawHistorySince(since)
+
+	_, err := session.SelectBySql(`SELECT DISTINCT ON (h.nodeid) h.nodeid, n.version,
+			(h.data::jsonb->>'MinFee')::bigint AS minfee
+		FROM nodehistory h
+		JOIN nodes n ON n.id = h.nodeid
+		WHERE h.eventtype = 'feefilter' AND h.timestamp > ?
+		ORDER BY h.nodeid, h.timestamp DESC`, since).Load(&entries)
+	if err != nil {
+		log.Println("Error while executing the query in GetLatestFeeFilters(...):", err.Error())
+		return nil
+	}
+
+	return entries
+}
+
+// Counts the nodes other than exclude with the given user agent in netgroup that were seen since
+// the given time. Nodes count once the enrichment stored their netgroup.
+func (storage *PostgresStorage) CountNodesByVersionInNetgroup(version string, netgroup string, exclude int64,
+	since time.Time) int64 {
+	session := storage.db.NewSession(nil)
+	var count int64
+	err := session.Select("COUNT(*)").
+		From(dbr.I("nodes").As("n")).
+		Join(dbr.I("nodenetworks").As("nn"), "nn.nodeid = n.id").
+		Where("nn.netgroup = ? AND n.version = ? AND n.lastseen > ? AND n.id <> ?", netgroup, version, since, exclude).
+		LoadOne(&count)
+	if err != nil {
+		log.Println("Error while executing the query in CountNodesByVersionInNetgroup(...):", err.Error())
+		return 0
+	}
+	return count
+}
+
+func (storage *PostgresStorage) AddSpyScore(entry *SpyScoreEntry) *SpyScoreEntry {
+	session := storage.db.NewSession(nil)
+	err := session.InsertInto("spyscores").
+		Columns("nodeid", "timestamp", "score", "data").
+		Record(entry).
+		Returning("id").
+		Load(&entry.Id)
+	if err != nil {
+		log.Println("Error while executing the query in AddSpyScore(...):", err.Error())
+		return nil
+	}
+	return entry
+}
+
+// Returns the nodes with the highest latest score since the given time
+func (storage *PostgresStorage) GetTopSpySuspects(since time.Time, limit uint64) []SpySuspect {
+	session := storage.db.NewSession(nil)
+	entries := make([]SpySuspect, 0)
+
+	_, err := session.SelectBySql(`SELECT * FROM (
+			SELECT DISTINCT ON (s.nodeid) s.nodeid, n.connstring, n.version, s.timestamp, s.score, s.data
+			FROM spyscores s
+			JOIN nodes n ON n.id = s.nodeid
+			WHERE s.timestamp > ?
+			ORDER BY s.nodeid, s.timestamp DESC
+		) latest
+		ORDER BY score DESC, timestamp DESC
+		LIMIT ?`, since, limit).Load(&entries)
+	if err != nil {
+		log.Println("Error while executing the query in GetTopSpySuspects(...):", err.Error())
+		return nil
+	}
+
+	return entries
+}
+
+// Returns nodes that have no row in nodenetworks yet
+func (storage *PostgresStorage) GetUnenrichedNodes(limit uint64) []NodeInfo {
+	session := storage.db.NewSession(nil)
+	nodes := make([]NodeInfo, 0)
+
+	_, err := session.SelectBySql(`SELECT n.id, n.connstring, n.referrer, n.discovery, n.lastseen, n.version, n.data
+		FROM nodes n
+		LEFT JOIN nodenetworks nn ON nn.nodeid = n.id
+		WHERE nn.nodeid IS NULL
+		LIMIT ?`, limit).Load(&nodes)
+	if err != nil {
+		log.Println("Error while executing the query in GetUnenrichedNodes(...):", err.Error())
+		return nil
+	}
+	return nodes
+}
+
+func (storage *PostgresStorage) SetNodeNetwork(entry *NodeNetworkEntry) bool {
+	_, err := storage.db.Exec(`INSERT INTO nodenetworks (nodeid, netgroup, asn, organization, updated)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (nodeid) DO UPDATE SET netgroup = EXCLUDED.netgroup, asn = EXCLUDED.asn,
+			organization = EXCLUDED.organization, updated = EXCLUDED.updated`,
+		entry.NodeId, entry.Netgroup, entry.ASN, entry.Organization, entry.Updated)
+	if err != nil {
+		log.Println("Error while executing the query in SetNodeNetwork(...):", err.Error())
+		return false
+	}
+	return true
+}
+
+// Counts the nodes seen since the given time per AS
+func (storage *PostgresStorage) GetNodesPerASN(since time.Time, limit uint64) []ASNNodeCount {
+	session := storage.db.NewSession(nil)
+	entries := make([]ASNNodeCount, 0)
+
+	_, err := session.SelectBySql(`SELECT nn.asn, nn.organization, COUNT(*) AS nodes
+		FROM nodes n
+		JOIN nodenetworks nn ON nn.nodeid = n.id
+		WHERE n.lastseen > ?
+		GROUP BY nn.asn, nn.organization
+		ORDER BY nodes DESC
+		LIMIT ?`, since, limit).Load(&entries)
+	if err != nil {
+		log.Println("Error while executing the query in GetNodesPerASN(...):", err.Error())
+		return nil
+	}
+	return entries
+}
+
+// Counts the nodes seen since the given time per AS and user agent
+func (storage *PostgresStorage) GetUserAgentsPerASN(since time.Time, limit uint64) []ASNUserAgentCount {
+	session := storage.db.NewSession(nil)
+	entries := make([]ASNUserAgentCount, 0)
+
+	_, err := session.SelectBySql(`SELECT nn.asn, nn.organization, n.version, COUNT(*) AS nodes
+		FROM nodes n
+		JOIN nodenetworks nn ON nn.nodeid = n.id
+		WHERE n.lastseen > ?
+		GROUP BY nn.asn, nn.organization, n.version
+		ORDER BY nodes DESC
+		LIMIT ?`, since, limit).Load(&entries)
+	if err != nil {
+		log.Println("Error while executing the query in GetUserAgentsPerASN(...):", err.Error())
+		return nil
+	}
+	return entries
+}
+
+// Counts the nodes discovered since the given time per netgroup and day
+func (storage *PostgresStorage) GetNewNodesPerNetgroup(since time.Time, limit uint64) []NetgroupDiscoveryCount {
+	session := storage.db.NewSession(nil)
+	entries := make([]NetgroupDiscoveryCount, 0)
+
+	_, err := session.SelectBySql(`SELECT nn.netgroup, date_trunc('day', n.discovery) AS day, COUNT(*) AS nodes
+		FROM nodes n
+		JOIN nodenetworks nn ON nn.nodeid = n.id
+		WHERE n.discovery > ? AND nn.netgroup IS NOT NULL
+		GROUP BY nn.netgroup, day
+		ORDER BY day DESC, nodes DESC
+		LIMIT ?`, since, limit).Load(&entries)
+	if err != nil {
+		log.Println("Error while executing the query in GetNewNodesPerNetgroup(...):", err.Error())
+		return nil
+	}
+	return entries
+}
+
+// Returns nodes that have no row in nodelocations yet
+func (storage *PostgresStorage) GetUnlocatedNodes(limit uint64) []NodeInfo {
+	session := storage.db.NewSession(nil)
+	nodes := make([]NodeInfo, 0)
+
+	_, err := session.SelectBySql(`SELECT n.id, n.connstring, n.referrer, n.discovery, n.lastseen, n.version, n.data
+		FROM nodes n
+		LEFT JOIN nodelocations nl ON nl.nodeid = n.id
+		WHERE nl.nodeid IS NULL
+		LIMIT ?`, limit).Load(&nodes)
+	if err != nil {
+		log.Println("Error while executing the query in GetUnlocatedNodes(...):", err.Error())
+		return nil
+	}
+	return nodes
+}
+
+func (storage *PostgresStorage) SetNodeLocation(entry *NodeLocationEntry) bool {
+	_, err := storage.db.Exec(`INSERT INTO nodelocations (nodeid, country, city, latitude, longitude, updated)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (nodeid) DO UPDATE SET country = EXCLUDED.country, city = EXCLUDED.city,
+			latitude = EXCLUDED.latitude, longitude = EXCLUDED.longitude, updated = EXCLUDED.updated`,
+		entry.NodeId, entry.Country, entry.City, entry.Latitude, entry.Longitude, entry.Updated)
+	if err != nil {
+		log.Println("Error while executing the query in SetNodeLocation(...):", err.Error())
+		return false
+	}
+	return true
+}
+
+// Counts the reachable nodes seen since the given time per country
+func (storage *PostgresStorage) GetNodesPerCountry(since time.Time) []CountryNodeCount {
+	session := storage.db.NewSession(nil)
+	entries := make([]CountryNodeCount, 0)
+
+	_, err := session.SelectBySql(`SELECT nl.country, COUNT(*) AS nodes
+		FROM nodes n
+		LEFT JOIN nodelocations nl ON nl.nodeid = n.id
+		WHERE n.lastseen > ? AND n.version <> ''
+		GROUP BY nl.country
+		ORDER BY nodes DESC`, since).Load(&entries)
+	if err != nil {
+		log.Println("Error while executing the query in GetNodesPerCountry(...):", err.Error())
+		return nil
+	}
+	return entries
+}
+
+// Returns the reachable nodes seen since the given time with their location
+func (storage *PostgresStorage) GetReachableNodeLocations(since time.Time) []NodeLocation {
+	session := storage.db.NewSession(nil)
+	entries := make([]NodeLocation, 0)
+
+	_, err := session.SelectBySql(`SELECT n.connstring, n.version, n.lastseen,
+			nl.country, nl.city, nl.latitude, nl.longitude
+		FROM nodes n
+		JOIN nodelocations nl ON nl.nodeid = n.id
+		WHERE n.lastseen > ? AND n.version <> ''`, since).Load(&entries)
+	if err != nil {
+		log.Println("Error while executing the query in GetReachableNodeLocations(...):", err.Error())
+		return nil
+	}
+	return entries
+}
+
+// Merges the samples that announced each address on day into addrgossip
+func (storage *PostgresStorage) AddGossipSightings(day time.Time, addresses map[string]uint8) bool {
+	tx, err := storage.db.Begin()
+	if err != nil {
+		log.Println("Error while beginning the transaction in AddGossipSightings(...):", err.Error())
+		return false
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`INSERT INTO addrgossip (day, connstring, samples) VALUES ($1, $2, $3)
+		ON CONFLICT (day, connstring) DO UPDATE SET samples = addrgossip.samples | EXCLUDED.samples`)
+	if err != nil {
+		log.Println("Error while preparing the query in AddGossipSightings(...):", err.Error())
+		return false
+	}
+	defer stmt.Close()
+
+	for connString, samples := range addresses {
+		if _, err := stmt.Exec(day, connString, int16(samples)); err != nil {
+			log.Println("Error while executing the query in AddGossipSightings(...):", err.Error())
+			return false
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Println("Error while committing the query in AddGossipSightings(...):", err.Error())
+		return false
+	}
+	return true
+}
+
+// Counts the reachable nodes, the churn against the previous day and the gossip captures of
+// the unreachable nodes for the UTC day starting at day. Unreachable nodes are those we failed to
+// connect to that day without completing a handshake with them. Events are taken from the raw
+// events and from the daily summaries of the events already rolled up.
+func (storage *PostgresStorage) GetNetworkCounts(day time.Time) *NetworkReportEntry {
+	session := storage.db.NewSession(nil)
+	entry := NetworkReportEntry{}
+	end, previous := day.Add(time.Hour*24), day.Add(-time.Hour*24)
+
+	_, err := session.SelectBySql(`WITH today AS (
+			SELECT nodeid FROM nodehistory
+			WHERE eventtype = 'session_begin' AND timestamp >= ? AND timestamp < ?
+			UNION
+			SELECT nodeid FROM nodehistorydaily WHERE eventtype = 'session_begin' AND day = ?::date
+		), yesterday AS (
+			SELECT nodeid FROM nodehistory
+			WHERE eventtype = 'session_begin' AND timestamp >= ? AND timestamp < ?
+			UNION
+			SELECT nodeid FROM nodehistorydaily WHERE eventtype = 'session_begin' AND day = ?::date
+		), failed AS (
+			SELECT nodeid FROM nodehistory
+			WHERE eventtype = 'connect_error' AND timestamp >= ? AND timestamp < ?
+			UNION
+			SELECT nodeid FROM nodehistorydaily WHERE eventtype = 'connect_error' AND day = ?::date
+		), unreachable AS (
+			SELECT g.samples FROM addrgossip g
+			JOIN nodes n ON n.connstring = g.connstring
+			WHERE g.day = ? AND n.id IN (SELECT nodeid FROM failed) AND n.id NOT IN (SELECT nodeid FROM today)
+		)
+		SELECT
+			(SELECT COUNT(*) FROM today) AS reachable,
+			(SELECT COUNT(*) FROM today WHERE nodeid NOT IN (SELECT nodeid FROM yesterday)) AS joined,
+			(SELECT COUNT(*) FROM yesterday WHERE nodeid NOT IN (SELECT nodeid FROM today)) AS departed,
+			(SELECT COUNT(*) FROM nodes WHERE discovery < ?) AS known,
+			(SELECT COUNT(*) FROM unreachable WHERE samples & 1 <> 0) AS gossipeven,
+			(SELECT COUNT(*) FROM unreachable WHERE samples & 2 <> 0) AS gossipodd,
+			(SELECT COUNT(*) FROM unreachable WHERE samples = 3) AS gossipboth`,
+		day, end, day.Format("2006-01-02"), previous, day, previous.Format("2006-01-02"),
+		day, end, day.Format("2006-01-02"), day, end).Load(&entry)
+	if err != nil {
+		log.Println("Error while executing the query in GetNetworkCounts(...):", err.Error())
+		return nil
+	}
+	entry.Day = day
+	return &entry
+}
+
+func (storage *PostgresStorage) SetNetworkReport(entry *NetworkReportEntry) bool {
+	_, err := storage.db.Exec(`INSERT INTO networkreports
+			(day, reachable, joined, departed, known, gossipeven, gossipodd, gossipboth, unreachable, updated)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (day) DO UPDATE SET reachable = EXCLUDED.reachable, joined = EXCLUDED.joined,
+			departed = EXCLUDED.departed, known = EXCLUDED.known, gossipeven = EXCLUDED.gossipeven,
+			gossipodd = EXCLUDED.gossipodd, gossipboth = EXCLUDED.gossipboth,
+			unreachable = EXCLUDED.unreachable, updated = EXCLUDED.updated`,
+		entry.Day, entry.Reachable, entry.Joined, entry.Departed, entry.Known,
+		entry.GossipEven, entry.GossipOdd, entry.GossipBoth, entry.Unreachable, entry.Updated)
+	if err != nil {
+		log.Println("Error while executing the query in SetNetworkReport(...):", err.Error())
+		return false
+	}
+	return true
+}
+
+// Returns the stored reports from the given day on, oldest first
+func (storage *PostgresStorage) GetNetworkReports(since time.Time) []NetworkReportEntry {
+	session := storage.db.NewSession(nil)
+	entries := make([]NetworkReportEntry, 0)
+
+	_, err := session.Select("*").
+		From("networkreports").
+		Where("day >= ?", since).
+		OrderBy("day").
+		Load(&entries)
+	if err != nil {
+		log.Println("Error while executing the query in GetNetworkReports(...):", err.Error())
+		return nil
+	}
+	return entries
+}
+
+func (storage *PostgresStorage) AddSessionUserAgent(entry *SessionUserAgentEntry) *SessionUserAgentEntry {
+	session := storage.db.NewSession(nil)
+	err := session.InsertInto("sessionuseragents").
+		Columns("nodeid", "timestamp", "raw", "implementation", "version", "comments").
+		Record(entry).
+		Returning("id").
+		Load(&entry.Id)
+	if err != nil {
+		log.Println("Error while executing the query in AddSessionUserAgent(...):", err.Error())
+		return nil
+	}
+	return entry
+}
+
+// Counts the nodes per day and implementation, or per implementation version if byVersion is
+// set, since the given time. An empty implementation includes all of them.
+func (storage *PostgresStorage) GetUserAgentAdoption(since time.Time, byVersion bool, implementation string) []UserAgentAdoption {
+	session := storage.db.NewSession(nil)
+	entries := make([]UserAgentAdoption, 0)
+
+	version := "''"
+	if byVersion {
+		version = "s.version"
+	}
+	_, err := session.SelectBySql(`WITH sessions AS (
+			SELECT date_trunc('day', timestamp) AS day, nodeid, implementation, version
+			FROM sessionuseragents
+			WHERE timestamp > ?
+		), totals AS (
+			SELECT day, COUNT(DISTINCT nodeid) AS total FROM sessions GROUP BY day
+		)
+		SELECT s.day, s.implementation, `+version+` AS version, COUNT(DISTINCT s.nodeid) AS nodes,
+			COUNT(DISTINCT s.nodeid)::DOUBLE PRECISION / t.total AS share
+		FROM sessions s
+		JOIN totals t ON t.day = s.day
+		WHERE ? = '' OR s.implementation = ?
+		GROUP BY s.day, s.implementation, `+version+`, t.total
+		ORDER BY s.day, nodes DESC`, since, implementation, implementation).Load(&entries)
+	if err != nil {
+		log.Println("Error while executing the query in GetUserAgentAdoption(...):", err.Error())
+		return nil
+	}
+	return entries
+}
+
+// Starting heights of the nodes seen since, most recently seen first
+func (storage *PostgresStorage) GetRecentStartingHeights(since time.Time, limit uint64) []StartingHeight {
+	session := storage.db.NewSession(nil)
+	entries := make([]StartingHeight, 0)
+
+	_, err := session.SelectBySql(`SELECT (data::json->>'StartingHeight')::integer AS height, lastseen
+		FROM nodes
+		WHERE lastseen > ? AND data IS NOT NULL
+		ORDER BY lastseen DESC
+		LIMIT ?`, since, limit).Load(&entries)
+	if err != nil {
+		log.Println("Error while executing the query in GetRecentStartingHeights(...):", err.Error())
+		return nil
+	}
+	return entries
+}
+
+// Records a canary unless its address is already known, as a node or an earlier canary. Returns
+// nil in that case as well as on errors.
+func (storage *PostgresStorage) AddCanary(entry *CanaryEntry) *CanaryEntry {
+	session := storage.db.NewSession(nil)
+	ids := make([]int64, 0)
+	_, err := session.SelectBySql(`INSERT INTO canaries (connstring, nodeid, injected)
+		SELECT ?, ?, ? WHERE NOT EXISTS (SELECT 1 FROM nodes WHERE connstring = ?)
+		ON CONFLICT (connstring) DO NOTHING
+		RETURNING id`, entry.ConnString, entry.NodeId, entry.Injected, entry.ConnString).Load(&ids)
+	if err != nil {
+		log.Println("Error while executing the query in AddCanary(...):", err.Error())
+		return nil
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	entry.Id = ids[0]
+	return entry
+}
+
+func (storage *PostgresStorage) GetCanary(connString string) *CanaryEntry {
+	session := storage.db.NewSession(nil)
+	entry := CanaryEntry{}
+	err := session.Select("*").From("canaries").Where("connstring = ?", connString).LoadOne(&entry)
+	if err != nil {
+		if err != dbr.ErrNotFound {
+			log.Println("Error while executing the query in GetCanary(...):", err.Error())
+		}
+		return nil
+	}
+	return &entry
+}
+
+func (storage *PostgresStorage) AddCanarySighting(entry *CanarySightingEntry) *CanarySightingEntry {
+	session := storage.db.NewSession(nil)
+	err := session.InsertInto("canarysightings").
+		Columns("canaryid", "nodeid", "timestamp", "advertised").
+		Record(entry).
+		Returning("id").
+		Load(&entry.Id)
+	if err != nil {
+		log.Println("Error while executing the query in AddCanarySighting(...):", err.Error())
+		return nil
+	}
+	return entry
+}
+
+// Returns the canaries injected since the given time with each of their sightings, ordered by
+// injection and sighting time
+func (storage *PostgresStorage) GetCanarySightings(since time.Time) []CanarySightingRow {
+	session := storage.db.NewSession(nil)
+	entries := make([]CanarySightingRow, 0)
+
+	_, err := session.SelectBySql(`SELECT c.connstring AS canary, t.connstring AS target, c.injected,
+			r.connstring AS reporter, s.timestamp AS seen, s.advertised
+		FROM canaries c
+		JOIN nodes t ON t.id = c.nodeid
+		LEFT JOIN canarysightings s ON s.canaryid = c.id
+		LEFT JOIN nodes r ON r.id = s.nodeid
+		WHERE c.injected > ?
+		ORDER BY c.injected, c.id, s.timestamp`, since).Load(&entries)
+	if err != nil {
+		log.Println("Error while executing the query in GetCanarySightings(...):", err.Error())
+		return nil
+	}
+	return entries
+}
@@ -0,0 +1,127 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/wire"
+	"log"
+	"net"
+	"time"
+)
+
+// Normalizes an address given by an operator, with or without port, into the [ip]:port form of
+// the connstring column
+func ConnStringFor(addr string, defaultPort uint16) (string, error) {
+	ip, port, err := parseSeedAddress(addr, defaultPort)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("[%s]:%d", ip.String(), port), nil
+}
+
+// Connects to connString, over the v2 transport first if tryV2, and returns the connection along
+// with the transport it speaks
+func dialPeer(connString string, config HandlerConfig, tryV2 bool, handshakeTimeout time.Duration) (net.Conn, string, error) {
+	conn, err := config.dial(connString)
+	if err != nil {
+		return nil, "", err
+	}
+	if !tryV2 {
+		return conn, TransportV1, nil
+	}
+
+	v2, err := NewV2Conn(conn, config.ChainParams.Net, handshakeTimeout)
+	if err == nil {
+		return v2, TransportV2, nil
+	}
+	// The peer hangs up on what looks like garbage to a v1 node, so retry without v2
+	log.Println("v2 handshake with", connString, "failed, falling back to v1:", err.Error())
+	_ = conn.Close()
+	conn, err = config.dial(connString)
+	if err != nil {
+		return nil, "", err
+	}
+	return conn, TransportV1, nil
+}
+
+// What a single handshake told us about a node
+type ProbeResult struct {
+	ConnString string
+	Transport  string
+	Identity   Identity
+	// Seconds from dialing until the verack arrived
+	HandshakeDuration float64
+	Version           *wire.MsgVersion
+	Services          []string
+	Stats             *StatsSnap
+}
+
+// Probe completes the version handshake with connString and disconnects right after, nothing is
+// recorded in the database
+func Probe(connString string, config HandlerConfig, transport TransportConfig) (*ProbeResult, error) {
+	versions := make(chan *wire.MsgVersion, 1)
+	verAcks := make(chan struct{}, 1)
+	// Without peers observed before, only the fixed policy advertises a height
+	if config.NewestBlock == nil {
+		config.NewestBlock = MakeTipTracker(config.Tip).NewestBlock
+	}
+	identity := pickIdentity(config.Identities)
+	peerCfg := config.witnessConfig(identity)
+	peerCfg.Listeners.OnVersion = func(p *Witness, msg *wire.MsgVersion) *wire.MsgReject {
+		select {
+		case versions <- msg:
+		default:
+		}
+		return nil
+	}
+	peerCfg.Listeners.OnVerAck = func(p *Witness, msg *wire.MsgVerAck) {
+		select {
+		case verAcks <- struct{}{}:
+		default:
+		}
+	}
+
+	started := time.Now()
+	conn, transportUsed, err := dialPeer(connString, config, transport.V2, transport.HandshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	p, err := NewOutboundPeer(peerCfg, connString)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	disconnected := make(chan struct{})
+	p.AssociateConnection(conn)
+	go func() {
+		p.WaitForDisconnect()
+		close(disconnected)
+	}()
+	defer func() {
+		p.Disconnect()
+		<-disconnected
+	}()
+
+	select {
+	case <-verAcks:
+	case <-disconnected:
+		return nil, errors.New("peer disconnected during the handshake")
+	case <-time.After(config.NegotiateTimeout):
+		return nil, errors.New("timed out waiting for the verack")
+	}
+
+	result := &ProbeResult{
+		ConnString:        connString,
+		Transport:         transportUsed,
+		Identity:          identity,
+		HandshakeDuration: time.Since(started).Seconds(),
+		Stats:             p.StatsSnapshot(),
+	}
+	select {
+	case result.Version = <-versions:
+	default:
+	}
+	result.Services = ServiceFlagNames(result.Stats.Services)
+	return result, nil
+}
@@ -0,0 +1,138 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/btcsuite/btcd/wire"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Peers that never get an answer to their requests take us for a broken node and some drop us.
+// We answer them like a pruned node: headers from the HeaderChain, notfound for any block or
+// transaction and a sample of the reachable nodes we know of for a getaddr.
+
+type ResponderConfig struct {
+	// Answer getheaders and getdata, both are ignored otherwise
+	Enabled bool
+	// Addresses sent in answer to the first getaddr of a session, getaddr is ignored if 0
+	GetAddrSize int
+	// Only nodes seen this recently are sent
+	GetAddrMaxAge time.Duration
+
+	// Answers getaddr from a pool shared by all sessions, set by MakeCoordinator
+	getAddr *sampleAddrPolicy
+}
+
+func (config ResponderConfig) Validate() error {
+	if config.GetAddrSize < 0 || config.GetAddrSize > wire.MaxAddrPerMsg {
+		return fmt.Errorf("the getaddr size must be between 0 and %d", wire.MaxAddrPerMsg)
+	}
+	if config.GetAddrSize > 0 && config.GetAddrMaxAge <= 0 {
+		return fmt.Errorf("answering getaddr needs a positive maximum age")
+	}
+	return nil
+}
+
+func (handler *BitcoinHandler) onHeadersHandler(p *Witness, msg *wire.MsgHeaders) {
+	handler.onAnnouncedHeaders(p, msg.Headers)
+}
+
+// Feeds the header chain. An announcement that does not connect means we missed blocks, so we
+// ask for the headers since our tip and keep the announcement until the answer arrives. Should
+// the answer not connect either, the peer does not follow our chain at all and we start over
+// with the announcement. Longer messages than an announcement are only ever answers, which keeps
+// a peer whose chain never connects to ours from making us ask again and again.
+func (handler *BitcoinHandler) onAnnouncedHeaders(p *Witness, headers []*wire.BlockHeader) {
+	connected := true
+	for _, header := range headers {
+		connected = handler.headers.Add(header) && connected
+	}
+	announcement := handler.unconnectedHeaders
+	handler.unconnectedHeaders = nil
+	if connected {
+		return
+	}
+	if announcement != nil {
+		if handler.headers.Restart(announcement) {
+			log.Println("Restarted the header chain from", handler.nodeInfo.ConnString)
+		}
+		return
+	}
+	if len(headers) > maxHeadersAnnouncement {
+		return
+	}
+
+	last := headers[len(headers)-1].BlockHash()
+	if err := p.PushGetHeadersMsg(handler.headers.Locator(), &last); err != nil {
+		log.Println("Error creating getheaders message:", err.Error())
+		return
+	}
+	handler.unconnectedHeaders = headers
+}
+
+func (handler *BitcoinHandler) onGetHeadersHandler(p *Witness, msg *wire.MsgGetHeaders) {
+	if !handler.config.Responder.Enabled {
+		return
+	}
+	reply := wire.NewMsgHeaders()
+	for _, header := range handler.headers.HeadersAfter(msg.BlockLocatorHashes, &msg.HashStop) {
+		_ = reply.AddBlockHeader(header)
+	}
+	p.QueueMessage(reply, nil)
+}
+
+// We keep no blocks or transactions, everything requested is notfound
+func (handler *BitcoinHandler) onGetDataHandler(p *Witness, msg *wire.MsgGetData) {
+	if !handler.config.Responder.Enabled || len(msg.InvList) == 0 {
+		return
+	}
+	reply := wire.NewMsgNotFound()
+	for _, inv := range msg.InvList {
+		_ = reply.AddInvVect(inv)
+	}
+	p.QueueMessage(reply, nil)
+}
+
+// Like Core, only the first getaddr of a session is answered
+func (handler *BitcoinHandler) onGetAddrHandler(p *Witness, msg *wire.MsgGetAddr) {
+	config := handler.config.Responder
+	if config.GetAddrSize == 0 || handler.answeredGetAddr {
+		return
+	}
+	handler.answeredGetAddr = true
+
+	if config.getAddr == nil {
+		return
+	}
+	addresses := config.getAddr.Addresses(handler)
+	if _, err := p.PushAddrMsg(addresses); err != nil {
+		log.Println("Error while answering getaddr of", handler.nodeInfo.ConnString, ":", err.Error())
+	}
+}
+
+// The address of a node as gossiped, with the services of its last handshake. Nil if its
+// connstring is not an IP address.
+func nodeNetAddress(node *NodeInfo) *wire.NetAddress {
+	host, port, err := net.SplitHostPort(node.ConnString)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	iport, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		return nil
+	}
+	metadata := NodeMetadata{}
+	if node.Data.Valid {
+		_ = json.Unmarshal([]byte(node.Data.String), &metadata)
+	}
+	return &wire.NetAddress{
+		Timestamp: node.LastSeen,
+		Services:  wire.ServiceFlag(metadata.Services),
+		IP:        ip,
+		Port:      uint16(iport),
+	}
+}
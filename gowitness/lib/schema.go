@@ -0,0 +1,129 @@
+package lib
+
+import (
+	"fmt"
+)
+
+// Tables beyond nodes and nodehistory are created by us on startup. Every statement has to be
+// safe to run against a database that already has them. Nodehistory is partitioned by
+// MaintainNodeHistory instead, converting it takes too long to happen on every startup.
+var schemaStatements = []string{
+	`CREATE TABLE IF NOT EXISTS transactions (
+		txid      CHAR(64) PRIMARY KEY,
+		wtxid     CHAR(64) NOT NULL,
+		nodeid    BIGINT NOT NULL,
+		firstseen TIMESTAMPTZ NOT NULL,
+		size      INTEGER NOT NULL,
+		vsize     INTEGER NOT NULL,
+		fee       BIGINT,
+		feerate   DOUBLE PRECISION,
+		raw       BYTEA NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS transactions_firstseen_idx ON transactions (firstseen)`,
+	`CREATE INDEX IF NOT EXISTS transactions_nodeid_idx ON transactions (nodeid)`,
+	`CREATE TABLE IF NOT EXISTS mempoolsnapshots (
+		id        BIGSERIAL PRIMARY KEY,
+		nodeid    BIGINT NOT NULL,
+		timestamp TIMESTAMPTZ NOT NULL,
+		size      BIGINT NOT NULL,
+		compared  BIGINT NOT NULL,
+		missing   BIGINT NOT NULL,
+		extra     BIGINT NOT NULL,
+		data      TEXT
+	)`,
+	`CREATE INDEX IF NOT EXISTS mempoolsnapshots_nodeid_timestamp_idx ON mempoolsnapshots (nodeid, timestamp)`,
+	`CREATE TABLE IF NOT EXISTS spyscores (
+		id        BIGSERIAL PRIMARY KEY,
+		nodeid    BIGINT NOT NULL,
+		timestamp TIMESTAMPTZ NOT NULL,
+		score     DOUBLE PRECISION NOT NULL,
+		data      TEXT
+	)`,
+	`CREATE INDEX IF NOT EXISTS spyscores_nodeid_timestamp_idx ON spyscores (nodeid, timestamp)`,
+	`CREATE TABLE IF NOT EXISTS nodenetworks (
+		nodeid       BIGINT PRIMARY KEY,
+		netgroup     TEXT,
+		asn          BIGINT,
+		organization TEXT,
+		updated      TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS nodenetworks_asn_idx ON nodenetworks (asn)`,
+	`CREATE INDEX IF NOT EXISTS nodenetworks_netgroup_idx ON nodenetworks (netgroup)`,
+	`CREATE TABLE IF NOT EXISTS nodelocations (
+		nodeid    BIGINT PRIMARY KEY,
+		country   CHAR(2),
+		city      TEXT,
+		latitude  DOUBLE PRECISION,
+		longitude DOUBLE PRECISION,
+		updated   TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS nodelocations_country_idx ON nodelocations (country)`,
+	`CREATE TABLE IF NOT EXISTS addrgossip (
+		day        DATE NOT NULL,
+		connstring TEXT NOT NULL,
+		samples    SMALLINT NOT NULL,
+		PRIMARY KEY (day, connstring)
+	)`,
+	`CREATE TABLE IF NOT EXISTS sessionuseragents (
+		id             BIGSERIAL PRIMARY KEY,
+		nodeid         BIGINT NOT NULL,
+		timestamp      TIMESTAMPTZ NOT NULL,
+		raw            TEXT NOT NULL,
+		implementation TEXT NOT NULL,
+		version        TEXT NOT NULL,
+		comments       TEXT
+	)`,
+	`CREATE INDEX IF NOT EXISTS sessionuseragents_timestamp_idx ON sessionuseragents (timestamp)`,
+	`CREATE TABLE IF NOT EXISTS networkreports (
+		day         DATE PRIMARY KEY,
+		reachable   BIGINT NOT NULL,
+		joined      BIGINT NOT NULL,
+		departed    BIGINT NOT NULL,
+		known       BIGINT NOT NULL,
+		gossipeven  BIGINT NOT NULL,
+		gossipodd   BIGINT NOT NULL,
+		gossipboth  BIGINT NOT NULL,
+		unreachable DOUBLE PRECISION,
+		updated     TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS canaries (
+		id         BIGSERIAL PRIMARY KEY,
+		connstring TEXT NOT NULL UNIQUE,
+		nodeid     BIGINT NOT NULL,
+		injected   TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS canaries_injected_idx ON canaries (injected)`,
+	`CREATE TABLE IF NOT EXISTS canarysightings (
+		id         BIGSERIAL PRIMARY KEY,
+		canaryid   BIGINT NOT NULL,
+		nodeid     BIGINT NOT NULL,
+		timestamp  TIMESTAMPTZ NOT NULL,
+		advertised TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS canarysightings_canaryid_idx ON canarysightings (canaryid)`,
+	`CREATE TABLE IF NOT EXISTS nodehistorydaily (
+		day       DATE NOT NULL,
+		nodeid    BIGINT NOT NULL,
+		eventtype TEXT NOT NULL,
+		events    BIGINT NOT NULL,
+		first     TIMESTAMPTZ NOT NULL,
+		last      TIMESTAMPTZ NOT NULL,
+		PRIMARY KEY (day, nodeid, eventtype)
+	)`,
+	`CREATE INDEX IF NOT EXISTS nodehistorydaily_nodeid_day_idx ON nodehistorydaily (nodeid, day)`,
+}
+
+// Creates the tables and indexes that are missing from the database
+func (storage *PostgresStorage) Migrate() error {
+	connectionErr := storage.checkConnected()
+	if connectionErr != nil {
+		return connectionErr
+	}
+
+	for _, statement := range schemaStatements {
+		if _, err := storage.db.Exec(statement); err != nil {
+			return fmt.Errorf("failed to migrate the schema: %s", err.Error())
+		}
+	}
+	return nil
+}
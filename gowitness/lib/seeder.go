@@ -0,0 +1,322 @@
+package lib
+
+import (
+	"fmt"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+	"golang.org/x/net/dns/dnsmessage"
+	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxDNSMessageSize = 512
+
+type SeederConfig struct {
+	// Only nodes on the default port of this chain are served, since DNS answers carry no port
+	ChainParams *chaincfg.Params
+	Port        uint16
+	BindAddress string
+	// Zone we are authoritative for, e.g. seed.example.com
+	Domain string
+	// Hostname of the NS record pointing at this instance
+	Nameserver string
+	// Responsible party mailbox in the SOA record, e.g. hostmaster.example.com
+	Mailbox    string
+	TTL        uint32
+	MaxAnswers int
+	// Only nodes that completed a handshake with us within this window are served
+	MaxAge time.Duration
+	// Minimum ratio of successful sessions to connection attempts within MaxAge
+	MinUptime       float64
+	RefreshInterval time.Duration
+}
+
+// Where the DNSSeeder reads the nodes it serves from, PostgresStorage when crawling
+type SeedStorage interface {
+	GetSeedCandidates(maxAge time.Duration) []SeedCandidate
+}
+
+type seedEntry struct {
+	ip       net.IP
+	services wire.ServiceFlag
+}
+
+// Answers A/AAAA queries for Domain with a random subset of known-good nodes in the same manner
+// the reference bitcoin-seeder does, including the x<hex> subdomains that filter by service bits
+type DNSSeeder struct {
+	config      SeederConfig
+	storage     func() SeedStorage // returns nil until storage is connected
+	zone        string
+	defaultPort string
+	seedsMtx    sync.RWMutex
+	seeds       []seedEntry
+}
+
+func MakeDNSSeeder(coordinator *Coordinator, config SeederConfig) (*DNSSeeder, error) {
+	return makeDNSSeeder(func() SeedStorage {
+		if storage := coordinator.Storage(); storage != nil {
+			return storage
+		}
+		return nil
+	}, config)
+}
+
+func makeDNSSeeder(storage func() SeedStorage, config SeederConfig) (*DNSSeeder, error) {
+	for _, name := range []string{config.Domain, config.Nameserver, config.Mailbox} {
+		if _, err := dnsmessage.NewName(canonicalDomain(name)); err != nil {
+			return nil, fmt.Errorf("invalid DNSSeeder name %s: %s", name, err.Error())
+		}
+	}
+	return &DNSSeeder{
+		config:      config,
+		storage:     storage,
+		zone:        canonicalDomain(config.Domain),
+		defaultPort: config.ChainParams.DefaultPort,
+		seeds:       make([]seedEntry, 0),
+	}, nil
+}
+
+// Names are validated up front in MakeDNSSeeder so this can not fail at query time
+func mustNewName(name string) dnsmessage.Name {
+	n, err := dnsmessage.NewName(name)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func canonicalDomain(domain string) string {
+	domain = strings.ToLower(domain)
+	if !strings.HasSuffix(domain, ".") {
+		domain += "."
+	}
+	return domain
+}
+
+// Reloads the set of nodes we hand out from the database
+func (seeder *DNSSeeder) refresh() {
+	storage := seeder.storage()
+	if storage == nil {
+		return
+	}
+	candidates := storage.GetSeedCandidates(seeder.config.MaxAge)
+	if candidates == nil {
+		return
+	}
+
+	seeds := make([]seedEntry, 0, len(candidates))
+	for _, candidate := range candidates {
+		if candidate.Attempts == 0 ||
+			float64(candidate.Successes)/float64(candidate.Attempts) < seeder.config.MinUptime {
+			continue
+		}
+		host, port, err := net.SplitHostPort(candidate.ConnString)
+		if err != nil || port != seeder.defaultPort {
+			continue
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			continue
+		}
+		seeds = append(seeds, seedEntry{ip: ip, services: wire.ServiceFlag(candidate.Services)})
+	}
+
+	seeder.seedsMtx.Lock()
+	seeder.seeds = seeds
+	seeder.seedsMtx.Unlock()
+	log.Println("DNSSeeder is now serving", len(seeds), "out of", len(candidates), "candidate nodes")
+}
+
+// Returns up to MaxAnswers random seeds of the requested address family that advertise
+// all the requested services
+func (seeder *DNSSeeder) sample(ipv6 bool, services wire.ServiceFlag) []net.IP {
+	seeder.seedsMtx.RLock()
+	matching := make([]net.IP, 0)
+	for _, seed := range seeder.seeds {
+		if (seed.ip.To4() == nil) != ipv6 || seed.services&services != services {
+			continue
+		}
+		matching = append(matching, seed.ip)
+	}
+	seeder.seedsMtx.RUnlock()
+
+	rand.Shuffle(len(matching), func(i, j int) {
+		matching[i], matching[j] = matching[j], matching[i]
+	})
+	if len(matching) > seeder.config.MaxAnswers {
+		matching = matching[:seeder.config.MaxAnswers]
+	}
+	return matching
+}
+
+// Parses the part of the query name in front of our zone. The apex serves nodes with
+// NODE_NETWORK, while x<hex> requires the given service bits instead.
+func parseServiceFilter(label string) (wire.ServiceFlag, bool) {
+	if label == "" {
+		return wire.SFNodeNetwork, true
+	}
+	if len(label) < 2 || label[0] != 'x' || strings.Contains(label, ".") {
+		return 0, false
+	}
+	flags, err := strconv.ParseUint(label[1:], 16, 64)
+	if err != nil {
+		return 0, false
+	}
+	return wire.ServiceFlag(flags), true
+}
+
+func (seeder *DNSSeeder) soa() (dnsmessage.ResourceHeader, dnsmessage.SOAResource) {
+	header := dnsmessage.ResourceHeader{
+		Name:  mustNewName(seeder.zone),
+		Type:  dnsmessage.TypeSOA,
+		Class: dnsmessage.ClassINET,
+		TTL:   seeder.config.TTL,
+	}
+	return header, dnsmessage.SOAResource{
+		NS:      mustNewName(canonicalDomain(seeder.config.Nameserver)),
+		MBox:    mustNewName(canonicalDomain(seeder.config.Mailbox)),
+		Serial:  uint32(time.Now().Unix()),
+		Refresh: 604800,
+		Retry:   86400,
+		Expire:  2592000,
+		MinTTL:  seeder.config.TTL,
+	}
+}
+
+// Builds the response for a single DNS query packet. Returns nil if the packet should be dropped.
+func (seeder *DNSSeeder) handleQuery(packet []byte) []byte {
+	var request dnsmessage.Message
+	if err := request.Unpack(packet); err != nil || request.Header.Response || len(request.Questions) == 0 {
+		return nil
+	}
+
+	question := request.Questions[0]
+	response := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               request.Header.ID,
+			Response:         true,
+			OpCode:           request.Header.OpCode,
+			Authoritative:    true,
+			RecursionDesired: request.Header.RecursionDesired,
+		},
+		Questions: []dnsmessage.Question{question},
+	}
+
+	name := strings.ToLower(question.Name.String())
+	switch {
+	case request.Header.OpCode != 0:
+		response.Header.RCode = dnsmessage.RCodeNotImplemented
+	case question.Class != dnsmessage.ClassINET:
+		response.Header.RCode = dnsmessage.RCodeRefused
+	case name != seeder.zone && !strings.HasSuffix(name, "."+seeder.zone):
+		response.Header.Authoritative = false
+		response.Header.RCode = dnsmessage.RCodeRefused
+	default:
+		seeder.answer(&response, question, strings.TrimSuffix(strings.TrimSuffix(name, seeder.zone), "."))
+	}
+
+	// Stay within the classic 512 byte UDP limit by handing out fewer nodes rather than
+	// setting TC, since any subset is as good as the next one
+	for {
+		serialized, err := response.Pack()
+		if err != nil {
+			log.Println("Failed to serialize DNS response:", err.Error())
+			return nil
+		}
+		if len(serialized) <= maxDNSMessageSize || len(response.Answers) == 0 {
+			return serialized
+		}
+		response.Answers = response.Answers[:len(response.Answers)-1]
+	}
+}
+
+func (seeder *DNSSeeder) answer(response *dnsmessage.Message, question dnsmessage.Question, label string) {
+	services, ok := parseServiceFilter(label)
+	if !ok {
+		response.Header.RCode = dnsmessage.RCodeNameError
+		soaHeader, soa := seeder.soa()
+		response.Authorities = append(response.Authorities, dnsmessage.Resource{Header: soaHeader, Body: &soa})
+		return
+	}
+
+	header := dnsmessage.ResourceHeader{
+		Name:  question.Name,
+		Type:  question.Type,
+		Class: dnsmessage.ClassINET,
+		TTL:   seeder.config.TTL,
+	}
+	switch question.Type {
+	case dnsmessage.TypeA:
+		for _, ip := range seeder.sample(false, services) {
+			body := dnsmessage.AResource{}
+			copy(body.A[:], ip.To4())
+			response.Answers = append(response.Answers, dnsmessage.Resource{Header: header, Body: &body})
+		}
+	case dnsmessage.TypeAAAA:
+		for _, ip := range seeder.sample(true, services) {
+			body := dnsmessage.AAAAResource{}
+			copy(body.AAAA[:], ip.To16())
+			response.Answers = append(response.Answers, dnsmessage.Resource{Header: header, Body: &body})
+		}
+	case dnsmessage.TypeNS:
+		if label == "" {
+			body := dnsmessage.NSResource{NS: mustNewName(canonicalDomain(seeder.config.Nameserver))}
+			response.Answers = append(response.Answers, dnsmessage.Resource{Header: header, Body: &body})
+		}
+	case dnsmessage.TypeSOA:
+		if label == "" {
+			soaHeader, soa := seeder.soa()
+			response.Answers = append(response.Answers, dnsmessage.Resource{Header: soaHeader, Body: &soa})
+		}
+	}
+
+	// NODATA responses carry our SOA so resolvers can cache the negative answer
+	if len(response.Answers) == 0 {
+		soaHeader, soa := seeder.soa()
+		response.Authorities = append(response.Authorities, dnsmessage.Resource{Header: soaHeader, Body: &soa})
+	}
+}
+
+// Blocks forever serving DNS queries over UDP
+func (seeder *DNSSeeder) Run() {
+	binding := fmt.Sprintf("[%s]:%d", seeder.config.BindAddress, seeder.config.Port)
+	conn, err := net.ListenPacket("udp", binding)
+	if err != nil {
+		log.Fatalf("Failed to bind DNSSeeder to %s: %s\n", binding, err.Error())
+	}
+	log.Println("Binding DNSSeeder for", seeder.zone, "to", binding)
+
+	go func() {
+		for {
+			seeder.refresh()
+			time.Sleep(seeder.config.RefreshInterval)
+		}
+	}()
+
+	buf := make([]byte, maxDNSMessageSize)
+	for {
+		n, remote, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Println("Error while reading DNS query:", err.Error())
+			continue
+		}
+		response := seeder.handleQuery(buf[:n])
+		if response == nil {
+			continue
+		}
+		_, _ = conn.WriteTo(response, remote)
+	}
+}
+
+func RunDNSSeeder(coordinator *Coordinator, config SeederConfig) {
+	seeder, err := MakeDNSSeeder(coordinator, config)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	seeder.Run()
+}
@@ -0,0 +1,172 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/gocraft/dbr"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"sort"
+	"testing"
+	"time"
+)
+
+func testSeederConfig() SeederConfig {
+	return SeederConfig{
+		ChainParams: &chaincfg.MainNetParams,
+		Domain:      "seed.example.com",
+		Nameserver:  "ns.example.com",
+		Mailbox:     "hostmaster.example.com",
+		TTL:         60,
+		MaxAnswers:  10,
+		MaxAge:      time.Hour,
+		MinUptime:   0.5,
+	}
+}
+
+// Stores a node seen a minute ago with the services and session outcomes given
+func putSeedNode(storage *MemoryStorage, connString string, services wire.ServiceFlag, successes, failures int) {
+	now := time.Now()
+	metadata, _ := json.Marshal(&NodeMetadata{Services: uint64(services)})
+	node := storage.PutNode(NodeInfo{ConnString: connString, Discovery: now, LastSeen: now.Add(-time.Minute),
+		Data: dbr.NewNullString(string(metadata))})
+	for i := 0; i < successes; i++ {
+		storage.AddNodeHistory(node, "session_begin", now.Add(-time.Minute), dbr.NullString{})
+		storage.AddNodeHistory(node, "session_end", now.Add(-time.Minute), dbr.NullString{})
+	}
+	for i := 0; i < failures; i++ {
+		storage.AddNodeHistory(node, "connect_error", now.Add(-time.Minute), dbr.NullString{})
+	}
+}
+
+func makeTestSeeder(t *testing.T, config SeederConfig, storage *MemoryStorage) *DNSSeeder {
+	t.Helper()
+	seeder, err := makeDNSSeeder(func() SeedStorage { return storage }, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seeder.refresh()
+	return seeder
+}
+
+func querySeeder(t *testing.T, seeder *DNSSeeder, name string, qtype dnsmessage.Type) (*dnsmessage.Message, int) {
+	t.Helper()
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 4242, RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET},
+		},
+	}
+	packet, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	packed := seeder.handleQuery(packet)
+	var response dnsmessage.Message
+	if err := response.Unpack(packed); err != nil {
+		t.Fatal(err)
+	}
+	if response.Header.ID != 4242 || !response.Header.Response || response.Header.Truncated {
+		t.Fatalf("answered %s with header %+v", name, response.Header)
+	}
+	return &response, len(packed)
+}
+
+// The addresses and names a response answers with, sorted
+func seederAnswers(response *dnsmessage.Message) []string {
+	answers := make([]string, 0)
+	for _, answer := range response.Answers {
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			answers = append(answers, net.IP(body.A[:]).String())
+		case *dnsmessage.AAAAResource:
+			answers = append(answers, net.IP(body.AAAA[:]).String())
+		case *dnsmessage.NSResource:
+			answers = append(answers, body.NS.String())
+		case *dnsmessage.SOAResource:
+			answers = append(answers, body.MBox.String())
+		}
+	}
+	sort.Strings(answers)
+	return answers
+}
+
+func TestDNSSeederAnswers(t *testing.T) {
+	storage := MakeMemoryStorage()
+	putSeedNode(storage, "[192.0.2.1]:8333", wire.SFNodeNetwork|wire.SFNodeWitness, 2, 0)
+	putSeedNode(storage, "[192.0.2.2]:8333", wire.SFNodeNetwork, 1, 1)
+	putSeedNode(storage, "[2001:db8::1]:8333", wire.SFNodeNetwork|wire.SFNodeWitness, 1, 0)
+	putSeedNode(storage, "[192.0.2.3]:18333", wire.SFNodeNetwork|wire.SFNodeWitness, 1, 0)
+	putSeedNode(storage, "[192.0.2.4]:8333", wire.SFNodeNetwork|wire.SFNodeWitness, 1, 3)
+	putSeedNode(storage, "[192.0.2.5]:8333", wire.SFNodeNetwork|wire.SFNodeWitness, 0, 0)
+	seeder := makeTestSeeder(t, testSeederConfig(), storage)
+
+	tests := []struct {
+		name          string
+		qtype         dnsmessage.Type
+		rcode         dnsmessage.RCode
+		authoritative bool
+		answers       []string
+		// Whether the SOA is in the authority section, as for NXDOMAIN and NODATA
+		soa bool
+	}{
+		{"seed.example.com.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, true,
+			[]string{"192.0.2.1", "192.0.2.2"}, false},
+		{"SEED.Example.COM.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, true,
+			[]string{"192.0.2.1", "192.0.2.2"}, false},
+		{"seed.example.com.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, true,
+			[]string{"2001:db8::1"}, false},
+		{"x9.seed.example.com.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, true,
+			[]string{"192.0.2.1"}, false},
+		{"x1.seed.example.com.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, true,
+			[]string{"192.0.2.1", "192.0.2.2"}, false},
+		{"xd.seed.example.com.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, true, []string{}, true},
+		{"x9.seed.example.com.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, true,
+			[]string{"2001:db8::1"}, false},
+		{"xzz.seed.example.com.", dnsmessage.TypeA, dnsmessage.RCodeNameError, true, []string{}, true},
+		{"a.x9.seed.example.com.", dnsmessage.TypeA, dnsmessage.RCodeNameError, true, []string{}, true},
+		{"seed.example.com.", dnsmessage.TypeNS, dnsmessage.RCodeSuccess, true,
+			[]string{"ns.example.com."}, false},
+		{"x9.seed.example.com.", dnsmessage.TypeNS, dnsmessage.RCodeSuccess, true, []string{}, true},
+		{"seed.example.com.", dnsmessage.TypeSOA, dnsmessage.RCodeSuccess, true,
+			[]string{"hostmaster.example.com."}, false},
+		{"seed.example.org.", dnsmessage.TypeA, dnsmessage.RCodeRefused, false, []string{}, false},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s %s", test.name, test.qtype), func(t *testing.T) {
+			response, _ := querySeeder(t, seeder, test.name, test.qtype)
+			if response.Header.RCode != test.rcode || response.Header.Authoritative != test.authoritative {
+				t.Fatalf("answered with header %+v", response.Header)
+			}
+			if answers := seederAnswers(response); fmt.Sprint(answers) != fmt.Sprint(test.answers) {
+				t.Fatalf("answered %v", answers)
+			}
+			soa := len(response.Authorities) == 1 && response.Authorities[0].Header.Type == dnsmessage.TypeSOA
+			if soa != test.soa || (!soa && len(response.Authorities) != 0) {
+				t.Fatalf("authorities %+v", response.Authorities)
+			}
+		})
+	}
+}
+
+// Answers are cut to fit into 512 bytes rather than setting TC
+func TestDNSSeederTruncation(t *testing.T) {
+	storage := MakeMemoryStorage()
+	for i := 0; i < 100; i++ {
+		putSeedNode(storage, fmt.Sprintf("[2001:db8::%x]:8333", i+1), wire.SFNodeNetwork, 1, 0)
+	}
+	config := testSeederConfig()
+	config.MaxAnswers = 100
+	seeder := makeTestSeeder(t, config, storage)
+
+	response, size := querySeeder(t, seeder, "seed.example.com.", dnsmessage.TypeAAAA)
+	if size > maxDNSMessageSize || len(response.Answers) == 0 || len(response.Answers) >= 100 {
+		t.Fatalf("answered with %d addresses in %d bytes", len(response.Answers), size)
+	}
+	// Another answer, 28 bytes with its name compressed, would not have fit
+	if size+28 <= maxDNSMessageSize {
+		t.Fatalf("answered with only %d addresses in %d bytes", len(response.Answers), size)
+	}
+}
@@ -0,0 +1,400 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"globalwitness/lib/testpeer"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const sessionTimeout = 5 * time.Second
+
+// A handler connected to a testpeer over a pipe, with everything it records kept in memory
+type testSession struct {
+	coordinator *Coordinator
+	storage     *MemoryStorage
+	peer        *testpeer.Peer
+	node        *NodeInfo
+	done        chan error
+}
+
+func testHandlerConfig() HandlerConfig {
+	config := DefaultHandlerConfig()
+	config.ChainParams = &chaincfg.RegressionNetParams
+	return config
+}
+
+func startSession(t *testing.T, config HandlerConfig, storage *MemoryStorage, peerConfig testpeer.Config,
+	prepare func(cd *Coordinator)) *testSession {
+	t.Helper()
+	peerConfig.ChainParams = config.ChainParams
+	peer := testpeer.New(peerConfig)
+	config.Dial = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		return peer.Pipe(), nil
+	}
+	cd := MakeCoordinator("test", 1, DatabaseConfig{}, RedisConfig{}, BootstrapConfig{}, CaptureConfig{}, nil,
+		MempoolConfig{}, TransportConfig{}, config, nil, nil)
+	if prepare != nil {
+		prepare(cd)
+	}
+
+	now := time.Now()
+	node := storage.PutNode(NodeInfo{ConnString: "[10.0.0.1]:18444", Discovery: now, LastSeen: now})
+	session := &testSession{coordinator: cd, storage: storage, peer: peer, node: node, done: make(chan error, 1)}
+	handler := MakeBitcoinHandler(node, storage, storage, cd.HandlerConfig)
+	go func() {
+		session.done <- handler.Run(cd)
+	}()
+	return session
+}
+
+func (session *testSession) waitFor(t *testing.T, command string) wire.Message {
+	t.Helper()
+	msg, err := session.peer.WaitFor(command, sessionTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// Waits for the handler to wrap up the session
+func (session *testSession) wait(t *testing.T) {
+	t.Helper()
+	select {
+	case err := <-session.done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(sessionTimeout):
+		t.Fatal("the session did not end")
+	}
+}
+
+// Disconnects the peer and waits for the handler to wrap up the session
+func (session *testSession) end(t *testing.T) {
+	t.Helper()
+	_ = session.peer.Close()
+	session.wait(t)
+}
+
+func eventually(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(sessionTimeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting until", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSessionHandshake(t *testing.T) {
+	storage := MakeMemoryStorage()
+	config := testHandlerConfig()
+	session := startSession(t, config, storage, testpeer.Config{
+		UserAgentName:    "Satoshi",
+		UserAgentVersion: "0.21.0",
+		Services:         wire.SFNodeNetwork | wire.SFNodeWitness,
+		StartingHeight:   1234,
+	}, nil)
+
+	version := session.waitFor(t, wire.CmdVersion).(*wire.MsgVersion)
+	if version.UserAgent != config.Identities[0].UserAgent {
+		t.Fatalf("we introduced ourselves as %s", version.UserAgent)
+	}
+	session.waitFor(t, wire.CmdSendHeaders)
+	session.end(t)
+
+	history := storage.History()
+	if len(history) != 2 || history[0].EventType != "session_begin" || history[1].EventType != "session_end" {
+		t.Fatalf("unexpected history %+v", history)
+	}
+	var begin SessionBeginMetadata
+	if err := json.Unmarshal([]byte(history[0].Data.String), &begin); err != nil || begin.Transport != TransportV1 {
+		t.Fatalf("unexpected session_begin %s: %v", history[0].Data.String, err)
+	}
+	var end SessionEndMetadata
+	if err := json.Unmarshal([]byte(history[1].Data.String), &end); err != nil ||
+		end.Traffic.Received[wire.CmdVersion].Messages != 1 || end.Traffic.Sent[wire.CmdVerAck].Messages != 1 {
+		t.Fatalf("unexpected session_end %s: %v", history[1].Data.String, err)
+	}
+
+	node := storage.GetNodeByConnString(session.node.ConnString)
+	// wire puts its own user agent in front of the one of testpeer
+	if !strings.HasSuffix(node.Version, "/Satoshi:0.21.0/") {
+		t.Fatalf("stored user agent %s", node.Version)
+	}
+	var metadata NodeMetadata
+	if err := json.Unmarshal([]byte(node.Data.String), &metadata); err != nil {
+		t.Fatal(err)
+	}
+	if metadata.StartingHeight != 1234 || wire.ServiceFlag(metadata.Services) != wire.SFNodeNetwork|wire.SFNodeWitness {
+		t.Fatalf("stored metadata %+v", metadata)
+	}
+}
+
+func TestSessionAnswersRequests(t *testing.T) {
+	headers := mineHeaders(t, chainhash.Hash{1}, time.Unix(1600000000, 0), 10, 0)
+	locator := headers[4].BlockHash()
+	getHeaders := wire.NewMsgGetHeaders()
+	_ = getHeaders.AddBlockLocatorHash(&locator)
+	txid := chainhash.Hash{7}
+	getData := wire.NewMsgGetData()
+	_ = getData.AddInvVect(wire.NewInvVect(wire.InvTypeWitnessTx, &txid))
+
+	config := testHandlerConfig()
+	config.Responder.Enabled = true
+	session := startSession(t, config, MakeMemoryStorage(), testpeer.Config{
+		Script: []testpeer.Step{{Message: getHeaders}, {Message: getData}},
+	}, func(cd *Coordinator) {
+		addHeaders(cd.HeaderChain, headers)
+	})
+	defer session.end(t)
+
+	reply := session.waitFor(t, wire.CmdHeaders).(*wire.MsgHeaders)
+	if len(reply.Headers) != 5 || reply.Headers[0].BlockHash() != headers[5].BlockHash() ||
+		reply.Headers[4].BlockHash() != headers[9].BlockHash() {
+		t.Fatalf("answered getheaders with %d headers", len(reply.Headers))
+	}
+	notFound := session.waitFor(t, wire.CmdNotFound).(*wire.MsgNotFound)
+	if len(notFound.InvList) != 1 || notFound.InvList[0].Hash != txid {
+		t.Fatalf("unexpected notfound %+v", notFound.InvList)
+	}
+}
+
+// The handler asks for the headers it missed and the answer fills the gap
+func TestSessionFillsHeaderGap(t *testing.T) {
+	headers := mineHeaders(t, chainhash.Hash{1}, time.Unix(1600000000, 0), 30, 0)
+	session := startSession(t, testHandlerConfig(), MakeMemoryStorage(), testpeer.Config{
+		Script: []testpeer.Step{{Message: testpeer.Headers(headers[25])}},
+	}, func(cd *Coordinator) {
+		addHeaders(cd.HeaderChain, headers[:20])
+	})
+	defer session.end(t)
+
+	request := session.waitFor(t, wire.CmdGetHeaders).(*wire.MsgGetHeaders)
+	if request.HashStop != headers[25].BlockHash() || *request.BlockLocatorHashes[0] != headers[19].BlockHash() {
+		t.Fatalf("asked for the headers from %s to %s", request.BlockLocatorHashes[0], request.HashStop)
+	}
+	if err := session.peer.Send(testpeer.Headers(headers[20:26]...)); err != nil {
+		t.Fatal(err)
+	}
+	tip := headers[25].BlockHash().String()
+	eventually(t, "the gap is filled", func() bool {
+		snapshot := session.coordinator.HeaderChain.Snapshot()
+		return snapshot.Tip == tip && snapshot.Length == 26
+	})
+}
+
+func TestSessionAddrPolicy(t *testing.T) {
+	gossiped := wire.NewNetAddressIPPort(net.ParseIP("10.0.0.9"), 18444, wire.SFNodeNetwork)
+
+	t.Run("sample", func(t *testing.T) {
+		storage := MakeMemoryStorage()
+		now := time.Now()
+		for _, connString := range []string{"[10.0.1.1]:18444", "[10.0.1.2]:18444", "[10.0.1.3]:18444"} {
+			storage.PutNode(NodeInfo{ConnString: connString, Version: "/Satoshi:0.21.0/", LastSeen: now})
+		}
+		config := testHandlerConfig()
+		config.AddrPolicy, _ = MakeAddrPolicy(AddrPolicyConfig{Policy: AddrPolicySample, SampleSize: 2,
+			SampleMaxAge: time.Hour})
+		session := startSession(t, config, storage, testpeer.Config{
+			Script: []testpeer.Step{{Message: testpeer.Addr(gossiped)}},
+		}, nil)
+		defer session.end(t)
+
+		reply := session.waitFor(t, wire.CmdAddr).(*wire.MsgAddr)
+		if len(reply.AddrList) != 2 {
+			t.Fatalf("answered with %d addresses", len(reply.AddrList))
+		}
+		for _, address := range reply.AddrList {
+			if address.IP.Equal(net.ParseIP("10.0.0.1")) {
+				t.Fatal("sent the peer its own address")
+			}
+		}
+		if storage.GetNodeByConnString("[10.0.0.9]:18444") == nil {
+			t.Fatal("the gossiped address was not added")
+		}
+	})
+
+	t.Run("self", func(t *testing.T) {
+		config := testHandlerConfig()
+		config.AddrPolicy, _ = MakeAddrPolicy(AddrPolicyConfig{Policy: AddrPolicySelf, Self: "192.0.2.1:8333"})
+		session := startSession(t, config, MakeMemoryStorage(), testpeer.Config{
+			Script: []testpeer.Step{{Message: testpeer.Addr(gossiped)}},
+		}, nil)
+		defer session.end(t)
+
+		reply := session.waitFor(t, wire.CmdAddr).(*wire.MsgAddr)
+		if len(reply.AddrList) != 1 || !reply.AddrList[0].IP.Equal(net.ParseIP("192.0.2.1")) ||
+			reply.AddrList[0].Port != 8333 || reply.AddrList[0].Services != advertisedServices {
+			t.Fatalf("unexpected answer %+v", reply.AddrList)
+		}
+	})
+}
+
+// A frame with a bad checksum ends the session without a connection error
+func TestSessionMalformedMessage(t *testing.T) {
+	config := testHandlerConfig()
+	frame, err := testpeer.Frame(config.ChainParams.Net, wire.CmdPing, make([]byte, 8), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := MakeMemoryStorage()
+	session := startSession(t, config, storage, testpeer.Config{
+		Script: []testpeer.Step{{Raw: frame}},
+	}, nil)
+	session.wait(t)
+
+	for _, entry := range storage.History() {
+		if entry.EventType != "session_begin" && entry.EventType != "session_end" {
+			t.Fatalf("recorded %s", entry.EventType)
+		}
+	}
+}
+
+type recordedCapture []*CaptureRecord
+
+func (capture *recordedCapture) Next() (*CaptureRecord, error) {
+	if len(*capture) == 0 {
+		return nil, io.EOF
+	}
+	record := (*capture)[0]
+	*capture = (*capture)[1:]
+	return record, nil
+}
+
+func TestReplayUsesCaptureTime(t *testing.T) {
+	config := testHandlerConfig()
+	captured := time.Now().Add(-time.Hour).Truncate(time.Second)
+	us := wire.NewNetAddressIPPort(net.ParseIP("10.0.0.1"), 18444, 0)
+	version := wire.NewMsgVersion(us, us, 1, 1234)
+	version.Services = wire.SFNodeNetwork
+	_ = version.AddUserAgent("Satoshi", "0.21.0")
+
+	capture := recordedCapture{}
+	for i, msg := range []wire.Message{version, wire.NewMsgVerAck(), wire.NewMsgFeeFilter(1000)} {
+		var frame bytes.Buffer
+		if err := wire.WriteMessage(&frame, msg, wire.ProtocolVersion, config.ChainParams.Net); err != nil {
+			t.Fatal(err)
+		}
+		capture = append(capture, &CaptureRecord{
+			Timestamp: captured.Add(time.Duration(i) * time.Minute),
+			Direction: CaptureReceived,
+			Frame:     frame.Bytes(),
+		})
+	}
+
+	cd := MakeCoordinator("test", 1, DatabaseConfig{}, RedisConfig{}, BootstrapConfig{}, CaptureConfig{}, nil,
+		MempoolConfig{}, TransportConfig{}, config, nil, nil)
+	storage := MakeMemoryStorage()
+	node := storage.PutNode(NodeInfo{ConnString: "[10.0.0.1]:18444"})
+	if err := MakeBitcoinHandler(node, storage, storage, cd.HandlerConfig).Replay(cd, &capture); err != nil {
+		t.Fatal(err)
+	}
+
+	history := storage.History()
+	if len(history) != 2 || history[0].EventType != "session_begin" || history[1].EventType != "feefilter" {
+		t.Fatalf("unexpected history %+v", history)
+	}
+	if !history[0].Timestamp.Equal(captured) || !history[1].Timestamp.Equal(captured.Add(2*time.Minute)) {
+		t.Fatalf("recorded at %s and %s", history[0].Timestamp, history[1].Timestamp)
+	}
+	if !storage.GetNodeByConnString(node.ConnString).LastSeen.Equal(captured) {
+		t.Fatal("the node was not seen when captured")
+	}
+	if cd.TipTracker.Observed() != 0 {
+		t.Fatal("the replay fed the tip tracker")
+	}
+}
+
+// A peer connecting to us is recorded and scored without being taken for reachable
+func TestInboundSessionIsScored(t *testing.T) {
+	config := testHandlerConfig()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// wire puts its own user agent in front of the one of testpeer
+	userAgent := "/btcwire:0.5.0/Spy:1.0/"
+	storage := MakeMemoryStorage()
+	seen := time.Now().Add(-time.Hour).Truncate(time.Second)
+	self := storage.PutNode(NodeInfo{ConnString: "[127.0.0.1]:18444", Version: userAgent, LastSeen: seen})
+	for i := 1; i < spyClusterSize; i++ {
+		storage.PutNode(NodeInfo{ConnString: fmt.Sprintf("[127.0.1.%d]:18444", i), Version: userAgent, LastSeen: seen})
+	}
+	storage.PutNode(NodeInfo{ConnString: "[127.1.0.1]:18444", Version: userAgent, LastSeen: seen})
+
+	cd := MakeCoordinator("test", 1, DatabaseConfig{}, RedisConfig{}, BootstrapConfig{}, CaptureConfig{}, nil,
+		MempoolConfig{}, TransportConfig{}, config, nil, nil)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		node := inboundNode(storage, conn.RemoteAddr(), config.ChainParams)
+		if node == nil || node.Id != self.Id {
+			_ = conn.Close()
+			return
+		}
+		MakeBitcoinHandler(node, storage, storage, cd.HandlerConfig).RunInbound(cd, conn)
+	}()
+
+	peer := testpeer.New(testpeer.Config{
+		ChainParams:      config.ChainParams,
+		UserAgentName:    "Spy",
+		UserAgentVersion: "1.0",
+		// The pong tells that the getaddr before it was handled
+		Script: []testpeer.Step{{Message: wire.NewMsgGetAddr()}, {Message: wire.NewMsgPing(1)}},
+	})
+	if err := peer.Dial(listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peer.WaitFor(wire.CmdPong, sessionTimeout); err != nil {
+		t.Fatal(err)
+	}
+	_ = peer.Close()
+	select {
+	case <-done:
+	case <-time.After(sessionTimeout):
+		t.Fatal("the session did not end")
+	}
+
+	history := storage.History()
+	if len(history) != 2 || history[0].EventType != "inbound_session_begin" ||
+		history[1].EventType != "inbound_session_end" {
+		t.Fatalf("unexpected history %+v", history)
+	}
+	if node := storage.GetNodeByConnString(self.ConnString); !node.LastSeen.Equal(seen) {
+		t.Fatal("an inbound session updated the node")
+	}
+
+	scores := storage.SpyScores()
+	if len(scores) != 1 || scores[0].NodeId != self.Id {
+		t.Fatalf("unexpected scores %+v", scores)
+	}
+	var details SpyScoreDetails
+	if err := json.Unmarshal([]byte(scores[0].Data.String), &details); err != nil {
+		t.Fatal(err)
+	}
+	if !details.Inbound || details.ClusterSize != spyClusterSize-1 {
+		t.Fatalf("unexpected score details %+v", details)
+	}
+	for _, reason := range details.Reasons {
+		if reason == SpyReasonUserAgentCluster {
+			t.Fatal("the peer counted towards its own cluster")
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package lib
+
+import (
+	"encoding/json"
+	"github.com/gocraft/dbr"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Heuristics flagging peers that behave like spy nodes or crawlers rather than like ordinary
+// nodes. Each session is scored once it ends, whether we or the peer opened it, a score of zero
+// is not stored.
+
+const (
+	SpyReasonNoTxRelay        = "no_tx_relay"
+	SpyReasonImmediateGetAddr = "immediate_getaddr"
+	SpyReasonUserAgentCluster = "user_agent_cluster"
+	SpyReasonAddrFanout       = "addr_fanout"
+	SpyReasonShortSession     = "short_session"
+
+	// Sessions shorter than this are not judged on transaction relay
+	spyMinTxObservation = time.Minute * 2
+	// A getaddr this soon after verack looks like a crawler harvesting addresses
+	spyGetAddrDelay = time.Second * 5
+	spyShortSession = time.Second * 30
+	// Core answers a single getaddr per connection with at most 1000 addresses
+	spyMaxAddresses = 2500
+	// Other nodes with the same user agent in the netgroup of a peer from which on they count
+	// as a cluster
+	spyClusterSize = 5
+	// Only nodes seen this recently count towards a cluster
+	spyClusterWindow = time.Hour * 24 * 7
+)
+
+var spyWeights = map[string]float64{
+	SpyReasonNoTxRelay:        0.3,
+	SpyReasonImmediateGetAddr: 0.2,
+	SpyReasonUserAgentCluster: 0.3,
+	SpyReasonAddrFanout:       0.2,
+	SpyReasonShortSession:     0.1,
+}
+
+// table spyscores
+type SpyScoreEntry struct {
+	Id        int64          `db:"id"`
+	NodeId    int64          `db:"nodeid"`
+	Timestamp time.Time      `db:"timestamp"`
+	Score     float64        `db:"score"`
+	Data      dbr.NullString `db:"data"`
+}
+
+// Serialized into the data column of the spyscores table
+type SpyScoreDetails struct {
+	Reasons []string
+	// The peer connected to us
+	Inbound bool
+	// The observations the reasons are based on
+	Duration     float64
+	TxAnnounced  int64
+	GetAddrDelay *float64
+	Addresses    int64
+	ClusterSize  int64
+}
+
+// A stored score joined with the node it belongs to
+type SpySuspect struct {
+	NodeId     int64          `db:"nodeid"`
+	ConnString string         `db:"connstring"`
+	Version    string         `db:"version"`
+	Timestamp  time.Time      `db:"timestamp"`
+	Score      float64        `db:"score"`
+	Data       dbr.NullString `db:"data"`
+}
+
+// What a handler observed during a session that the heuristics look at
+type spyObservations struct {
+	started     time.Time
+	verAck      atomic.Value
+	getAddr     atomic.Value
+	txAnnounced int64
+	addresses   int64
+}
+
+func (observations *spyObservations) onVerAck() {
+	observations.verAck.Store(time.Now())
+}
+
+// Only the first getaddr of a session is of interest
+func (observations *spyObservations) onGetAddr() {
+	if observations.getAddr.Load() == nil {
+		observations.getAddr.Store(time.Now())
+	}
+}
+
+func (observations *spyObservations) onTxAnnounced() {
+	atomic.AddInt64(&observations.txAnnounced, 1)
+}
+
+func (observations *spyObservations) onAddresses(count int) {
+	atomic.AddInt64(&observations.addresses, int64(count))
+}
+
+// Returns the netgroup of connString as stored in nodenetworks, empty if it is not an IP address
+func connStringNetgroup(connString string) string {
+	host, _, err := net.SplitHostPort(connString)
+	if err != nil {
+		return ""
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+	return Netgroup(ip)
+}
+
+// Scores the session that just ended, clusterSize is the number of other nodes with the same
+// user agent in the netgroup of the peer
+func scoreSession(observations *spyObservations, ended time.Time, clusterSize int64) (float64, *SpyScoreDetails) {
+	duration := ended.Sub(observations.started)
+	details := &SpyScoreDetails{
+		Reasons:     make([]string, 0),
+		Duration:    duration.Seconds(),
+		TxAnnounced: atomic.LoadInt64(&observations.txAnnounced),
+		Addresses:   atomic.LoadInt64(&observations.addresses),
+		ClusterSize: clusterSize,
+	}
+
+	verAck, handshaken := observations.verAck.Load().(time.Time)
+	if handshaken && duration >= spyMinTxObservation && details.TxAnnounced == 0 {
+		details.Reasons = append(details.Reasons, SpyReasonNoTxRelay)
+	}
+	if getAddr, ok := observations.getAddr.Load().(time.Time); ok && handshaken {
+		delay := getAddr.Sub(verAck).Seconds()
+		details.GetAddrDelay = &delay
+		if getAddr.Sub(verAck) < spyGetAddrDelay {
+			details.Reasons = append(details.Reasons, SpyReasonImmediateGetAddr)
+		}
+	}
+	if clusterSize >= spyClusterSize {
+		details.Reasons = append(details.Reasons, SpyReasonUserAgentCluster)
+	}
+	if details.Addresses > spyMaxAddresses {
+		details.Reasons = append(details.Reasons, SpyReasonAddrFanout)
+	}
+	if handshaken && duration < spyShortSession {
+		details.Reasons = append(details.Reasons, SpyReasonShortSession)
+	}
+
+	var score float64
+	for _, reason := range details.Reasons {
+		score += spyWeights[reason]
+	}
+	if score > 1 {
+		score = 1
+	}
+	return score, details
+}
+
+// Scores the session of handler and stores the result if anything looked suspicious
+func (handler *BitcoinHandler) storeSpyScore(ended time.Time) {
+	var clusterSize int64
+	if netgroup := connStringNetgroup(handler.nodeInfo.ConnString); netgroup != "" && handler.nodeInfo.Version != "" {
+		clusterSize = handler.db.CountNodesByVersionInNetgroup(handler.nodeInfo.Version, netgroup,
+			handler.nodeInfo.Id, ended.Add(-spyClusterWindow))
+	}
+
+	score, details := scoreSession(&handler.spyObservations, ended, clusterSize)
+	details.Inbound = handler.inbound
+	if score == 0 {
+		return
+	}
+	log.Println("Spy score of", handler.nodeInfo.ConnString, "is", score, "for", strings.Join(details.Reasons, ", "))
+
+	serialized, _ := json.Marshal(details)
+	handler.db.AddSpyScore(&SpyScoreEntry{
+		NodeId:    handler.nodeInfo.Id,
+		Timestamp: ended,
+		Score:     score,
+		Data:      dbr.NewNullString(serialized),
+	})
+}
@@ -0,0 +1,445 @@
+// Package testpeer provides a scriptable fake remote bitcoin node that a Witness
+// can be pointed at, either over a net.Pipe or a loopback listener, or that
+// connects to an inbound Witness itself. The fake node performs the
+// version/verack handshake like a regular node and then plays
+// back a script of messages, including malformed frames, at fixed offsets from
+// the end of the handshake while recording everything the Witness sends.
+package testpeer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Step is a single scripted action. Exactly one of Message and Raw should be
+// set.
+type Step struct {
+	// At is the offset from the end of the handshake at which the step is
+	// played.
+	At time.Duration
+
+	// Message is encoded and framed for the configured network.
+	Message wire.Message
+
+	// Raw is written to the connection as is, which allows sending
+	// malformed frames.
+	Raw []byte
+
+	// Disconnect closes the connection once the step was played.
+	Disconnect bool
+}
+
+// Config describes the identity of the fake node and what it does once the
+// handshake completed.
+type Config struct {
+	// ChainParams defaults to mainnet when nil.
+	ChainParams *chaincfg.Params
+
+	// ProtocolVersion defaults to wire.ProtocolVersion when zero.
+	ProtocolVersion uint32
+
+	UserAgentName    string
+	UserAgentVersion string
+	Services         wire.ServiceFlag
+	StartingHeight   int32
+
+	// SkipVerAck makes the fake node send its version but never a verack,
+	// for exercising handshake timeouts.
+	SkipVerAck bool
+
+	// DisablePong stops the fake node from answering pings.
+	DisablePong bool
+
+	Script []Step
+}
+
+// Peer is the fake remote node.
+type Peer struct {
+	cfg     Config
+	conn    net.Conn
+	sendMtx sync.Mutex
+
+	// initiator is set when the fake node opened the connection and so
+	// sends its version first.
+	initiator bool
+
+	mtx      sync.Mutex
+	cond     *sync.Cond
+	received []wire.Message
+	closed   bool
+	err      error
+
+	done chan struct{}
+}
+
+// New returns a fake node for the given config. Use Pipe, Listen or Serve to
+// start it.
+func New(cfg Config) *Peer {
+	if cfg.ChainParams == nil {
+		cfg.ChainParams = &chaincfg.MainNetParams
+	}
+	if cfg.ProtocolVersion == 0 {
+		cfg.ProtocolVersion = wire.ProtocolVersion
+	}
+	if cfg.UserAgentName == "" {
+		cfg.UserAgentName = "testpeer"
+	}
+	if cfg.UserAgentVersion == "" {
+		cfg.UserAgentVersion = "0.0.1"
+	}
+
+	p := &Peer{
+		cfg:      cfg,
+		received: make([]wire.Message, 0),
+		done:     make(chan struct{}),
+	}
+	p.cond = sync.NewCond(&p.mtx)
+	return p
+}
+
+// Pipe starts serving on one end of an in-memory connection and returns the
+// other end for the Witness to use. Only outbound witnesses can use a pipe
+// since inbound ones need a TCP remote address.
+func (p *Peer) Pipe() net.Conn {
+	local, remote := net.Pipe()
+	go func() {
+		_ = p.Serve(remote)
+	}()
+	return local
+}
+
+// Listen accepts a single connection on addr, e.g. 127.0.0.1:0, and serves
+// it. The returned listener tells the caller where to connect to.
+func (p *Peer) Listen(addr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		conn, err := listener.Accept()
+		_ = listener.Close()
+		if err != nil {
+			p.finish(err)
+			return
+		}
+		_ = p.Serve(conn)
+	}()
+	return listener, nil
+}
+
+// Dial connects to an inbound Witness listening on addr and serves the
+// connection in the background. The fake node sends its version first, like
+// any node opening a connection.
+func (p *Peer) Dial(addr string) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	p.initiator = true
+	go func() {
+		_ = p.Serve(conn)
+	}()
+	return nil
+}
+
+// Serve performs the handshake on conn, plays the script and then keeps
+// recording incoming messages until the connection is closed. It blocks until
+// then and returns the first error encountered.
+func (p *Peer) Serve(conn net.Conn) error {
+	p.mtx.Lock()
+	p.conn = conn
+	p.mtx.Unlock()
+
+	if err := p.handshake(); err != nil {
+		p.finish(err)
+		_ = conn.Close()
+		return err
+	}
+
+	go p.readLoop()
+	if err := p.playScript(); err != nil {
+		p.finish(err)
+		_ = conn.Close()
+	}
+
+	<-p.done
+	return p.Err()
+}
+
+func (p *Peer) handshake() error {
+	var remoteServices wire.ServiceFlag
+	if !p.initiator {
+		remoteVersion, err := p.readVersion()
+		if err != nil {
+			return err
+		}
+		remoteServices = remoteVersion.Services
+	}
+
+	nonce, err := wire.RandomUint64()
+	if err != nil {
+		return err
+	}
+	us := wire.NewNetAddressIPPort(net.IPv4(127, 0, 0, 1), 0, p.cfg.Services)
+	them := wire.NewNetAddressIPPort(net.IPv4(127, 0, 0, 1), 0, remoteServices)
+	version := wire.NewMsgVersion(us, them, nonce, p.cfg.StartingHeight)
+	version.ProtocolVersion = int32(p.cfg.ProtocolVersion)
+	version.Services = p.cfg.Services
+	if err := version.AddUserAgent(p.cfg.UserAgentName, p.cfg.UserAgentVersion); err != nil {
+		return err
+	}
+	if err := p.Send(version); err != nil {
+		return err
+	}
+	if p.initiator {
+		if _, err := p.readVersion(); err != nil {
+			return err
+		}
+	}
+	if p.cfg.SkipVerAck {
+		return nil
+	}
+	return p.Send(wire.NewMsgVerAck())
+}
+
+func (p *Peer) readVersion() (*wire.MsgVersion, error) {
+	msg, err := p.readMessage()
+	if err != nil {
+		return nil, err
+	}
+	version, ok := msg.(*wire.MsgVersion)
+	if !ok {
+		return nil, fmt.Errorf("expected version, got %s", msg.Command())
+	}
+	p.record(version)
+	return version, nil
+}
+
+func (p *Peer) playScript() error {
+	start := time.Now()
+	for _, step := range p.cfg.Script {
+		if wait := step.At - time.Since(start); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-p.done:
+				return nil
+			}
+		}
+
+		var err error
+		switch {
+		case step.Message != nil:
+			err = p.Send(step.Message)
+		case step.Raw != nil:
+			err = p.SendRaw(step.Raw)
+		}
+		if err != nil {
+			return err
+		}
+		if step.Disconnect {
+			return p.Close()
+		}
+	}
+	return nil
+}
+
+func (p *Peer) readLoop() {
+	for {
+		msg, err := p.readMessage()
+		if err != nil {
+			// Commands wire does not know are skipped over rather than
+			// treated as fatal.
+			if _, ok := err.(*wire.MessageError); ok {
+				continue
+			}
+			if err == io.EOF || p.isClosed() {
+				err = nil
+			}
+			p.finish(err)
+			return
+		}
+		p.record(msg)
+
+		if ping, ok := msg.(*wire.MsgPing); ok && !p.cfg.DisablePong {
+			if err := p.Send(wire.NewMsgPong(ping.Nonce)); err != nil {
+				p.finish(err)
+				return
+			}
+		}
+	}
+}
+
+func (p *Peer) readMessage() (wire.Message, error) {
+	msg, _, err := wire.ReadMessage(p.conn, p.cfg.ProtocolVersion, p.cfg.ChainParams.Net)
+	return msg, err
+}
+
+func (p *Peer) record(msg wire.Message) {
+	p.mtx.Lock()
+	p.received = append(p.received, msg)
+	p.cond.Broadcast()
+	p.mtx.Unlock()
+}
+
+func (p *Peer) isClosed() bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.closed
+}
+
+func (p *Peer) finish(err error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	select {
+	case <-p.done:
+		return
+	default:
+	}
+	p.err = err
+	p.closed = true
+	close(p.done)
+	p.cond.Broadcast()
+}
+
+// Send frames and writes msg to the Witness.
+func (p *Peer) Send(msg wire.Message) error {
+	p.sendMtx.Lock()
+	defer p.sendMtx.Unlock()
+	return wire.WriteMessage(p.conn, msg, p.cfg.ProtocolVersion, p.cfg.ChainParams.Net)
+}
+
+// SendRaw writes buf to the Witness without any framing.
+func (p *Peer) SendRaw(buf []byte) error {
+	p.sendMtx.Lock()
+	defer p.sendMtx.Unlock()
+	_, err := p.conn.Write(buf)
+	return err
+}
+
+// Close disconnects from the Witness.
+func (p *Peer) Close() error {
+	p.mtx.Lock()
+	p.closed = true
+	conn := p.conn
+	p.mtx.Unlock()
+
+	if conn == nil {
+		return nil
+	}
+	return conn.Close()
+}
+
+// Done is closed once the connection went away for any reason.
+func (p *Peer) Done() <-chan struct{} {
+	return p.done
+}
+
+// Err returns the error that ended the session, nil if it ended with an
+// orderly disconnect.
+func (p *Peer) Err() error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.err
+}
+
+// Received returns a copy of every message the Witness sent so far, including
+// its version message.
+func (p *Peer) Received() []wire.Message {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	received := make([]wire.Message, len(p.received))
+	copy(received, p.received)
+	return received
+}
+
+// WaitFor blocks until the Witness sent a message with the given command or
+// the timeout expired, and returns the first such message.
+func (p *Peer) WaitFor(command string, timeout time.Duration) (wire.Message, error) {
+	timer := time.AfterFunc(timeout, func() {
+		p.mtx.Lock()
+		p.cond.Broadcast()
+		p.mtx.Unlock()
+	})
+	defer timer.Stop()
+	deadline := time.Now().Add(timeout)
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for {
+		for _, msg := range p.received {
+			if msg.Command() == command {
+				return msg, nil
+			}
+		}
+		if p.closed {
+			return nil, fmt.Errorf("disconnected before receiving %s", command)
+		}
+		if !time.Now().Before(deadline) {
+			return nil, fmt.Errorf("timed out waiting for %s", command)
+		}
+		p.cond.Wait()
+	}
+}
+
+// Frame builds a raw message frame for command and payload. A bad checksum
+// can be requested to produce a frame the Witness has to reject.
+func Frame(bitcoinNet wire.BitcoinNet, command string, payload []byte, badChecksum bool) ([]byte, error) {
+	if len(command) > wire.CommandSize {
+		return nil, errors.New("command is too long")
+	}
+
+	var buf bytes.Buffer
+	var cmd [wire.CommandSize]byte
+	copy(cmd[:], command)
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(bitcoinNet))
+	buf.Write(cmd[:])
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(len(payload)))
+
+	checksum := chainhash.DoubleHashB(payload)[:4]
+	if badChecksum {
+		checksum[0] ^= 0xff
+	}
+	buf.Write(checksum)
+	buf.Write(payload)
+	return buf.Bytes(), nil
+}
+
+// Addr returns an addr message announcing the given addresses.
+func Addr(addrs ...*wire.NetAddress) *wire.MsgAddr {
+	msg := wire.NewMsgAddr()
+	_ = msg.AddAddresses(addrs...)
+	return msg
+}
+
+// Inv returns an inv message announcing the given items with one type.
+func Inv(invType wire.InvType, hashes ...*chainhash.Hash) *wire.MsgInv {
+	msg := wire.NewMsgInv()
+	for _, hash := range hashes {
+		_ = msg.AddInvVect(wire.NewInvVect(invType, hash))
+	}
+	return msg
+}
+
+// Headers returns a headers message announcing the given headers.
+func Headers(headers ...*wire.BlockHeader) *wire.MsgHeaders {
+	msg := wire.NewMsgHeaders()
+	for _, header := range headers {
+		_ = msg.AddBlockHeader(header)
+	}
+	return msg
+}
+
+// Ping returns a ping message with the given nonce.
+func Ping(nonce uint64) *wire.MsgPing {
+	return wire.NewMsgPing(nonce)
+}
@@ -0,0 +1,173 @@
+package lib
+
+import (
+	"fmt"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The block height we advertise in our version message. Peers treat a node at height 0 as one
+// that is still syncing, so by default we advertise the tip the network reports to us: the
+// median starting height of the peers we recently completed a handshake with.
+
+const (
+	// Height 0, as before the height was configurable
+	TipPolicyNone = "none"
+	// The observed tip
+	TipPolicyTip = "tip"
+	// The observed tip minus Lag blocks, like a node that is slightly behind
+	TipPolicyLagged = "lagged"
+	// FixedHeight regardless of what peers report
+	TipPolicyFixed = "fixed"
+
+	// Starting heights of this many recent handshakes make up the observed tip
+	tipSampleSize = 64
+	// Observations older than this are ignored
+	tipSampleMaxAge = time.Hour
+)
+
+type TipConfig struct {
+	// One of the TipPolicy* policies, TipPolicyNone if empty
+	Policy      string
+	Lag         int32
+	FixedHeight int32
+}
+
+func (config TipConfig) Validate() error {
+	switch config.Policy {
+	case "", TipPolicyNone, TipPolicyTip:
+	case TipPolicyLagged:
+		if config.Lag <= 0 {
+			return fmt.Errorf("the %s tip policy needs a positive lag", TipPolicyLagged)
+		}
+	case TipPolicyFixed:
+		if config.FixedHeight <= 0 {
+			return fmt.Errorf("the %s tip policy needs a positive height", TipPolicyFixed)
+		}
+	default:
+		return fmt.Errorf("unknown tip policy %s", config.Policy)
+	}
+	return nil
+}
+
+// The starting height stored with a node during its last handshake
+type StartingHeight struct {
+	Height   int32     `db:"height"`
+	LastSeen time.Time `db:"lastseen"`
+}
+
+type tipObservation struct {
+	height int32
+	seen   time.Time
+}
+
+// TipTracker keeps the starting heights peers reported and derives the height we advertise
+type TipTracker struct {
+	mtx          sync.Mutex
+	config       TipConfig
+	observations []tipObservation
+	next         int
+}
+
+func MakeTipTracker(config TipConfig) *TipTracker {
+	if config.Policy == "" {
+		config.Policy = TipPolicyNone
+	}
+	return &TipTracker{config: config, observations: make([]tipObservation, 0, tipSampleSize)}
+}
+
+// Records the starting height a peer reported, heights of peers claiming none are ignored
+func (tracker *TipTracker) observe(height int32, seen time.Time) {
+	if tracker == nil || height <= 0 {
+		return
+	}
+	tracker.mtx.Lock()
+	defer tracker.mtx.Unlock()
+	observation := tipObservation{height: height, seen: seen}
+	if len(tracker.observations) < tipSampleSize {
+		tracker.observations = append(tracker.observations, observation)
+		return
+	}
+	tracker.observations[tracker.next] = observation
+	tracker.next = (tracker.next + 1) % tipSampleSize
+}
+
+// Seeds the tracker with the starting heights stored for recently seen nodes
+func (tracker *TipTracker) Load(db *PostgresStorage) int {
+	observations := db.GetRecentStartingHeights(time.Now().Add(-tipSampleMaxAge), tipSampleSize)
+	for _, observation := range observations {
+		tracker.observe(observation.Height, observation.LastSeen)
+	}
+	return len(observations)
+}
+
+// The median of the recent starting heights, 0 if there are none. A median so that a few
+// peers lying about their height do not move it.
+func (tracker *TipTracker) Observed() int32 {
+	if tracker == nil {
+		return 0
+	}
+	since := time.Now().Add(-tipSampleMaxAge)
+	tracker.mtx.Lock()
+	heights := make([]int, 0, len(tracker.observations))
+	for _, observation := range tracker.observations {
+		if observation.seen.After(since) {
+			heights = append(heights, int(observation.height))
+		}
+	}
+	tracker.mtx.Unlock()
+
+	if len(heights) == 0 {
+		return 0
+	}
+	sort.Ints(heights)
+	return int32(heights[len(heights)/2])
+}
+
+// The height we advertise under the configured policy
+func (tracker *TipTracker) Advertised() int32 {
+	if tracker == nil {
+		return 0
+	}
+	switch tracker.config.Policy {
+	case TipPolicyTip:
+		return tracker.Observed()
+	case TipPolicyLagged:
+		height := tracker.Observed() - tracker.config.Lag
+		if height < 0 {
+			return 0
+		}
+		return height
+	case TipPolicyFixed:
+		return tracker.config.FixedHeight
+	default:
+		return 0
+	}
+}
+
+// NewestBlock is the HashFunc of our WitnessConfig. Only the height goes into the version
+// message, we do not know the hash of the block at that height.
+func (tracker *TipTracker) NewestBlock() (*chainhash.Hash, int32, error) {
+	return &chainhash.Hash{}, tracker.Advertised(), nil
+}
+
+type TipSnapshot struct {
+	Policy     string
+	Observed   int32
+	Advertised int32
+	Samples    int
+}
+
+func (tracker *TipTracker) Snapshot() TipSnapshot {
+	tracker.mtx.Lock()
+	samples := len(tracker.observations)
+	tracker.mtx.Unlock()
+	return TipSnapshot{
+		Policy:     tracker.config.Policy,
+		Observed:   tracker.Observed(),
+		Advertised: tracker.Advertised(),
+		Samples:    samples,
+	}
+}
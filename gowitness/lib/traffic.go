@@ -0,0 +1,123 @@
+package lib
+
+import (
+	"sync"
+	"time"
+)
+
+// Messages and bytes exchanged with a peer for a single command
+type MessageCounter struct {
+	Messages uint64
+	Bytes    uint64
+}
+
+// TrafficSnapshot is a copy of the counters of a session, keyed by command
+type TrafficSnapshot struct {
+	Received map[string]MessageCounter
+	Sent     map[string]MessageCounter
+}
+
+// TrafficStats counts the messages of a session per command and direction
+type TrafficStats struct {
+	mtx      sync.Mutex
+	received map[string]*MessageCounter
+	sent     map[string]*MessageCounter
+}
+
+func MakeTrafficStats() *TrafficStats {
+	return &TrafficStats{
+		received: make(map[string]*MessageCounter),
+		sent:     make(map[string]*MessageCounter),
+	}
+}
+
+func (stats *TrafficStats) add(counters map[string]*MessageCounter, command string, bytes int) {
+	stats.mtx.Lock()
+	defer stats.mtx.Unlock()
+	counter, ok := counters[command]
+	if !ok {
+		counter = &MessageCounter{}
+		counters[command] = counter
+	}
+	counter.Messages++
+	counter.Bytes += uint64(bytes)
+}
+
+func (stats *TrafficStats) AddReceived(command string, bytes int) {
+	stats.add(stats.received, command, bytes)
+}
+
+func (stats *TrafficStats) AddSent(command string, bytes int) {
+	stats.add(stats.sent, command, bytes)
+}
+
+func (stats *TrafficStats) Snapshot() TrafficSnapshot {
+	stats.mtx.Lock()
+	defer stats.mtx.Unlock()
+	snapshot := TrafficSnapshot{
+		Received: make(map[string]MessageCounter, len(stats.received)),
+		Sent:     make(map[string]MessageCounter, len(stats.sent)),
+	}
+	for command, counter := range stats.received {
+		snapshot.Received[command] = *counter
+	}
+	for command, counter := range stats.sent {
+		snapshot.Sent[command] = *counter
+	}
+	return snapshot
+}
+
+// Recorded in the session_end event once a peer disconnects
+type SessionEndMetadata struct {
+	// Seconds from the start of the handler to the disconnect
+	Duration      float64
+	BytesSent     uint64
+	BytesReceived uint64
+	Traffic       TrafficSnapshot
+	// One of the SessionEnd* reasons if we ended the session, empty if the peer or the witness did
+	Reason string `json:",omitempty"`
+}
+
+// Live view of a connected peer for the API
+type PeerTraffic struct {
+	ConnString string
+	Since      time.Time
+	Traffic    TrafficSnapshot
+}
+
+func (cd *Coordinator) registerHandler(handler *BitcoinHandler) {
+	cd.handlers.Store(handler.nodeInfo.ConnString, handler)
+}
+
+func (cd *Coordinator) unregisterHandler(handler *BitcoinHandler) {
+	cd.handlers.Delete(handler.nodeInfo.ConnString)
+}
+
+// Returns the message counters of every peer currently connected
+func (cd *Coordinator) Traffic() []PeerTraffic {
+	traffic := make([]PeerTraffic, 0)
+	cd.handlers.Range(func(key, value interface{}) bool {
+		handler := value.(*BitcoinHandler)
+		traffic = append(traffic, PeerTraffic{
+			ConnString: handler.nodeInfo.ConnString,
+			Since:      handler.started,
+			Traffic:    handler.traffic.Snapshot(),
+		})
+		return true
+	})
+	return traffic
+}
+
+// Returns the message counters of the peer at connString if it is connected
+func (cd *Coordinator) PeerTraffic(connString string) (*PeerTraffic, bool) {
+	value, ok := cd.handlers.Load(connString)
+	if !ok {
+		return nil, false
+	}
+	handler := value.(*BitcoinHandler)
+	return &PeerTraffic{
+		ConnString: connString,
+		Since:      handler.started,
+		Traffic:    handler.traffic.Snapshot(),
+	}, true
+}
@@ -0,0 +1,360 @@
+package lib
+
+import (
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"math"
+	"sync"
+	"time"
+)
+
+// Policies deciding which announced transactions we fetch with getdata
+const (
+	TxSampleNone       = "none"
+	TxSampleAll        = "all"
+	TxSamplePercentage = "percentage"
+	// Fetches like TxSampleAll but only stores the transactions that match the filter
+	TxSampleFilter = "filter"
+)
+
+const (
+	// Bytes charged against the bucket of a peer per requested transaction before we know its
+	// real size, corrected once the transaction arrived
+	txSampleSizeEstimate = 400
+
+	// Requests a single peer may have outstanding before further announcements are ignored
+	txSampleMaxPending = 1000
+
+	// Transactions remembered as already requested from some peer
+	txSampleMaxRequested = 100000
+
+	// Requests unanswered for this long are given up on, the transaction may then be requested
+	// from another peer
+	txSampleRequestTimeout = time.Minute * 2
+
+	// How often a peer looks for requests that timed out
+	txSampleSweepInterval = time.Second * 10
+)
+
+// Script classes, named after the types Bitcoin Core reports for a scriptPubKey
+const (
+	ScriptNonStandard         = "nonstandard"
+	ScriptPubKey              = "pubkey"
+	ScriptPubKeyHash          = "pubkeyhash"
+	ScriptScriptHash          = "scripthash"
+	ScriptMultiSig            = "multisig"
+	ScriptNullData            = "nulldata"
+	ScriptWitnessV0KeyHash    = "witness_v0_keyhash"
+	ScriptWitnessV0ScriptHash = "witness_v0_scripthash"
+	ScriptWitnessV1Taproot    = "witness_v1_taproot"
+	ScriptWitnessUnknown      = "witness_unknown"
+)
+
+var scriptClasses = []string{ScriptNonStandard, ScriptPubKey, ScriptPubKeyHash, ScriptScriptHash,
+	ScriptMultiSig, ScriptNullData, ScriptWitnessV0KeyHash, ScriptWitnessV0ScriptHash,
+	ScriptWitnessV1Taproot, ScriptWitnessUnknown}
+
+type TxSamplingConfig struct {
+	// One of the TxSample* policies, sampling is disabled if empty or TxSampleNone
+	Policy string
+	// Share of announced transactions to fetch under TxSamplePercentage, between 0 and 100
+	Percentage float64
+	// Under TxSampleFilter a transaction is kept if one of its outputs is of these classes,
+	// any class matches if empty
+	ScriptClasses []string
+	// Under TxSampleFilter a transaction is kept if its outputs sum up to at least this many
+	// satoshis
+	MinValue int64
+	// Bandwidth each peer may spend on transactions we requested
+	BytesPerSecond float64
+	// Bytes a peer may send in a burst above BytesPerSecond
+	Burst float64
+}
+
+// TxSampler is shared by every handler of a coordinator so that each transaction is only
+// requested from the first peer that announced it to us
+type TxSampler struct {
+	config    TxSamplingConfig
+	classes   map[string]bool
+	requested *txClaims
+}
+
+func MakeTxSampler(config TxSamplingConfig) (*TxSampler, error) {
+	switch config.Policy {
+	case "", TxSampleNone, TxSampleAll, TxSampleFilter:
+	case TxSamplePercentage:
+		if config.Percentage < 0 || config.Percentage > 100 {
+			return nil, fmt.Errorf("sampling percentage %f is not between 0 and 100", config.Percentage)
+		}
+	default:
+		return nil, fmt.Errorf("unknown transaction sampling policy %s", config.Policy)
+	}
+	if config.Policy != "" && config.Policy != TxSampleNone && config.BytesPerSecond <= 0 {
+		return nil, fmt.Errorf("transaction sampling needs a positive bandwidth limit")
+	}
+
+	classes := make(map[string]bool)
+	for _, class := range config.ScriptClasses {
+		known := false
+		for _, name := range scriptClasses {
+			known = known || name == class
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown script class %s", class)
+		}
+		classes[class] = true
+	}
+
+	return &TxSampler{
+		config:    config,
+		classes:   classes,
+		requested: newTxClaims(txSampleMaxRequested),
+	}, nil
+}
+
+func (sampler *TxSampler) Enabled() bool {
+	return sampler != nil && sampler.config.Policy != "" && sampler.config.Policy != TxSampleNone
+}
+
+// Decides whether an announced transaction should be requested and marks it as requested if so.
+// The percentage is taken over the txid rather than at random so that every instance samples
+// the same transactions.
+func (sampler *TxSampler) claim(hash *chainhash.Hash, now time.Time) bool {
+	if !sampler.Enabled() {
+		return false
+	}
+	if sampler.config.Policy == TxSamplePercentage {
+		bucket := binary.LittleEndian.Uint64(hash[:8]) % 10000
+		if float64(bucket) >= sampler.config.Percentage*100 {
+			return false
+		}
+	}
+
+	return sampler.requested.claim(hash, now)
+}
+
+// Lets another peer claim a transaction we failed to get, claimed is when we claimed it
+func (sampler *TxSampler) release(hash *chainhash.Hash, claimed time.Time) {
+	sampler.requested.release(hash, claimed)
+}
+
+// Keeps a transaction we got from being requested again
+func (sampler *TxSampler) fetched(hash *chainhash.Hash) {
+	sampler.requested.fetched(hash)
+}
+
+type txClaim struct {
+	hash    chainhash.Hash
+	claimed time.Time
+	fetched bool
+}
+
+// The transactions requested from some peer, bounded like mruInventoryMap. A claim that was
+// neither answered nor released within txSampleRequestTimeout lapses, which frees the
+// transactions requested from peers that went silent or away.
+type txClaims struct {
+	mtx    sync.Mutex
+	claims map[chainhash.Hash]*list.Element
+	order  *list.List
+	limit  int
+}
+
+func newTxClaims(limit int) *txClaims {
+	return &txClaims{
+		claims: make(map[chainhash.Hash]*list.Element),
+		order:  list.New(),
+		limit:  limit,
+	}
+}
+
+// Claims hash unless it was fetched or another claim on it is still running
+func (claims *txClaims) claim(hash *chainhash.Hash, now time.Time) bool {
+	claims.mtx.Lock()
+	defer claims.mtx.Unlock()
+	if element, ok := claims.claims[*hash]; ok {
+		claim := element.Value.(*txClaim)
+		if claim.fetched || now.Sub(claim.claimed) < txSampleRequestTimeout {
+			return false
+		}
+		claim.claimed = now
+		claims.order.MoveToFront(element)
+		return true
+	}
+
+	if claims.order.Len() >= claims.limit {
+		oldest := claims.order.Back()
+		delete(claims.claims, oldest.Value.(*txClaim).hash)
+		claims.order.Remove(oldest)
+	}
+	claims.claims[*hash] = claims.order.PushFront(&txClaim{hash: *hash, claimed: now})
+	return true
+}
+
+// Drops the claim made at claimed, a claim another peer made since ours lapsed is kept
+func (claims *txClaims) release(hash *chainhash.Hash, claimed time.Time) {
+	claims.mtx.Lock()
+	defer claims.mtx.Unlock()
+	if element, ok := claims.claims[*hash]; ok && element.Value.(*txClaim).claimed.Equal(claimed) &&
+		!element.Value.(*txClaim).fetched {
+		claims.order.Remove(element)
+		delete(claims.claims, *hash)
+	}
+}
+
+func (claims *txClaims) fetched(hash *chainhash.Hash) {
+	claims.mtx.Lock()
+	defer claims.mtx.Unlock()
+	if element, ok := claims.claims[*hash]; ok {
+		element.Value.(*txClaim).fetched = true
+	}
+}
+
+// Reports whether a fetched transaction should be stored
+func (sampler *TxSampler) keep(tx *wire.MsgTx) bool {
+	if sampler.config.Policy != TxSampleFilter {
+		return true
+	}
+
+	var total int64
+	matched := len(sampler.classes) == 0
+	for _, out := range tx.TxOut {
+		total += out.Value
+		matched = matched || sampler.classes[ClassifyScript(out.PkScript)]
+	}
+	return matched && total >= sampler.config.MinValue
+}
+
+// Classifies an output script into one of the Script* classes
+func ClassifyScript(script []byte) string {
+	size := len(script)
+	switch {
+	case size == 25 && script[0] == 0x76 && script[1] == 0xa9 && script[2] == 0x14 &&
+		script[23] == 0x88 && script[24] == 0xac:
+		return ScriptPubKeyHash
+	case size == 23 && script[0] == 0xa9 && script[1] == 0x14 && script[22] == 0x87:
+		return ScriptScriptHash
+	case (size == 35 && script[0] == 0x21 || size == 67 && script[0] == 0x41) && script[size-1] == 0xac:
+		return ScriptPubKey
+	case size > 0 && script[0] == 0x6a:
+		return ScriptNullData
+	case size == 22 && script[0] == 0x00 && script[1] == 0x14:
+		return ScriptWitnessV0KeyHash
+	case size == 34 && script[0] == 0x00 && script[1] == 0x20:
+		return ScriptWitnessV0ScriptHash
+	case size == 34 && script[0] == 0x51 && script[1] == 0x20:
+		return ScriptWitnessV1Taproot
+	case size >= 4 && size <= 42 && script[0] >= 0x51 && script[0] <= 0x60 && int(script[1]) == size-2:
+		return ScriptWitnessUnknown
+	case size >= 37 && script[0] >= 0x51 && script[0] <= 0x60 && script[size-2] >= 0x51 &&
+		script[size-2] <= 0x60 && script[size-1] == 0xae:
+		return ScriptMultiSig
+	default:
+		return ScriptNonStandard
+	}
+}
+
+// Token bucket counted in bytes. Taking more than is available is allowed and puts the bucket
+// into debt, which has to be paid off before the next request.
+type tokenBucket struct {
+	mtx    sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+func (bucket *tokenBucket) refill() {
+	now := time.Now()
+	bucket.tokens = math.Min(bucket.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*bucket.rate)
+	bucket.last = now
+}
+
+// Takes n bytes if the bucket is not in debt
+func (bucket *tokenBucket) TryTake(n float64) bool {
+	bucket.mtx.Lock()
+	defer bucket.mtx.Unlock()
+	bucket.refill()
+	if bucket.tokens <= 0 {
+		return false
+	}
+	bucket.tokens -= n
+	return true
+}
+
+// Takes n bytes unconditionally, a negative n returns bytes to the bucket
+func (bucket *tokenBucket) Take(n float64) {
+	bucket.mtx.Lock()
+	defer bucket.mtx.Unlock()
+	bucket.refill()
+	bucket.tokens = math.Min(bucket.burst, bucket.tokens-n)
+}
+
+// Per-peer state of the requests we sent, only touched from the listeners of a single peer
+type txRequests struct {
+	bucket    *tokenBucket
+	pending   map[chainhash.Hash]time.Time
+	nextSweep time.Time
+}
+
+func newTxRequests(config TxSamplingConfig) *txRequests {
+	burst := config.Burst
+	if burst < txSampleSizeEstimate {
+		burst = txSampleSizeEstimate
+	}
+	return &txRequests{
+		bucket:  newTokenBucket(config.BytesPerSecond, burst),
+		pending: make(map[chainhash.Hash]time.Time),
+	}
+}
+
+// Gives up on the requests older than txSampleRequestTimeout. Their claims have lapsed by now,
+// what is left is to refund their estimate to the bucket and make room for new requests.
+func (requests *txRequests) expire(sampler *TxSampler, now time.Time) {
+	if now.Before(requests.nextSweep) {
+		return
+	}
+	requests.nextSweep = now.Add(txSampleSweepInterval)
+	for hash, requested := range requests.pending {
+		if now.Sub(requested) < txSampleRequestTimeout {
+			continue
+		}
+		delete(requests.pending, hash)
+		requests.bucket.Take(-txSampleSizeEstimate)
+		sampler.release(&hash, requested)
+	}
+}
+
+// Computes the fee of tx from the outputs it spends. Returns false unless every input spends
+// an output of a transaction in parents.
+func transactionFee(tx *wire.MsgTx, parents map[chainhash.Hash]*wire.MsgTx) (int64, bool) {
+	var fee int64
+	for _, in := range tx.TxIn {
+		parent, ok := parents[in.PreviousOutPoint.Hash]
+		if !ok || int(in.PreviousOutPoint.Index) >= len(parent.TxOut) {
+			return 0, false
+		}
+		fee += parent.TxOut[in.PreviousOutPoint.Index].Value
+	}
+	for _, out := range tx.TxOut {
+		fee -= out.Value
+	}
+	return fee, fee >= 0
+}
+
+// Virtual size as defined in BIP141
+func transactionVSize(tx *wire.MsgTx) int {
+	weight := tx.SerializeSizeStripped()*3 + tx.SerializeSize()
+	return (weight + 3) / 4
+}
@@ -0,0 +1,92 @@
+package lib
+
+import (
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTxClaims(t *testing.T) {
+	claims := newTxClaims(2)
+	now := time.Unix(1600000000, 0)
+	first, second, third := chainhash.Hash{1}, chainhash.Hash{2}, chainhash.Hash{3}
+
+	if !claims.claim(&first, now) || claims.claim(&first, now.Add(time.Second)) {
+		t.Fatal("a transaction was claimed twice")
+	}
+	lapsed := now.Add(txSampleRequestTimeout)
+	if !claims.claim(&first, lapsed) {
+		t.Fatal("an unanswered claim did not lapse")
+	}
+	claims.release(&first, now)
+	if claims.claim(&first, lapsed) {
+		t.Fatal("releasing a lapsed claim dropped the one made after it")
+	}
+
+	claims.claim(&second, now)
+	claims.fetched(&second)
+	if claims.claim(&second, now.Add(time.Hour)) {
+		t.Fatal("a fetched transaction was claimed again")
+	}
+	claims.claim(&third, now)
+	if !claims.claim(&first, now) {
+		t.Fatal("the oldest claim was not evicted at the limit")
+	}
+}
+
+func TestTxClaimsAreAtomic(t *testing.T) {
+	claims := newTxClaims(10)
+	hash := chainhash.Hash{1}
+	now := time.Now()
+	var claimed int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if claims.claim(&hash, now) {
+				atomic.AddInt32(&claimed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if claimed != 1 {
+		t.Fatalf("claimed %d times", claimed)
+	}
+}
+
+func TestTxRequestsExpire(t *testing.T) {
+	sampler, err := MakeTxSampler(TxSamplingConfig{Policy: TxSampleAll, BytesPerSecond: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := newTxRequests(sampler.config)
+	now := time.Now()
+	stale, recent := chainhash.Hash{1}, chainhash.Hash{2}
+	for _, hash := range []*chainhash.Hash{&stale, &recent} {
+		requested := now
+		if *hash == stale {
+			requested = now.Add(-txSampleRequestTimeout)
+		}
+		if !requests.bucket.TryTake(txSampleSizeEstimate) || !sampler.claim(hash, requested) {
+			t.Fatal("could not request", hash)
+		}
+		requests.pending[*hash] = requested
+	}
+	if requests.bucket.TryTake(txSampleSizeEstimate) {
+		t.Fatal("the bucket is not in debt")
+	}
+
+	requests.expire(sampler, now)
+	if _, ok := requests.pending[stale]; ok || len(requests.pending) != 1 {
+		t.Fatalf("%d requests pending after the sweep", len(requests.pending))
+	}
+	if requests.bucket.tokens < -1 {
+		t.Fatalf("the estimate of the expired request was not refunded, %f tokens", requests.bucket.tokens)
+	}
+	if !sampler.claim(&stale, now) || sampler.claim(&recent, now) {
+		t.Fatal("the sweep did not release exactly the expired claim")
+	}
+}
@@ -0,0 +1,144 @@
+package lib
+
+import (
+	"github.com/gocraft/dbr"
+	"strings"
+	"time"
+)
+
+// Parsing of BIP14 user agents such as /Satoshi:0.17.1/ or /btcwire:0.5.0/btcd:0.23.3(comment)/.
+// Every component names a client with an optional version and comments, each one built on the
+// one before it, so the last component is the implementation the node actually runs.
+
+const UserAgentUnknown = "unknown"
+
+type UserAgentComponent struct {
+	Name     string
+	Version  string
+	Comments []string
+}
+
+type UserAgent struct {
+	Raw        string
+	Components []UserAgentComponent
+	// Name and version of the last component, UserAgentUnknown if there is none
+	Implementation string
+	Version        string
+	// Comments of all components in order
+	Comments []string
+}
+
+// ParseUserAgent splits a user agent into its components. Malformed parts are kept as well as
+// they can be rather than rejected, non-standard user agents are what we want to see.
+func ParseUserAgent(raw string) UserAgent {
+	agent := UserAgent{
+		Raw:            raw,
+		Components:     make([]UserAgentComponent, 0),
+		Implementation: UserAgentUnknown,
+		Comments:       make([]string, 0),
+	}
+
+	// Slashes inside of comments do not separate components
+	depth, start := 0, 0
+	parts := make([]string, 0)
+	for i, c := range raw {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			if depth > 0 {
+				depth--
+			}
+		case '/':
+			if depth == 0 {
+				parts = append(parts, raw[start:i])
+				start = i + 1
+			}
+		}
+	}
+	parts = append(parts, raw[start:])
+
+	for _, part := range parts {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		component := parseUserAgentComponent(part)
+		agent.Components = append(agent.Components, component)
+		agent.Comments = append(agent.Comments, component.Comments...)
+	}
+	if len(agent.Components) > 0 {
+		last := agent.Components[len(agent.Components)-1]
+		if last.Name != "" {
+			agent.Implementation = last.Name
+		}
+		agent.Version = last.Version
+	}
+	return agent
+}
+
+// Name of the first component, the client the others build on, UserAgentUnknown if there is none
+func (agent UserAgent) Base() string {
+	if len(agent.Components) == 0 || agent.Components[0].Name == "" {
+		return UserAgentUnknown
+	}
+	return agent.Components[0].Name
+}
+
+// Parses Name:Version(comment; comment)
+func parseUserAgentComponent(part string) UserAgentComponent {
+	component := UserAgentComponent{Comments: make([]string, 0)}
+	if open := strings.Index(part, "("); open >= 0 {
+		comments := part[open+1:]
+		comments = strings.TrimSuffix(strings.TrimSpace(comments), ")")
+		for _, comment := range strings.Split(comments, ";") {
+			if comment = strings.TrimSpace(comment); comment != "" {
+				component.Comments = append(component.Comments, comment)
+			}
+		}
+		part = part[:open]
+	}
+
+	if colon := strings.Index(part, ":"); colon >= 0 {
+		component.Name = strings.TrimSpace(part[:colon])
+		component.Version = strings.TrimSpace(part[colon+1:])
+	} else {
+		component.Name = strings.TrimSpace(part)
+	}
+	return component
+}
+
+// table sessionuseragents
+type SessionUserAgentEntry struct {
+	Id             int64          `db:"id"`
+	NodeId         int64          `db:"nodeid"`
+	Timestamp      time.Time      `db:"timestamp"`
+	Raw            string         `db:"raw"`
+	Implementation string         `db:"implementation"`
+	Version        string         `db:"version"`
+	Comments       dbr.NullString `db:"comments"`
+}
+
+func makeSessionUserAgentEntry(nodeId int64, timestamp time.Time, raw string) *SessionUserAgentEntry {
+	agent := ParseUserAgent(raw)
+	entry := &SessionUserAgentEntry{
+		NodeId:         nodeId,
+		Timestamp:      timestamp,
+		Raw:            raw,
+		Implementation: agent.Implementation,
+		Version:        agent.Version,
+	}
+	if len(agent.Comments) > 0 {
+		entry.Comments = dbr.NewNullString(strings.Join(agent.Comments, "; "))
+	}
+	return entry
+}
+
+// Nodes running an implementation, or a version of it, on a day and their share of all nodes
+// we had a session with that day
+type UserAgentAdoption struct {
+	Day            time.Time `db:"day"`
+	Implementation string    `db:"implementation"`
+	Version        string    `db:"version"`
+	Nodes          int64     `db:"nodes"`
+	Share          float64   `db:"share"`
+}
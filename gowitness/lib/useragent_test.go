@@ -0,0 +1,24 @@
+package lib
+
+import (
+	"testing"
+)
+
+func TestParseUserAgent(t *testing.T) {
+	agent := ParseUserAgent("/btcwire:0.5.0/btcd:0.23.3(linux; a/b)/")
+	if len(agent.Components) != 2 || agent.Implementation != "btcd" || agent.Version != "0.23.3" {
+		t.Fatalf("parsed %+v", agent)
+	}
+	if agent.Base() != "btcwire" {
+		t.Fatalf("the base of %s is %s", agent.Raw, agent.Base())
+	}
+	if len(agent.Comments) != 2 || agent.Comments[1] != "a/b" {
+		t.Fatalf("parsed the comments as %q", agent.Comments)
+	}
+
+	for _, raw := range []string{"", "/", "/:1.0/"} {
+		if agent := ParseUserAgent(raw); agent.Base() != UserAgentUnknown || agent.Implementation != UserAgentUnknown {
+			t.Fatalf("parsed %q as %+v", raw, agent)
+		}
+	}
+}
@@ -0,0 +1,347 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The BIP324 v2 transport. V2Conn wraps an established connection and translates between the
+// v1 frames the Witness reads and writes and encrypted v2 packets on the wire, so nothing above
+// it needs to know which transport is in use.
+
+const (
+	TransportV1 = "v1"
+	TransportV2 = "v2"
+
+	// SFNodeP2PV2 is the service bit of peers that accept the v2 transport
+	SFNodeP2PV2 wire.ServiceFlag = 1 << 11
+
+	v2GarbageTerminatorSize = 16
+	v2MaxGarbageSize        = 4095
+	v2LengthSize            = 3
+	v2HeaderSize            = 1
+	v2MaxContentsSize       = 1<<24 - 1
+
+	// Set in the header byte of packets the receiver has to ignore
+	v2IgnoreBit = 0x80
+)
+
+// Message types with a one byte encoding in v2 packets, the position is the short id
+var v2ShortIds = []string{
+	"",
+	wire.CmdAddr, wire.CmdBlock, CmdBlockTxn, CmdCmpctBlock, wire.CmdFeeFilter,
+	wire.CmdFilterAdd, wire.CmdFilterClear, wire.CmdFilterLoad, wire.CmdGetBlocks, CmdGetBlockTxn,
+	wire.CmdGetData, wire.CmdGetHeaders, wire.CmdHeaders, wire.CmdInv, wire.CmdMemPool,
+	wire.CmdMerkleBlock, wire.CmdNotFound, wire.CmdPing, wire.CmdPong, CmdSendCmpct,
+	wire.CmdTx, wire.CmdGetCFilters, wire.CmdCFilter, wire.CmdGetCFHeaders, wire.CmdCFHeaders,
+	wire.CmdGetCFCheckpt, wire.CmdCFCheckpt, "addrv2",
+}
+
+type TransportConfig struct {
+	// Attempt the v2 handshake before falling back to v1
+	V2 bool
+	// Upper bound on the time the v2 handshake may take
+	HandshakeTimeout time.Duration
+	// ip:port inbound peers are accepted on, none are if empty. They always use v1.
+	Listen string
+	// Inbound sessions at a time, further peers are disconnected right away
+	MaxInbound int64
+}
+
+// The keys both sides derive from the shared secret
+type v2Keys struct {
+	sendLength, recvLength         []byte
+	sendPacket, recvPacket         []byte
+	sendTerminator, recvTerminator []byte
+	sessionId                      []byte
+}
+
+func deriveV2Keys(secret []byte, network wire.BitcoinNet, initiator bool) (*v2Keys, error) {
+	salt := make([]byte, 4)
+	binary.LittleEndian.PutUint32(salt, uint32(network))
+	salt = append([]byte("bitcoin_v2_shared_secret"), salt...)
+
+	expand := func(label string, size int) ([]byte, error) {
+		key := make([]byte, size)
+		_, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(label)), key)
+		return key, err
+	}
+	labels := []string{"initiator_L", "initiator_P", "responder_L", "responder_P", "garbage_terminators", "session_id"}
+	derived := make(map[string][]byte)
+	for _, label := range labels {
+		size := 32
+		if label == "garbage_terminators" {
+			size = 2 * v2GarbageTerminatorSize
+		}
+		key, err := expand(label, size)
+		if err != nil {
+			return nil, err
+		}
+		derived[label] = key
+	}
+
+	terminators := derived["garbage_terminators"]
+	keys := &v2Keys{
+		sendLength:     derived["initiator_L"],
+		sendPacket:     derived["initiator_P"],
+		recvLength:     derived["responder_L"],
+		recvPacket:     derived["responder_P"],
+		sendTerminator: terminators[:v2GarbageTerminatorSize],
+		recvTerminator: terminators[v2GarbageTerminatorSize:],
+		sessionId:      derived["session_id"],
+	}
+	if !initiator {
+		keys.sendLength, keys.recvLength = keys.recvLength, keys.sendLength
+		keys.sendPacket, keys.recvPacket = keys.recvPacket, keys.sendPacket
+		keys.sendTerminator, keys.recvTerminator = keys.recvTerminator, keys.sendTerminator
+	}
+	return keys, nil
+}
+
+// One direction of a v2 session
+type v2Cipher struct {
+	length *fsChaCha20
+	packet *fsChaCha20Poly1305
+}
+
+func (cipher *v2Cipher) encrypt(header byte, contents, aad []byte) []byte {
+	length := make([]byte, 4)
+	binary.LittleEndian.PutUint32(length, uint32(len(contents)))
+	packet := cipher.length.crypt(length[:v2LengthSize])
+	return append(packet, cipher.packet.encrypt(aad, append([]byte{header}, contents...))...)
+}
+
+// Reads and decrypts one packet, returning its header byte and contents
+func (cipher *v2Cipher) decrypt(r io.Reader, aad []byte) (byte, []byte, error) {
+	encryptedLength := make([]byte, v2LengthSize)
+	if _, err := io.ReadFull(r, encryptedLength); err != nil {
+		return 0, nil, err
+	}
+	length := make([]byte, 4)
+	copy(length, cipher.length.crypt(encryptedLength))
+
+	ciphertext := make([]byte, v2HeaderSize+int(binary.LittleEndian.Uint32(length))+poly1305TagSize)
+	if _, err := io.ReadFull(r, ciphertext); err != nil {
+		return 0, nil, err
+	}
+	plaintext, err := cipher.packet.decrypt(aad, ciphertext)
+	if err != nil {
+		return 0, nil, err
+	}
+	return plaintext[0], plaintext[v2HeaderSize:], nil
+}
+
+// V2Conn is a connection on which the v2 handshake completed
+type V2Conn struct {
+	net.Conn
+	network wire.BitcoinNet
+	keys    *v2Keys
+
+	sendMtx  sync.Mutex
+	send     v2Cipher
+	outgoing []byte
+
+	recv     v2Cipher
+	incoming []byte
+}
+
+// Performs the v2 handshake as the initiator on conn. An error means the peer does not speak
+// v2 or the handshake failed, conn is unusable afterwards either way.
+func NewV2Conn(conn net.Conn, network wire.BitcoinNet, timeout time.Duration) (*V2Conn, error) {
+	if timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(timeout))
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	key, err := newEllSwiftKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	garbageSize, err := rand.Int(rand.Reader, big.NewInt(v2MaxGarbageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	garbage := make([]byte, garbageSize.Int64())
+	if _, err := rand.Read(garbage); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(append([]byte{}, key.encoded...), garbage...)); err != nil {
+		return nil, err
+	}
+
+	theirs := make([]byte, ellSwiftSize)
+	if _, err := io.ReadFull(conn, theirs); err != nil {
+		return nil, err
+	}
+	secret, err := key.sharedSecret(theirs, true)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := deriveV2Keys(secret, network, true)
+	if err != nil {
+		return nil, err
+	}
+
+	v2 := &V2Conn{
+		Conn:    conn,
+		network: network,
+		keys:    keys,
+		send:    v2Cipher{length: newFSChaCha20(keys.sendLength), packet: newFSChaCha20Poly1305(keys.sendPacket)},
+		recv:    v2Cipher{length: newFSChaCha20(keys.recvLength), packet: newFSChaCha20Poly1305(keys.recvPacket)},
+	}
+
+	// Our garbage is authenticated by the version packet, which has no contents we need
+	version := v2.send.encrypt(0, nil, garbage)
+	if _, err := conn.Write(append(append([]byte{}, keys.sendTerminator...), version...)); err != nil {
+		return nil, err
+	}
+
+	theirGarbage, err := v2.readGarbage()
+	if err != nil {
+		return nil, err
+	}
+	// The first packet after the garbage is the version packet, possibly preceded by decoys
+	aad := theirGarbage
+	for {
+		header, _, err := v2.recv.decrypt(conn, aad)
+		if err != nil {
+			return nil, err
+		}
+		aad = nil
+		if header&v2IgnoreBit == 0 {
+			break
+		}
+	}
+	return v2, nil
+}
+
+// Reads up to and including the garbage terminator of the peer, returning the garbage
+func (conn *V2Conn) readGarbage() ([]byte, error) {
+	buf := make([]byte, 0, v2MaxGarbageSize+v2GarbageTerminatorSize)
+	b := make([]byte, 1)
+	for len(buf) < cap(buf) {
+		if _, err := io.ReadFull(conn.Conn, b); err != nil {
+			return nil, err
+		}
+		buf = append(buf, b[0])
+		if len(buf) >= v2GarbageTerminatorSize &&
+			bytes.Equal(buf[len(buf)-v2GarbageTerminatorSize:], conn.keys.recvTerminator) {
+			return buf[:len(buf)-v2GarbageTerminatorSize], nil
+		}
+	}
+	return nil, errors.New("v2 garbage terminator not found")
+}
+
+// SessionId identifies the session, both sides derive the same one
+func (conn *V2Conn) SessionId() []byte {
+	return conn.keys.sessionId
+}
+
+// The command a short id stands for. Ids we do not know yet get a made up command, so that their
+// messages are counted and sampled as unknown ones rather than dropped.
+func v2ShortIdCommand(shortId int) string {
+	if shortId < len(v2ShortIds) {
+		return v2ShortIds[shortId]
+	}
+	return fmt.Sprintf("v2short:%d", shortId)
+}
+
+// Returns the next message as a v1 frame, skipping decoy packets
+func (conn *V2Conn) readFrame() ([]byte, error) {
+	for {
+		header, contents, err := conn.recv.decrypt(conn.Conn, nil)
+		if err != nil {
+			return nil, err
+		}
+		if header&v2IgnoreBit != 0 || len(contents) == 0 {
+			continue
+		}
+
+		var command string
+		var payload []byte
+		if shortId := int(contents[0]); shortId != 0 {
+			command, payload = v2ShortIdCommand(shortId), contents[1:]
+		} else {
+			if len(contents) < 1+wire.CommandSize {
+				return nil, fmt.Errorf("v2 packet of %d bytes is too short for a command", len(contents))
+			}
+			command = strings.TrimRight(string(contents[1:1+wire.CommandSize]), "\x00")
+			payload = contents[1+wire.CommandSize:]
+		}
+
+		frame := make([]byte, wire.MessageHeaderSize, wire.MessageHeaderSize+len(payload))
+		binary.LittleEndian.PutUint32(frame[0:4], uint32(conn.network))
+		copy(frame[4:16], command)
+		binary.LittleEndian.PutUint32(frame[16:20], uint32(len(payload)))
+		copy(frame[20:24], chainhash.DoubleHashB(payload)[0:4])
+		return append(frame, payload...), nil
+	}
+}
+
+func (conn *V2Conn) Read(b []byte) (int, error) {
+	for len(conn.incoming) == 0 {
+		frame, err := conn.readFrame()
+		if err != nil {
+			return 0, err
+		}
+		conn.incoming = frame
+	}
+	n := copy(b, conn.incoming)
+	conn.incoming = conn.incoming[n:]
+	return n, nil
+}
+
+// Collects v1 frames, wire writes header and payload separately, and sends each complete one
+// as a v2 packet
+func (conn *V2Conn) Write(b []byte) (int, error) {
+	conn.sendMtx.Lock()
+	defer conn.sendMtx.Unlock()
+
+	conn.outgoing = append(conn.outgoing, b...)
+	for len(conn.outgoing) >= wire.MessageHeaderSize {
+		length := int(binary.LittleEndian.Uint32(conn.outgoing[16:20]))
+		if length > v2MaxContentsSize-1-wire.CommandSize {
+			return 0, fmt.Errorf("message of %d bytes is too large for a v2 packet", length)
+		}
+		if len(conn.outgoing) < wire.MessageHeaderSize+length {
+			break
+		}
+
+		command := conn.outgoing[4:16]
+		payload := conn.outgoing[wire.MessageHeaderSize : wire.MessageHeaderSize+length]
+		contents := make([]byte, 0, 1+wire.CommandSize+length)
+		name := strings.TrimRight(string(command), "\x00")
+		shortId := 0
+		for id, candidate := range v2ShortIds {
+			if id > 0 && candidate == name {
+				shortId = id
+				break
+			}
+		}
+		if shortId != 0 {
+			contents = append(contents, byte(shortId))
+		} else {
+			contents = append(append(contents, 0), command...)
+		}
+		contents = append(contents, payload...)
+
+		if _, err := conn.Conn.Write(conn.send.encrypt(0, contents, nil)); err != nil {
+			return 0, err
+		}
+		conn.outgoing = conn.outgoing[wire.MessageHeaderSize+length:]
+	}
+	return len(b), nil
+}
@@ -8,6 +8,7 @@
 package lib
 
 import (
+	"bytes"
 	"container/list"
 	"errors"
 	"fmt"
@@ -27,7 +28,7 @@ import (
 
 const (
 	// MaxProtocolVersion is the max protocol version the peer supports.
-	MaxProtocolVersion = wire.FeeFilterVersion
+	MaxProtocolVersion = WtxidRelayVersion
 
 	// DefaultTrickleInterval is the min time between attempts to send an
 	// inv message to a peer.
@@ -200,6 +201,26 @@ type MessageListeners struct {
 	// message.
 	OnSendHeaders func(p *Witness, msg *wire.MsgSendHeaders)
 
+	// OnSendCmpct is invoked when a peer receives a sendcmpct bitcoin
+	// message.
+	OnSendCmpct func(p *Witness, msg *MsgSendCmpct)
+
+	// OnCmpctBlock is invoked when a peer receives a cmpctblock bitcoin
+	// message.
+	OnCmpctBlock func(p *Witness, msg *MsgCmpctBlock)
+
+	// OnGetBlockTxn is invoked when a peer receives a getblocktxn bitcoin
+	// message.
+	OnGetBlockTxn func(p *Witness, msg *MsgGetBlockTxn)
+
+	// OnBlockTxn is invoked when a peer receives a blocktxn bitcoin
+	// message.
+	OnBlockTxn func(p *Witness, msg *MsgBlockTxn)
+
+	// OnUnknown is invoked when a peer receives a message with a command
+	// that is not otherwise understood.  The payload is left undecoded.
+	OnUnknown func(p *Witness, msg *MsgUnknown)
+
 	// OnRead is invoked when a peer receives a bitcoin message.  It
 	// consists of the number of bytes read, the message, and whether or not
 	// an error in the read occurred.  Typically, callers will opt to use
@@ -248,6 +269,10 @@ type WitnessConfig struct {
 	// '/', ':', '(', ')'.
 	UserAgentComments []string
 
+	// UserAgent is advertised as is when set, instead of appending
+	// UserAgentName and UserAgentVersion to the btcwire user agent.
+	UserAgent string
+
 	// ChainParams identifies which chain parameters the peer is associated
 	// with.  It is highly recommended to specify this field, however it can
 	// be omitted in which case the test network will be used.
@@ -275,12 +300,32 @@ type WitnessConfig struct {
 	// inventory to a peer.
 	TrickleInterval time.Duration
 
+	// NegotiateTimeout is the time allowed for the version handshake.  The
+	// default negotiateTimeout is used if it is not positive.
+	NegotiateTimeout time.Duration
+
+	// IdleTimeout is the duration of inactivity after which the peer is
+	// disconnected.  The default idleTimeout is used if it is not positive.
+	IdleTimeout time.Duration
+
 	// Bypass trickle queue for block propagation
 	EagerBlockPropagation bool
 
 	// Configure if we will propagate blocks at all. They become too memory intensive for
 	// our terms and purposes at one point
 	PropagateBlocks bool
+
+	// Capture receives a copy of every raw frame read from and written to
+	// the peer when set.
+	Capture *CaptureWriter
+
+	// CompactBlockAnnouncements asks peers that support BIP152 to announce
+	// new blocks to us with cmpctblock in high-bandwidth mode.
+	CompactBlockAnnouncements bool
+
+	// WtxidRelay asks peers that support BIP339 to announce transactions
+	// to us by wtxid.
+	WtxidRelay bool
 }
 
 // minUint32 is a helper function to return the minimum of two uint32s.
@@ -451,6 +496,10 @@ type Witness struct {
 	advertisedProtoVer   uint32 // protocol version advertised by remote
 	protocolVersion      uint32 // negotiated protocol version
 	sendHeadersPreferred bool   // peer sent a sendheaders message
+	sendCmpctVersion     uint64 // highest compact block version the peer sent sendcmpct for
+	sendCmpctAnnounce    bool   // peer picked us as a high-bandwidth compact block relay
+	wtxidRelaySent       bool   // we sent wtxidrelay during the handshake
+	wtxidRelayReceived   bool   // peer sent wtxidrelay during the handshake
 	verAckReceived       bool
 	witnessEnabled       bool
 
@@ -799,6 +848,31 @@ func (p *Witness) WantsHeaders() bool {
 	return sendHeadersPreferred
 }
 
+// CompactBlocks returns the highest compact block version the peer
+// announced it understands, zero if none, and whether it asked us to
+// announce new blocks in high-bandwidth mode.
+//
+// This function is safe for concurrent access.
+func (p *Witness) CompactBlocks() (uint64, bool) {
+	p.flagsMtx.Lock()
+	version, announce := p.sendCmpctVersion, p.sendCmpctAnnounce
+	p.flagsMtx.Unlock()
+
+	return version, announce
+}
+
+// WtxidRelay returns true if both sides sent wtxidrelay before their verack,
+// in which case transactions are announced and requested by wtxid.
+//
+// This function is safe for concurrent access.
+func (p *Witness) WtxidRelay() bool {
+	p.flagsMtx.Lock()
+	wtxidRelay := p.wtxidRelaySent && p.wtxidRelayReceived
+	p.flagsMtx.Unlock()
+
+	return wtxidRelay
+}
+
 // IsWitnessEnabled returns true if the peer has signalled that it supports
 // segregated witness.
 //
@@ -1002,9 +1076,20 @@ func (p *Witness) handlePongMsg(msg *wire.MsgPong) {
 
 // readMessage reads the next bitcoin message from the peer with logging.
 func (p *Witness) readMessage(encoding wire.MessageEncoding) (wire.Message, []byte, error) {
-	n, msg, buf, err := wire.ReadMessageWithEncodingN(p.conn,
+	// Tee the raw bytes off the connection when capturing so that even
+	// frames wire fails to parse end up in the capture.
+	var r io.Reader = p.conn
+	var frame bytes.Buffer
+	if p.cfg.Capture != nil {
+		r = io.TeeReader(p.conn, &frame)
+	}
+
+	n, msg, buf, err := readMessageN(r,
 		p.ProtocolVersion(), p.cfg.ChainParams.Net, encoding)
 	atomic.AddUint64(&p.bytesReceived, uint64(n))
+	if p.cfg.Capture != nil && frame.Len() > 0 {
+		_ = p.cfg.Capture.WriteRecord(CaptureReceived, frame.Bytes())
+	}
 	if p.cfg.Listeners.OnRead != nil {
 		p.cfg.Listeners.OnRead(p, n, msg, err)
 	}
@@ -1023,9 +1108,18 @@ func (p *Witness) writeMessage(msg wire.Message, enc wire.MessageEncoding) error
 	}
 
 	// Write the message to the peer.
-	n, err := wire.WriteMessageWithEncodingN(p.conn, msg,
+	var w io.Writer = p.conn
+	var frame bytes.Buffer
+	if p.cfg.Capture != nil {
+		w = io.MultiWriter(p.conn, &frame)
+	}
+
+	n, err := wire.WriteMessageWithEncodingN(w, msg,
 		p.ProtocolVersion(), p.cfg.ChainParams.Net, enc)
 	atomic.AddUint64(&p.bytesSent, uint64(n))
+	if p.cfg.Capture != nil && frame.Len() > 0 {
+		_ = p.cfg.Capture.WriteRecord(CaptureSent, frame.Bytes())
+	}
 	if p.cfg.Listeners.OnWrite != nil {
 		p.cfg.Listeners.OnWrite(p, n, msg, err)
 	}
@@ -1264,7 +1358,7 @@ cleanup:
 func (p *Witness) inHandler() {
 	// The timer is stopped when a new message is received and reset after it
 	// is processed.
-	idleTimer := time.AfterFunc(idleTimeout, func() {
+	idleTimer := time.AfterFunc(p.cfg.IdleTimeout, func() {
 		p.Disconnect()
 	})
 
@@ -1280,7 +1374,7 @@ out:
 			// disconnect the peer when we're in regression test mode and the
 			// error is one of the allowed errors.
 			if p.isAllowedReadError(err) {
-				idleTimer.Reset(idleTimeout)
+				idleTimer.Reset(p.cfg.IdleTimeout)
 				continue
 			}
 
@@ -1331,6 +1425,16 @@ out:
 				p.cfg.Listeners.OnVerAck(p, msg)
 			}
 
+			// Version 2 compact blocks need the witness serialization.
+			if p.cfg.CompactBlockAnnouncements &&
+				p.ProtocolVersion() >= CompactBlocksVersion {
+				version := CompactBlocksLegacy
+				if p.IsWitnessEnabled() {
+					version = CompactBlocksWitness
+				}
+				p.QueueMessage(NewMsgSendCmpct(true, version), nil)
+			}
+
 		case *wire.MsgGetAddr:
 			if p.cfg.Listeners.OnGetAddr != nil {
 				p.cfg.Listeners.OnGetAddr(p, msg)
@@ -1467,12 +1571,60 @@ out:
 				p.cfg.Listeners.OnSendHeaders(p, msg)
 			}
 
+		case *MsgSendCmpct:
+			// Versions we do not know are ignored as BIP152 asks for.
+			if msg.Version == CompactBlocksLegacy ||
+				msg.Version == CompactBlocksWitness {
+				p.flagsMtx.Lock()
+				if msg.Version > p.sendCmpctVersion {
+					p.sendCmpctVersion = msg.Version
+				}
+				p.sendCmpctAnnounce = msg.Announce
+				p.flagsMtx.Unlock()
+			}
+
+			if p.cfg.Listeners.OnSendCmpct != nil {
+				p.cfg.Listeners.OnSendCmpct(p, msg)
+			}
+
+		case *MsgWTxIdRelay:
+			// BIP339 only allows wtxidrelay before verack.
+			p.flagsMtx.Lock()
+			if !p.verAckReceived {
+				p.wtxidRelayReceived = true
+			}
+			p.flagsMtx.Unlock()
+
+		case *MsgSendAddrV2:
+			// We never announce addrv2 support, so there is nothing to
+			// negotiate.
+
+		case *MsgCmpctBlock:
+			if p.cfg.Listeners.OnCmpctBlock != nil {
+				p.cfg.Listeners.OnCmpctBlock(p, msg)
+			}
+
+		case *MsgGetBlockTxn:
+			if p.cfg.Listeners.OnGetBlockTxn != nil {
+				p.cfg.Listeners.OnGetBlockTxn(p, msg)
+			}
+
+		case *MsgBlockTxn:
+			if p.cfg.Listeners.OnBlockTxn != nil {
+				p.cfg.Listeners.OnBlockTxn(p, msg)
+			}
+
+		case *MsgUnknown:
+			if p.cfg.Listeners.OnUnknown != nil {
+				p.cfg.Listeners.OnUnknown(p, msg)
+			}
+
 		default:
 		}
 		p.stallControl <- stallControlMsg{sccHandlerDone, rmsg}
 
 		// A message was received so reset the idle timer.
-		idleTimer.Reset(idleTimeout)
+		idleTimer.Reset(p.cfg.IdleTimeout)
 	}
 
 	// Ensure the idle timer is stopped to avoid leaking the resource.
@@ -1952,8 +2104,12 @@ func (p *Witness) localVersionMsg() (*wire.MsgVersion, error) {
 
 	// Version message.
 	msg := wire.NewMsgVersion(ourNA, theirNA, nonce, blockNum)
-	msg.AddUserAgent(p.cfg.UserAgentName, p.cfg.UserAgentVersion,
-		p.cfg.UserAgentComments...)
+	if p.cfg.UserAgent != "" {
+		msg.UserAgent = p.cfg.UserAgent
+	} else {
+		msg.AddUserAgent(p.cfg.UserAgentName, p.cfg.UserAgentVersion,
+			p.cfg.UserAgentComments...)
+	}
 
 	// Advertise local services.
 	msg.Services = p.cfg.Services
@@ -2018,7 +2174,7 @@ func (p *Witness) start() error {
 			p.Disconnect()
 			return err
 		}
-	case <-time.After(negotiateTimeout):
+	case <-time.After(p.cfg.NegotiateTimeout):
 		p.Disconnect()
 		return errors.New("protocol negotiation timeout")
 	}
@@ -2031,6 +2187,14 @@ func (p *Witness) start() error {
 	go p.outHandler()
 	go p.pingHandler()
 
+	// BIP339 needs wtxidrelay to be sent before our verack.
+	if p.cfg.WtxidRelay && p.ProtocolVersion() >= WtxidRelayVersion {
+		p.flagsMtx.Lock()
+		p.wtxidRelaySent = true
+		p.flagsMtx.Unlock()
+		p.QueueMessage(&MsgWTxIdRelay{}, nil)
+	}
+
 	// Send our verack message now that the IO processing machinery has started.
 	p.QueueMessage(wire.NewMsgVerAck(), nil)
 	return nil
@@ -2097,6 +2261,14 @@ func newPeerBase(origCfg *WitnessConfig, inbound bool) *Witness {
 		cfg.TrickleInterval = DefaultTrickleInterval
 	}
 
+	// Likewise for the timeouts.
+	if cfg.NegotiateTimeout <= 0 {
+		cfg.NegotiateTimeout = negotiateTimeout
+	}
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = idleTimeout
+	}
+
 	p := Witness{
 		inbound:         inbound,
 		wireEncoding:    wire.BaseEncoding,
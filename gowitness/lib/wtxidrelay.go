@@ -0,0 +1,60 @@
+package lib
+
+import (
+	"github.com/btcsuite/btcd/wire"
+	"io"
+)
+
+// Transaction relay by wtxid as specified in BIP339, and the BIP155 signal that comes with the
+// same protocol version
+
+const (
+	CmdWTxIdRelay = "wtxidrelay"
+	CmdSendAddrV2 = "sendaddrv2"
+
+	// WtxidRelayVersion is the protocol version from which on peers understand BIP339
+	WtxidRelayVersion uint32 = 70016
+
+	// InvTypeWTx announces or requests a transaction by its wtxid
+	InvTypeWTx wire.InvType = 5
+)
+
+// MsgWTxIdRelay is sent between version and verack by peers that want transactions announced
+// by wtxid
+type MsgWTxIdRelay struct{}
+
+func (msg *MsgWTxIdRelay) BtcDecode(r io.Reader, pver uint32, enc wire.MessageEncoding) error {
+	return nil
+}
+
+func (msg *MsgWTxIdRelay) BtcEncode(w io.Writer, pver uint32, enc wire.MessageEncoding) error {
+	return nil
+}
+
+func (msg *MsgWTxIdRelay) Command() string {
+	return CmdWTxIdRelay
+}
+
+func (msg *MsgWTxIdRelay) MaxPayloadLength(pver uint32) uint32 {
+	return 0
+}
+
+// MsgSendAddrV2 is sent between version and verack by peers that accept addrv2. We never send
+// it ourselves, so peers keep using addr with us.
+type MsgSendAddrV2 struct{}
+
+func (msg *MsgSendAddrV2) BtcDecode(r io.Reader, pver uint32, enc wire.MessageEncoding) error {
+	return nil
+}
+
+func (msg *MsgSendAddrV2) BtcEncode(w io.Writer, pver uint32, enc wire.MessageEncoding) error {
+	return nil
+}
+
+func (msg *MsgSendAddrV2) Command() string {
+	return CmdSendAddrV2
+}
+
+func (msg *MsgSendAddrV2) MaxPayloadLength(pver uint32) uint32 {
+	return 0
+}